@@ -0,0 +1,312 @@
+package duat
+
+// This file contains the implementation of release archive packaging for binaries produced
+// by builds.  Archives are deterministic, entries are ordered by name and carry fixed
+// ownership, permissions and modification times, so that repeated packaging of identical
+// binaries produces identical archives.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// DefaultArchiveName is the template used to name archives, the extension is added to it
+//
+const DefaultArchiveName = "{{.Module}}{{with .Version}}-{{.}}{{end}}-{{.OS}}-{{.Arch}}{{.Arm}}{{with .Suffix}}-{{.}}{{end}}"
+
+// ArchiveNameValues contains the values available to archive name templates
+//
+type ArchiveNameValues struct {
+	Module  string // The name of the module, and of the binary within the archive
+	Version string // The semantic version of the module, when known
+	GitHash string // The hash of the current commit, when known
+	OS      string
+	Arch    string
+	Arm     string // The GOARM value of arm binaries
+	Suffix  string // The output suffix of the binary, when one was used
+}
+
+// ArchiveOptions contains the parameters for packaging binaries into release archives
+//
+type ArchiveOptions struct {
+	Files     []string  // The binaries to package, named module-os-arch[-suffix], defaults to the binaries found by GoFetchBuilt
+	Dir       string    // The directory containing the README, LICENSE and CHANGELOG files, defaults to the current directory
+	Extras    []string  // Additional files, defaults to the README, LICENSE and CHANGELOG files found in Dir
+	OutputDir string    // The directory receiving the archives, defaults to ./dist
+	Name      string    // The template used to name archives, defaults to DefaultArchiveName
+	Format    string    // Either tar.gz or zip, by default zip is used for windows binaries and tar.gz otherwise
+	ModTime   time.Time // The modification time of archive entries, defaults to the source date and then the Unix epoch
+}
+
+// archiveEntry is a single file to be placed into an archive
+//
+type archiveEntry struct {
+	name string
+	mode os.FileMode
+	data []byte
+}
+
+// DefaultArchiveExtras returns the README, LICENSE and CHANGELOG files found in a directory,
+// matching names are case insensitive and may have any extension, for example README.md
+//
+func DefaultArchiveExtras(dir string) (extras []string, err kv.Error) {
+	infos, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	extras = []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		base := strings.ToUpper(strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())))
+		switch base {
+		case "README", "LICENSE", "LICENCE", "CHANGELOG":
+			extras = append(extras, filepath.Join(dir, info.Name()))
+		}
+	}
+	return extras, nil
+}
+
+// archiveTarget returns the target, and any suffix, of a binary named using the conventions
+// of GoBuildWithOptions, module-os-arch[-suffix][.exe]
+//
+func archiveTarget(module string, fn string) (target GoTarget, suffix string, isBinary bool) {
+	name := strings.TrimSuffix(filepath.Base(fn), ".exe")
+	if !strings.HasPrefix(name, module+"-") {
+		return target, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, module+"-"), "-", 3)
+	if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return target, "", false
+	}
+	target = GoTarget{OS: parts[0], Arch: parts[1]}
+	if strings.HasPrefix(target.Arch, "arm") && len(target.Arch) > 3 && target.Arch != "arm64" {
+		target.Arch, target.Arm = "arm", strings.TrimPrefix(target.Arch, "arm")
+	}
+	if len(parts) == 3 {
+		suffix = parts[2]
+	}
+	return target, suffix, true
+}
+
+// PackageArchives bundles each of the binaries, along with the extra files, into a release
+// archive and returns the names of the archives.  Binaries are renamed to the name of the
+// module within the archives.
+//
+func (md *MetaData) PackageArchives(opts ArchiveOptions) (archives []string, err kv.Error) {
+	files := opts.Files
+	if len(files) == 0 {
+		if files, err = md.GoFetchBuilt(); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := opts.Dir
+	if len(dir) == 0 {
+		dir = "."
+	}
+	extras := opts.Extras
+	if extras == nil {
+		if extras, err = DefaultArchiveExtras(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	outputDir := opts.OutputDir
+	if len(outputDir) == 0 {
+		outputDir = "dist"
+	}
+	if errGo := os.MkdirAll(outputDir, 0755); errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", outputDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	nameText := opts.Name
+	if len(nameText) == 0 {
+		nameText = DefaultArchiveName
+	}
+	nameTmpl, errGo := template.New("archive").Funcs(FuncMap(nil)).Option("missingkey=error").Parse(nameText)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "invalid archive name template").With("template", nameText).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	modTime := opts.ModTime
+	if modTime.IsZero() {
+		if modTime, err = md.SourceDate(); err != nil {
+			modTime = time.Unix(0, 0)
+		}
+	}
+	modTime = modTime.UTC().Truncate(time.Second)
+
+	extraEntries := make([]*archiveEntry, 0, len(extras))
+	for _, extra := range extras {
+		data, errGo := ioutil.ReadFile(extra)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", extra).With("stack", stack.Trace().TrimRuntime())
+		}
+		extraEntries = append(extraEntries, &archiveEntry{name: filepath.Base(extra), mode: 0644, data: data})
+	}
+
+	archives = []string{}
+	for _, fn := range files {
+		target, suffix, isBinary := archiveTarget(md.Module, fn)
+		if !isBinary {
+			continue
+		}
+
+		values := &ArchiveNameValues{
+			Module: md.Module,
+			OS:     target.OS,
+			Arch:   target.Arch,
+			Arm:    target.Arm,
+			Suffix: suffix,
+		}
+		if md.SemVer != nil {
+			values.Version = md.SemVer.String()
+		}
+		if md.Git != nil {
+			values.GitHash = md.Git.Hash
+		}
+		name := &strings.Builder{}
+		if errGo = nameTmpl.Execute(name, values); errGo != nil {
+			return archives, kv.Wrap(errGo, "invalid archive name template").With("template", nameText).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		data, errGo := ioutil.ReadFile(fn)
+		if errGo != nil {
+			return archives, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		binName := md.Module
+		if target.OS == "windows" {
+			binName += ".exe"
+		}
+		entries := append([]*archiveEntry{{name: binName, mode: 0755, data: data}}, extraEntries...)
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+		format := opts.Format
+		if len(format) == 0 {
+			format = "tar.gz"
+			if target.OS == "windows" {
+				format = "zip"
+			}
+		}
+
+		archive := filepath.Join(outputDir, name.String()+"."+format)
+		switch format {
+		case "tar.gz":
+			err = writeTarGz(archive, entries, modTime)
+		case "zip":
+			err = writeZip(archive, entries, modTime)
+		default:
+			err = kv.NewError("unknown archive format, use tar.gz or zip").With("format", format).With("stack", stack.Trace().TrimRuntime())
+		}
+		if err != nil {
+			return archives, err
+		}
+		archives = append(archives, archive)
+	}
+
+	if len(archives) == 0 {
+		return archives, kv.NewError("no binaries named after the module were found to package").With("module", md.Module).With("stack", stack.Trace().TrimRuntime())
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// writeTarGz writes a gzip compressed tar archive, see tarGz
+//
+func writeTarGz(fn string, entries []*archiveEntry, modTime time.Time) (err kv.Error) {
+	data, err := tarGz(entries, modTime)
+	if err != nil {
+		return err.With("file", fn)
+	}
+	if errGo := ioutil.WriteFile(fn, data, 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// tarGz returns a gzip compressed tar archive without any ownership information or gzip
+// header fields that vary between runs.  Entries with os.ModeDir set are directories.
+//
+func tarGz(entries []*archiveEntry, modTime time.Time) (data []byte, err kv.Error) {
+	buf := &bytes.Buffer{}
+	gz, errGo := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.name,
+			Mode:     int64(entry.mode.Perm()),
+			Size:     int64(len(entry.data)),
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+		if entry.mode.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+		}
+		if errGo = tw.WriteHeader(hdr); errGo != nil {
+			return nil, kv.Wrap(errGo).With("entry", entry.name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, errGo = tw.Write(entry.data); errGo != nil {
+			return nil, kv.Wrap(errGo).With("entry", entry.name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if errGo = tw.Close(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = gz.Close(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return buf.Bytes(), nil
+}
+
+// writeZip writes a deflate compressed zip archive with fixed modification times
+//
+func writeZip(fn string, entries []*archiveEntry, modTime time.Time) (err kv.Error) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.BestCompression)
+	})
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Deflate,
+			Modified: modTime,
+		}
+		hdr.SetMode(entry.mode)
+		w, errGo := zw.CreateHeader(hdr)
+		if errGo != nil {
+			return kv.Wrap(errGo).With("file", fn, "entry", entry.name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, errGo = w.Write(entry.data); errGo != nil {
+			return kv.Wrap(errGo).With("file", fn, "entry", entry.name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if errGo := zw.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo := ioutil.WriteFile(fn, buf.Bytes(), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package duat
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/go-test/deep"
+)
+
+// TestPackageArchives checks that archives are named using templates, contain the binary and
+// extra files in a stable order, and are identical when repackaged
+//
+func TestPackageArchives(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "archive")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"README.md":                  "readme",
+		"LICENSE":                    "license",
+		"CHANGELOG.md":               "changes",
+		"main.go":                    "package main",
+		"bin/tool-linux-amd64":       "linux",
+		"bin/tool-linux-arm7":        "arm",
+		"bin/tool-windows-amd64.exe": "windows",
+		"bin/other-linux-amd64":      "other",
+	})
+
+	ver, _ := semver.NewVersion("1.2.3")
+	md := &MetaData{Module: "tool", SemVer: ver}
+	opts := ArchiveOptions{
+		Files: []string{
+			filepath.Join(dir, "bin", "tool-linux-amd64"),
+			filepath.Join(dir, "bin", "tool-linux-arm7"),
+			filepath.Join(dir, "bin", "tool-windows-amd64.exe"),
+			filepath.Join(dir, "bin", "other-linux-amd64"),
+		},
+		Dir:       dir,
+		OutputDir: filepath.Join(dir, "dist"),
+		ModTime:   time.Unix(1600000000, 0),
+	}
+
+	archives, err := md.PackageArchives(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, archive := range archives {
+		names = append(names, filepath.Base(archive))
+	}
+	if diff := deep.Equal(names, []string{"tool-1.2.3-linux-amd64.tar.gz", "tool-1.2.3-linux-arm7.tar.gz", "tool-1.2.3-windows-amd64.zip"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	f, errGo := os.Open(archives[0])
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer f.Close()
+	gz, errGo := gzip.NewReader(f)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	entries := []string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, errGo := tr.Next()
+		if errGo != nil {
+			break
+		}
+		if !hdr.ModTime.Equal(opts.ModTime) || len(hdr.Uname) != 0 {
+			t.Error("unexpected header", hdr)
+		}
+		entries = append(entries, hdr.Name)
+	}
+	if diff := deep.Equal(entries, []string{"CHANGELOG.md", "LICENSE", "README.md", "tool"}); diff != nil {
+		t.Error(diff)
+	}
+
+	zr, errGo := zip.OpenReader(archives[2])
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer zr.Close()
+	if zr.File[3].Name != "tool.exe" || zr.File[3].Mode()&0111 == 0 {
+		t.Error("unexpected zip entry", zr.File[3].Name, zr.File[3].Mode())
+	}
+
+	// Repackaging using a different name template must produce identical archives
+	original, errGo := ioutil.ReadFile(archives[0])
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	opts.Name = "{{.Module}}_{{.OS}}_{{.Arch}}{{.Arm}}"
+	if archives, err = md.PackageArchives(opts); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(archives[0]) != "tool_linux_amd64.tar.gz" {
+		t.Fatal("unexpected archive", archives[0])
+	}
+	repackaged, errGo := ioutil.ReadFile(archives[0])
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !bytes.Equal(original, repackaged) {
+		t.Error("repackaged archive differs")
+	}
+}
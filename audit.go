@@ -0,0 +1,619 @@
+package duat
+
+// This file contains the implementation of an offline vulnerability audit of the modules of
+// a Go module, or binary, using a local copy of an OSV database such as the Go vulnerability
+// database available from https://vuln.go.dev/vulndb.zip
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+
+	"golang.org/x/mod/semver"
+)
+
+// AuditSeverity is the severity of an advisory, ordered from the least to most severe
+//
+type AuditSeverity int
+
+// The severities of advisories, unknown is used for advisories without a severity
+//
+const (
+	SeverityUnknown AuditSeverity = iota
+	SeverityLow
+	SeverityModerate
+	SeverityHigh
+	SeverityCritical
+)
+
+// String returns the name of the severity
+//
+func (severity AuditSeverity) String() string {
+	switch severity {
+	case SeverityLow:
+		return "LOW"
+	case SeverityModerate:
+		return "MODERATE"
+	case SeverityHigh:
+		return "HIGH"
+	case SeverityCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MarshalJSON encodes the severity using its name
+//
+func (severity AuditSeverity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(severity.String())
+}
+
+// ParseAuditSeverity returns the severity with the supplied name, medium is accepted as
+// an alternative to moderate
+//
+func ParseAuditSeverity(name string) (severity AuditSeverity, err kv.Error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "LOW":
+		return SeverityLow, nil
+	case "MODERATE", "MEDIUM":
+		return SeverityModerate, nil
+	case "HIGH":
+		return SeverityHigh, nil
+	case "CRITICAL":
+		return SeverityCritical, nil
+	case "UNKNOWN", "":
+		return SeverityUnknown, nil
+	}
+	return SeverityUnknown, kv.NewError("unknown severity, use low, moderate, high or critical").With("severity", name).With("stack", stack.Trace().TrimRuntime())
+}
+
+// osvEvent is a single point within the version history of an affected range
+//
+type osvEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+}
+
+// version returns the version at which the event occurs
+//
+func (event *osvEvent) version() string {
+	switch {
+	case len(event.Introduced) != 0:
+		return event.Introduced
+	case len(event.Fixed) != 0:
+		return event.Fixed
+	default:
+		return event.LastAffected
+	}
+}
+
+// osvRange is a range of affected versions described by a series of events
+//
+type osvRange struct {
+	Type   string     `json:"type"`
+	Events []osvEvent `json:"events"`
+}
+
+// osvAffected describes the affected versions of a single package
+//
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges           []osvRange `json:"ranges,omitempty"`
+	Versions         []string   `json:"versions,omitempty"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity,omitempty"`
+	} `json:"database_specific,omitempty"`
+}
+
+// OSVEntry is the subset of an OSV advisory used by audits, see https://ossf.github.io/osv-schema/
+//
+type OSVEntry struct {
+	ID        string        `json:"id"`
+	Summary   string        `json:"summary,omitempty"`
+	Details   string        `json:"details,omitempty"`
+	Aliases   []string      `json:"aliases,omitempty"`
+	Withdrawn string        `json:"withdrawn,omitempty"`
+	Affected  []osvAffected `json:"affected"`
+	Severity  []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity,omitempty"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity,omitempty"`
+	} `json:"database_specific,omitempty"`
+}
+
+// severity returns the severity of the entry using the severity assigned by the database,
+// or otherwise the highest CVSS v3 base score of the entry
+//
+func (entry *OSVEntry) severity(affected *osvAffected) (severity AuditSeverity) {
+	for _, name := range []string{affected.DatabaseSpecific.Severity, entry.DatabaseSpecific.Severity} {
+		if parsed, err := ParseAuditSeverity(name); err == nil && parsed != SeverityUnknown {
+			return parsed
+		}
+	}
+	for _, score := range entry.Severity {
+		if !strings.HasPrefix(score.Type, "CVSS_V3") {
+			continue
+		}
+		if rating := cvssSeverity(cvss3BaseScore(score.Score)); rating > severity {
+			severity = rating
+		}
+	}
+	return severity
+}
+
+// OSVDatabase contains the Go ecosystem advisories of an OSV database, indexed by module
+//
+type OSVDatabase struct {
+	Source  string                 // The directory, or zip file, the database was loaded from
+	modules map[string][]*OSVEntry // Advisories keyed by the module path
+}
+
+// LoadOSVDatabase reads the OSV JSON files found within a directory tree, or zip file.  Files
+// that are not OSV entries, such as the indexes of the Go vulnerability database, are
+// ignored along with entries that have been withdrawn.
+//
+func LoadOSVDatabase(source string) (db *OSVDatabase, err kv.Error) {
+	db = &OSVDatabase{Source: source, modules: map[string][]*OSVEntry{}}
+
+	info, errGo := os.Stat(source)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("database", source).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if info.IsDir() {
+		errGo = filepath.Walk(source, func(path string, info os.FileInfo, errGo error) error {
+			if errGo != nil || info.IsDir() || !strings.HasSuffix(path, ".json") {
+				return errGo
+			}
+			data, errGo := ioutil.ReadFile(path)
+			if errGo != nil {
+				return errGo
+			}
+			db.add(data)
+			return nil
+		})
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("database", source).With("stack", stack.Trace().TrimRuntime())
+		}
+		return db, nil
+	}
+
+	archive, errGo := zip.OpenReader(source)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "the database must be a directory or zip file").With("database", source).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		r, errGo := file.Open()
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("database", source, "file", file.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		data, errGo := ioutil.ReadAll(r)
+		r.Close()
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("database", source, "file", file.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		db.add(data)
+	}
+	return db, nil
+}
+
+// add indexes an entry of the database, documents that are not OSV entries are skipped
+//
+func (db *OSVDatabase) add(data []byte) {
+	entry := &OSVEntry{}
+	if errGo := json.Unmarshal(data, entry); errGo != nil || len(entry.ID) == 0 || len(entry.Withdrawn) != 0 {
+		return
+	}
+	seen := map[string]bool{}
+	for _, affected := range entry.Affected {
+		if affected.Package.Ecosystem != "Go" || seen[affected.Package.Name] {
+			continue
+		}
+		seen[affected.Package.Name] = true
+		db.modules[affected.Package.Name] = append(db.modules[affected.Package.Name], entry)
+	}
+}
+
+// Len returns the number of advisory and module pairs within the database
+//
+func (db *OSVDatabase) Len() (count int) {
+	for _, entries := range db.modules {
+		count += len(entries)
+	}
+	return count
+}
+
+// canonicalVersion returns the semantic version, with a v prefix, of module versions, OSV
+// versions which have no prefix, and Go release versions such as go1.21rc2
+//
+func canonicalVersion(version string) string {
+	if strings.HasPrefix(version, "go") {
+		version = strings.TrimPrefix(version, "go")
+		for _, pre := range []string{"rc", "beta", "alpha"} {
+			if i := strings.Index(version, pre); i > 0 {
+				version = version[:i] + "-" + pre + "." + version[i+len(pre):]
+				break
+			}
+		}
+		release := strings.SplitN(version, "-", 2)
+		if strings.Count(release[0], ".") == 1 {
+			release[0] += ".0"
+		}
+		version = strings.Join(release, "-")
+	}
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return version
+}
+
+// affects returns true when the version falls within the affected versions of a package,
+// along with the earliest fixed version later than the version when one is known
+//
+func (affected *osvAffected) affects(version string) (isAffected bool, fixed string) {
+	version = canonicalVersion(version)
+	for _, listed := range affected.Versions {
+		if canonicalVersion(listed) == version {
+			isAffected = true
+		}
+	}
+
+	for _, rng := range affected.Ranges {
+		if rng.Type != "SEMVER" {
+			continue
+		}
+		events := append([]osvEvent{}, rng.Events...)
+		sort.SliceStable(events, func(i, j int) bool {
+			if events[i].Introduced == "0" {
+				return events[j].Introduced != "0"
+			}
+			if events[j].Introduced == "0" {
+				return false
+			}
+			return semver.Compare(canonicalVersion(events[i].version()), canonicalVersion(events[j].version())) < 0
+		})
+
+		// Events are applied in version order with those later than the version being
+		// audited having no effect
+		inRange := false
+		rangeFixed := ""
+		for _, event := range events {
+			switch {
+			case len(event.Introduced) != 0:
+				if event.Introduced == "0" || semver.Compare(version, canonicalVersion(event.Introduced)) >= 0 {
+					inRange = true
+				}
+			case len(event.Fixed) != 0:
+				if semver.Compare(version, canonicalVersion(event.Fixed)) >= 0 {
+					inRange = false
+				} else if len(rangeFixed) == 0 {
+					rangeFixed = canonicalVersion(event.Fixed)
+				}
+			case len(event.LastAffected) != 0:
+				if semver.Compare(version, canonicalVersion(event.LastAffected)) > 0 {
+					inRange = false
+				}
+			}
+		}
+		if inRange {
+			isAffected = true
+			if len(rangeFixed) != 0 && (len(fixed) == 0 || semver.Compare(rangeFixed, fixed) < 0) {
+				fixed = rangeFixed
+			}
+		}
+	}
+	return isAffected, fixed
+}
+
+// ranges returns a readable description of the affected versions of a package
+//
+func (affected *osvAffected) ranges() (desc string) {
+	parts := []string{}
+	for _, rng := range affected.Ranges {
+		if rng.Type != "SEMVER" {
+			continue
+		}
+		for _, event := range rng.Events {
+			switch {
+			case len(event.Introduced) != 0:
+				parts = append(parts, ">="+event.Introduced)
+			case len(event.Fixed) != 0:
+				parts = append(parts, "<"+event.Fixed)
+			case len(event.LastAffected) != 0:
+				parts = append(parts, "<="+event.LastAffected)
+			}
+		}
+	}
+	if len(affected.Versions) != 0 {
+		parts = append(parts, strings.Join(affected.Versions, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// AuditFinding is an advisory that affects a module version used by the audited module, or
+// binary
+//
+type AuditFinding struct {
+	ID       string        `json:"id"`
+	Aliases  []string      `json:"aliases,omitempty"`
+	Summary  string        `json:"summary,omitempty"`
+	Module   string        `json:"module"`
+	Version  string        `json:"version"`
+	Affected string        `json:"affected"`        // The affected version ranges of the module
+	Fixed    string        `json:"fixed,omitempty"` // The earliest version containing the fix, when one exists
+	Severity AuditSeverity `json:"severity"`
+}
+
+// AuditReport contains the findings of an audit
+//
+type AuditReport struct {
+	Target   string          `json:"target"`   // The module directory, or binary, audited
+	Database string          `json:"database"` // The source of the advisories
+	Modules  int             `json:"modules"`  // The number of modules checked
+	Findings []*AuditFinding `json:"findings"` // The findings sorted by module and advisory
+}
+
+// AuditOptions contains the parameters for an audit
+//
+type AuditOptions struct {
+	GoRunOptions
+	Binary   string // A Go binary to be audited, when not specified the module in the directory is used
+	Database string // The directory, or zip file, containing the OSV database
+}
+
+// AuditModules checks the module dependencies of a module, or a binary along with the
+// standard library it was built using, against a local OSV database.  No network access
+// is performed.
+//
+func AuditModules(opts AuditOptions) (report *AuditReport, err kv.Error) {
+	db, err := LoadOSVDatabase(opts.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	var sbom *SBOM
+	target := opts.Binary
+	if len(opts.Binary) != 0 {
+		if sbom, err = ReadBinarySBOM(opts.Binary); err != nil {
+			return nil, err
+		}
+	} else {
+		run := opts.GoRunOptions.defaults()
+		if _, target, err = GoModulePath(run.Dir); err != nil {
+			return nil, err
+		}
+		if sbom, err = ReadModuleSBOM(target); err != nil {
+			return nil, err
+		}
+	}
+	return db.Audit(target, sbom), nil
+}
+
+// Audit checks the modules of a bill of materials against the database.  Modules replaced
+// by other module versions are checked using the replacement while those replaced by local
+// directories are skipped.
+//
+func (db *OSVDatabase) Audit(target string, sbom *SBOM) (report *AuditReport) {
+	report = &AuditReport{
+		Target:   target,
+		Database: db.Source,
+		Findings: []*AuditFinding{},
+	}
+
+	mods := make([]*SBOMModule, 0, len(sbom.Modules)+1)
+	mods = append(mods, sbom.Modules...)
+	// The standard library is treated as a module by the Go vulnerability database
+	if version := strings.Fields(sbom.GoVersion); len(version) != 0 && strings.HasPrefix(version[0], "go1") {
+		mods = append(mods, &SBOMModule{Path: "stdlib", Version: version[0]})
+	}
+
+	for _, mod := range mods {
+		path, version := mod.Path, mod.Version
+		if len(mod.Replace) != 0 {
+			replace := strings.SplitN(mod.Replace, "@", 2)
+			if len(replace) != 2 {
+				continue
+			}
+			path, version = replace[0], replace[1]
+		}
+		if len(version) == 0 || version == "(devel)" {
+			continue
+		}
+		report.Modules++
+
+		for _, entry := range db.modules[path] {
+			for i := range entry.Affected {
+				affected := &entry.Affected[i]
+				if affected.Package.Ecosystem != "Go" || affected.Package.Name != path {
+					continue
+				}
+				isAffected, fixed := affected.affects(version)
+				if !isAffected {
+					continue
+				}
+				report.Findings = append(report.Findings, &AuditFinding{
+					ID:       entry.ID,
+					Aliases:  entry.Aliases,
+					Summary:  entry.Summary,
+					Module:   path,
+					Version:  version,
+					Affected: affected.ranges(),
+					Fixed:    fixed,
+					Severity: entry.severity(affected),
+				})
+				break
+			}
+		}
+	}
+
+	sort.Slice(report.Findings, func(i, j int) bool {
+		if report.Findings[i].Module != report.Findings[j].Module {
+			return report.Findings[i].Module < report.Findings[j].Module
+		}
+		return report.Findings[i].ID < report.Findings[j].ID
+	})
+	return report
+}
+
+// Violations returns the findings at, or above, the severity of the policy.  Findings with
+// an unknown severity, which includes every advisory of the Go vulnerability database, are
+// only returned when failUnknown is set.
+//
+func (report *AuditReport) Violations(failOn AuditSeverity, failUnknown bool) (violations []*AuditFinding) {
+	violations = []*AuditFinding{}
+	for _, finding := range report.Findings {
+		if finding.Severity == SeverityUnknown {
+			if failUnknown {
+				violations = append(violations, finding)
+			}
+			continue
+		}
+		if failOn != SeverityUnknown && finding.Severity >= failOn {
+			violations = append(violations, finding)
+		}
+	}
+	return violations
+}
+
+// WriteText writes the findings in a human readable form
+//
+func (report *AuditReport) WriteText(w io.Writer) (err kv.Error) {
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "%d modules of %s checked against %s\n", report.Modules, report.Target, report.Database)
+	for _, finding := range report.Findings {
+		fixed := "no fix available"
+		if len(finding.Fixed) != 0 {
+			fixed = "fixed in " + finding.Fixed
+		}
+		fmt.Fprintf(text, "%s\t%s\t%s@%s\taffected %s\t%s\t%s\n", finding.ID, finding.Severity, finding.Module, finding.Version, finding.Affected, fixed, finding.Summary)
+	}
+	if len(report.Findings) == 0 {
+		text.WriteString("no vulnerabilities found\n")
+	}
+
+	if _, errGo := io.WriteString(w, text.String()); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// WriteJSON writes the report as a JSON document
+//
+func (report *AuditReport) WriteJSON(w io.Writer) (err kv.Error) {
+	return writeJSON(w, report)
+}
+
+// cvssSeverity returns the qualitative rating of a CVSS v3 score
+//
+func cvssSeverity(score float64) AuditSeverity {
+	switch {
+	case score >= 9.0:
+		return SeverityCritical
+	case score >= 7.0:
+		return SeverityHigh
+	case score >= 4.0:
+		return SeverityModerate
+	case score > 0:
+		return SeverityLow
+	default:
+		return SeverityUnknown
+	}
+}
+
+// cvss3BaseScore returns the base score of a CVSS v3 vector, for example
+// CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H, or zero when the vector is invalid
+//
+func cvss3BaseScore(vector string) (score float64) {
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C":  {"H": 0.56, "L": 0.22, "N": 0},
+		"I":  {"H": 0.56, "L": 0.22, "N": 0},
+		"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	}
+
+	metrics := map[string]float64{}
+	scope := ""
+	privileges := ""
+	for _, part := range strings.Split(vector, "/") {
+		metric := strings.SplitN(part, ":", 2)
+		if len(metric) != 2 {
+			return 0
+		}
+		switch metric[0] {
+		case "S":
+			scope = metric[1]
+		case "PR":
+			privileges = metric[1]
+		}
+		if values, isPresent := weights[metric[0]]; isPresent {
+			weight, isValid := values[metric[1]]
+			if !isValid {
+				return 0
+			}
+			metrics[metric[0]] = weight
+		}
+	}
+	if len(metrics) != len(weights) || (scope != "U" && scope != "C") {
+		return 0
+	}
+
+	// Privileges carry more weight when the scope changes
+	if scope == "C" {
+		switch privileges {
+		case "L":
+			metrics["PR"] = 0.68
+		case "H":
+			metrics["PR"] = 0.5
+		}
+	}
+
+	iss := 1 - (1-metrics["C"])*(1-metrics["I"])*(1-metrics["A"])
+	impact := 6.42 * iss
+	if scope == "C" {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0
+	}
+	exploitability := 8.22 * metrics["AV"] * metrics["AC"] * metrics["PR"] * metrics["UI"]
+
+	if scope == "C" {
+		return cvssRoundUp(math.Min(1.08*(impact+exploitability), 10))
+	}
+	return cvssRoundUp(math.Min(impact+exploitability, 10))
+}
+
+// cvssRoundUp rounds up to one decimal place as defined by the CVSS v3.1 specification
+//
+func cvssRoundUp(value float64) float64 {
+	scaled := int64(math.Round(value * 100000))
+	if scaled%10000 == 0 {
+		return float64(scaled) / 100000
+	}
+	return float64(scaled/10000+1) / 10
+}
@@ -0,0 +1,78 @@
+package duat
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// TestAuditModules checks that module versions are matched against the affected ranges of
+// advisories read from directory and zip databases, and that the severity policy is applied
+//
+func TestAuditModules(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "audit")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := map[string]string{
+		"db/ID/GO-2022-0001.json": `{"id":"GO-2022-0001","summary":"first","affected":[{"package":{"ecosystem":"Go","name":"example.com/a"},
+			"ranges":[{"type":"SEMVER","events":[{"introduced":"0"},{"fixed":"1.1.0"},{"introduced":"1.2.0"},{"fixed":"1.2.5"}]}]}]}`,
+		"db/ID/GHSA-xxxx.json": `{"id":"GHSA-xxxx","summary":"second","severity":[{"type":"CVSS_V3","score":"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}],
+			"affected":[{"package":{"ecosystem":"Go","name":"example.com/b"},"ranges":[{"type":"SEMVER","events":[{"introduced":"2.0.0"},{"last_affected":"2.3.0"}]}]}]}`,
+		"db/ID/GO-2022-0003.json": `{"id":"GO-2022-0003","summary":"withdrawn","withdrawn":"2022-01-01T00:00:00Z","affected":[{"package":{"ecosystem":"Go","name":"example.com/a"}}]}`,
+		"db/index/modules.json":   `[{"path":"example.com/a"}]`,
+		"project/go.mod":          "module example.com/project\n\ngo 1.18\n\nrequire (\n\texample.com/a v1.2.3\n\texample.com/b v2.1.0+incompatible\n\texample.com/c v1.0.0\n)\n\nreplace example.com/c => ../c\n",
+	}
+	writeTree(t, dir, entries)
+
+	archive, errGo := os.Create(filepath.Join(dir, "db.zip"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	writer := zip.NewWriter(archive)
+	for name, content := range entries {
+		if filepath.Dir(name) == "db/ID" {
+			w, errGo := writer.Create(filepath.Base(name))
+			if errGo != nil {
+				t.Fatal(errGo)
+			}
+			w.Write([]byte(content))
+		}
+	}
+	writer.Close()
+	archive.Close()
+
+	for _, db := range []string{"db", "db.zip"} {
+		report, err := AuditModules(AuditOptions{
+			GoRunOptions: GoRunOptions{Dir: filepath.Join(dir, "project")},
+			Database:     filepath.Join(dir, db),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := deep.Equal(report.Findings, []*AuditFinding{
+			{ID: "GO-2022-0001", Summary: "first", Module: "example.com/a", Version: "v1.2.3", Affected: ">=0 <1.1.0 >=1.2.0 <1.2.5", Fixed: "v1.2.5"},
+			{ID: "GHSA-xxxx", Summary: "second", Module: "example.com/b", Version: "v2.1.0+incompatible", Affected: ">=2.0.0 <=2.3.0", Severity: SeverityCritical},
+		}); diff != nil {
+			t.Fatal(db, diff)
+		}
+
+		if violations := report.Violations(SeverityHigh, false); len(violations) != 1 || violations[0].ID != "GHSA-xxxx" {
+			t.Error(db, "unexpected violations", violations)
+		}
+		if violations := report.Violations(SeverityUnknown, true); len(violations) != 1 || violations[0].ID != "GO-2022-0001" {
+			t.Error(db, "unexpected violations", violations)
+		}
+	}
+
+	if score := cvss3BaseScore("CVSS:3.1/AV:N/AC:L/PR:L/UI:N/S:C/C:L/I:L/A:N"); score != 6.4 {
+		t.Error("unexpected CVSS score", score)
+	}
+}
@@ -0,0 +1,168 @@
+package duat
+
+// This file contains the implementation of a cache that skips builds of binaries whose
+// inputs have not changed since they were last built
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// digestListFormat is the go list template used to obtain the files of the packages
+// contributing to a binary.  Packages from the module cache are identified by their module
+// version, which go.sum already authenticates, rather than by their files.
+//
+const digestListFormat = `{{if not .Standard}}{{.ImportPath}}{{"\t"}}{{.Dir}}{{"\t"}}` +
+	`{{with .Module}}{{if not (or .Main .Replace)}}{{.Path}}@{{.Version}}{{end}}{{end}}` +
+	`{{range .GoFiles}}{{"\t"}}{{.}}{{end}}{{range .CgoFiles}}{{"\t"}}{{.}}{{end}}` +
+	`{{range .CFiles}}{{"\t"}}{{.}}{{end}}{{range .CXXFiles}}{{"\t"}}{{.}}{{end}}` +
+	`{{range .HFiles}}{{"\t"}}{{.}}{{end}}{{range .SFiles}}{{"\t"}}{{.}}{{end}}` +
+	`{{range .SysoFiles}}{{"\t"}}{{.}}{{end}}{{range .EmbedFiles}}{{"\t"}}{{.}}{{end}}{{"\n"}}{{end}}`
+
+// digestFile returns the name of the file, stored beside a binary, that holds the digest
+// of the inputs used to build it
+//
+func digestFile(binary string) string {
+	return binary + ".digest"
+}
+
+// BuildDigest returns the hex encoded sha256 digest of the inputs used to build the main
+// package of the options for a target.  The digest covers the source files of the
+// packages the binary depends upon, the go.mod and go.sum files, the build tags, flags
+// and ldflags, and the toolchain.
+//
+func (md *MetaData) BuildDigest(opts GoBuildOptions, ldFlags string, target GoTarget) (digest string, err kv.Error) {
+	run := opts.GoRunOptions.defaults()
+	env := goBuildEnv(targetEnv(opts.Env, target))
+
+	hash := sha256.New()
+
+	fmt.Fprintf(hash, "target\t%s\n", target.String())
+	for _, arg := range md.buildArgs(opts, ldFlags) {
+		fmt.Fprintf(hash, "arg\t%s\n", arg)
+	}
+
+	toolchain, err := manifestEnv(run, env)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(toolchain))
+	for k := range toolchain {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(hash, "env\t%s=%s\n", k, toolchain[k])
+	}
+
+	_, moduleDir, err := GoModulePath(run.Dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		fileDigest, err := fileSHA256(filepath.Join(moduleDir, name))
+		if err != nil {
+			// A module without dependencies has no go.sum
+			if name == "go.sum" {
+				continue
+			}
+			return "", err
+		}
+		fmt.Fprintf(hash, "file\t%s\t%s\n", name, fileDigest)
+	}
+
+	out := &strings.Builder{}
+	errOut := &strings.Builder{}
+	run.Stdout = out
+	run.Stderr = errOut
+	args := append([]string{"list", "-deps"}, tagArgs(opts.Tags)...)
+	args = append(args, "-f", digestListFormat, ".")
+	if err = RunCommand(run.Ctx, run.goCommand(env, args...)); err != nil {
+		return "", err.With("output", strings.TrimSpace(errOut.String()))
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(out.String()))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		pkgPath, pkgDir, moduleVersion := fields[0], fields[1], fields[2]
+		if len(moduleVersion) != 0 {
+			fmt.Fprintf(hash, "package\t%s\t%s\n", pkgPath, moduleVersion)
+			continue
+		}
+		fmt.Fprintf(hash, "package\t%s\n", pkgPath)
+		for _, name := range fields[3:] {
+			fileDigest, err := fileSHA256(filepath.Join(pkgDir, name))
+			if err != nil {
+				return "", err.With("package", pkgPath)
+			}
+			fmt.Fprintf(hash, "file\t%s\t%s\n", name, fileDigest)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// cachedBuild returns a result for a target when the binary exists and the digest stored
+// beside it matches the current build inputs, otherwise nil is returned
+//
+func (md *MetaData) cachedBuild(opts GoBuildOptions, ldFlags string, target GoTarget) (result *GoBuildResult) {
+	path := md.buildPath(opts, target)
+
+	info, errGo := os.Stat(path)
+	if errGo != nil {
+		return nil
+	}
+	stored, errGo := ioutil.ReadFile(digestFile(path))
+	if errGo != nil {
+		return nil
+	}
+
+	// Failures to compute the digest simply result in the binary being built
+	digest, err := md.BuildDigest(opts, ldFlags, target)
+	if err != nil || digest != strings.TrimSpace(string(stored)) {
+		return nil
+	}
+
+	result = &GoBuildResult{
+		Target: target,
+		Path:   path,
+		Size:   info.Size(),
+		Digest: digest,
+		Cached: true,
+	}
+	if opts.Reproducible {
+		if _, errGo = os.Stat(path + ".manifest.json"); errGo != nil {
+			return nil
+		}
+		result.Manifest = path + ".manifest.json"
+	}
+	return result
+}
+
+// saveBuildDigest stores the digest of the build inputs beside a binary that was built
+// successfully
+//
+func (md *MetaData) saveBuildDigest(opts GoBuildOptions, ldFlags string, result *GoBuildResult) (err kv.Error) {
+	if result.Digest, err = md.BuildDigest(opts, ldFlags, result.Target); err != nil {
+		return err.With("module", md.Module, "target", result.Target.String())
+	}
+
+	fn := digestFile(result.Path)
+	if errGo := ioutil.WriteFile(fn, []byte(result.Digest+"\n"), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBuildCache checks that binaries are only rebuilt when their inputs change, or when
+// a build is forced
+//
+func TestBuildCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping builds in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "buildcache")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":             "module example.com/project\n\ngo 1.18\n",
+		"main.go":            "package main\n\nimport \"example.com/project/version\"\n\nfunc main() { println(version.BuildTime) }\n",
+		"version/version.go": "package version\n\nvar BuildTime = \"unknown\"\n",
+	})
+
+	md := &MetaData{Module: "project"}
+	opts := GoBuildOptions{
+		GoRunOptions: GoRunOptions{Dir: dir, Stdout: ioutil.Discard, Stderr: ioutil.Discard},
+		OutputDir:    filepath.Join(dir, "bin"),
+	}
+
+	build := func(opts GoBuildOptions, cached bool) {
+		t.Helper()
+		results, err := md.GoBuildWithOptions(opts)
+		if err != nil {
+			t.Fatal(err, results[0].Output)
+		}
+		if results[0].Cached != cached {
+			t.Fatalf("expected cached to be %v for %+v", cached, results[0])
+		}
+		if len(results[0].Digest) == 0 {
+			t.Fatal("the build digest was missing")
+		}
+	}
+
+	build(opts, false)
+	build(opts, true)
+
+	// A change to a dependency of the binary invalidates the digest
+	writeTree(t, dir, map[string]string{
+		"version/version.go": "package version\n\nvar BuildTime = \"unset\"\n",
+	})
+	build(opts, false)
+	build(opts, true)
+
+	opts.Tags = []string{"extra"}
+	build(opts, false)
+
+	opts.Force = true
+	build(opts, false)
+
+	// GoCompile builds the package in the current directory and shares the cache
+	cwd, errGo := os.Getwd()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = os.Chdir(dir); errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Chdir(cwd)
+
+	before, errGo := os.Stat(md.buildPath(opts, defaultGoTarget(nil)))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	outputs, err := md.GoCompile(nil, opts.Tags, nil, opts.OutputDir, "")
+	if err != nil {
+		t.Fatal(err, outputs)
+	}
+	after, errGo := os.Stat(outputs[0])
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Fatal("GoCompile rebuilt a binary whose inputs were unchanged")
+	}
+}
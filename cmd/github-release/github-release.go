@@ -31,6 +31,9 @@ var (
 	verbose = flag.Bool("v", false, "When enabled will print internal logging for this tool")
 	token   = flag.String("github-token", "", "The github token string obtained from https://github.com/settings/tokens, defaults to the env var GITHUB_TOKEN")
 	module  = flag.String("module", ".", "The name of the component that is being used to identify the container image, this will default to the current working directory")
+
+	signingKey  = flag.String("signing-key", "", "A PKCS #8 PEM ed25519, minisign, or OpenSSH private key file, when supplied a signed SHA256SUMS file and signatures for each file are added to the release")
+	keyPassword = flag.String("key-password", "", "The password for an encrypted signing key, best supplied using the KEY_PASSWORD env var")
 )
 
 func usage() {
@@ -57,6 +60,28 @@ func init() {
 	flag.Usage = usage
 }
 
+// signUploads adds a signed checksums file, and signatures for each of the uploads, to
+// the files being uploaded.  The checksums file and the signatures are written to the
+// supplied directory leaving the directories of the uploads untouched.
+//
+func signUploads(md *duat.MetaData, uploads []string, tmpDir string) (signed []string, err kv.Error) {
+	key, err := duat.LoadArtifactKey(*signingKey, []byte(*keyPassword))
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := md.SignArtifacts(duat.SignOptions{
+		Files:        uploads,
+		SumsFile:     filepath.Join(tmpDir, duat.SHA256SumsFile),
+		Key:          key,
+		SignatureDir: tmpDir,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(uploads, outputs...), nil
+}
+
 func main() {
 
 	// Parse the CLI flags
@@ -71,13 +96,13 @@ func main() {
 	if *verbose {
 		logger.SetLevel(logxi.LevelDebug)
 	}
-	if len(os.Args) < 1 {
+	if len(flag.Args()) < 1 {
 		fmt.Fprintln(os.Stderr, kv.NewError("no input file names were supplied").With("stack", stack.Trace().TrimRuntime()))
 		os.Exit(-1)
 	}
 
 	fns := []string{}
-	for _, fn := range os.Args[1:] {
+	for _, fn := range flag.Args() {
 		if fn == "-" {
 			buff, errGo := ioutil.ReadAll(os.Stdin)
 			if errGo != nil {
@@ -113,7 +138,31 @@ func main() {
 		os.Exit(-1)
 	}
 
-	if err = md.CreateRelease(*token, "", uploads); err != nil {
+	// os.Exit skips deferred functions so the signing directory is removed explicitly
+	// before exiting on any error
+	tmpDir := ""
+	if len(*signingKey) != 0 {
+		dir, errGo := ioutil.TempDir("", "github-release")
+		if errGo != nil {
+			fmt.Fprintln(os.Stderr, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+			os.Exit(-1)
+		}
+		tmpDir = dir
+
+		if uploads, err = signUploads(md, uploads, tmpDir); err != nil {
+			os.RemoveAll(tmpDir)
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	err = md.CreateRelease(*token, "", uploads)
+
+	if len(tmpDir) != 0 {
+		os.RemoveAll(tmpDir)
+	}
+
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(-1)
 	}
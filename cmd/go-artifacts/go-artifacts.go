@@ -0,0 +1,429 @@
+package main
+
+// This file contains the main function for a tool that operates on the artifacts produced
+// by builds, such as generating the software bill of materials for a module or binary
+//
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	logxi "github.com/karlmutch/logxi/v1" // Using a forked copy of this package results in build issues
+	colorable "github.com/mattn/go-colorable"
+
+	"github.com/jjeffery/kv" // Forked copy of https://github.com/jjeffery/kv
+
+	"github.com/karlmutch/duat"
+	"github.com/karlmutch/duat/version"
+
+	"github.com/karlmutch/envflag" // Forked copy of https://github.com/GoBike/envflag
+)
+
+var (
+	logger = logxi.NewLogger(logxi.NewConcurrentWriter(colorable.NewColorableStderr()), "go-artifacts")
+
+	verFn   = flag.String("f", "README.md,README.adoc", "A list of files from which the first match will be used as the source of truth for the version")
+	verbose = flag.Bool("v", false, "When enabled will print internal logging for this tool")
+	dir     = flag.String("dir", ".", "The directory of the module, or repository, being processed")
+
+	binary     = flag.String("binary", "", "A Go binary to be processed, when not specified the module in the directory is used")
+	format     = flag.String("format", "", "The output format, spdx (default) or cyclonedx for sbom, and text (default) or json for inspect and audit")
+	output     = flag.String("output", "-", "The file to which output is written, - for the console")
+	confidence = flag.Float64("confidence", 0.85, "The minimum confidence, from 0 to 1, of licenses reported by the license detector")
+
+	sums        = flag.String("sums", "", "The checksums file written by sign, and read by verify, defaults to bin/SHA256SUMS")
+	signingKey  = flag.String("signing-key", "", "A PKCS #8 PEM ed25519, minisign, or OpenSSH private key file used to sign artifacts")
+	keyPassword = flag.String("key-password", "", "The password for an encrypted signing key, best supplied using the KEY_PASSWORD env var")
+	publicKey   = flag.String("public-key", "", "A minisign, PEM ed25519, or OpenSSH public key file used to verify signatures")
+
+	database    = flag.String("database", "", "The directory, or zip file, containing a local copy of an OSV vulnerability database, such as https://vuln.go.dev/vulndb.zip, used by audit")
+	failOn      = flag.String("fail-on", "high", "The lowest severity of advisory, low, moderate, high or critical, that causes audit to fail, none disables failures")
+	failUnknown = flag.Bool("fail-unknown", false, "Causes audit to fail for advisories without a severity, which includes every advisory of the Go vulnerability database, including those of the standard library")
+
+	module        = flag.String("module", "", "The name of the module used to locate binaries, named module-os-arch, and to name archives, defaults to the name of the directory")
+	archiveName   = flag.String("archive-name", duat.DefaultArchiveName, "The text/template used to name archives, using .Module, .Version, .GitHash, .OS, .Arch, .Arm and .Suffix")
+	archiveDir    = flag.String("archive-dir", "dist", "The directory into which archives are written")
+	archiveFormat = flag.String("archive-format", "", "Either tar.gz or zip, by default zip is used for windows binaries and tar.gz for others")
+	extras        = flag.String("extras", "", "A comma separated list of files added to archives, defaults to the README, LICENSE and CHANGELOG files of the directory")
+
+	manifest       = flag.String("manifest", "package.yaml", "The YAML manifest listing the binaries, configuration files, systemd units, scripts and dependencies of packages")
+	packageFormats = flag.String("package-formats", "deb,rpm", "A comma separated list of the package formats, deb and rpm, written by package")
+	targets        = flag.String("targets", "linux/amd64", "A comma separated list of linux os/arch[/arm] targets packaged by package")
+	packageDir     = flag.String("package-dir", "dist", "The directory into which packages are written")
+
+	coverageDir       = flag.String("coverage-dir", "./coverage", "The directory containing the profile-*.out coverage profiles merged and checked by coverage")
+	coverageHTML      = flag.Bool("coverage-html", false, "Write a coverage.html report using go tool cover")
+	coverageCobertura = flag.Bool("coverage-cobertura", false, "Write a cobertura.xml report")
+	coverageThreshold = flag.Float64("coverage-threshold", 0, "The minimum total coverage percentage, zero disables the check")
+	coverageHistory   = flag.String("coverage-history", "", "A JSON file recording the coverage of releases, coverage may not fall below the last release")
+	coverageTolerance = flag.Float64("coverage-tolerance", 0, "The percentage points by which coverage may fall below the last release")
+
+	symbols = flag.String("symbols", "", "A comma separated list of fully qualified string variables, for example example.com/project/version.Version, reported by inspect in addition to those of the duat version package")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[options] [command]      build artifact tool (go-artifacts)      ", version.GitHash, "    ", version.BuildTime)
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "go-artifacts operates on the artifacts produced by Go builds, and the modules they are built from.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "    sbom     Writes a software bill of materials, with detected licenses, for a binary or module")
+	fmt.Fprintln(os.Stderr, "    sign     Writes a SHA256SUMS file for the files supplied as arguments, or the binaries in ./bin, and signs")
+	fmt.Fprintln(os.Stderr, "             it along with each file when a signing key is supplied")
+	fmt.Fprintln(os.Stderr, "    inspect  Prints the version symbols, build settings, VCS information and dependencies of the binary")
+	fmt.Fprintln(os.Stderr, "             supplied as an argument, or using the binary option.  When two binaries are supplied")
+	fmt.Fprintln(os.Stderr, "             the differences between them are printed")
+	fmt.Fprintln(os.Stderr, "    audit    Checks the modules of the binary option, or the module, against a local OSV database and")
+	fmt.Fprintln(os.Stderr, "             fails when advisories match the severity policy")
+	fmt.Fprintln(os.Stderr, "    archive  Packages the binaries supplied as arguments, or those in ./bin, into deterministic tar.gz,")
+	fmt.Fprintln(os.Stderr, "             or zip for windows, archives along with the README, LICENSE and CHANGELOG files")
+	fmt.Fprintln(os.Stderr, "    package  Writes .deb and .rpm packages, without using dpkg or rpm, containing the files listed by")
+	fmt.Fprintln(os.Stderr, "             the manifest and versioned using the module version")
+	fmt.Fprintln(os.Stderr, "    coverage Merges the coverage profiles collected by go-modules, or the duat test APIs, writes the")
+	fmt.Fprintln(os.Stderr, "             reports and fails when coverage is below the threshold or that of the last release")
+	fmt.Fprintln(os.Stderr, "    verify   Checks the signature of a SHA256SUMS file, and then the files supplied as arguments, or")
+	fmt.Fprintln(os.Stderr, "             all of the files it lists, against their checksums and signatures")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Environment Variables:")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "options can also be extracted from environment variables by changing dashes '-' to underscores and using upper case.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "log levels are handled by the LOGXI env variables, these are documented at https://github.com/mgutz/logxi")
+}
+
+func init() {
+	flag.Usage = usage
+}
+
+// loadMetaData returns the version and git information for the directory, both are
+// optional
+//
+func loadMetaData() (md *duat.MetaData, err kv.Error) {
+	md = &duat.MetaData{}
+	for _, verFile := range strings.Split(*verFn, ",") {
+		if _, errGo := os.Stat(verFile); errGo == nil {
+			if _, err = md.LoadVer(verFile); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if err = md.LoadGit(*dir, true); err != nil {
+		logger.Debug(fmt.Sprintf("git information is not available due to %v", err))
+	}
+	return md, nil
+}
+
+// writeOutput runs a function with the writer selected by the output option
+//
+func writeOutput(write func(w io.Writer) kv.Error) (err kv.Error) {
+	if *output == "-" {
+		return write(os.Stdout)
+	}
+	f, errGo := os.Create(*output)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", *output)
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if errGo = f.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", *output)
+	}
+	return nil
+}
+
+func sbom(md *duat.MetaData) (err kv.Error) {
+	bom, err := md.SBOM(duat.SBOMOptions{
+		GoRunOptions: duat.GoRunOptions{Dir: *dir},
+		Binary:       *binary,
+		Confidence:   float32(*confidence),
+	})
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(*format) {
+	case "", "spdx":
+		return writeOutput(bom.WriteSPDX)
+	case "cyclonedx":
+		return writeOutput(bom.WriteCycloneDX)
+	default:
+		return kv.NewError("unknown SBOM format, use spdx or cyclonedx").With("format", *format)
+	}
+}
+
+// sumsFile returns the checksums file selected by the sums option
+//
+func sumsFile() string {
+	if len(*sums) != 0 {
+		return *sums
+	}
+	return filepath.Join("bin", duat.SHA256SumsFile)
+}
+
+func sign(md *duat.MetaData, files []string) (err kv.Error) {
+	opts := duat.SignOptions{
+		Files:    files,
+		SumsFile: sumsFile(),
+	}
+	if len(*signingKey) != 0 {
+		if opts.Key, err = duat.LoadArtifactKey(*signingKey, []byte(*keyPassword)); err != nil {
+			return err
+		}
+	}
+
+	outputs, err := md.SignArtifacts(opts)
+	if err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		fmt.Println(output)
+	}
+	return nil
+}
+
+func verify(files []string) (err kv.Error) {
+	if len(*publicKey) == 0 {
+		return kv.NewError("the public-key option must be supplied to verify signatures")
+	}
+	pub, err := duat.LoadArtifactPublicKey(*publicKey)
+	if err != nil {
+		return err
+	}
+
+	verified, err := duat.VerifyArtifacts(sumsFile(), pub, files)
+	for _, fn := range verified {
+		fmt.Println(fn, "OK")
+	}
+	return err
+}
+
+func inspect(files []string) (err kv.Error) {
+	if len(files) == 0 && len(*binary) != 0 {
+		files = []string{*binary}
+	}
+	if len(files) == 0 || len(files) > 2 {
+		return kv.NewError("inspect requires one binary, or two binaries to be compared").With("binaries", files)
+	}
+
+	extra := []string{}
+	for _, symbol := range strings.Split(*symbols, ",") {
+		if symbol = strings.TrimSpace(symbol); len(symbol) != 0 {
+			extra = append(extra, symbol)
+		}
+	}
+
+	infos := make([]*duat.BinaryInfo, 0, len(files))
+	for _, fn := range files {
+		info, err := duat.InspectBinary(fn, extra)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	var writeText, writeJSON func(w io.Writer) kv.Error
+	if len(infos) == 1 {
+		writeText, writeJSON = infos[0].WriteText, infos[0].WriteJSON
+	} else {
+		comparison := duat.CompareBinaries(infos[0], infos[1])
+		writeText, writeJSON = comparison.WriteText, comparison.WriteJSON
+	}
+
+	switch strings.ToLower(*format) {
+	case "", "text":
+		return writeOutput(writeText)
+	case "json":
+		return writeOutput(writeJSON)
+	default:
+		return kv.NewError("unknown inspect format, use text or json").With("format", *format)
+	}
+}
+
+func audit() (err kv.Error) {
+	if len(*database) == 0 {
+		return kv.NewError("the database option must be supplied for audits")
+	}
+	policy := duat.SeverityUnknown
+	if !strings.EqualFold(*failOn, "none") {
+		if policy, err = duat.ParseAuditSeverity(*failOn); err != nil {
+			return err
+		}
+	}
+
+	report, err := duat.AuditModules(duat.AuditOptions{
+		GoRunOptions: duat.GoRunOptions{Dir: *dir},
+		Binary:       *binary,
+		Database:     *database,
+	})
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(*format) {
+	case "", "text":
+		err = writeOutput(report.WriteText)
+	case "json":
+		err = writeOutput(report.WriteJSON)
+	default:
+		return kv.NewError("unknown audit format, use text or json").With("format", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if violations := report.Violations(policy, *failUnknown); len(violations) != 0 {
+		ids := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			ids = append(ids, violation.ID)
+		}
+		return kv.NewError("advisories matching the severity policy were found").With("advisories", strings.Join(ids, ","), "fail-on", *failOn)
+	}
+	return nil
+}
+
+// setModule names the module using the module option, or the name of the directory
+//
+func setModule(md *duat.MetaData) (err kv.Error) {
+	md.Module = *module
+	if len(md.Module) == 0 {
+		absDir, errGo := filepath.Abs(*dir)
+		if errGo != nil {
+			return kv.Wrap(errGo).With("dir", *dir)
+		}
+		md.Module = filepath.Base(absDir)
+	}
+	return nil
+}
+
+func archive(md *duat.MetaData, files []string) (err kv.Error) {
+	if err = setModule(md); err != nil {
+		return err
+	}
+
+	opts := duat.ArchiveOptions{
+		Files:     files,
+		Dir:       *dir,
+		OutputDir: *archiveDir,
+		Name:      *archiveName,
+		Format:    *archiveFormat,
+	}
+	if len(*extras) != 0 {
+		opts.Extras = strings.Split(*extras, ",")
+	}
+
+	archives, err := md.PackageArchives(opts)
+	if err != nil {
+		return err
+	}
+	for _, fn := range archives {
+		fmt.Println(fn)
+	}
+	return nil
+}
+
+func linuxPackages(md *duat.MetaData) (err kv.Error) {
+	if err = setModule(md); err != nil {
+		return err
+	}
+
+	buildTargets, err := duat.ParseGoTargets(strings.Split(*targets, ","))
+	if err != nil {
+		return err
+	}
+
+	packages, err := md.LinuxPackages(duat.PackageOptions{
+		Manifest:  *manifest,
+		Formats:   strings.Split(*packageFormats, ","),
+		Targets:   buildTargets,
+		OutputDir: *packageDir,
+	})
+	if err != nil {
+		return err
+	}
+	for _, fn := range packages {
+		fmt.Println(fn)
+	}
+	return nil
+}
+
+func checkCoverage(md *duat.MetaData) (err kv.Error) {
+	report, err := md.CheckCoverage(&duat.CoverageOptions{
+		Dir:         *coverageDir,
+		HTML:        *coverageHTML,
+		Cobertura:   *coverageCobertura,
+		Threshold:   *coverageThreshold,
+		HistoryFile: *coverageHistory,
+		Tolerance:   *coverageTolerance,
+	})
+	if report != nil {
+		fmt.Printf("coverage %.1f%% of %d statements\n", report.Total.Percent, report.Total.Statements)
+	}
+	return err
+}
+
+func main() {
+
+	// Parse the CLI flags
+	if !flag.Parsed() {
+		envflag.Parse()
+	}
+
+	if *verbose {
+		logger.SetLevel(logxi.LevelDebug)
+	}
+
+	logger.Debug(fmt.Sprintf("%s built at %s, against commit id %s\n", os.Args[0], version.BuildTime, version.GitHash))
+
+	if len(flag.Args()) < 1 {
+		usage()
+		fmt.Fprintf(os.Stderr, "a command must be specified. you must specify only one of the commands [sbom|sign|verify|inspect|audit|archive|package|coverage]\n")
+		os.Exit(-1)
+	}
+
+	md, err := loadMetaData()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-2)
+	}
+
+	switch command := flag.Arg(0); command {
+	case "sbom":
+		err = sbom(md)
+	case "sign":
+		err = sign(md, flag.Args()[1:])
+	case "verify":
+		err = verify(flag.Args()[1:])
+	case "inspect":
+		err = inspect(flag.Args()[1:])
+	case "audit":
+		err = audit()
+	case "archive":
+		err = archive(md, flag.Args()[1:])
+	case "package":
+		err = linuxPackages(md)
+	case "coverage":
+		err = checkCoverage(md)
+	default:
+		usage()
+		fmt.Fprintf(os.Stderr, "unknown command '%s'. you must specify only one of the commands [sbom|sign|verify|inspect|audit|archive|package|coverage]\n", command)
+		os.Exit(-1)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-3)
+	}
+}
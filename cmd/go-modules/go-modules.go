@@ -0,0 +1,286 @@
+package main
+
+// This file contains the main function for a tool that discovers the go modules within a
+// repository, including those of a go.work workspace, and builds or tests each of them
+// in dependency order
+//
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	logxi "github.com/karlmutch/logxi/v1" // Using a forked copy of this package results in build issues
+	colorable "github.com/mattn/go-colorable"
+
+	"github.com/karlmutch/duat"
+	"github.com/karlmutch/duat/version"
+
+	"github.com/karlmutch/envflag" // Forked copy of https://github.com/GoBike/envflag
+)
+
+var (
+	logger = logxi.NewLogger(logxi.NewConcurrentWriter(colorable.NewColorableStderr()), "go-modules")
+
+	verFn   = flag.String("f", "README.md,README.adoc", "A list of files from which the first match will be used as the source of truth for the version")
+	verbose = flag.Bool("v", false, "When enabled will print internal logging for this tool")
+	dir     = flag.String("dir", ".", "The root directory of the repository, or workspace, containing the modules")
+
+	outputDir = flag.String("output-dir", "./bin", "The directory into which binaries are written")
+	targets   = flag.String("targets", "", "A comma separated list of os/arch[/arm] build targets, defaults to the target of the environment")
+	tags      = flag.String("tags", "", "A comma separated list of build tags")
+	modules   = flag.String("modules", "", "A comma separated list of module paths to be processed, defaults to all modules")
+	stop      = flag.Bool("stop", false, "Stop at the first module that fails")
+	results   = flag.String("results", "", "When present a JSON summary of the results for each module is written to this file")
+	timeout   = flag.Duration("timeout", 0, "The maximum duration of each go command, zero for no limit")
+	force     = flag.Bool("force", false, "Build binaries, or run generators, even when their inputs are unchanged since they were last run")
+	check     = flag.Bool("check", false, "When generating, fail if any generated files are out of date rather than running the generators")
+
+	coverage          = flag.Bool("coverage", false, "When testing, collect coverage from every module and merge the profiles once all modules are tested")
+	coverageDir       = flag.String("coverage-dir", "./coverage", "The directory into which coverage profiles and reports are written")
+	coverageMode      = flag.String("coverage-mode", "set", "The go test -covermode used to collect coverage, set, count or atomic")
+	coverPkg          = flag.String("coverpkg", "", "A comma separated list of go test -coverpkg patterns, used to include packages from other modules")
+	coverageHTML      = flag.Bool("coverage-html", false, "Write a coverage.html report using go tool cover")
+	coverageCobertura = flag.Bool("coverage-cobertura", false, "Write a cobertura.xml report")
+	coverageThreshold = flag.Float64("coverage-threshold", 0, "The minimum total coverage percentage, zero disables the check, implies -coverage")
+	coverageHistory   = flag.String("coverage-history", "", "A JSON file recording the coverage of releases, coverage may not fall below the last release, implies -coverage")
+	coverageTolerance = flag.Float64("coverage-tolerance", 0, "The percentage points by which coverage may fall below the last release")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[options] [command]      go module build and test tool (go-modules)      ", version.GitHash, "    ", version.BuildTime)
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "go-modules finds every go.mod within a directory tree, or the modules used by a go.work file, and")
+	fmt.Fprintln(os.Stderr, "processes them in dependency order.  Modules that depend upon a module that failed are skipped.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "    list     Lists the modules, in dependency order, with their main packages")
+	fmt.Fprintln(os.Stderr, "    build    Builds the main packages of every module, this is the default")
+	fmt.Fprintln(os.Stderr, "    test     Runs the tests of every module, optionally checking the merged coverage of all modules")
+	fmt.Fprintln(os.Stderr, "    generate Runs the go generate directives of every module whose inputs, or outputs, have changed")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Environment Variables:")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "options can also be extracted from environment variables by changing dashes '-' to underscores and using upper case.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "log levels are handled by the LOGXI env variables, these are documented at https://github.com/mgutz/logxi")
+}
+
+func init() {
+	flag.Usage = usage
+}
+
+func splitList(list string) (items []string) {
+	items = []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+type moduleSummary struct {
+	Module   string   `json:"module"`
+	Dir      string   `json:"dir"`
+	Status   string   `json:"status"`
+	Duration float64  `json:"duration_seconds"`
+	Binaries []string `json:"binaries,omitempty"`
+	Failed   []string `json:"failed_tests,omitempty"`
+	Stale    []string `json:"stale_generators,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func main() {
+
+	// Parse the CLI flags
+	if !flag.Parsed() {
+		envflag.Parse()
+	}
+
+	if *verbose {
+		logger.SetLevel(logxi.LevelDebug)
+	}
+
+	logger.Debug(fmt.Sprintf("%s built at %s, against commit id %s\n", os.Args[0], version.BuildTime, version.GitHash))
+
+	if len(flag.Args()) > 1 {
+		usage()
+		fmt.Fprintf(os.Stderr, "too many (%d - %v), command(s). you must specify only one of the commands [list|build|test|generate]\n", len(flag.Args()), flag.Args())
+		os.Exit(-1)
+	}
+
+	ws, err := duat.FindGoModules(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-2)
+	}
+
+	command := flag.Arg(0)
+	if len(command) == 0 {
+		command = "build"
+	}
+
+	if command == "list" {
+		for _, module := range ws.Modules {
+			fmt.Println(module.Path, module.Dir)
+			for _, main := range module.Mains {
+				fmt.Println("    ", main)
+			}
+		}
+		os.Exit(0)
+	}
+
+	if command != "build" && command != "test" && command != "generate" {
+		usage()
+		fmt.Fprintf(os.Stderr, "unknown command '%s'. you must specify only one of the commands [list|build|test|generate]\n", command)
+		os.Exit(-1)
+	}
+
+	// Version information is optional, without it binaries are built without version details
+	md := &duat.MetaData{}
+	for _, verFile := range strings.Split(*verFn, ",") {
+		if _, errGo := os.Stat(verFile); errGo == nil {
+			if _, err = md.LoadVer(verFile); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(-2)
+			}
+			break
+		}
+	}
+	if err = md.LoadGit(*dir, true); err != nil {
+		logger.Debug(fmt.Sprintf("git information is not available due to %v", err))
+	}
+
+	buildTargets, err := duat.ParseGoTargets(splitList(*targets))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop any go commands that are running if the user interrupts the tool
+	go func() {
+		stopC := make(chan os.Signal, 1)
+		signal.Notify(stopC, os.Interrupt, syscall.SIGTERM)
+		<-stopC
+		cancel()
+	}()
+
+	run := duat.GoRunOptions{Ctx: ctx, Timeout: *timeout}
+
+	var coverageOpts *duat.CoverageOptions
+	if *coverage || *coverageThreshold > 0 || len(*coverageHistory) != 0 {
+		coverageOpts = &duat.CoverageOptions{
+			Dir:         *coverageDir,
+			Mode:        *coverageMode,
+			CoverPkg:    splitList(*coverPkg),
+			HTML:        *coverageHTML,
+			Cobertura:   *coverageCobertura,
+			Threshold:   *coverageThreshold,
+			HistoryFile: *coverageHistory,
+			Tolerance:   *coverageTolerance,
+		}
+	}
+
+	opts := duat.GoModulesOptions{
+		Build: duat.GoBuildOptions{
+			GoRunOptions: run,
+			Tags:         splitList(*tags),
+			OutputDir:    *outputDir,
+			Targets:      buildTargets,
+			Force:        *force,
+		},
+		Test: duat.GoTestOptions{
+			GoRunOptions: run,
+			Tags:         splitList(*tags),
+			Coverage:     coverageOpts,
+		},
+		Generate: duat.GoGenerateModuleOptions{
+			GoRunOptions: run,
+			Filter:       duat.GoSourceFilter{Tags: splitList(*tags)},
+			Force:        *force,
+			Check:        *check,
+		},
+		RunTests:       command == "test",
+		RunGenerate:    command == "generate",
+		StopOnFailure:  *stop,
+		IncludeModules: splitList(*modules),
+	}
+
+	moduleResults, err := md.GoModules(ws, opts)
+
+	summaries := make([]*moduleSummary, 0, len(moduleResults))
+	for _, result := range moduleResults {
+		summary := &moduleSummary{
+			Module:   result.Module.Path,
+			Dir:      result.Module.Dir,
+			Status:   "ok",
+			Duration: result.Duration.Round(time.Millisecond).Seconds(),
+		}
+		for _, build := range result.Builds {
+			if build.Err == nil {
+				summary.Binaries = append(summary.Binaries, build.Path)
+			}
+		}
+		if result.Tests != nil {
+			for _, test := range result.Tests.Failed() {
+				summary.Failed = append(summary.Failed, strings.TrimSuffix(test.Package+"."+test.Name, "."))
+			}
+		}
+		for _, generated := range result.Generated {
+			if len(generated.Stale) != 0 {
+				summary.Stale = append(summary.Stale, fmt.Sprintf("%s:%d %s (%s)", generated.Directive.File, generated.Directive.Line, generated.Directive.Text, generated.Stale))
+			}
+		}
+		switch {
+		case result.Skipped:
+			summary.Status = "skipped"
+		case result.Err != nil:
+			summary.Status = "failed"
+		}
+		if result.Err != nil {
+			summary.Error = result.Err.Error()
+		}
+		summaries = append(summaries, summary)
+
+		fmt.Fprintf(os.Stdout, "%-8s %-50s %6.1fs\n", summary.Status, summary.Module, summary.Duration)
+		for _, failed := range summary.Failed {
+			fmt.Fprintln(os.Stdout, "         ", failed)
+		}
+		for _, stale := range summary.Stale {
+			fmt.Fprintln(os.Stdout, "         ", stale)
+		}
+	}
+
+	if len(*results) != 0 {
+		data, errGo := json.MarshalIndent(summaries, "", "  ")
+		if errGo == nil {
+			errGo = ioutil.WriteFile(*results, append(data, '\n'), 0644)
+		}
+		if errGo != nil {
+			fmt.Fprintln(os.Stderr, errGo.Error())
+			os.Exit(-3)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-4)
+	}
+}
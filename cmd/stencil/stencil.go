@@ -27,7 +27,15 @@ var (
 	input  = flag.String("input", "", "The name of an input file, defaults to the standard input of the shell")
 	output = flag.String("output", "", "The name of an output file, default to the console")
 
-	values       = flag.String("values", "", "A comma seperated list of k=v pairs, that can act as overriden values or new values within the template")
+	inputDir  = flag.String("input-dir", "", "A directory tree of templates, files with a .tmpl suffix are rendered and others copied, file and directory names are also templates")
+	outputDir = flag.String("output-dir", "", "The directory into which the input-dir tree is rendered")
+	partials  = flag.String("partials", "", "A comma separated list of directories containing templates, typically define blocks, that are available to all inputs using template and include")
+
+	values       = flag.String("values", "", "A comma seperated list of k=v pairs, that can act as overriden values or new values within the template, keys can be dotted paths such as a.b[0].c and values are typed as bools, integers or null unless quoted")
+	valueFiles   = flag.String("values-files", "", "A comma seperated list of JSON, YAML, TOML, .env or INI files, or - for the standard input, whose values are deep merged in order for use within the template")
+	setString    = &pairsFlag{}
+	setJSON      = &pairsFlag{}
+	strict       = flag.Bool("strict", false, "Fails when templates reference missing values, reporting the location of each, and warns about values that are not used")
 	suppressWarn = flag.Bool("supress-warnings", false, "This flag will cause warnings to become supressed")
 	warnError    = flag.Bool("error-warnings", false, "This flag will cause warnings to be treated error exits")
 )
@@ -56,7 +64,31 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "log levels are handled by the LOGXI env variables, these are documented at https://github.com/mgutz/logxi")
 }
 
+// pairsFlag collects the k=v pairs of a flag that can be repeated
+//
+type pairsFlag map[string]string
+
+func (pairs *pairsFlag) String() string {
+	text := []string{}
+	for k, v := range *pairs {
+		text = append(text, k+"="+v)
+	}
+	return strings.Join(text, " ")
+}
+
+func (pairs *pairsFlag) Set(text string) error {
+	pair := strings.SplitN(text, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("the key value pair %q must be seperated with an equals (=)", text)
+	}
+	(*pairs)[pair[0]] = pair[1]
+	return nil
+}
+
 func init() {
+	flag.Var(setString, "set-string", "A k=v pair, that can be repeated, whose value is always a string, keys can be dotted paths")
+	flag.Var(setJSON, "set-json", "A k=v pair, that can be repeated, whose value is a JSON document, keys can be dotted paths")
+
 	flag.Usage = usage
 }
 
@@ -113,36 +145,68 @@ func main() {
 		logger.Debug(fmt.Sprintf("%s:%s", repo, ver))
 	}
 
-	// Setup the I/O streams that will be processed using the standard input
-	// and output as the defaults
-	in := os.Stdin
-	out := os.Stdout
-
-	if len(*input) != 0 {
-		file, errGo := os.Open(*input)
-		if errGo != nil {
-			fmt.Fprintln(os.Stderr, errGo.Error())
-			os.Exit(-2)
-		}
-		in = file
-	}
-	if len(*output) != 0 {
-		file, errGo := os.Open(*output)
-		if errGo != nil {
-			fmt.Fprintln(os.Stderr, errGo.Error())
-			os.Exit(-2)
-		}
-		out = file
+	if len(*inputDir) != 0 && len(*outputDir) == 0 {
+		fmt.Fprintln(os.Stderr, "the -output-dir option must be used with the -input-dir option")
+		os.Exit(-3)
 	}
 
-	// Take the open streams that will be used and place them into a parameter structure for the
+	// Take the streams that will be used and place them into a parameter structure for the
 	// template function, along with key value pairs of template variables specified on the command line
 	opts := duat.TemplateOptions{
-		IOFiles: []duat.TemplateIOFiles{{
-			In:  in,
-			Out: out,
-		}},
+		InputDir:       *inputDir,
+		OutputDir:      *outputDir,
 		OverrideValues: map[string]string{},
+		StringValues:   *setString,
+		JSONValues:     *setJSON,
+		Strict:         *strict,
+	}
+	if len(*valueFiles) != 0 {
+		opts.ValueFiles = strings.Split(*valueFiles, ",")
+	}
+	if len(*partials) != 0 {
+		opts.PartialDirs = strings.Split(*partials, ",")
+	}
+
+	readsStdin := false
+	for _, fn := range opts.ValueFiles {
+		readsStdin = readsStdin || fn == duat.StdinValues
+	}
+
+	// Setup the I/O streams that will be processed using the standard input
+	// and output as the defaults, unless only a directory tree is being rendered
+	if len(*inputDir) == 0 || len(*input) != 0 {
+		if len(*input) == 0 && readsStdin {
+			fmt.Fprintln(os.Stderr, "the -input option must be used when values are read from the standard input")
+			os.Exit(-3)
+		}
+		in := os.Stdin
+		out := os.Stdout
+		name := "stdin"
+
+		if len(*input) != 0 {
+			file, errGo := os.Open(*input)
+			if errGo != nil {
+				fmt.Fprintln(os.Stderr, errGo.Error())
+				os.Exit(-2)
+			}
+			defer file.Close()
+			in = file
+			name = *input
+		}
+		if len(*output) != 0 {
+			file, errGo := os.Create(*output)
+			if errGo != nil {
+				fmt.Fprintln(os.Stderr, errGo.Error())
+				os.Exit(-2)
+			}
+			defer file.Close()
+			out = file
+		}
+		opts.IOFiles = []duat.TemplateIOFiles{{
+			In:   in,
+			Out:  out,
+			Name: name,
+		}}
 	}
 
 	if len(*values) != 0 {
@@ -173,7 +237,7 @@ func main() {
 			}
 		}
 	}
-	if *warnError {
+	if *warnError && len(warnings) != 0 {
 		os.Exit(-1)
 	}
 }
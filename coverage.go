@@ -0,0 +1,619 @@
+package duat
+
+// This file contains the implementation of test coverage collection, the merging of
+// coverage profiles, coverage reporting and gating builds on coverage levels
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// CoverageOptions controls the collection of coverage by go test and the checks applied to it
+//
+type CoverageOptions struct {
+	Dir         string   // The directory for profiles and reports, defaults to ./coverage
+	Mode        string   // The go test -covermode, defaults to set
+	CoverPkg    []string // Patterns for go test -coverpkg, used to include packages from other modules
+	HTML        bool     // Write coverage.html using go tool cover
+	Cobertura   bool     // Write cobertura.xml
+	Threshold   float64  // The minimum total coverage percentage, zero disables the check
+	HistoryFile string   // A JSON file recording the coverage of releases, coverage may not fall below the last release
+	Tolerance   float64  // The percentage points by which coverage may fall below the last release
+	CollectOnly bool     // Only collect a profile, for runs that are later merged using CheckCoverage
+	Profiles    []string // The profiles merged by CheckCoverage, test runs add those they collect, when empty every profile within the directory is merged
+}
+
+// CoverBlock is a single block from a coverage profile
+//
+type CoverBlock struct {
+	File      string // The import path qualified file name
+	StartLine int
+	StartCol  int
+	EndLine   int
+	EndCol    int
+	NumStmt   int
+	Count     int
+}
+
+func (block *CoverBlock) key() string {
+	return fmt.Sprintf("%s:%d.%d,%d.%d", block.File, block.StartLine, block.StartCol, block.EndLine, block.EndCol)
+}
+
+// CoverProfile contains the blocks from one or more merged coverage profiles
+//
+type CoverProfile struct {
+	Mode   string
+	Blocks []*CoverBlock
+
+	index map[string]*CoverBlock
+}
+
+// PackageCoverage contains the coverage of the statements in a single package
+//
+type PackageCoverage struct {
+	Package    string  `json:"package"`
+	Statements int     `json:"statements"`
+	Covered    int     `json:"covered"`
+	Percent    float64 `json:"percent"`
+}
+
+// CoverageReport contains the coverage of a profile by package and in total
+//
+type CoverageReport struct {
+	Packages []*PackageCoverage `json:"packages"`
+	Total    *PackageCoverage   `json:"total"`
+}
+
+// ParseCoverProfile reads a coverage profile in the format written by go test -coverprofile
+//
+func ParseCoverProfile(r io.Reader) (profile *CoverProfile, err kv.Error) {
+	profile = &CoverProfile{Blocks: []*CoverBlock{}, index: map[string]*CoverBlock{}}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "mode:") {
+			mode := strings.TrimSpace(strings.TrimPrefix(line, "mode:"))
+			if len(profile.Mode) != 0 && profile.Mode != mode {
+				return nil, kv.NewError("coverage modes differ").With("mode", mode, "expected", profile.Mode).With("stack", stack.Trace().TrimRuntime())
+			}
+			profile.Mode = mode
+			continue
+		}
+
+		// name.go:line.column,line.column numberOfStatements count
+		block := &CoverBlock{}
+		colon := strings.LastIndex(line, ":")
+		if colon < 0 {
+			return nil, kv.NewError("invalid coverage profile line").With("line", lineNum).With("stack", stack.Trace().TrimRuntime())
+		}
+		block.File = line[:colon]
+		if _, errGo := fmt.Sscanf(line[colon+1:], "%d.%d,%d.%d %d %d",
+			&block.StartLine, &block.StartCol, &block.EndLine, &block.EndCol, &block.NumStmt, &block.Count); errGo != nil {
+			return nil, kv.Wrap(errGo, "invalid coverage profile line").With("line", lineNum).With("stack", stack.Trace().TrimRuntime())
+		}
+		profile.add(block)
+	}
+	if errGo := scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return profile, nil
+}
+
+// add includes a block in the profile, blocks already present have their counts combined
+// according to the mode of the profile
+//
+func (profile *CoverProfile) add(block *CoverBlock) {
+	existing, isPresent := profile.index[block.key()]
+	if !isPresent {
+		copied := *block
+		profile.index[block.key()] = &copied
+		profile.Blocks = append(profile.Blocks, &copied)
+		return
+	}
+	if profile.Mode == "set" {
+		if block.Count > existing.Count {
+			existing.Count = block.Count
+		}
+		return
+	}
+	existing.Count += block.Count
+}
+
+// MergeCoverProfiles combines profiles, for example those from the tests of different modules,
+// into a single profile.  All of the profiles must use the same mode.
+//
+func MergeCoverProfiles(profiles ...*CoverProfile) (merged *CoverProfile, err kv.Error) {
+	merged = &CoverProfile{Blocks: []*CoverBlock{}, index: map[string]*CoverBlock{}}
+	for _, profile := range profiles {
+		if len(merged.Mode) == 0 {
+			merged.Mode = profile.Mode
+		}
+		if profile.Mode != merged.Mode {
+			return nil, kv.NewError("coverage modes differ").With("mode", profile.Mode, "expected", merged.Mode).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, block := range profile.Blocks {
+			merged.add(block)
+		}
+	}
+	sort.SliceStable(merged.Blocks, func(i, j int) bool {
+		bi, bj := merged.Blocks[i], merged.Blocks[j]
+		if bi.File != bj.File {
+			return bi.File < bj.File
+		}
+		if bi.StartLine != bj.StartLine {
+			return bi.StartLine < bj.StartLine
+		}
+		return bi.StartCol < bj.StartCol
+	})
+	return merged, nil
+}
+
+// MergeCoverProfileFiles reads and merges coverage profile files
+//
+func MergeCoverProfileFiles(files []string) (merged *CoverProfile, err kv.Error) {
+	profiles := make([]*CoverProfile, 0, len(files))
+	for _, fn := range files {
+		f, errGo := os.Open(fn)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		profile, err := ParseCoverProfile(f)
+		f.Close()
+		if err != nil {
+			return nil, err.With("file", fn)
+		}
+		profiles = append(profiles, profile)
+	}
+	return MergeCoverProfiles(profiles...)
+}
+
+// Write saves the profile in the format used by go test -coverprofile
+//
+func (profile *CoverProfile) Write(w io.Writer) (err kv.Error) {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "mode: %s\n", profile.Mode)
+	for _, block := range profile.Blocks {
+		fmt.Fprintf(out, "%s %d %d\n", block.key(), block.NumStmt, block.Count)
+	}
+	if errGo := out.Flush(); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func percent(covered int, statements int) float64 {
+	if statements == 0 {
+		return 0
+	}
+	return float64(covered) * 100 / float64(statements)
+}
+
+// Report returns the statement coverage of each package, and in total
+//
+func (profile *CoverProfile) Report() (report *CoverageReport) {
+	pkgs := map[string]*PackageCoverage{}
+	report = &CoverageReport{Packages: []*PackageCoverage{}, Total: &PackageCoverage{}}
+
+	for _, block := range profile.Blocks {
+		name := path.Dir(block.File)
+		pkg, isPresent := pkgs[name]
+		if !isPresent {
+			pkg = &PackageCoverage{Package: name}
+			pkgs[name] = pkg
+			report.Packages = append(report.Packages, pkg)
+		}
+		pkg.Statements += block.NumStmt
+		report.Total.Statements += block.NumStmt
+		if block.Count > 0 {
+			pkg.Covered += block.NumStmt
+			report.Total.Covered += block.NumStmt
+		}
+	}
+
+	sort.Slice(report.Packages, func(i, j int) bool { return report.Packages[i].Package < report.Packages[j].Package })
+	for _, pkg := range report.Packages {
+		pkg.Percent = percent(pkg.Covered, pkg.Statements)
+	}
+	report.Total.Percent = percent(report.Total.Covered, report.Total.Statements)
+	return report
+}
+
+type coberturaLine struct {
+	Number int `xml:"number,attr"`
+	Hits   int `xml:"hits,attr"`
+}
+
+type coberturaClass struct {
+	Name       string           `xml:"name,attr"`
+	Filename   string           `xml:"filename,attr"`
+	LineRate   string           `xml:"line-rate,attr"`
+	BranchRate string           `xml:"branch-rate,attr"`
+	Complexity string           `xml:"complexity,attr"`
+	Methods    struct{}         `xml:"methods"`
+	Lines      []*coberturaLine `xml:"lines>line"`
+}
+
+type coberturaPackage struct {
+	Name       string            `xml:"name,attr"`
+	LineRate   string            `xml:"line-rate,attr"`
+	BranchRate string            `xml:"branch-rate,attr"`
+	Complexity string            `xml:"complexity,attr"`
+	Classes    []*coberturaClass `xml:"classes>class"`
+}
+
+type coberturaCoverage struct {
+	XMLName         xml.Name            `xml:"coverage"`
+	LineRate        string              `xml:"line-rate,attr"`
+	BranchRate      string              `xml:"branch-rate,attr"`
+	LinesCovered    int                 `xml:"lines-covered,attr"`
+	LinesValid      int                 `xml:"lines-valid,attr"`
+	BranchesCovered int                 `xml:"branches-covered,attr"`
+	BranchesValid   int                 `xml:"branches-valid,attr"`
+	Complexity      string              `xml:"complexity,attr"`
+	Version         string              `xml:"version,attr"`
+	Timestamp       int64               `xml:"timestamp,attr"`
+	Sources         []string            `xml:"sources>source"`
+	Packages        []*coberturaPackage `xml:"packages>package"`
+}
+
+func lineRate(covered int, valid int) string {
+	if valid == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(covered)/float64(valid), 'f', 4, 64)
+}
+
+// WriteCobertura writes the profile as a Cobertura XML report.  File names that are within
+// the module are written relative to the module directory, which is used as the source root.
+//
+func (profile *CoverProfile) WriteCobertura(w io.Writer, modulePath string, moduleDir string) (err kv.Error) {
+	// Collect the hit counts of lines per file, a line is covered if any block covering it was run
+	files := map[string]map[int]int{}
+	for _, block := range profile.Blocks {
+		lines, isPresent := files[block.File]
+		if !isPresent {
+			lines = map[int]int{}
+			files[block.File] = lines
+		}
+		for line := block.StartLine; line <= block.EndLine; line++ {
+			if hits, isPresent := lines[line]; !isPresent || block.Count > hits {
+				lines[line] = block.Count
+			}
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := &coberturaCoverage{
+		BranchRate: "0",
+		Complexity: "0",
+		Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
+		Sources:    []string{moduleDir},
+		Packages:   []*coberturaPackage{},
+	}
+	pkgs := map[string]*coberturaPackage{}
+	pkgCounts := map[string][2]int{}
+
+	for _, name := range names {
+		pkgName := path.Dir(name)
+		pkg, isPresent := pkgs[pkgName]
+		if !isPresent {
+			pkg = &coberturaPackage{Name: pkgName, BranchRate: "0", Complexity: "0", Classes: []*coberturaClass{}}
+			pkgs[pkgName] = pkg
+			report.Packages = append(report.Packages, pkg)
+		}
+
+		filename := name
+		if strings.HasPrefix(name, modulePath+"/") {
+			filename = strings.TrimPrefix(name, modulePath+"/")
+		}
+		class := &coberturaClass{Name: path.Base(name), Filename: filename, BranchRate: "0", Complexity: "0", Lines: []*coberturaLine{}}
+
+		lineNums := make([]int, 0, len(files[name]))
+		for line := range files[name] {
+			lineNums = append(lineNums, line)
+		}
+		sort.Ints(lineNums)
+
+		covered := 0
+		for _, line := range lineNums {
+			hits := files[name][line]
+			class.Lines = append(class.Lines, &coberturaLine{Number: line, Hits: hits})
+			if hits > 0 {
+				covered++
+			}
+		}
+		class.LineRate = lineRate(covered, len(lineNums))
+		pkg.Classes = append(pkg.Classes, class)
+
+		counts := pkgCounts[pkgName]
+		pkgCounts[pkgName] = [2]int{counts[0] + covered, counts[1] + len(lineNums)}
+		report.LinesCovered += covered
+		report.LinesValid += len(lineNums)
+	}
+
+	for name, pkg := range pkgs {
+		pkg.LineRate = lineRate(pkgCounts[name][0], pkgCounts[name][1])
+	}
+	report.LineRate = lineRate(report.LinesCovered, report.LinesValid)
+
+	if _, errGo := io.WriteString(w, xml.Header+"<!DOCTYPE coverage SYSTEM \"http://cobertura.sourceforge.net/xml/coverage-04.dtd\">\n"); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if errGo := enc.Encode(report); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := io.WriteString(w, "\n"); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// CoverageRecord is the coverage recorded for a single release
+//
+type CoverageRecord struct {
+	Version string    `json:"version"`
+	Total   float64   `json:"total"`
+	Time    time.Time `json:"time"`
+}
+
+// CoverageHistory contains the coverage of past releases
+//
+type CoverageHistory struct {
+	Releases []*CoverageRecord `json:"releases"`
+}
+
+// LoadCoverageHistory reads a coverage history file, a missing file results in an empty history
+//
+func LoadCoverageHistory(fn string) (history *CoverageHistory, err kv.Error) {
+	history = &CoverageHistory{Releases: []*CoverageRecord{}}
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return history, nil
+		}
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = json.Unmarshal(data, history); errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return history, nil
+}
+
+// Save writes the coverage history file
+//
+func (history *CoverageHistory) Save(fn string) (err kv.Error) {
+	data, errGo := json.MarshalIndent(history, "", "  ")
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = ioutil.WriteFile(fn, append(data, '\n'), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// LastRelease returns the record for the most recent release preceding version, if version
+// is nil the most recent release is returned
+//
+func (history *CoverageHistory) LastRelease(version *semver.Version) (last *CoverageRecord) {
+	var lastVer *semver.Version
+	for _, record := range history.Releases {
+		ver, errGo := semver.NewVersion(record.Version)
+		if errGo != nil || len(ver.Prerelease()) != 0 {
+			continue
+		}
+		if version != nil && !ver.LessThan(version) {
+			continue
+		}
+		if lastVer == nil || lastVer.LessThan(ver) {
+			last, lastVer = record, ver
+		}
+	}
+	return last
+}
+
+// Record adds, or replaces, the coverage for a release
+//
+func (history *CoverageHistory) Record(version string, total float64) {
+	for _, record := range history.Releases {
+		if record.Version == version {
+			record.Total = total
+			record.Time = time.Now().UTC()
+			return
+		}
+	}
+	history.Releases = append(history.Releases, &CoverageRecord{Version: version, Total: total, Time: time.Now().UTC()})
+}
+
+// coverProfileName returns the file name for the profile of a go test run in the module.  The
+// run is identified by its directory, tags, options and packages so that the different runs
+// made within a module keep their own profiles, while repeating a run replaces its profile.
+//
+func coverProfileName(modulePath string, run []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(run, "\x00")))
+	return "profile-" + fileSafeModule(modulePath) + "-" + hex.EncodeToString(hash[:4]) + ".out"
+}
+
+// coverageArgs adds the go test arguments that collect a coverage profile for the module
+// containing pkgDir into the coverage directory, which is relative to the current directory,
+// and adds the profile to those of the options.  The selection contains the tags, options
+// and packages of the go test run.
+//
+func coverageArgs(opts *CoverageOptions, pkgDir string, selection []string, args []string) (withCoverage []string, err kv.Error) {
+	dir := opts.Dir
+	if len(dir) == 0 {
+		dir = "./coverage"
+	}
+	dir, errGo := filepath.Abs(dir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = os.MkdirAll(dir, os.ModePerm); errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	modulePath, moduleDir, err := GoModulePath(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	absDir, errGo := filepath.Abs(pkgDir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", pkgDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	relDir, errGo := filepath.Rel(moduleDir, absDir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", pkgDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	run := append([]string{filepath.ToSlash(relDir)}, selection...)
+
+	mode := opts.Mode
+	if len(mode) == 0 {
+		mode = "set"
+	}
+	profile := filepath.Join(dir, coverProfileName(modulePath, run))
+	withCoverage = append(args, "-covermode", mode, "-coverprofile", profile)
+	if len(opts.CoverPkg) != 0 {
+		withCoverage = append(withCoverage, "-coverpkg", strings.Join(opts.CoverPkg, ","))
+	}
+
+	// Repeating a run replaces its profile rather than adding another
+	for _, fn := range opts.Profiles {
+		if fn == profile {
+			return withCoverage, nil
+		}
+	}
+	opts.Profiles = append(opts.Profiles, profile)
+	return withCoverage, nil
+}
+
+// CheckCoverage merges the profiles of the options, or when there are none those collected
+// in the coverage directory, writes the merged profile, a JSON report and the optional HTML and Cobertura reports, and then checks
+// the total coverage against the threshold and the coverage of the last release.  When the
+// module version is a release, and the checks pass, its coverage is added to the history.
+//
+func (md *MetaData) CheckCoverage(opts *CoverageOptions) (report *CoverageReport, err kv.Error) {
+	dir := opts.Dir
+	if len(dir) == 0 {
+		dir = "./coverage"
+	}
+
+	// Profiles left in the directory by earlier runs are only merged when the runs that
+	// produced the profiles are not known
+	files := append([]string{}, opts.Profiles...)
+	if len(files) == 0 {
+		found, errGo := filepath.Glob(filepath.Join(dir, "profile-*.out"))
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		files = found
+	}
+	if len(files) == 0 {
+		return nil, kv.NewError("no coverage profiles were found").With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	sort.Strings(files)
+
+	profile, err := MergeCoverProfileFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := filepath.Join(dir, "coverage.out")
+	if err = writeReportFile(merged, profile.Write); err != nil {
+		return nil, err
+	}
+
+	report = profile.Report()
+	err = writeReportFile(filepath.Join(dir, "coverage.json"), func(w io.Writer) kv.Error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if errGo := enc.Encode(report); errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if opts.HTML {
+		run := GoRunOptions{}.defaults()
+		cmd := run.goCommand(nil, "tool", "cover", "-html="+merged, "-o", filepath.Join(dir, "coverage.html"))
+		if err = RunCommand(run.Ctx, cmd); err != nil {
+			return report, err
+		}
+	}
+
+	if opts.Cobertura {
+		// Workspaces may not have a module at their root in which case file names are
+		// left as import paths
+		modulePath, moduleDir, err := GoModulePath(".")
+		if err != nil {
+			var errGo error
+			if moduleDir, errGo = filepath.Abs("."); errGo != nil {
+				return report, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		err = writeReportFile(filepath.Join(dir, "cobertura.xml"), func(w io.Writer) kv.Error {
+			return profile.WriteCobertura(w, modulePath, moduleDir)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	total := report.Total.Percent
+	if opts.Threshold > 0 && total < opts.Threshold {
+		return report, kv.NewError("coverage is below the threshold").With("coverage", fmt.Sprintf("%.1f%%", total), "threshold", fmt.Sprintf("%.1f%%", opts.Threshold)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(opts.HistoryFile) == 0 {
+		return report, nil
+	}
+
+	history, err := LoadCoverageHistory(opts.HistoryFile)
+	if err != nil {
+		return report, err
+	}
+	if last := history.LastRelease(md.SemVer); last != nil && total < last.Total-opts.Tolerance {
+		return report, kv.NewError("coverage is below that of the last release").With("coverage", fmt.Sprintf("%.1f%%", total), "release", last.Version, "release_coverage", fmt.Sprintf("%.1f%%", last.Total)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if md.SemVer != nil && len(md.SemVer.Prerelease()) == 0 {
+		history.Record(md.SemVer.String(), total)
+		if err = history.Save(opts.HistoryFile); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,101 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver"
+)
+
+// TestCoverProfiles checks the merging of profiles and the percentages reported for them
+//
+func TestCoverProfiles(t *testing.T) {
+	first, err := ParseCoverProfile(strings.NewReader(`mode: set
+example.com/a/a.go:3.10,5.2 2 1
+example.com/a/a.go:7.10,9.2 2 0
+example.com/b/b.go:3.10,5.2 4 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ParseCoverProfile(strings.NewReader(`mode: set
+example.com/a/a.go:7.10,9.2 2 1
+example.com/b/b.go:3.10,5.2 4 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergeCoverProfiles(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := merged.Report()
+	if len(report.Packages) != 2 || report.Packages[0].Percent != 100 || report.Packages[1].Percent != 0 {
+		t.Fatalf("unexpected package coverage %+v %+v", report.Packages[0], report.Packages[1])
+	}
+	if report.Total.Statements != 8 || report.Total.Covered != 4 || report.Total.Percent != 50 {
+		t.Fatalf("unexpected total coverage %+v", report.Total)
+	}
+
+	cobertura := &strings.Builder{}
+	if err = merged.WriteCobertura(cobertura, "example.com", "/src"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`lines-covered="6" lines-valid="9"`, `filename="a/a.go"`, `<line number="7" hits="1"></line>`} {
+		if !strings.Contains(cobertura.String(), expected) {
+			t.Error("missing", expected, "in", cobertura.String())
+		}
+	}
+
+	if _, err = MergeCoverProfiles(first, &CoverProfile{Mode: "count"}); err == nil {
+		t.Fatal("profiles with different modes were merged")
+	}
+
+	// Runs of different packages, or tags, in a module must not replace each others profiles
+	unit := coverProfileName("example.com/a", []string{".", "./..."})
+	if unit != coverProfileName("example.com/a", []string{".", "./..."}) {
+		t.Fatal("repeated runs used different profiles")
+	}
+	for _, run := range [][]string{{".", "./pkg"}, {".", "-tags", "integration", "./..."}, {"cmd", "./..."}} {
+		if coverProfileName("example.com/a", run) == unit {
+			t.Fatal("runs shared a profile", run)
+		}
+	}
+}
+
+// TestCoverageHistory checks that coverage is compared against the release preceding the version
+//
+func TestCoverageHistory(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "coverage")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "history.json")
+	history, err := LoadCoverageHistory(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.Record("1.0.0", 60)
+	history.Record("1.1.0", 70)
+	history.Record("2.0.0-pre", 90)
+	if err = history.Save(fn); err != nil {
+		t.Fatal(err)
+	}
+	if history, err = LoadCoverageHistory(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	current, _ := semver.NewVersion("1.1.0")
+	if last := history.LastRelease(current); last == nil || last.Version != "1.0.0" {
+		t.Fatal("unexpected last release", last)
+	}
+	if last := history.LastRelease(nil); last == nil || last.Version != "1.1.0" {
+		t.Fatal("unexpected last release", last)
+	}
+}
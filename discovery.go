@@ -0,0 +1,301 @@
+package duat
+
+// This file contains the implementation of an index of the packages within a module that
+// is used to discover main packages, function and method definitions, and packages
+// containing go generate directives
+
+import (
+	"go/ast"
+	"go/token"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+
+	"golang.org/x/tools/go/packages"
+)
+
+// GoFuncDefinition records the location of a function, or method, definition
+//
+type GoFuncDefinition struct {
+	Name       string // The function name, or Type.Method for methods including those of generic types
+	ImportPath string // The import path of the package containing the definition
+	File       string // The file containing the definition
+	Line       int    // The line of the definition within the file
+}
+
+// GoIndexedPackage contains the details of a single package within an index
+//
+type GoIndexedPackage struct {
+	ImportPath string              // The import path of the package
+	Name       string              // The package name
+	Dir        string              // The directory containing the package
+	Files      []string            // The go files selected by the build constraints of the index
+	Main       bool                // True for main packages that produce commands
+	Imports    []string            // The import paths of the packages imported by this package
+	Generate   []string            // The files containing go generate directives
+	Funcs      []*GoFuncDefinition // The function and method definitions within the package
+	Errors     []string            // Any errors encountered loading the package
+}
+
+// GoPackageIndex contains the packages of a module loaded once, along with lookups for
+// the questions commonly asked of a module by builds
+//
+type GoPackageIndex struct {
+	Dir      string              // The directory within which the packages were loaded
+	Packages []*GoIndexedPackage // The packages, sorted by import path
+	funcs    map[string][]*GoFuncDefinition
+}
+
+// GoIndexOptions contains the parameters used for indexing the packages of a module
+//
+type GoIndexOptions struct {
+	GoRunOptions
+	Env      map[string]string // Additional environment variables for the go tooling
+	Filter   GoSourceFilter    // The target and tags used to select source files
+	Patterns []string          // The package patterns to load, defaults to ./...
+	Names    bool              // Only load the names and files of the packages, enough to find main packages without parsing them
+}
+
+// IndexGoPackages loads and parses the packages matching the patterns of the options.
+// Packages with errors are retained with their errors so that a single broken package
+// does not hide the remainder of the module.
+//
+func IndexGoPackages(opts GoIndexOptions) (index *GoPackageIndex, err kv.Error) {
+	run := opts.GoRunOptions.defaults()
+
+	patterns := opts.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+
+	env := targetEnv(opts.Env, opts.Filter.target())
+	if opts.Filter.Cgo {
+		env["CGO_ENABLED"] = "1"
+	}
+
+	mode := packages.NeedName | packages.NeedFiles
+	if !opts.Names {
+		// Discovery only needs the syntax of the packages, type checking without NeedDeps
+		// would load dependencies from export data that the loader cannot always supply
+		mode |= packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedSyntax
+	}
+
+	cfg := &packages.Config{
+		Mode:       mode,
+		Context:    run.Ctx,
+		Dir:        run.Dir,
+		Env:        goBuildEnv(env),
+		BuildFlags: tagArgs(opts.Filter.Tags),
+	}
+
+	pkgs, errGo := packages.Load(cfg, patterns...)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to load the packages").With("dir", run.Dir, "patterns", patterns).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	index = &GoPackageIndex{
+		Dir:      run.Dir,
+		Packages: make([]*GoIndexedPackage, 0, len(pkgs)),
+		funcs:    map[string][]*GoFuncDefinition{},
+	}
+	for _, pkg := range pkgs {
+		indexed := indexGoPackage(pkg)
+		for _, def := range indexed.Funcs {
+			index.funcs[def.Name] = append(index.funcs[def.Name], def)
+		}
+		index.Packages = append(index.Packages, indexed)
+	}
+	sort.Slice(index.Packages, func(i, j int) bool {
+		return index.Packages[i].ImportPath < index.Packages[j].ImportPath
+	})
+	return index, nil
+}
+
+// indexGoPackage extracts the details of a loaded package
+//
+func indexGoPackage(pkg *packages.Package) (indexed *GoIndexedPackage) {
+	indexed = &GoIndexedPackage{
+		ImportPath: pkg.PkgPath,
+		Name:       pkg.Name,
+		Files:      append([]string{}, pkg.GoFiles...),
+		Main:       pkg.Name == "main",
+		Imports:    make([]string, 0, len(pkg.Imports)),
+		Generate:   []string{},
+		Funcs:      []*GoFuncDefinition{},
+		Errors:     []string{},
+	}
+	if len(pkg.GoFiles) != 0 {
+		indexed.Dir = filepath.Dir(pkg.GoFiles[0])
+	}
+	for _, imported := range pkg.Imports {
+		indexed.Imports = append(indexed.Imports, imported.PkgPath)
+	}
+	sort.Strings(indexed.Imports)
+	for _, pkgErr := range pkg.Errors {
+		indexed.Errors = append(indexed.Errors, pkgErr.Error())
+	}
+
+	for _, file := range pkg.Syntax {
+		fn := pkg.Fset.Position(file.Package).Filename
+		if hasGoGenerate(pkg.Fset, file) {
+			indexed.Generate = append(indexed.Generate, fn)
+		}
+		for _, decl := range file.Decls {
+			fun, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			pos := pkg.Fset.Position(fun.Name.Pos())
+			indexed.Funcs = append(indexed.Funcs, &GoFuncDefinition{
+				Name:       funcName(fun),
+				ImportPath: pkg.PkgPath,
+				File:       pos.Filename,
+				Line:       pos.Line,
+			})
+		}
+	}
+	sort.Strings(indexed.Generate)
+	return indexed
+}
+
+// hasGoGenerate returns true when a file contains a go generate directive, these are line
+// comments beginning at the start of a line, see isGoGenerate
+//
+func hasGoGenerate(fset *token.FileSet, file *ast.File) bool {
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			if isGoGenerate(comment.Text) && fset.Position(comment.Slash).Column == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// funcName returns the name of a function, or Type.Method for methods.  The receiver type
+// is taken from the receiver expression with any pointer and type parameters removed.
+//
+func funcName(fun *ast.FuncDecl) (name string) {
+	name = fun.Name.Name
+	if fun.Recv == nil || len(fun.Recv.List) == 0 {
+		return name
+	}
+
+	expr := fun.Recv.List[0].Type
+	for {
+		switch xv := expr.(type) {
+		case *ast.StarExpr:
+			expr = xv.X
+		case *ast.ParenExpr:
+			expr = xv.X
+		case *ast.IndexExpr:
+			expr = xv.X
+		case *ast.IndexListExpr:
+			expr = xv.X
+		case *ast.Ident:
+			return xv.Name + "." + name
+		default:
+			return name
+		}
+	}
+}
+
+// Mains returns the main packages of the index
+//
+func (index *GoPackageIndex) Mains() (mains []*GoIndexedPackage) {
+	mains = []*GoIndexedPackage{}
+	for _, pkg := range index.Packages {
+		if pkg.Main {
+			mains = append(mains, pkg)
+		}
+	}
+	return mains
+}
+
+// DependencyOrder returns the packages of the index ordered so that every package appears
+// after the packages within the index that it imports
+//
+func (index *GoPackageIndex) DependencyOrder() (ordered []*GoIndexedPackage) {
+	byPath := make(map[string]*GoIndexedPackage, len(index.Packages))
+	for _, pkg := range index.Packages {
+		byPath[pkg.ImportPath] = pkg
+	}
+
+	ordered = make([]*GoIndexedPackage, 0, len(index.Packages))
+	visited := make(map[string]bool, len(index.Packages))
+
+	// Import cycles are rejected by the compiler so the visited marker is set on entry
+	// simply to guarantee termination
+	var visit func(pkg *GoIndexedPackage)
+	visit = func(pkg *GoIndexedPackage) {
+		if visited[pkg.ImportPath] {
+			return
+		}
+		visited[pkg.ImportPath] = true
+		for _, imported := range pkg.Imports {
+			if dep, isPresent := byPath[imported]; isPresent {
+				visit(dep)
+			}
+		}
+		ordered = append(ordered, pkg)
+	}
+	for _, pkg := range index.Packages {
+		visit(pkg)
+	}
+	return ordered
+}
+
+// FindFunc returns the definitions of a function, or a method when the name is of the
+// form Type.Method.  Methods of generic types are named without their type parameters.
+//
+func (index *GoPackageIndex) FindFunc(name string) (defs []*GoFuncDefinition) {
+	return append([]*GoFuncDefinition{}, index.funcs[name]...)
+}
+
+// FindFuncIn returns the definitions of a function, or method, within the package of a
+// directory
+//
+func (index *GoPackageIndex) FindFuncIn(name string, dir string) (defs []*GoFuncDefinition) {
+	defs = []*GoFuncDefinition{}
+	if absDir, errGo := filepath.Abs(dir); errGo == nil {
+		dir = absDir
+	}
+	for _, def := range index.funcs[name] {
+		if filepath.Dir(def.File) == dir {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+// FuncPackages returns the packages that define any of the named functions or methods
+//
+func (index *GoPackageIndex) FuncPackages(names []string) (pkgs []*GoIndexedPackage) {
+	wanted := map[string]struct{}{}
+	for _, name := range names {
+		for _, def := range index.funcs[name] {
+			wanted[def.ImportPath] = struct{}{}
+		}
+	}
+	pkgs = []*GoIndexedPackage{}
+	for _, pkg := range index.Packages {
+		if _, isPresent := wanted[pkg.ImportPath]; isPresent {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// GeneratePackages returns the packages with files that contain go generate directives
+//
+func (index *GoPackageIndex) GeneratePackages() (pkgs []*GoIndexedPackage) {
+	pkgs = []*GoIndexedPackage{}
+	for _, pkg := range index.Packages {
+		if len(pkg.Generate) != 0 {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
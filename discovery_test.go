@@ -0,0 +1,94 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// TestIndexGoPackages checks that main packages, function and method definitions, and
+// go generate directives are found using a single index of a module
+//
+func TestIndexGoPackages(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping package loading in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "discovery")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":             "module example.com/project\n\ngo 1.18\n",
+		"cmd/tool/main.go":   "package main\n\nimport \"example.com/project/list\"\n\nfunc main() { list.New[int]().Push(1) }\n",
+		"list/list.go":       "package list\n\n//go:generate echo list\n\ntype List[T any] struct{ items []T }\n\nfunc New[T any]() *List[T] { return &List[T]{} }\n\nfunc (l *List[T]) Push(item T) { l.items = append(l.items, item) }\n",
+		"list/list_other.go": "//go:build other\n\npackage list\n\nfunc Other() {}\n",
+		"util/util.go":       "package util\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\n// Not a directive //go:generate echo util\n\ntype Pair[K comparable, V any] struct{}\n\nfunc (Pair[K, V]) Key() { fmt.Fprintln(os.Stderr, \"key\") }\n",
+	})
+
+	index, err := IndexGoPackages(GoIndexOptions{GoRunOptions: GoRunOptions{Dir: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mains := []string{}
+	for _, pkg := range index.Mains() {
+		mains = append(mains, pkg.ImportPath)
+	}
+	if diff := deep.Equal(mains, []string{"example.com/project/cmd/tool"}); diff != nil {
+		t.Error(diff)
+	}
+
+	for name, expected := range map[string]string{
+		"New":       "example.com/project/list",
+		"List.Push": "example.com/project/list",
+		"Pair.Key":  "example.com/project/util",
+		"Other":     "",
+	} {
+		defs := index.FindFunc(name)
+		switch {
+		case len(expected) == 0 && len(defs) != 0:
+			t.Error(name, "was found in a file excluded by its build constraints")
+		case len(expected) != 0 && (len(defs) != 1 || defs[0].ImportPath != expected):
+			t.Error(name, "was not found in", expected)
+		}
+	}
+
+	generate := []string{}
+	for _, pkg := range index.GeneratePackages() {
+		for _, fn := range pkg.Generate {
+			rel, _ := filepath.Rel(dir, fn)
+			generate = append(generate, filepath.ToSlash(rel))
+		}
+	}
+	if diff := deep.Equal(generate, []string{"list/list.go"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// The directory finders use the index, including its handling of generic receivers, and
+	// packages importing the standard library
+	file, err := FindGoFuncIn("Pair.Key", filepath.Join(dir, "util"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != filepath.Join(dir, "util", "util.go") {
+		t.Error("Pair.Key was found in", file)
+	}
+	possibles, err := FindPossibleGoFuncs([]string{"List.Push", "Pair.Key", "Other"}, []string{filepath.Join(dir, "list"), filepath.Join(dir, "util")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for _, fn := range possibles {
+		rel, _ := filepath.Rel(dir, fn)
+		found = append(found, filepath.ToSlash(rel))
+	}
+	if diff := deep.Equal(found, []string{"list/list.go", "util/util.go"}); diff != nil {
+		t.Error(diff)
+	}
+}
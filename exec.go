@@ -0,0 +1,185 @@
+package duat
+
+// This file contains the implementation of a layer for running external commands, such as
+// the go tooling, using argument vectors and an explicit environment rather than a shell
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+var (
+	goBinary = "go"
+)
+
+func init() {
+	goRoot := os.Getenv("GOROOT")
+	if len(goRoot) != 0 {
+		goBinary = filepath.Join(goRoot, "bin", "go")
+	}
+}
+
+// Command describes a program that is to be run without the involvement of a shell
+//
+type Command struct {
+	Args    []string      // The program followed by its arguments, each element is passed as a single argument
+	Env     []string      // The complete environment in key=value form, nil inherits the environment of this process
+	Dir     string        // The working directory, empty for the current directory
+	Stdout  io.Writer     // Receives the standard output, nil discards it
+	Stderr  io.Writer     // Receives the standard error, nil discards it
+	Timeout time.Duration // The maximum duration of the command, zero for no limit
+}
+
+// String returns a human readable form of the command suitable for logging
+//
+func (command *Command) String() string {
+	return strings.Join(command.Args, " ")
+}
+
+// RunCommand will run a command and wait for it to complete.  The command is killed if
+// the context is cancelled or the timeout of the command expires.
+//
+func RunCommand(ctx context.Context, command *Command) (err kv.Error) {
+	if len(command.Args) == 0 {
+		return kv.NewError("no command was specified").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if command.Timeout > 0 {
+		timeoutCtx, cancel := context.WithTimeout(ctx, command.Timeout)
+		defer cancel()
+		ctx = timeoutCtx
+	}
+
+	cmd := exec.CommandContext(ctx, command.Args[0], command.Args[1:]...)
+	cmd.Env = command.Env
+	cmd.Dir = command.Dir
+	cmd.Stdout = command.Stdout
+	cmd.Stderr = command.Stderr
+
+	dir := command.Dir
+	if len(dir) == 0 {
+		dir, _ = os.Getwd()
+	}
+
+	if errGo := cmd.Start(); errGo != nil {
+		return kv.Wrap(errGo, "unable to start the command").With("cmd", command.String(), "dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo := cmd.Wait(); errGo != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return kv.Wrap(ctxErr, "the command was stopped").With("cmd", command.String(), "dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		return kv.Wrap(errGo, "the command failed").With("cmd", command.String(), "dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// RunCommands runs commands one after another stopping at the first failure
+//
+func RunCommands(ctx context.Context, commands []*Command) (err kv.Error) {
+	for _, command := range commands {
+		if err = RunCommand(ctx, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeEnv returns the environment in base with the values from overrides replacing, or
+// being added to it.  The result is sorted to keep commands reproducible.
+//
+func MergeEnv(base []string, overrides map[string]string) (env []string) {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for _, item := range base {
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		merged[pair[0]] = pair[1]
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+
+	env = make([]string, 0, len(merged))
+	for k, v := range merged {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// GoRunOptions contains the controls shared by the methods that run the go tooling
+//
+type GoRunOptions struct {
+	Ctx      context.Context // Used to cancel the commands, defaults to the background context
+	Timeout  time.Duration   // The maximum duration of each command, zero for no limit
+	Stdout   io.Writer       // Receives the standard output of the commands, defaults to os.Stdout
+	Stderr   io.Writer       // Receives the standard error of the commands, defaults to os.Stderr
+	Dir      string          // The package directory in which the commands run, defaults to the current directory
+	SkipTidy bool            // Do not run go mod tidy, which ignores go.work files, before the command
+}
+
+// defaults returns a copy of the options with any missing values filled in
+//
+func (run GoRunOptions) defaults() (filled GoRunOptions) {
+	filled = run
+	if filled.Ctx == nil {
+		filled.Ctx = context.Background()
+	}
+	if filled.Stdout == nil {
+		filled.Stdout = os.Stdout
+	}
+	if filled.Stderr == nil {
+		filled.Stderr = os.Stderr
+	}
+	if len(filled.Dir) == 0 {
+		filled.Dir = "."
+	}
+	return filled
+}
+
+// goCommand prepares a command that runs the go tool with the supplied arguments
+//
+func (run GoRunOptions) goCommand(env []string, args ...string) (command *Command) {
+	return &Command{
+		Args:    append([]string{goBinary}, args...),
+		Env:     env,
+		Dir:     run.Dir,
+		Stdout:  run.Stdout,
+		Stderr:  run.Stderr,
+		Timeout: run.Timeout,
+	}
+}
+
+// goModTidy runs go mod tidy unless the options skip it
+//
+func (run GoRunOptions) goModTidy(env []string) (err kv.Error) {
+	if run.SkipTidy {
+		return nil
+	}
+	return RunCommand(run.Ctx, run.goCommand(env, "mod", "tidy"))
+}
+
+// goBuildEnv returns the environment used for running the go tooling, cgo is disabled
+// unless the caller explicitly enables it using env
+//
+func goBuildEnv(env map[string]string) (buildEnv []string) {
+	overrides := map[string]string{"CGO_ENABLED": "0"}
+	for k, v := range env {
+		overrides[k] = v
+	}
+	return MergeEnv(os.Environ(), overrides)
+}
@@ -0,0 +1,49 @@
+package duat
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// TestMergeEnv checks that overrides replace inherited values and that the result is ordered
+//
+func TestMergeEnv(t *testing.T) {
+	env := MergeEnv([]string{"B=2", "A=1", "CGO_ENABLED=1", "broken"}, map[string]string{"CGO_ENABLED": "0", "C": "x y"})
+	expected := []string{"A=1", "B=2", "C=x y", "CGO_ENABLED=0"}
+	if diff := deep.Equal(env, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+// TestRunCommand checks that commands are run without a shell, that failures are returned
+// rather than ending the process and that timeouts stop commands
+//
+func TestRunCommand(t *testing.T) {
+	if _, errGo := exec.LookPath("sleep"); errGo != nil {
+		t.Skip("sleep is not available")
+	}
+
+	out := &strings.Builder{}
+	if err := RunCommand(nil, &Command{Args: []string{"echo", "a && b"}, Stdout: out}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "a && b\n" {
+		t.Fatal("arguments were not passed verbatim", out.String())
+	}
+
+	if err := RunCommand(nil, &Command{Args: []string{"duat-command-that-does-not-exist"}}); err == nil {
+		t.Fatal("a missing command was not reported")
+	}
+
+	startTime := time.Now()
+	if err := RunCommand(nil, &Command{Args: []string{"sleep", "30"}, Timeout: 100 * time.Millisecond}); err == nil {
+		t.Fatal("a timed out command was not reported")
+	}
+	if time.Since(startTime) > 10*time.Second {
+		t.Fatal("the timeout did not stop the command")
+	}
+}
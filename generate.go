@@ -0,0 +1,482 @@
+package duat
+
+// This file contains the implementation of go generate runs that process the directives of
+// a module in package dependency order, only running the directives whose inputs or
+// outputs have changed since they were last run
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+const (
+	// GoGenerateStateFile is the default name of the file, within the module directory,
+	// that records the inputs and outputs of the go generate directives last run
+	GoGenerateStateFile = ".duat-generate.json"
+
+	goGeneratePrefix = "//go:generate"
+	inputsPrefix     = "//duat:inputs "
+	outputsPrefix    = "//duat:outputs "
+)
+
+// GoGenerateDirective describes a single go generate directive.  The inputs and outputs of
+// a directive are declared using //duat:inputs and //duat:outputs comment lines, each
+// containing a space separated list of file patterns relative to the directory of the
+// file, immediately above the directive.
+//
+type GoGenerateDirective struct {
+	ImportPath string   // The import path of the package containing the directive
+	File       string   // The file containing the directive
+	Line       int      // The line of the directive within the file
+	Text       string   // The source text of the directive
+	Occurrence int      // The number of earlier directives within the file with the same text
+	Inputs     []string // The declared file patterns read by the generator
+	Outputs    []string // The declared file patterns written by the generator
+}
+
+// isGoGenerate returns true for a line that is a go generate directive, as with the go tool
+// the directive must begin the line and be followed by a space or tab
+//
+func isGoGenerate(text string) bool {
+	return strings.HasPrefix(text, goGeneratePrefix+" ") || strings.HasPrefix(text, goGeneratePrefix+"\t")
+}
+
+// command returns the text of the directive following the //go:generate prefix
+//
+func (directive *GoGenerateDirective) command() string {
+	return strings.TrimLeft(strings.TrimPrefix(directive.Text, goGeneratePrefix), " \t")
+}
+
+// key returns the identifier of the directive within the state file, line numbers are not
+// used so that unrelated edits of the file do not orphan the records.  Repeated directives
+// within a file are told apart using their occurrence.
+//
+func (directive *GoGenerateDirective) key(moduleDir string) string {
+	rel, errGo := filepath.Rel(moduleDir, directive.File)
+	if errGo != nil {
+		rel = directive.File
+	}
+	key := filepath.ToSlash(rel) + " " + directive.command()
+	if directive.Occurrence != 0 {
+		key += fmt.Sprintf(" #%d", directive.Occurrence)
+	}
+	return key
+}
+
+// GoGenerateRecord contains the digests recorded when a directive was last run
+//
+type GoGenerateRecord struct {
+	Inputs  string            `json:"inputs"`            // A digest of the directive, its file and declared inputs
+	Outputs map[string]string `json:"outputs,omitempty"` // The digests of the declared outputs, by module relative path
+}
+
+// GoGenerateState contains the records of the directives within a module
+//
+type GoGenerateState struct {
+	Directives map[string]*GoGenerateRecord `json:"directives"`
+}
+
+// LoadGoGenerateState reads a state file, an empty state is returned if the file does
+// not exist
+//
+func LoadGoGenerateState(fn string) (state *GoGenerateState, err kv.Error) {
+	state = &GoGenerateState{Directives: map[string]*GoGenerateRecord{}}
+
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return state, nil
+		}
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = json.Unmarshal(data, state); errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to parse the go generate state").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if state.Directives == nil {
+		state.Directives = map[string]*GoGenerateRecord{}
+	}
+	return state, nil
+}
+
+// Save writes the state file
+//
+func (state *GoGenerateState) Save(fn string) (err kv.Error) {
+	data, errGo := json.MarshalIndent(state, "", "  ")
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = ioutil.WriteFile(fn, append(data, '\n'), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// ParseGoGenerateDirectives extracts the go generate directives from a file.  As with the
+// go tool only lines that begin with the directive are used.
+//
+func ParseGoGenerateDirectives(fn string) (directives []*GoGenerateDirective, err kv.Error) {
+	directives = []*GoGenerateDirective{}
+
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	inputs := []string{}
+	outputs := []string{}
+	seen := map[string]int{}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		switch {
+		case strings.HasPrefix(text, inputsPrefix):
+			inputs = append(inputs, strings.Fields(strings.TrimPrefix(text, inputsPrefix))...)
+		case strings.HasPrefix(text, outputsPrefix):
+			outputs = append(outputs, strings.Fields(strings.TrimPrefix(text, outputsPrefix))...)
+		case isGoGenerate(text):
+			directive := &GoGenerateDirective{
+				File:    fn,
+				Line:    line,
+				Text:    text,
+				Inputs:  inputs,
+				Outputs: outputs,
+			}
+			directive.Occurrence = seen[directive.command()]
+			seen[directive.command()]++
+			directives = append(directives, directive)
+			inputs = []string{}
+			outputs = []string{}
+		default:
+			// Declarations only apply to the directive that immediately follows them
+			inputs = []string{}
+			outputs = []string{}
+		}
+	}
+	if errGo = scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return directives, nil
+}
+
+// FindGoGenerateDirectives returns the go generate directives within the packages of an
+// index.  Packages are ordered so that the directives of a package run before those of
+// the packages that import it, within a package files and their directives are in the
+// order used by the go tool.
+//
+func FindGoGenerateDirectives(index *GoPackageIndex) (directives []*GoGenerateDirective, err kv.Error) {
+	directives = []*GoGenerateDirective{}
+	for _, pkg := range index.DependencyOrder() {
+		for _, fn := range pkg.Generate {
+			found, err := ParseGoGenerateDirectives(fn)
+			if err != nil {
+				return nil, err.With("package", pkg.ImportPath)
+			}
+			for _, directive := range found {
+				directive.ImportPath = pkg.ImportPath
+				directives = append(directives, directive)
+			}
+		}
+	}
+	return directives, nil
+}
+
+// matchFiles expands the file patterns of a directive into a sorted list of files
+//
+func (directive *GoGenerateDirective) matchFiles(patterns []string) (files []string, missing []string, err kv.Error) {
+	dir := filepath.Dir(directive.File)
+	found := map[string]struct{}{}
+	for _, pattern := range patterns {
+		matches, errGo := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if errGo != nil {
+			return nil, nil, kv.Wrap(errGo, "invalid file pattern").With("pattern", pattern, "file", directive.File, "line", directive.Line).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(matches) == 0 {
+			missing = append(missing, pattern)
+		}
+		for _, match := range matches {
+			found[match] = struct{}{}
+		}
+	}
+	files = make([]string, 0, len(found))
+	for fn := range found {
+		files = append(files, fn)
+	}
+	sort.Strings(files)
+	return files, missing, nil
+}
+
+// inputsDigest returns a digest of the directive text, the file containing it and the
+// declared inputs
+//
+func (directive *GoGenerateDirective) inputsDigest(moduleDir string) (digest string, err kv.Error) {
+	inputs, missing, err := directive.matchFiles(directive.Inputs)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "directive\t%s\n", directive.Text)
+	for _, fn := range append([]string{directive.File}, inputs...) {
+		fileDigest, err := fileSHA256(fn)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(moduleDir, fn)
+		fmt.Fprintf(hash, "file\t%s\t%s\n", filepath.ToSlash(rel), fileDigest)
+	}
+	for _, pattern := range missing {
+		fmt.Fprintf(hash, "missing\t%s\n", pattern)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// outputsDigests returns the digests of the declared outputs that exist, along with the
+// patterns that matched no files
+//
+func (directive *GoGenerateDirective) outputsDigests(moduleDir string) (digests map[string]string, missing []string, err kv.Error) {
+	outputs, missing, err := directive.matchFiles(directive.Outputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	digests = make(map[string]string, len(outputs))
+	for _, fn := range outputs {
+		rel, _ := filepath.Rel(moduleDir, fn)
+		if digests[filepath.ToSlash(rel)], err = fileSHA256(fn); err != nil {
+			return nil, nil, err
+		}
+	}
+	return digests, missing, nil
+}
+
+// staleReason returns a description of why a directive needs to be run, or an empty
+// string when its record is current
+//
+func (directive *GoGenerateDirective) staleReason(moduleDir string, record *GoGenerateRecord) (reason string, err kv.Error) {
+	if record == nil {
+		return "not previously generated", nil
+	}
+	digest, err := directive.inputsDigest(moduleDir)
+	if err != nil {
+		return "", err
+	}
+	if digest != record.Inputs {
+		return "inputs changed", nil
+	}
+
+	outputs, missing, err := directive.outputsDigests(moduleDir)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) != 0 {
+		return "outputs missing " + strings.Join(missing, ","), nil
+	}
+	for fn, digest := range record.Outputs {
+		if outputs[fn] != digest {
+			return "output changed " + fn, nil
+		}
+	}
+	for fn := range outputs {
+		if _, isPresent := record.Outputs[fn]; !isPresent {
+			return "output added " + fn, nil
+		}
+	}
+	return "", nil
+}
+
+// runGoGenerateDirective runs the generator for a directive using the go tool so that the
+// environment of the generator matches that of go generate.  Other directives within the
+// file that have the same text are also run.
+//
+func (md *MetaData) runGoGenerateDirective(run GoRunOptions, opts GoGenerateModuleOptions, directive *GoGenerateDirective, result *GoGenerateResult) (err kv.Error) {
+	genOpts := GoGenerateOptions{
+		GoRunOptions: run,
+		Env:          opts.Env,
+		Tags:         opts.Filter.Tags,
+		Opts:         []string{"-run", "^" + regexp.QuoteMeta(directive.Text) + "$"},
+	}
+	genOpts.Dir = filepath.Dir(directive.File)
+	genOpts.SkipTidy = true
+
+	result.Ran = true
+	result.Output, err = md.GoGenerateWithOptions(directive.File, genOpts)
+	return err
+}
+
+// GoGenerateModuleOptions contains the parameters for running the go generate directives
+// of a module
+//
+type GoGenerateModuleOptions struct {
+	GoRunOptions
+	Env       map[string]string // Additional environment variables for the generators
+	Filter    GoSourceFilter    // The target and tags used to select the files with directives
+	Patterns  []string          // The package patterns searched for directives, defaults to ./...
+	StateFile string            // The file recording the directives last run, defaults to GoGenerateStateFile in the module directory
+	Force     bool              // Run every directive regardless of whether it is stale
+	Check     bool              // Do not run any directives, instead return an error if any are stale
+}
+
+// GoGenerateResult contains the outcome of a single go generate directive
+//
+type GoGenerateResult struct {
+	Directive *GoGenerateDirective
+	Stale     string   // Why the directive was stale, empty when it was current
+	Ran       bool     // True when the generator was run
+	Output    []string // The output of the generator, populated when it failed
+	Err       kv.Error
+}
+
+// GoGenerateModule runs the go generate directives of a module in package dependency
+// order.  Directives that are current according to the state file are skipped.  In check
+// mode nothing is run and an error is returned when any generated files are out of date.
+//
+func (md *MetaData) GoGenerateModule(opts GoGenerateModuleOptions) (results []*GoGenerateResult, err kv.Error) {
+	run := opts.GoRunOptions.defaults()
+
+	_, moduleDir, err := GoModulePath(run.Dir)
+	if err != nil {
+		return nil, err
+	}
+	stateFile := opts.StateFile
+	if len(stateFile) == 0 {
+		stateFile = filepath.Join(moduleDir, GoGenerateStateFile)
+	}
+	state, err := LoadGoGenerateState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := IndexGoPackages(GoIndexOptions{GoRunOptions: run, Env: opts.Env, Filter: opts.Filter, Patterns: opts.Patterns})
+	if err != nil {
+		return nil, err
+	}
+	directives, err := FindGoGenerateDirectives(index)
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]*GoGenerateResult, 0, len(directives))
+
+	// Directives are checked as they are reached so that the outputs of generators that
+	// are inputs to later directives are current
+	stale := []string{}
+	tidied := opts.Check
+	generated := map[string]struct{}{}
+	for _, directive := range directives {
+		result := &GoGenerateResult{Directive: directive}
+		results = append(results, result)
+
+		key := directive.key(moduleDir)
+		if result.Stale, result.Err = directive.staleReason(moduleDir, state.Directives[key]); result.Err != nil {
+			break
+		}
+		if opts.Force && !opts.Check && len(result.Stale) == 0 {
+			result.Stale = "forced"
+		}
+		if len(result.Stale) == 0 {
+			continue
+		}
+		stale = append(stale, fmt.Sprintf("%s:%d", directive.File, directive.Line))
+		if opts.Check {
+			continue
+		}
+
+		// The module dependencies are resolved once for all of the generators
+		if !tidied {
+			if result.Err = run.goModTidy(goBuildEnv(opts.Env)); result.Err != nil {
+				break
+			}
+			tidied = true
+		}
+
+		// go generate runs every directive of a file matching the text, so repeated
+		// directives are run once and each of their occurrences recorded
+		ran := directive.File + "\n" + directive.Text
+		if _, isPresent := generated[ran]; isPresent {
+			result.Ran = true
+		} else {
+			if result.Err = md.runGoGenerateDirective(run, opts, directive, result); result.Err != nil {
+				break
+			}
+			generated[ran] = struct{}{}
+		}
+
+		record := &GoGenerateRecord{}
+		if record.Inputs, result.Err = directive.inputsDigest(moduleDir); result.Err != nil {
+			break
+		}
+		var missing []string
+		if record.Outputs, missing, result.Err = directive.outputsDigests(moduleDir); result.Err != nil {
+			break
+		}
+		if len(missing) != 0 {
+			result.Err = kv.NewError("declared outputs were not generated").With("outputs", strings.Join(missing, ","), "file", directive.File, "line", directive.Line).With("stack", stack.Trace().TrimRuntime())
+			break
+		}
+		state.Directives[key] = record
+	}
+
+	if opts.Check {
+		for _, result := range results {
+			if result.Err != nil {
+				return results, result.Err.With("module", md.Module)
+			}
+		}
+		if len(stale) != 0 {
+			return results, kv.NewError("generated files are out of date").With("module", md.Module, "directives", strings.Join(stale, ",")).With("stack", stack.Trace().TrimRuntime())
+		}
+		return results, nil
+	}
+
+	// Records for directives that no longer exist are discarded, files excluded by the
+	// filter are not scanned so their records are kept
+	current := make(map[string]struct{}, len(directives))
+	for _, directive := range directives {
+		current[directive.key(moduleDir)] = struct{}{}
+	}
+	scanned := map[string]struct{}{}
+	for _, pkg := range index.Packages {
+		for _, fn := range pkg.Files {
+			if rel, errGo := filepath.Rel(moduleDir, fn); errGo == nil {
+				scanned[filepath.ToSlash(rel)] = struct{}{}
+			}
+		}
+	}
+	for key := range state.Directives {
+		if _, isPresent := current[key]; isPresent {
+			continue
+		}
+		fn := strings.SplitN(key, " ", 2)[0]
+		_, isScanned := scanned[fn]
+		if _, errGo := os.Stat(filepath.Join(moduleDir, filepath.FromSlash(fn))); isScanned || os.IsNotExist(errGo) {
+			delete(state.Directives, key)
+		}
+	}
+
+	// Modules without directives are left without a state file
+	if _, errGo := os.Stat(stateFile); len(state.Directives) != 0 || errGo == nil {
+		if err = state.Save(stateFile); err != nil {
+			return results, err
+		}
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			return results, result.Err.With("module", md.Module)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,155 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGoGenerateModule checks that directives run in package dependency order and are only
+// rerun when their declared inputs, outputs or the generating file change
+//
+func TestGoGenerateModule(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping generators in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "generate")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":       "module example.com/project\n\ngo 1.18\n",
+		"app/main.go":  "package main\n\nimport _ \"example.com/project/lib\"\n\n//duat:inputs ../lib/data.out\n//duat:outputs copy.out\n//go:generate cp ../lib/data.out copy.out\n\nfunc main() {}\n",
+		"lib/lib.go":   "package lib\n\nconst Name = \"lib\"\n\n//duat:inputs data.txt\n//duat:outputs data.out\n//go:generate cp data.txt data.out\n",
+		"lib/data.txt": "first\n",
+	})
+
+	md := &MetaData{}
+	opts := GoGenerateModuleOptions{
+		GoRunOptions: GoRunOptions{Dir: dir, Stdout: ioutil.Discard, Stderr: ioutil.Discard, SkipTidy: true},
+	}
+	generate := func(opts GoGenerateModuleOptions, expected ...bool) {
+		t.Helper()
+		results, err := md.GoGenerateModule(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(expected) {
+			t.Fatalf("expected %d directives, found %d", len(expected), len(results))
+		}
+		for i, result := range results {
+			if result.Ran != expected[i] {
+				t.Fatalf("expected ran to be %v for %s (%s)", expected[i], result.Directive.Text, result.Stale)
+			}
+		}
+	}
+	copied := func(expected string) {
+		t.Helper()
+		data, errGo := ioutil.ReadFile(filepath.Join(dir, "app", "copy.out"))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %q to be generated, found %q", expected, string(data))
+		}
+	}
+
+	// The library is generated before the application which uses its output
+	generate(opts, true, true)
+	copied("first\n")
+	generate(opts, false, false)
+
+	check := opts
+	check.Check = true
+	if _, err := md.GoGenerateModule(check); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTree(t, dir, map[string]string{"lib/data.txt": "second\n"})
+	if _, err := md.GoGenerateModule(check); err == nil {
+		t.Fatal("stale generated files were not detected")
+	}
+	generate(opts, true, true)
+	copied("second\n")
+
+	// Modifying a generated file makes its directive stale
+	writeTree(t, dir, map[string]string{"app/copy.out": "edited\n"})
+	generate(opts, false, true)
+	copied("second\n")
+
+	force := opts
+	force.Force = true
+	generate(force, true, true)
+}
+
+// TestGoGenerateRepeated checks that directives repeated within a file are run once for
+// each time they appear
+//
+func TestGoGenerateRepeated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping generators in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "generate")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":     "module example.com/project\n\ngo 1.18\n",
+		"lib/lib.go": "package lib\n\n//go:generate sh -c \"echo run >> count.out\"\n//go:generate sh -c \"echo run >> count.out\"\n//go:generate sh -c \"echo run >> count.out\"\n",
+	})
+
+	md := &MetaData{}
+	opts := GoGenerateModuleOptions{
+		GoRunOptions: GoRunOptions{Dir: dir, Stdout: ioutil.Discard, Stderr: ioutil.Discard, SkipTidy: true},
+	}
+	results, err := md.GoGenerateModule(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if !result.Ran {
+			t.Fatal("a repeated directive was not recorded as run", result.Directive.Line)
+		}
+	}
+	data, errGo := ioutil.ReadFile(filepath.Join(dir, "lib", "count.out"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if string(data) != "run\nrun\nrun\n" {
+		t.Fatalf("expected three runs, found %q", string(data))
+	}
+}
+
+// TestParseGoGenerateDirectives checks that directives separated by tabs are found, as they
+// are by the go tool, and that repeated directives within a file have their own records
+//
+func TestParseGoGenerateDirectives(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "generate")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"gen.go": "package gen\n\n//go:generate\tgo run ./tool\n//go:generate go run ./tool\n//go:generatego run ./tool\n",
+	})
+
+	directives, err := ParseGoGenerateDirectives(filepath.Join(dir, "gen.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(directives) != 2 {
+		t.Fatalf("expected 2 directives, found %d", len(directives))
+	}
+	first, second := directives[0].key(dir), directives[1].key(dir)
+	if first != "gen.go go run ./tool" || second != "gen.go go run ./tool #1" {
+		t.Fatalf("unexpected directive keys %q and %q", first, second)
+	}
+}
@@ -3,17 +3,14 @@ package duat
 // This file contains methods for Go builds using the duat conventions
 
 import (
-	"bufio"
-	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
-	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
 
@@ -23,17 +20,6 @@ import (
 	fileio "github.com/karlmutch/duat/pkg/fileio"
 )
 
-var (
-	goModTidy = "go mod tidy"
-)
-
-func init() {
-	goRoot := os.Getenv("GOROOT")
-	if len(goRoot) != 0 {
-		goModTidy = filepath.Join(goRoot, "bin", "go mod tidy")
-	}
-}
-
 // Look for directories inside the root 'dir' and return their paths, skip any vendor directories
 //
 func findDirs(dir string) (dirs []string, err kv.Error) {
@@ -98,71 +84,93 @@ func FindGoFiles(dir string) (files []string, err kv.Error) {
 	}
 }
 
-func GoFileTags(fn string, tags []string) (tagsSatisfied bool) {
-	file, errGo := os.Open(fn)
-	if errGo != nil {
-		return false
-	}
-	defer file.Close()
+// GoSourceFilter selects the go source files of a package that the compiler would use
+// when building for a target.  Filenames with GOOS and GOARCH suffixes, and the boolean
+// expressions of //go:build lines, or the older multi-line // +build form, are evaluated
+// against the target and tags.
+//
+type GoSourceFilter struct {
+	Target GoTarget // The target of the build, defaults to the target of the environment
+	Tags   []string // Build tags
+	Cgo    bool     // Select cgo files, duat builds disable cgo unless it is enabled explicitly
+}
 
-	scan := bufio.NewScanner(file)
-	scan.Scan()
-	tokens := strings.Split(scan.Text(), " ")
-	if tokens[0] != "//" {
-		return true
+// target returns the target of the filter, or that of the environment when the filter
+// has none
+//
+func (filter GoSourceFilter) target() (target GoTarget) {
+	if len(filter.Target.OS) == 0 || len(filter.Target.Arch) == 0 {
+		return defaultGoTarget(nil)
 	}
-	fileTags := map[string]struct{}{}
-	for _, token := range tokens[1:] {
-		if len(token) != 0 {
-			fileTags[token] = struct{}{}
+	return filter.Target
+}
+
+// context returns the go/build context equivalent to the filter
+//
+func (filter GoSourceFilter) context() (ctx *build.Context) {
+	target := filter.target()
+
+	filtered := build.Default
+	filtered.GOOS = target.OS
+	filtered.GOARCH = target.Arch
+	filtered.CgoEnabled = filter.Cgo
+	filtered.BuildTags = append([]string{}, filter.Tags...)
+
+	// Tool tags such as amd64.v1 describe the architecture of the environment, only the
+	// experiments carry over to other architectures
+	if target.Arch != build.Default.GOARCH {
+		filtered.ToolTags = []string{}
+		for _, tag := range build.Default.ToolTags {
+			if strings.HasPrefix(tag, "goexperiment.") {
+				filtered.ToolTags = append(filtered.ToolTags, tag)
+			}
 		}
 	}
-	if _, isPresent := fileTags["+build"]; !isPresent {
-		return true
-	}
-	delete(fileTags, "+build")
-	for _, aTag := range tags {
-		delete(fileTags, aTag)
+	return &filtered
+}
+
+// Match returns true if the compiler would use the file when building for the target
+// of the filter
+//
+func (filter GoSourceFilter) Match(fn string) (matched bool, err kv.Error) {
+	matched, errGo := filter.context().MatchFile(filepath.Dir(fn), filepath.Base(fn))
+	if errGo != nil {
+		return false, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
 	}
-	return len(fileTags) == 0
+	return matched, nil
+}
+
+// GoFileTags returns true if the compiler would use the file when building for the target
+// of the environment with the supplied tags.  Files that cannot be read, or that have
+// invalid build constraints, are not used.
+//
+func GoFileTags(fn string, tags []string) (tagsSatisfied bool) {
+	tagsSatisfied, err := GoSourceFilter{Tags: tags}.Match(fn)
+	return err == nil && tagsSatisfied
 }
 
 // FindGoFunc will locate a function or method within a directory of source files.
 // Use "receiver.func" for methods, a function name without the dot for functions.
 //
 func FindGoFuncIn(funcName string, dir string, tags []string) (file string, err kv.Error) {
-	fs := token.NewFileSet()
-	pkgs, errGo := parser.ParseDir(fs, dir,
-		func(fi os.FileInfo) (isOK bool) {
-			return GoFileTags(filepath.Join(dir, fi.Name()), tags)
-		}, 0)
-	if errGo != nil {
-		return file, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
-	}
-
-	for _, pkg := range pkgs {
-		ast.Inspect(pkg, func(n ast.Node) bool {
-			if fun, ok := n.(*ast.FuncDecl); ok {
-				name := fun.Name.Name
-				if fun.Recv != nil {
-					for _, v := range fun.Recv.List {
-						switch xv := v.Type.(type) {
-						case *ast.StarExpr:
-							if si, ok := xv.X.(*ast.Ident); ok {
-								name = fmt.Sprintf("%s.%s", si.Name, fun.Name)
-							}
-						case *ast.Ident:
-							name = fmt.Sprintf("%s.%s", xv.Name, fun.Name)
-						}
-					}
-				}
-				if name == funcName {
-					file = fs.Position(fun.Name.NamePos).Filename
-					return false
-				}
-			}
-			return true
-		})
+	return FindGoFuncInWithFilter(funcName, dir, GoSourceFilter{Tags: tags})
+}
+
+// FindGoFuncInWithFilter will locate a function or method within the package of a directory
+// using a GoPackageIndex, of the source files selected by the filter, for the module
+// containing the directory
+//
+func FindGoFuncInWithFilter(funcName string, dir string, filter GoSourceFilter) (file string, err kv.Error) {
+	_, moduleDir, err := GoModulePath(dir)
+	if err != nil {
+		return file, err
+	}
+	index, err := IndexGoPackages(GoIndexOptions{GoRunOptions: GoRunOptions{Dir: moduleDir}, Filter: filter})
+	if err != nil {
+		return file, err
+	}
+	for _, def := range index.FindFuncIn(funcName, dir) {
+		return def.File, nil
 	}
 	return file, nil
 }
@@ -171,6 +179,13 @@ func FindGoFuncIn(funcName string, dir string, tags []string) (file string, err
 // files
 //
 func FindGoGenerateFiles(dir string, tags []string) (genFiles []string, err kv.Error) {
+	return FindGoGenerateFilesWithFilter(dir, GoSourceFilter{Tags: tags})
+}
+
+// FindGoGenerateFilesWithFilter is used to descend recursively into a directory to locate
+// go generate files that are selected by the filter
+//
+func FindGoGenerateFilesWithFilter(dir string, filter GoSourceFilter) (genFiles []string, err kv.Error) {
 	genFiles = []string{}
 	foundDirs := map[string]struct{}{}
 
@@ -198,28 +213,20 @@ func FindGoGenerateFiles(dir string, tags []string) (genFiles []string, err kv.E
 		fs := token.NewFileSet()
 		pkgs, errGo := parser.ParseDir(fs, dir,
 			func(fi os.FileInfo) (isOK bool) {
-				return GoFileTags(filepath.Join(dir, fi.Name()), tags)
+				matched, err := filter.Match(filepath.Join(dir, fi.Name()))
+				return err == nil && matched
 			}, parser.ParseComments)
 		if errGo != nil {
 			return genFiles, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
 		}
 
-		func() {
-			for _, pkg := range pkgs {
-				for fn, f := range pkg.Files {
-					for _, group := range f.Comments {
-						for _, comment := range group.List {
-							pos := fs.PositionFor(comment.Pos(), true)
-							if pos.Line == 1 && pos.Column == 1 {
-								if strings.HasPrefix(comment.Text, "go:generate") || strings.HasPrefix(comment.Text, "//go:generate") {
-									genFiles = append(genFiles, fn)
-								}
-							}
-						}
-					}
+		for _, pkg := range pkgs {
+			for fn, f := range pkg.Files {
+				if hasGoGenerate(fs, f) {
+					genFiles = append(genFiles, fn)
 				}
 			}
-		}()
+		}
 	}
 
 	return genFiles, nil
@@ -228,10 +235,17 @@ func FindGoGenerateFiles(dir string, tags []string) (genFiles []string, err kv.E
 // FindGoGenerateDirs is used to locate and directories that contain
 // go files that have well formed fo generate directives.  The directories
 func FindGoGenerateDirs(dirs []string, tags []string) (genFiles []string, err kv.Error) {
+	return FindGoGenerateDirsWithFilter(dirs, GoSourceFilter{Tags: tags})
+}
+
+// FindGoGenerateDirsWithFilter is used to locate the go files with go generate directives
+// inside the directories that are selected by the filter
+//
+func FindGoGenerateDirsWithFilter(dirs []string, filter GoSourceFilter) (genFiles []string, err kv.Error) {
 	genFiles = []string{}
 	foundFiles := map[string]struct{}{}
 	for _, dir := range dirs {
-		files, err := FindGoGenerateFiles(dir, tags)
+		files, err := FindGoGenerateFilesWithFilter(dir, filter)
 		if err != nil {
 			return nil, err
 		}
@@ -254,17 +268,40 @@ func FindGoGenerateDirs(dirs []string, tags []string) (genFiles []string, err kv
 // checking we might not be sure that the function does not exist
 //
 func FindPossibleGoFuncs(names []string, dirs []string, tags []string) (possibles []string, err kv.Error) {
+	return FindPossibleGoFuncsWithFilter(names, dirs, GoSourceFilter{Tags: tags})
+}
+
+// FindPossibleGoFuncsWithFilter is used to locate the files that might contain the named
+// functions within the source files selected by the filter.  The module containing the
+// directories is indexed once, see GoPackageIndex, and directories that cannot be indexed
+// are returned as a possible location using the directory name followed by a separator.
+//
+func FindPossibleGoFuncsWithFilter(names []string, dirs []string, filter GoSourceFilter) (possibles []string, err kv.Error) {
 	possibles = []string{}
 	files := map[string]struct{}{}
+	indexes := map[string]*GoPackageIndex{}
 	for _, dir := range dirs {
-		for _, name := range names {
-			// Some what inefficent as we are scanning the dir
-			// potentially multiple times
-			file, err := FindGoFuncIn(name, dir, tags)
-			if err == nil && len(file) == 0 {
-				continue
+		found := []string{}
+		index := (*GoPackageIndex)(nil)
+		if _, moduleDir, err := GoModulePath(dir); err == nil {
+			isPresent := false
+			if index, isPresent = indexes[moduleDir]; !isPresent {
+				// Modules that cannot be indexed are recorded using a nil index
+				index, _ = IndexGoPackages(GoIndexOptions{GoRunOptions: GoRunOptions{Dir: moduleDir}, Filter: filter})
+				indexes[moduleDir] = index
 			}
-			// Avoid duplicates
+		}
+		if index == nil {
+			found = append(found, dir+string(filepath.Separator))
+		} else {
+			for _, name := range names {
+				for _, def := range index.FindFuncIn(name, dir) {
+					found = append(found, def.File)
+				}
+			}
+		}
+		// Avoid duplicates
+		for _, file := range found {
 			if _, isPresent := files[file]; !isPresent {
 				files[file] = struct{}{}
 				possibles = append(possibles, file)
@@ -274,7 +311,11 @@ func FindPossibleGoFuncs(names []string, dirs []string, tags []string) (possible
 	return possibles, nil
 }
 
-func (md *MetaData) GoBuild(tags []string, opts []string, outputDir string, outputSuffix string, versionBump bool) (outputs []string, err kv.Error) {
+// GoBuild will build the main package in the current directory, optionally bumping the
+// pre-release version first.  If targets are supplied binaries are built for each of them,
+// otherwise the target is taken from the environment.
+//
+func (md *MetaData) GoBuild(tags []string, opts []string, outputDir string, outputSuffix string, versionBump bool, targets ...GoTarget) (outputs []string, err kv.Error) {
 
 	// Dont do any version manipulation if we are just preparing images
 	// As we begin the build determine if we are using a pre-released version
@@ -288,32 +329,20 @@ func (md *MetaData) GoBuild(tags []string, opts []string, outputDir string, outp
 		}
 	}
 
-	if outputs, err = md.GoSimpleBuild(tags, opts, outputDir, outputSuffix); err != nil {
+	if outputs, err = md.GoSimpleBuild(tags, opts, outputDir, outputSuffix, targets...); err != nil {
 		return []string{}, err
 	}
 
 	return outputs, nil
 }
 
-func runCMD(cmds []string, logOut io.Writer, logErr io.Writer) (err kv.Error) {
-
-	cmd := exec.Command("bash", "-c", strings.Join(cmds, " && "))
-	cmd.Stdout = logOut
-	cmd.Stderr = logErr
-
-	if errGo := cmd.Start(); errGo != nil {
-		dir, _ := os.Getwd()
-		fmt.Fprintln(os.Stderr, kv.Wrap(errGo, "unable to run the compiler").
-			With("stack", stack.Trace().TrimRuntime()).With("cmds", strings.Join(cmds, "¶ ")).
-			With("dir", dir).Error())
-		os.Exit(-3)
-	}
-
-	if errGo := cmd.Wait(); errGo != nil {
-		return kv.Wrap(errGo, "unable to run the compiler").
-			With("stack", stack.Trace().TrimRuntime()).With("cmds", strings.Join(cmds, "¶ "))
-	}
-	return nil
+// GoGenerateOptions contains the parameters for running the go generator
+//
+type GoGenerateOptions struct {
+	GoRunOptions
+	Env  map[string]string // Additional environment variables for the generator
+	Tags []string          // Build tags
+	Opts []string          // Additional options for the go generate command, each is passed as a single argument
 }
 
 // GoGenerate will invoke the go generator.  This method must resort to using the
@@ -321,73 +350,126 @@ func runCMD(cmds []string, logOut io.Writer, logErr io.Writer) (err kv.Error) {
 // exposes the go generator
 //
 func (md *MetaData) GoGenerate(file string, env map[string]string, tags []string, opts []string) (outputs []string, err kv.Error) {
+	return md.GoGenerateWithOptions(file, GoGenerateOptions{Env: env, Tags: tags, Opts: opts})
+}
+
+// GoGenerateWithOptions will invoke the go generator for a single file, the output of the
+// generator is returned when it fails
+//
+func (md *MetaData) GoGenerateWithOptions(file string, opts GoGenerateOptions) (outputs []string, err kv.Error) {
 	outputs = []string{}
 
-	buildEnv := make([]string, 0, len(env))
+	run := opts.GoRunOptions.defaults()
+	outBuf := &strings.Builder{}
+	run.Stdout = io.MultiWriter(run.Stdout, outBuf)
+	run.Stderr = io.MultiWriter(run.Stderr, outBuf)
 
-	for k, v := range env {
-		buildEnv = append(buildEnv, fmt.Sprintf("%s='%s'", k, v))
-	}
+	env := goBuildEnv(opts.Env)
 
-	tagOption := ""
-	if len(tags) > 0 {
-		tagOption = fmt.Sprintf(" -tags \"%s\" ", strings.Join(tags, " "))
-	}
+	args := append([]string{"generate"}, tagArgs(opts.Tags)...)
+	args = append(args, opts.Opts...)
+	args = append(args, file)
 
-	cmds := []string{
-		goModTidy,
-		fmt.Sprintf("%s go generate %s %s %s",
-			strings.Join(buildEnv, " "), file, strings.Join(opts, " "), tagOption),
+	if err = run.goModTidy(env); err == nil {
+		err = RunCommand(run.Ctx, run.goCommand(env, args...))
 	}
-
-	outBuf := &strings.Builder{}
-	if err = runCMD(cmds, io.MultiWriter(os.Stdout, outBuf), io.MultiWriter(os.Stderr, outBuf)); err != nil {
+	if err != nil {
 		outputs = append(outputs, strings.Split(outBuf.String(), "\n")...)
 		return outputs, err.With("module", md.Module).With("file", file)
 	}
 	return outputs, nil
 }
 
-func (md *MetaData) GoSimpleBuild(tags []string, opts []string, outputDir string, outputSuffix string) (outputs []string, err kv.Error) {
+// GoInstallDir returns the directory into which the go tool installs executables, GOBIN
+// when it is set otherwise the bin directory of the first GOPATH entry, which the go tool
+// defaults to $HOME/go when GOPATH is not set
+//
+func GoInstallDir() (dir string, err kv.Error) {
+	run := GoRunOptions{}.defaults()
+	if dir, err = goEnvValue(run, "GOBIN"); err != nil || len(dir) != 0 {
+		return dir, err
+	}
+	goPath, err := goEnvValue(run, "GOPATH")
+	if err != nil {
+		return "", err
+	}
+	goPath = strings.Split(goPath, string(os.PathListSeparator))[0]
+	if len(goPath) == 0 {
+		return "", kv.NewError("unable to determine the compiler bin output dir, set GOBIN or GOPATH").With("stack", stack.Trace().TrimRuntime())
+	}
+	return filepath.Join(goPath, "bin"), nil
+}
+
+// GoSimpleBuild will build the main package in the current directory for the supplied targets,
+// or the target of the environment if none are supplied, and then copy any executables
+// into the install directory of the go tool, see GoInstallDir
+//
+func (md *MetaData) GoSimpleBuild(tags []string, opts []string, outputDir string, outputSuffix string, targets ...GoTarget) (outputs []string, err kv.Error) {
+	return md.GoSimpleBuildWithOptions(GoBuildOptions{
+		Tags:         tags,
+		Opts:         opts,
+		OutputDir:    outputDir,
+		OutputSuffix: outputSuffix,
+		Targets:      targets,
+	})
+}
+
+// GoSimpleBuildWithOptions will build the main package using GoBuildWithOptions, reusing
+// binaries whose inputs are unchanged unless Force is set, and then copy any executables
+// in the output directory into the install directory of the go tool, see GoInstallDir
+//
+func (md *MetaData) GoSimpleBuildWithOptions(opts GoBuildOptions) (outputs []string, err kv.Error) {
 	outputs = []string{}
 
-	// Copy the compiled file into the GOPATH bin directory
-	goPath := os.Getenv("GOPATH")
-	if len(goPath) == 0 {
-		return outputs, kv.NewError("unable to determine the compiler bin output dir, env var GOPATH might be missing or empty").With("stack", stack.Trace().TrimRuntime())
+	// Copy the compiled file into the GOBIN, or GOPATH bin, directory
+	installDir, err := GoInstallDir()
+	if err != nil {
+		return outputs, err
 	}
 
-	if len(outputDir) == 0 {
-		outputDir = "./bin"
+	if len(opts.OutputDir) == 0 {
+		opts.OutputDir = "./bin"
 	}
 
-	if outputs, err = md.GoCompile(map[string]string{}, tags, opts, outputDir, outputSuffix); err != nil {
+	results, err := md.GoBuildWithOptions(opts)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if result.Err != nil {
+			return result.Output, result.Err
+		}
+		outputs = append(outputs, result.Path)
+	}
+	if err != nil {
 		return outputs, err
 	}
 
-	// Any executable binaries are copied into your $GOPATH/bin automatically
-	if errGo := os.MkdirAll(filepath.Join(goPath, "bin"), os.ModePerm); errGo != nil {
+	// Any executable binaries are copied into your install directory automatically
+	if errGo := os.MkdirAll(installDir, os.ModePerm); errGo != nil {
 		if !os.IsExist(errGo) {
-			return outputs, kv.Wrap(errGo, "unable to create the $GOPATH/bin directory").With("stack", stack.Trace().TrimRuntime())
+			return outputs, kv.Wrap(errGo, "unable to create the install directory").With("dir", installDir).With("stack", stack.Trace().TrimRuntime())
 		}
 	}
 
-	// Find any executables we have and copy them to the gopath bin directory as well
-	binPath, errGo := filepath.Abs(filepath.Join(".", "bin"))
+	// Find any executables we have and copy them to the install directory as well
+	binPath, errGo := filepath.Abs(opts.OutputDir)
 	if errGo != nil {
-		return outputs, kv.Wrap(errGo, "unable to copy binary files from the ./bin directory").With("stack", stack.Trace().TrimRuntime())
+		return outputs, kv.Wrap(errGo, "unable to copy binary files from the output directory").With("dir", opts.OutputDir).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	errGo = filepath.Walk(binPath, func(path string, f os.FileInfo, err error) error {
+	errGo = filepath.Walk(binPath, func(path string, f os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return kv.Wrap(errGo).With("file", path).With("stack", stack.Trace().TrimRuntime())
+		}
 		if f.IsDir() {
 			return nil
 		}
 		// Is the file executable at all ?
 		if f.Mode()&0111 != 0 {
-			src := filepath.Join("bin", f.Name())
-			dst := filepath.Join(goPath, "bin", filepath.Base(f.Name()))
+			dst := filepath.Join(installDir, filepath.Base(f.Name()))
 
-			if err := fileio.CopyFile(src, dst); err != nil {
+			if err := fileio.CopyFile(path, dst); err != nil {
 				return err
 			}
 			outputs = append(outputs, dst)
@@ -433,128 +515,155 @@ func (md *MetaData) GoFetchBuilt() (outputs []string, err kv.Error) {
 	return outputs, errGo.(kv.Error)
 }
 
+// GoCompile will build the main package in the current directory for the target selected
+// by the environment, and env, into the output directory.  Binaries whose inputs are
+// unchanged are reused, GoBuildWithOptions can be used to force a build.
+//
 func (md *MetaData) GoCompile(env map[string]string, tags []string, opts []string, outputDir string, outputSuffix string) (outputs []string, err kv.Error) {
-	if errGo := os.Mkdir("bin", os.ModePerm); errGo != nil {
-		if !os.IsExist(errGo) {
-			return outputs, kv.Wrap(errGo, "unable to create the bin directory").With("stack", stack.Trace().TrimRuntime())
+	outputs = []string{}
+
+	results, err := md.GoBuildWithOptions(GoBuildOptions{
+		Env:          env,
+		Tags:         tags,
+		Opts:         opts,
+		OutputDir:    outputDir,
+		OutputSuffix: outputSuffix,
+	})
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if result.Err != nil {
+			return result.Output, result.Err
 		}
+		outputs = append(outputs, result.Path)
 	}
+	if err != nil {
+		return outputs, err
+	}
+	return outputs, nil
+}
 
-	// prepare flags and options needed for the actual build
-	ldFlags := []string{}
-	ldFlags = append(ldFlags, fmt.Sprintf("-X github.com/karlmutch/duat/version.BuildTime=%s", time.Now().Format("2006-01-02_15:04:04-0700")))
-	ldFlags = append(ldFlags, fmt.Sprintf("-X github.com/karlmutch/duat/version.GitHash=%s", md.Git.Hash))
-	ldFlags = append(ldFlags, fmt.Sprintf("-X github.com/karlmutch/duat/version.SemVer=\"%s\"", md.SemVer.String()))
+// GoTestOptions contains the parameters for running the tests of the package in the
+// current directory
+//
+type GoTestOptions struct {
+	GoRunOptions
+	Env         map[string]string // Additional environment variables for the tests
+	Tags        []string          // Build tags
+	Opts        []string          // Additional options for the go test command, each is passed as a single argument
+	Symbols     *VersionSymbols   // The variables that receive version information, defaults to the duat version package of the module
+	Packages    []string          // The packages to be tested, defaults to the package in the current directory
+	JUnitFile   string            // When present a JUnit XML report is written to this file
+	SummaryFile string            // When present a JSON summary of the results is written to this file
+	Coverage    *CoverageOptions  // When present coverage is collected and checked
+}
 
-	buildOS, hasOS := os.LookupEnv("GOOS")
-	arch, hasArch := os.LookupEnv("GOARCH")
+// GoTest will run the tests for the package in the current directory
+//
+func (md *MetaData) GoTest(env map[string]string, tags []string, opts []string) (err kv.Error) {
+	return md.GoTestWithOptions(GoTestOptions{Env: env, Tags: tags, Opts: opts})
+}
 
-	if !hasOS {
-		buildOS = runtime.GOOS
-	}
-	if !hasArch {
-		arch = runtime.GOARCH
-	}
-	if arch == "arm" {
-		if arm, isPresent := os.LookupEnv("GOARM"); isPresent {
-			arch += arm
-		}
-	}
+// GoTestWithOptions will run the tests for the package in the current directory, a failure
+// to start the tests, or a test failure, is returned as an error
+//
+func (md *MetaData) GoTestWithOptions(opts GoTestOptions) (err kv.Error) {
+	_, err = md.GoTestReport(opts)
+	return err
+}
 
-	buildEnv := []string{"GO_ENABLED=0"}
-	// If the LD_LIBRARY_PATH is present bring it into the build automatically
-	if ldPath, hasLdPath := os.LookupEnv("LD_LIBRARY_PATH"); hasLdPath {
-		buildEnv = append(buildEnv, fmt.Sprintf("LD_LIBRARY_PATH=%s", ldPath))
-	}
+// GoTestReport will run the tests using go test -json returning a report of the results.  The
+// output of the tests is written to the Stdout of the options as the tests run.  If any test
+// fails an error naming the failed tests is returned along with the report.
+//
+func (md *MetaData) GoTestReport(opts GoTestOptions) (report *TestReport, err kv.Error) {
 
-	for k, v := range env {
-		buildEnv = append(buildEnv, fmt.Sprintf("%s='%s'", k, v))
-		switch k {
-		case "GOOS":
-			buildOS = v
-		case "GOARCH":
-			arch = v
-		}
-	}
+	run := opts.GoRunOptions.defaults()
+	env := goBuildEnv(opts.Env)
 
-	goPath, isPresent := os.LookupEnv("GOPATH")
-	if !isPresent {
-		goPath, _ = os.LookupEnv("HOME")
-	}
-	trimpath := ""
-	if len(goPath) != 0 {
-		trimpath = "-gcflags \"all=-trimpath=" + goPath + "\""
+	ldFlags, err := md.VersionLDFlags(run.Dir, opts.Symbols, time.Now())
+	if err != nil {
+		return nil, err.With("module", md.Module)
 	}
 
-	output := md.Module + "-" + buildOS + "-" + arch
-	if len(outputSuffix) != 0 {
-		output += "-" + outputSuffix
+	if err = run.goModTidy(env); err != nil {
+		return nil, err.With("module", md.Module)
 	}
-	output = filepath.Join(outputDir, output)
 
-	tagOption := ""
-	if len(tags) > 0 {
-		tagOption = fmt.Sprintf(" -tags \"%s\" ", strings.Join(tags, " "))
-	}
+	args := append([]string{"test", "-json"}, tagArgs(opts.Tags)...)
+	args = append(args, "-ldflags", ldFlags)
 
-	cmds := []string{
-		goModTidy,
-		fmt.Sprintf(("%s go build %s %s %s -ldflags \"" + strings.Join(ldFlags, " ") + "\" -o " + output + " ."),
-			strings.Join(buildEnv, " "), strings.Join(opts, " "), trimpath, tagOption),
+	pkgs := opts.Packages
+	if len(pkgs) == 0 {
+		pkgs = []string{"."}
 	}
 
-	outBuf := &strings.Builder{}
-	if err = runCMD(cmds, io.MultiWriter(os.Stdout, outBuf), io.MultiWriter(os.Stderr, outBuf)); err != nil {
-		outputs = append(outputs, strings.Split(outBuf.String(), "\n")...)
-		return outputs, err.With("module", md.Module)
+	if opts.Coverage != nil {
+		// Runs that check coverage do so using only the profile they collect
+		if !opts.Coverage.CollectOnly {
+			opts.Coverage.Profiles = nil
+		}
+		selection := append(tagArgs(opts.Tags), opts.Opts...)
+		selection = append(selection, pkgs...)
+		if args, err = coverageArgs(opts.Coverage, run.Dir, selection, args); err != nil {
+			return nil, err.With("module", md.Module)
+		}
 	}
-	return outputs, nil
-}
 
-func (md *MetaData) GoTest(env map[string]string, tags []string, opts []string) (err kv.Error) {
+	args = append(args, opts.Opts...)
+	args = append(args, pkgs...)
 
-	// prepare flags and options needed for the actual build
-	ldFlags := []string{}
-	ldFlags = append(ldFlags, fmt.Sprintf("-X github.com/karlmutch/duat/version.BuildTime=%s", time.Now().Format("2006-01-02_15:04:04-0700")))
-	ldFlags = append(ldFlags, fmt.Sprintf("-X github.com/karlmutch/duat/version.GitHash=%s", md.Git.Hash))
-	ldFlags = append(ldFlags, fmt.Sprintf("-X github.com/karlmutch/duat/version.SemVer=\"%s\"", md.SemVer.String()))
+	// The event stream is parsed as it arrives so that progress remains visible
+	events, eventsWriter := io.Pipe()
+	parsed := make(chan kv.Error, 1)
+	go func() {
+		var parseErr kv.Error
+		report, parseErr = ParseTestEvents(events, run.Stdout)
+		// Drain anything left so the go tool cannot block on a reader that has stopped
+		io.Copy(ioutil.Discard, events)
+		parsed <- parseErr
+	}()
 
-	buildEnv := []string{"GO_ENABLED=0"}
-	// If the LD_LIBRARY_PATH is present bring it into the build automatically
-	if ldPath, hasLdPath := os.LookupEnv("LD_LIBRARY_PATH"); hasLdPath {
-		buildEnv = append(buildEnv, fmt.Sprintf("LD_LIBRARY_PATH=%s", ldPath))
-	}
+	cmd := run.goCommand(env, args...)
+	cmd.Stdout = eventsWriter
+	runErr := RunCommand(run.Ctx, cmd)
+	eventsWriter.Close()
 
-	for k, v := range env {
-		buildEnv = append(buildEnv, fmt.Sprintf("%s='%s'", k, v))
+	if err = <-parsed; err != nil {
+		return report, err.With("module", md.Module)
 	}
 
-	tagOption := ""
-	if len(tags) > 0 {
-		tagOption = fmt.Sprintf(" -tags \"%s\" ", strings.Join(tags, " "))
+	if len(opts.JUnitFile) != 0 {
+		if err = writeReportFile(opts.JUnitFile, report.WriteJUnit); err != nil {
+			return report, err.With("module", md.Module)
+		}
 	}
-
-	cmds := []string{
-		goModTidy,
-		fmt.Sprintf(("%s go test %s -ldflags \"" + strings.Join(ldFlags, " ") + "\" %s ."),
-			strings.Join(buildEnv, " "), tagOption, strings.Join(opts, " ")),
+	if len(opts.SummaryFile) != 0 {
+		if err = writeReportFile(opts.SummaryFile, report.WriteSummaryJSON); err != nil {
+			return report, err.With("module", md.Module)
+		}
 	}
 
-	cmd := exec.Command("bash", "-c", strings.Join(cmds, " && "))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if errGo := cmd.Start(); errGo != nil {
-		dir, _ := os.Getwd()
-		fmt.Fprintln(os.Stderr, kv.Wrap(errGo, "unable to run the test").With("module", md.Module).
-			With("stack", stack.Trace().TrimRuntime()).With("cmds", strings.Join(cmds, "¶ ")).
-			With("dir", dir).Error())
-		os.Exit(-3)
+	if failed := report.Failed(); len(failed) != 0 {
+		names := make([]string, 0, len(failed))
+		for _, test := range failed {
+			name := test.Package
+			if len(test.Name) != 0 {
+				name += "." + test.Name
+			}
+			names = append(names, name)
+		}
+		return report, kv.NewError("tests failed").With("module", md.Module, "tests", strings.Join(names, ",")).With("stack", stack.Trace().TrimRuntime())
+	}
+	if runErr != nil {
+		return report, runErr.With("module", md.Module)
 	}
 
-	if errGo := cmd.Wait(); errGo != nil {
-		return kv.Wrap(errGo, "unable to run the compiler").
-			With("stack", stack.Trace().TrimRuntime()).With("cmds", strings.Join(cmds, "¶ "))
+	if opts.Coverage != nil && !opts.Coverage.CollectOnly {
+		if report.Coverage, err = md.CheckCoverage(opts.Coverage); err != nil {
+			return report, err.With("module", md.Module)
+		}
 	}
-	return nil
+	return report, nil
 }
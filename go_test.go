@@ -1,6 +1,9 @@
 package duat
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/go-test/deep"
@@ -26,3 +29,89 @@ func TestGoGenerator(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+// TestGoTargets checks the parsing of build target specifications and the naming of
+// the binaries produced for them
+//
+func TestGoTargets(t *testing.T) {
+	targets, err := ParseGoTargets([]string{"linux/amd64", "linux/arm64", "darwin/arm64", "windows/amd64", "linux/arm/7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, target := range targets {
+		names = append(names, target.binaryName("tool", ""))
+	}
+	expected := []string{"tool-linux-amd64", "tool-linux-arm64", "tool-darwin-arm64", "tool-windows-amd64.exe", "tool-linux-arm7"}
+	if diff := deep.Equal(expected, names); diff != nil {
+		t.Error(diff)
+	}
+
+	for _, bad := range []string{"linux", "linux/amd64/7", "/amd64"} {
+		if _, err = ParseGoTargets([]string{bad}); err == nil {
+			t.Error("invalid target was accepted", bad)
+		}
+	}
+}
+
+// TestGoSourceFilter checks that source files are selected using the same build constraints
+// as the compiler
+//
+func TestGoSourceFilter(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "filter")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"plain.go":         "package p\n",
+		"plain_linux.go":   "package p\n",
+		"plain_windows.go": "package p\n",
+		"arch_arm64.go":    "package p\n",
+		"expr.go":          "// Copyright\n\n//go:build (linux || darwin) && !extra\n\npackage p\n",
+		"tagged.go":        "//go:build extra || other\n\npackage p\n",
+		"legacy.go":        "// +build linux darwin\n// +build extra\n\npackage p\n",
+		"cgo.go":           "//go:build cgo\n\npackage p\n",
+		"invalid.go":       "//go:build (linux\n\npackage p\n",
+	})
+
+	cases := []struct {
+		filter   GoSourceFilter
+		expected []string
+	}{
+		{
+			filter:   GoSourceFilter{Target: GoTarget{OS: "linux", Arch: "amd64"}},
+			expected: []string{"expr.go", "plain.go", "plain_linux.go"},
+		},
+		{
+			filter:   GoSourceFilter{Target: GoTarget{OS: "linux", Arch: "arm64"}, Tags: []string{"extra"}},
+			expected: []string{"arch_arm64.go", "legacy.go", "plain.go", "plain_linux.go", "tagged.go"},
+		},
+		{
+			filter:   GoSourceFilter{Target: GoTarget{OS: "windows", Arch: "amd64"}, Tags: []string{"other"}, Cgo: true},
+			expected: []string{"cgo.go", "plain.go", "plain_windows.go", "tagged.go"},
+		},
+	}
+
+	infos, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	for _, aCase := range cases {
+		matched := []string{}
+		for _, info := range infos {
+			if ok, _ := aCase.filter.Match(filepath.Join(dir, info.Name())); ok {
+				matched = append(matched, info.Name())
+			}
+		}
+		if diff := deep.Equal(aCase.expected, matched); diff != nil {
+			t.Error(aCase.filter.Target, aCase.filter.Tags, diff)
+		}
+	}
+
+	if _, err := (GoSourceFilter{}).Match(filepath.Join(dir, "invalid.go")); err == nil {
+		t.Error("an invalid build constraint was accepted")
+	}
+}
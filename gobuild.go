@@ -0,0 +1,460 @@
+package duat
+
+// This file contains the implementation of Go builds that produce binaries for a
+// matrix of operating system and architecture targets
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// GoTarget identifies the operating system and architecture for which a binary is built
+//
+type GoTarget struct {
+	OS   string // The GOOS value for the build
+	Arch string // The GOARCH value for the build
+	Arm  string // The GOARM value for the build, only used when Arch is arm
+}
+
+// String returns the target using the os/arch[/arm] notation used by the go tooling
+//
+func (target GoTarget) String() string {
+	if target.Arch == "arm" && len(target.Arm) != 0 {
+		return target.OS + "/" + target.Arch + "/" + target.Arm
+	}
+	return target.OS + "/" + target.Arch
+}
+
+// binaryName returns the file name for a binary of the module built for the target
+//
+func (target GoTarget) binaryName(module string, suffix string) (name string) {
+	arch := target.Arch
+	if arch == "arm" {
+		arch += target.Arm
+	}
+	name = module + "-" + target.OS + "-" + arch
+	if len(suffix) != 0 {
+		name += "-" + suffix
+	}
+	if target.OS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// ParseGoTargets converts a list of os/arch[/arm] specifications, for example
+// linux/amd64 or linux/arm/7, into build targets
+//
+func ParseGoTargets(specs []string) (targets []GoTarget, err kv.Error) {
+	targets = make([]GoTarget, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+		parts := strings.Split(spec, "/")
+		if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, kv.NewError("build targets must be specified as os/arch[/arm]").With("target", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		target := GoTarget{OS: parts[0], Arch: parts[1]}
+		if len(parts) == 3 {
+			if target.Arch != "arm" {
+				return nil, kv.NewError("an arm version can only be used with the arm architecture").With("target", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+			target.Arm = parts[2]
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// defaultGoTarget returns the target selected by the environment of the process, with
+// any GOOS, GOARCH or GOARM values in env taking precedence
+//
+func defaultGoTarget(env map[string]string) (target GoTarget) {
+	target = GoTarget{
+		OS:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+	}
+	if buildOS, isPresent := os.LookupEnv("GOOS"); isPresent {
+		target.OS = buildOS
+	}
+	if arch, isPresent := os.LookupEnv("GOARCH"); isPresent {
+		target.Arch = arch
+	}
+	if arm, isPresent := os.LookupEnv("GOARM"); isPresent {
+		target.Arm = arm
+	}
+	for k, v := range env {
+		switch k {
+		case "GOOS":
+			target.OS = v
+		case "GOARCH":
+			target.Arch = v
+		case "GOARM":
+			target.Arm = v
+		}
+	}
+	return target
+}
+
+// GoBuildOptions contains the parameters for a build of a go main package into binaries
+// for one or more targets
+//
+type GoBuildOptions struct {
+	GoRunOptions
+	Name         string             // The base name of the binaries, defaults to the module name of the metadata
+	Env          map[string]string  // Additional environment variables for the compiler
+	Tags         []string           // Build tags
+	Opts         []string           // Additional options for the go build command, each is passed as a single argument
+	OutputDir    string             // The directory into which binaries are written, defaults to ./bin
+	OutputSuffix string             // An optional suffix added to the names of the binaries
+	VersionBump  bool               // Bump the pre-release version before building
+	Targets      []GoTarget         // The targets to build, defaults to the target of the environment
+	Parallel     int                // The maximum number of concurrent builds, defaults to the number of CPUs
+	Symbols      *VersionSymbols    // The variables that receive version information, defaults to the duat version package of the module
+	Reproducible bool               // Build using the source date and without local paths, writing a manifest beside each binary
+	SigningKey   ed25519.PrivateKey // When present, and building reproducibly, manifests are signed using this key
+	Force        bool               // Build even when the digest of the build inputs matches that of the existing binary
+}
+
+// reproducibleBuild contains the values shared by all targets of a reproducible build
+//
+type reproducibleBuild struct {
+	modulePath string
+	sourceDate time.Time
+	graphHash  string
+	key        ed25519.PrivateKey
+}
+
+// GoBuildResult contains the outcome of building a binary for a single target
+//
+type GoBuildResult struct {
+	Target   GoTarget
+	Path     string        // The path of the binary
+	Size     int64         // The size of the binary in bytes
+	Duration time.Duration // The time taken by the compiler
+	Output   []string      // The output of the compiler, populated when the build failed
+	Manifest string        // The path of the build manifest, populated by reproducible builds
+	Digest   string        // The digest of the build inputs, see GoBuildOptions.Force
+	Cached   bool          // True when the existing binary was up to date and the build was skipped
+	Err      kv.Error
+}
+
+// GoBuildWithOptions will build binaries for all of the targets in the options with bounded
+// parallelism.  A result is returned for every target, if any of the targets fail an error
+// will also be returned.
+//
+func (md *MetaData) GoBuildWithOptions(opts GoBuildOptions) (results []*GoBuildResult, err kv.Error) {
+
+	if opts.VersionBump {
+		if len(md.SemVer.Prerelease()) != 0 {
+			if _, err = md.BumpPrerelease(); err != nil {
+				return results, err
+			}
+		}
+	}
+
+	if len(opts.OutputDir) == 0 {
+		opts.OutputDir = "./bin"
+	}
+	// The compiler runs in the package directory so the output location is fixed beforehand
+	outputDir, errGo := filepath.Abs(opts.OutputDir)
+	if errGo != nil {
+		return results, kv.Wrap(errGo, "unable to locate the output directory").With("dir", opts.OutputDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	opts.OutputDir = outputDir
+	if errGo := os.MkdirAll(opts.OutputDir, os.ModePerm); errGo != nil {
+		return results, kv.Wrap(errGo, "unable to create the output directory").With("dir", opts.OutputDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	targets := opts.Targets
+	if len(targets) == 0 {
+		targets = []GoTarget{defaultGoTarget(opts.Env)}
+	}
+
+	run := opts.GoRunOptions.defaults()
+	opts.GoRunOptions = run
+
+	// All targets share a single build time and set of version information
+	buildTime := time.Now()
+	if opts.Reproducible {
+		if buildTime, err = md.SourceDate(); err != nil {
+			return results, err.With("module", md.Module)
+		}
+	}
+
+	symbols, modulePath, err := ResolveVersionSymbols(run.Dir, opts.Symbols)
+	if err != nil {
+		return results, err.With("module", md.Module)
+	}
+	values := md.LDFlagValues(modulePath, buildTime)
+	ldFlags, err := symbols.LDFlags(values)
+	if err != nil {
+		return results, err.With("module", md.Module)
+	}
+
+	// The build time is left out of the digests so that unchanged binaries are not rebuilt
+	// just because time has passed
+	digestValues := *values
+	if !opts.Reproducible {
+		digestValues.BuildTime = ""
+	}
+	digestLDFlags, err := symbols.LDFlags(&digestValues)
+	if err != nil {
+		return results, err.With("module", md.Module)
+	}
+
+	results = make([]*GoBuildResult, len(targets))
+	pending := []int{}
+	for i, target := range targets {
+		if !opts.Force {
+			if results[i] = md.cachedBuild(opts, digestLDFlags, target); results[i] != nil {
+				fmt.Fprintf(run.Stdout, "%s is up to date\n", results[i].Path)
+				continue
+			}
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return results, nil
+	}
+
+	// The module dependencies are shared by all targets so are resolved once only
+	if err = run.goModTidy(goBuildEnv(opts.Env)); err != nil {
+		return results, err.With("module", md.Module)
+	}
+
+	var reproducible *reproducibleBuild
+	if opts.Reproducible {
+		if reproducible, err = md.prepareReproducible(run, opts); err != nil {
+			return results, err.With("module", md.Module)
+		}
+	}
+
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+
+	outputLock := sync.Mutex{}
+	limiter := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+
+	for _, i := range pending {
+		wg.Add(1)
+		go func(i int, target GoTarget) {
+			defer wg.Done()
+
+			limiter <- struct{}{}
+			defer func() { <-limiter }()
+
+			outBuf := &strings.Builder{}
+			errBuf := &strings.Builder{}
+			targetOpts := opts
+			targetOpts.Stdout = outBuf
+			targetOpts.Stderr = errBuf
+			results[i] = md.goCompile(targetOpts, ldFlags, reproducible, target)
+			if results[i].Err == nil {
+				results[i].Err = md.saveBuildDigest(targetOpts, digestLDFlags, results[i])
+			}
+
+			// Output from concurrent builds is released one build at a time to keep it readable
+			outputLock.Lock()
+			io.WriteString(run.Stdout, outBuf.String())
+			io.WriteString(run.Stderr, errBuf.String())
+			outputLock.Unlock()
+		}(i, targets[i])
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.Target.String())
+		}
+	}
+	if len(failed) != 0 {
+		return results, kv.NewError("one or more build targets failed").With("module", md.Module, "targets", strings.Join(failed, ",")).With("stack", stack.Trace().TrimRuntime())
+	}
+	return results, nil
+}
+
+// tagArgs returns the go tool arguments needed to select the build tags
+//
+func tagArgs(tags []string) (args []string) {
+	if len(tags) == 0 {
+		return []string{}
+	}
+	return []string{"-tags", strings.Join(tags, ",")}
+}
+
+// prepareReproducible gathers the values shared by the targets of a reproducible build
+//
+func (md *MetaData) prepareReproducible(run GoRunOptions, opts GoBuildOptions) (reproducible *reproducibleBuild, err kv.Error) {
+	reproducible = &reproducibleBuild{key: opts.SigningKey}
+
+	if reproducible.sourceDate, err = md.SourceDate(); err != nil {
+		return nil, err
+	}
+	if reproducible.modulePath, _, err = GoModulePath(run.Dir); err != nil {
+		return nil, err
+	}
+
+	run.Stdout = nil
+	if reproducible.graphHash, err = moduleGraphHash(run, goBuildEnv(opts.Env)); err != nil {
+		return nil, err
+	}
+	return reproducible, nil
+}
+
+// targetEnv returns the environment for building a target, the target takes precedence over
+// any values supplied by the caller
+//
+func targetEnv(env map[string]string, target GoTarget) (buildEnv map[string]string) {
+	buildEnv = map[string]string{}
+	for k, v := range env {
+		buildEnv[k] = v
+	}
+	buildEnv["GOOS"] = target.OS
+	buildEnv["GOARCH"] = target.Arch
+	delete(buildEnv, "GOARM")
+	if target.Arch == "arm" && len(target.Arm) != 0 {
+		buildEnv["GOARM"] = target.Arm
+	}
+	return buildEnv
+}
+
+// buildPath returns the path of the binary for a target
+//
+func (md *MetaData) buildPath(opts GoBuildOptions, target GoTarget) (path string) {
+	name := opts.Name
+	if len(name) == 0 {
+		name = md.Module
+	}
+	return filepath.Join(opts.OutputDir, target.binaryName(name, opts.OutputSuffix))
+}
+
+// buildArgs returns the arguments for the go tool that build a binary, excluding the
+// output and package
+//
+func (md *MetaData) buildArgs(opts GoBuildOptions, ldFlags string) (args []string) {
+	args = []string{"build"}
+	args = append(args, opts.Opts...)
+
+	if opts.Reproducible {
+		// Stamping version control information requires the module to be inside a repository
+		buildVCS := "-buildvcs=false"
+		if md.Git != nil && md.Git.Repo != nil {
+			buildVCS = "-buildvcs=true"
+		}
+		args = append(args, "-trimpath", buildVCS)
+	} else {
+		goPath, isPresent := os.LookupEnv("GOPATH")
+		if !isPresent {
+			goPath, _ = os.LookupEnv("HOME")
+		}
+		if len(goPath) != 0 {
+			args = append(args, "-gcflags", "all=-trimpath="+goPath)
+		}
+	}
+	args = append(args, tagArgs(opts.Tags)...)
+	return append(args, "-ldflags", ldFlags)
+}
+
+// goCompile runs the compiler for a single target, the caller is responsible for
+// having prepared the output directory and module dependencies.  When reproducible is
+// present a manifest is written beside the binary.
+//
+func (md *MetaData) goCompile(opts GoBuildOptions, ldFlags string, reproducible *reproducibleBuild, target GoTarget) (result *GoBuildResult) {
+
+	result = &GoBuildResult{
+		Target: target,
+		Path:   md.buildPath(opts, target),
+	}
+
+	run := opts.GoRunOptions
+	tags := opts.Tags
+	buildEnv := goBuildEnv(targetEnv(opts.Env, target))
+
+	buildArgs := md.buildArgs(opts, ldFlags)
+	args := append(append([]string{}, buildArgs...), "-o", result.Path, ".")
+
+	outBuf := &strings.Builder{}
+	run.Stdout = io.MultiWriter(run.Stdout, outBuf)
+	run.Stderr = io.MultiWriter(run.Stderr, outBuf)
+
+	startTime := time.Now()
+	err := RunCommand(run.Ctx, run.goCommand(buildEnv, args...))
+	result.Duration = time.Since(startTime)
+
+	if err != nil {
+		result.Output = strings.Split(outBuf.String(), "\n")
+		result.Err = err.With("module", md.Module, "target", target.String())
+		return result
+	}
+
+	info, errGo := os.Stat(result.Path)
+	if errGo != nil {
+		result.Err = kv.Wrap(errGo, "compiler output missing").With("module", md.Module, "target", target.String()).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	result.Size = info.Size()
+
+	if reproducible != nil {
+		manifest := &BuildManifest{
+			Artifact:        filepath.Base(result.Path),
+			Size:            result.Size,
+			Module:          reproducible.modulePath,
+			Target:          target.String(),
+			SourceDate:      reproducible.sourceDate,
+			Tags:            append([]string{}, tags...),
+			BuildFlags:      append(buildArgs[1:], "."),
+			LDFlags:         ldFlags,
+			ModuleGraphHash: reproducible.graphHash,
+		}
+		if md.SemVer != nil {
+			manifest.Version = md.SemVer.String()
+		}
+		if md.Git != nil {
+			manifest.GitHash = md.Git.Hash
+		}
+		if err = md.writeManifest(manifest, result.Path, buildEnv, reproducible.key, run); err != nil {
+			result.Err = err.With("module", md.Module, "target", target.String())
+			return result
+		}
+		result.Manifest = result.Path + ".manifest.json"
+	}
+
+	return result
+}
+
+// writeManifest completes a manifest using the artifact and toolchain, signs it if a key
+// is present and saves it beside the artifact
+//
+func (md *MetaData) writeManifest(manifest *BuildManifest, artifact string, env []string, key ed25519.PrivateKey, run GoRunOptions) (err kv.Error) {
+	if manifest.SHA256, err = fileSHA256(artifact); err != nil {
+		return err
+	}
+	if manifest.GoEnv, err = manifestEnv(run, env); err != nil {
+		return err
+	}
+	manifest.GoVersion = manifest.GoEnv["GOVERSION"]
+
+	if key != nil {
+		if err = manifest.Sign(key); err != nil {
+			return err
+		}
+	}
+	return manifest.Write(artifact + ".manifest.json")
+}
@@ -0,0 +1,350 @@
+package duat
+
+// This file contains the implementation of a model for the results of go tests, populated
+// from the event stream produced by go test -json, along with JUnit XML and JSON reporting
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// TestEvent is a single event from the output of go test -json, see go doc test2json
+//
+type TestEvent struct {
+	Time       time.Time `json:",omitempty"`
+	Action     string
+	Package    string  `json:",omitempty"`
+	Test       string  `json:",omitempty"`
+	Elapsed    float64 `json:",omitempty"`
+	Output     string  `json:",omitempty"`
+	ImportPath string  `json:",omitempty"` // Present on build-output events
+}
+
+// TestCase contains the outcome of a single test, subtests are recorded as separate cases
+// using their full names
+//
+type TestCase struct {
+	Package  string        `json:"package"`
+	Name     string        `json:"name"`   // The test name, empty for failures of the package as a whole
+	Action   string        `json:"action"` // One of pass, fail or skip, or run if the test never finished
+	Duration time.Duration `json:"duration"`
+	Output   []string      `json:"output,omitempty"`
+}
+
+// TestPackage contains the outcome of the tests for a single package
+//
+type TestPackage struct {
+	Name     string        `json:"name"`
+	Action   string        `json:"action"`
+	Duration time.Duration `json:"duration"`
+	Output   []string      `json:"output,omitempty"` // Output not associated with any test, including build failures
+	Tests    []*TestCase   `json:"tests"`
+
+	tests map[string]*TestCase
+}
+
+// TestReport contains the outcome of a go test run
+//
+type TestReport struct {
+	Start    time.Time       `json:"start"`
+	Duration time.Duration   `json:"duration"`
+	Packages []*TestPackage  `json:"packages"`
+	Output   []string        `json:"output,omitempty"`   // Lines that were not test events
+	Coverage *CoverageReport `json:"coverage,omitempty"` // Populated when coverage was collected and checked
+
+	packages map[string]*TestPackage
+}
+
+// TestSummary contains the counts of a test run along with the failures
+//
+type TestSummary struct {
+	Packages int         `json:"packages"`
+	Tests    int         `json:"tests"`
+	Passed   int         `json:"passed"`
+	Failed   int         `json:"failed"`
+	Skipped  int         `json:"skipped"`
+	Duration float64     `json:"duration_seconds"`
+	Failures []*TestCase `json:"failures"`
+}
+
+func (report *TestReport) pkg(name string) (pkg *TestPackage) {
+	if report.packages == nil {
+		report.packages = map[string]*TestPackage{}
+	}
+	if pkg = report.packages[name]; pkg == nil {
+		pkg = &TestPackage{Name: name, Action: "run", Tests: []*TestCase{}, tests: map[string]*TestCase{}}
+		report.packages[name] = pkg
+		report.Packages = append(report.Packages, pkg)
+	}
+	return pkg
+}
+
+func (pkg *TestPackage) test(name string) (test *TestCase) {
+	if test = pkg.tests[name]; test == nil {
+		test = &TestCase{Package: pkg.Name, Name: name, Action: "run"}
+		pkg.tests[name] = test
+		pkg.Tests = append(pkg.Tests, test)
+	}
+	return test
+}
+
+// Add updates the report with a single event
+//
+func (report *TestReport) Add(event *TestEvent) {
+	if report.Start.IsZero() || (!event.Time.IsZero() && event.Time.Before(report.Start)) {
+		report.Start = event.Time
+	}
+
+	name := event.Package
+	if len(name) == 0 {
+		name = event.ImportPath
+	}
+	pkg := report.pkg(name)
+	elapsed := time.Duration(event.Elapsed * float64(time.Second))
+
+	if len(event.Test) == 0 {
+		switch event.Action {
+		case "output", "build-output":
+			pkg.Output = append(pkg.Output, strings.TrimSuffix(event.Output, "\n"))
+		case "pass", "fail", "skip":
+			pkg.Action = event.Action
+			pkg.Duration = elapsed
+		case "build-fail":
+			pkg.Action = "fail"
+		}
+		return
+	}
+
+	test := pkg.test(event.Test)
+	switch event.Action {
+	case "output":
+		test.Output = append(test.Output, strings.TrimSuffix(event.Output, "\n"))
+	case "pass", "fail", "skip":
+		test.Action = event.Action
+		test.Duration = elapsed
+	}
+}
+
+// ParseTestEvents reads the output of go test -json into a report.  The text of the output
+// events is copied to out, when present, so that the run can be followed as it progresses.
+//
+func ParseTestEvents(r io.Reader, out io.Writer) (report *TestReport, err kv.Error) {
+	report = &TestReport{Packages: []*TestPackage{}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		event := &TestEvent{}
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), event) != nil || len(event.Action) == 0 {
+			report.Output = append(report.Output, line)
+			if out != nil {
+				fmt.Fprintln(out, line)
+			}
+			continue
+		}
+		report.Add(event)
+		if out != nil && len(event.Output) != 0 {
+			io.WriteString(out, event.Output)
+		}
+	}
+	if errGo := scanner.Err(); errGo != nil {
+		return report, kv.Wrap(errGo, "unable to read the test events").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, pkg := range report.Packages {
+		report.Duration += pkg.Duration
+	}
+	return report, nil
+}
+
+// Failed returns the tests that failed.  Packages that failed without any failing test, for
+// example when they do not compile, are returned as a case with an empty name holding the
+// output of the package.
+//
+func (report *TestReport) Failed() (failed []*TestCase) {
+	failed = []*TestCase{}
+	for _, pkg := range report.Packages {
+		testFailed := false
+		for _, test := range pkg.Tests {
+			if test.Action == "fail" {
+				failed = append(failed, test)
+				testFailed = true
+			}
+		}
+		if pkg.Action == "fail" && !testFailed {
+			failed = append(failed, &TestCase{Package: pkg.Name, Action: "fail", Duration: pkg.Duration, Output: pkg.Output})
+		}
+	}
+	return failed
+}
+
+// Summary returns the counts of the tests in the report
+//
+func (report *TestReport) Summary() (summary *TestSummary) {
+	summary = &TestSummary{
+		Packages: len(report.Packages),
+		Duration: report.Duration.Seconds(),
+		Failures: report.Failed(),
+	}
+	for _, pkg := range report.Packages {
+		for _, test := range pkg.Tests {
+			summary.Tests++
+			switch test.Action {
+			case "pass":
+				summary.Passed++
+			case "skip":
+				summary.Skipped++
+			}
+		}
+	}
+	summary.Failed = len(summary.Failures)
+	return summary
+}
+
+// WriteSummaryJSON writes the summary of the report as JSON
+//
+func (report *TestReport) WriteSummaryJSON(w io.Writer) (err kv.Error) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if errGo := enc.Encode(report.Summary()); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitSuite struct {
+	Name      string       `xml:"name,attr"`
+	Tests     int          `xml:"tests,attr"`
+	Failures  int          `xml:"failures,attr"`
+	Skipped   int          `xml:"skipped,attr"`
+	Time      string       `xml:"time,attr"`
+	Timestamp string       `xml:"timestamp,attr,omitempty"`
+	Cases     []*junitCase `xml:"testcase"`
+	SystemOut string       `xml:"system-out,omitempty"`
+}
+
+type junitSuites struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Skipped  int           `xml:"skipped,attr"`
+	Time     string        `xml:"time,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the report using the JUnit XML format, one test suite per package
+//
+func (report *TestReport) WriteJUnit(w io.Writer) (err kv.Error) {
+	suites := &junitSuites{Time: junitTime(report.Duration), Suites: []*junitSuite{}}
+
+	pkgs := append([]*TestPackage{}, report.Packages...)
+	sort.SliceStable(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+
+	for _, pkg := range pkgs {
+		suite := &junitSuite{
+			Name:  pkg.Name,
+			Time:  junitTime(pkg.Duration),
+			Cases: []*junitCase{},
+		}
+		if !report.Start.IsZero() {
+			suite.Timestamp = report.Start.UTC().Format(time.RFC3339)
+		}
+
+		testFailed := false
+		for _, test := range pkg.Tests {
+			tc := &junitCase{Classname: pkg.Name, Name: test.Name, Time: junitTime(test.Duration)}
+			switch test.Action {
+			case "fail":
+				tc.Failure = &junitFailure{Message: "Failed", Text: strings.Join(test.Output, "\n")}
+				suite.Failures++
+				testFailed = true
+			case "skip":
+				tc.Skipped = &junitSkipped{Message: strings.Join(test.Output, "\n")}
+				suite.Skipped++
+			default:
+				tc.SystemOut = strings.Join(test.Output, "\n")
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		if pkg.Action == "fail" && !testFailed {
+			suite.Cases = append(suite.Cases, &junitCase{
+				Classname: pkg.Name,
+				Name:      "package",
+				Time:      junitTime(pkg.Duration),
+				Failure:   &junitFailure{Message: "Failed", Text: strings.Join(pkg.Output, "\n")},
+			})
+			suite.Failures++
+		} else {
+			suite.SystemOut = strings.Join(pkg.Output, "\n")
+		}
+		suite.Tests = len(suite.Cases)
+
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, errGo := io.WriteString(w, xml.Header); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if errGo := enc.Encode(suites); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := io.WriteString(w, "\n"); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// writeReportFile saves a report using the supplied writer function
+//
+func writeReportFile(fn string, write func(w io.Writer) kv.Error) (err kv.Error) {
+	f, errGo := os.Create(fn)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err.With("file", fn)
+	}
+	if errGo = f.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
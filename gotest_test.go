@@ -0,0 +1,59 @@
+package duat
+
+import (
+	"strings"
+	"testing"
+)
+
+var testEvents = `{"Time":"2021-01-01T00:00:00Z","Action":"run","Package":"example.com/a","Test":"TestPass"}
+{"Action":"output","Package":"example.com/a","Test":"TestPass","Output":"=== RUN   TestPass\n"}
+{"Action":"pass","Package":"example.com/a","Test":"TestPass","Elapsed":0.5}
+{"Action":"run","Package":"example.com/a","Test":"TestFail"}
+{"Action":"output","Package":"example.com/a","Test":"TestFail","Output":"    a_test.go:10: broken <value>\n"}
+{"Action":"fail","Package":"example.com/a","Test":"TestFail","Elapsed":0.25}
+{"Action":"run","Package":"example.com/a","Test":"TestSkip"}
+{"Action":"skip","Package":"example.com/a","Test":"TestSkip"}
+{"Action":"fail","Package":"example.com/a","Elapsed":1}
+# example.com/b
+{"ImportPath":"example.com/b","Action":"build-output","Output":"b.go:3:1: syntax error\n"}
+{"Action":"fail","Package":"example.com/b","Elapsed":0}
+`
+
+// TestGoTestEvents checks that test events are collected into a report and rendered
+//
+func TestGoTestEvents(t *testing.T) {
+	out := &strings.Builder{}
+	report, err := ParseTestEvents(strings.NewReader(testEvents), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "broken <value>") {
+		t.Fatal("test output was not passed through", out.String())
+	}
+
+	failed := report.Failed()
+	if len(failed) != 2 || failed[0].Name != "TestFail" || failed[1].Package != "example.com/b" || len(failed[1].Name) != 0 {
+		t.Fatal("unexpected failures", failed)
+	}
+
+	summary := report.Summary()
+	if summary.Tests != 3 || summary.Passed != 1 || summary.Skipped != 1 || summary.Failed != 2 || summary.Packages != 2 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	junit := &strings.Builder{}
+	if err = report.WriteJUnit(junit); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<testsuites tests="4" failures="2" skipped="1" time="1.000">`,
+		`<testcase classname="example.com/a" name="TestFail" time="0.250">`,
+		`broken &lt;value&gt;`,
+		`<testcase classname="example.com/b" name="package" time="0.000">`,
+		`syntax error`,
+	} {
+		if !strings.Contains(junit.String(), expected) {
+			t.Error("missing", expected, "in", junit.String())
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package duat
+
+// This file contains the implementation of offline inspection of Go binaries, reading the
+// build information embedded by the compiler along with the version information injected
+// into string variables by the linker
+
+import (
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// BinaryModule is a module recorded within the build information of a binary
+//
+type BinaryModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	Sum     string `json:"sum,omitempty"`
+	Replace string `json:"replace,omitempty"` // The replacement path, or path@version, used in place of the module
+}
+
+// BinarySetting is a single build setting, such as -trimpath or GOOS, recorded in a binary
+//
+type BinarySetting struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// BinarySymbol is the value of a string variable, typically one injected using -X, within a
+// binary
+//
+type BinarySymbol struct {
+	Symbol string `json:"symbol"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // Either "symbols" when read from the data of the binary, or "ldflags" when taken from the recorded linker flags
+}
+
+// BinaryVCS contains the version control information stamped into a binary by the go tool
+//
+type BinaryVCS struct {
+	System   string `json:"system,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Modified bool   `json:"modified"`
+}
+
+// BinaryInfo contains the details of a Go binary that identify exactly how it was built
+//
+type BinaryInfo struct {
+	Path      string           `json:"path"`
+	SHA256    string           `json:"sha256"`
+	GoVersion string           `json:"go_version"`
+	Main      *BinaryModule    `json:"main"`
+	Version   []*BinarySymbol  `json:"version"`  // The version symbols found, sorted by symbol
+	Settings  []*BinarySetting `json:"settings"` // The build settings, other than those of the VCS, in the order recorded
+	VCS       *BinaryVCS       `json:"vcs,omitempty"`
+	Deps      []*BinaryModule  `json:"deps"` // The module dependencies, sorted by path
+}
+
+// binaryModule converts a module from the build information
+//
+func binaryModule(mod *debug.Module) (converted *BinaryModule) {
+	converted = &BinaryModule{
+		Path:    mod.Path,
+		Version: mod.Version,
+		Sum:     mod.Sum,
+	}
+	if mod.Replace != nil {
+		converted.Replace = mod.Replace.Path
+		if len(mod.Replace.Version) != 0 {
+			converted.Replace += "@" + mod.Replace.Version
+		}
+		converted.Sum = mod.Replace.Sum
+	}
+	return converted
+}
+
+// InspectBinary reads the build information, and version symbols, of a Go binary without
+// running it.  The duat version package symbols of the main module, and of duat itself,
+// any symbols assigned using -X within the recorded linker flags, and the additional
+// symbols supplied are reported when present.
+//
+func InspectBinary(fn string, symbols []string) (info *BinaryInfo, err kv.Error) {
+	bi, errGo := buildinfo.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to read the build information").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	info = &BinaryInfo{
+		Path:      fn,
+		GoVersion: bi.GoVersion,
+		Main:      binaryModule(&bi.Main),
+		Version:   []*BinarySymbol{},
+		Settings:  []*BinarySetting{},
+		Deps:      make([]*BinaryModule, 0, len(bi.Deps)),
+	}
+	if info.SHA256, err = fileSHA256(fn); err != nil {
+		return nil, err
+	}
+
+	ldFlags := ""
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs":
+			info.vcs().System = setting.Value
+		case "vcs.revision":
+			info.vcs().Revision = setting.Value
+		case "vcs.time":
+			info.vcs().Time = setting.Value
+		case "vcs.modified":
+			info.vcs().Modified = setting.Value == "true"
+		default:
+			if setting.Key == "-ldflags" {
+				ldFlags = setting.Value
+			}
+			info.Settings = append(info.Settings, &BinarySetting{Key: setting.Key, Value: setting.Value})
+		}
+	}
+
+	for _, dep := range bi.Deps {
+		info.Deps = append(info.Deps, binaryModule(dep))
+	}
+	sort.Slice(info.Deps, func(i, j int) bool {
+		return info.Deps[i].Path < info.Deps[j].Path
+	})
+
+	// Gather the candidate symbols, the linker flags are only recorded by the go tool for
+	// builds that do not use -trimpath so the data of the binary is preferred
+	assigned := ldFlagAssignments(ldFlags)
+	wanted := map[string]bool{}
+	for _, symbol := range symbols {
+		wanted[symbol] = true
+	}
+	for symbol := range assigned {
+		wanted[symbol] = true
+	}
+	if len(bi.Main.Path) != 0 {
+		for _, symbol := range DefaultVersionSymbols(bi.Main.Path).names() {
+			wanted[symbol] = true
+		}
+	}
+	for _, symbol := range DuatVersionSymbols().names() {
+		wanted[symbol] = true
+	}
+
+	values, err := readStringSymbols(fn, wanted)
+	if err != nil {
+		return nil, err
+	}
+	for symbol := range wanted {
+		if value, isPresent := values[symbol]; isPresent {
+			info.Version = append(info.Version, &BinarySymbol{Symbol: symbol, Value: value, Source: "symbols"})
+			continue
+		}
+		if value, isPresent := assigned[symbol]; isPresent {
+			info.Version = append(info.Version, &BinarySymbol{Symbol: symbol, Value: value, Source: "ldflags"})
+		}
+	}
+	sort.Slice(info.Version, func(i, j int) bool {
+		return info.Version[i].Symbol < info.Version[j].Symbol
+	})
+	return info, nil
+}
+
+// vcs returns the version control information of the binary, adding it when absent
+//
+func (info *BinaryInfo) vcs() *BinaryVCS {
+	if info.VCS == nil {
+		info.VCS = &BinaryVCS{}
+	}
+	return info.VCS
+}
+
+// splitQuoted splits a string into fields separated by white space, fields may be quoted
+// using single or double quotes in the same manner as the go tool splits flags
+//
+func splitQuoted(s string) (fields []string) {
+	fields = []string{}
+	for {
+		s = strings.TrimLeft(s, " \t\n\r")
+		if len(s) == 0 {
+			return fields
+		}
+		if quote := s[0]; quote == '\'' || quote == '"' {
+			if end := strings.IndexByte(s[1:], quote); end >= 0 {
+				fields = append(fields, s[1:end+1])
+				s = s[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexAny(s, " \t\n\r")
+		if end < 0 {
+			end = len(s)
+		}
+		fields = append(fields, s[:end])
+		s = s[end:]
+	}
+}
+
+// ldFlagAssignments returns the values assigned to symbols using -X within linker flags
+//
+func ldFlagAssignments(ldFlags string) (assigned map[string]string) {
+	assigned = map[string]string{}
+	fields := splitQuoted(ldFlags)
+	for i := 0; i < len(fields); i++ {
+		assignment := ""
+		switch field := strings.TrimPrefix(fields[i], "-"); {
+		case field == "-X" || field == "X":
+			if i+1 < len(fields) {
+				i++
+				assignment = fields[i]
+			}
+		case strings.HasPrefix(field, "X="), strings.HasPrefix(field, "-X="):
+			assignment = field[strings.Index(field, "=")+1:]
+		}
+		if eq := strings.Index(assignment, "="); eq > 0 {
+			assigned[assignment[:eq]] = assignment[eq+1:]
+		}
+	}
+	return assigned
+}
+
+// exeSection is a loaded region of an executable, bytes beyond the data held in the file
+// are zero
+//
+type exeSection struct {
+	addr     uint64
+	size     uint64
+	fileSize uint64
+	r        io.ReaderAt
+}
+
+// executable provides access to the memory image of an executable by virtual address
+//
+type executable struct {
+	order    binary.ByteOrder
+	ptrSize  int
+	sections []exeSection
+	symbols  map[string]uint64 // The addresses of the wanted symbols that were found
+}
+
+// read returns the bytes of the memory image at an address
+//
+func (exe *executable) read(addr uint64, size uint64) (data []byte, errGo error) {
+	for _, sect := range exe.sections {
+		if addr < sect.addr || addr+size > sect.addr+sect.size {
+			continue
+		}
+		data = make([]byte, size)
+		offset := addr - sect.addr
+		if offset < sect.fileSize {
+			available := sect.fileSize - offset
+			if available > size {
+				available = size
+			}
+			if _, errGo = sect.r.ReadAt(data[:available], int64(offset)); errGo != nil {
+				return nil, errGo
+			}
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("address %#x is not mapped", addr)
+}
+
+// readString returns the value of a string variable at an address
+//
+func (exe *executable) readString(addr uint64) (value string, errGo error) {
+	header, errGo := exe.read(addr, uint64(2*exe.ptrSize))
+	if errGo != nil {
+		return "", errGo
+	}
+	ptr, length := uint64(0), uint64(0)
+	if exe.ptrSize == 8 {
+		ptr, length = exe.order.Uint64(header), exe.order.Uint64(header[8:])
+	} else {
+		ptr, length = uint64(exe.order.Uint32(header)), uint64(exe.order.Uint32(header[4:]))
+	}
+	if length == 0 {
+		return "", nil
+	}
+	if length > 1<<20 {
+		return "", fmt.Errorf("string length %d is implausible", length)
+	}
+	data, errGo := exe.read(ptr, length)
+	return string(data), errGo
+}
+
+// readStringSymbols returns the values of the wanted string variables that can be found
+// within the symbol table of an ELF, Mach-O or PE executable.  Stripped binaries have no
+// symbol table and so return no values.
+//
+func readStringSymbols(fn string, wanted map[string]bool) (values map[string]string, err kv.Error) {
+	values = map[string]string{}
+
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, errGo = f.ReadAt(magic, 0); errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	exe := &executable{symbols: map[string]uint64{}}
+	switch {
+	case string(magic) == elf.ELFMAG:
+		errGo = exe.loadELF(f, wanted)
+	case magic[0] == 'M' && magic[1] == 'Z':
+		errGo = exe.loadPE(f, wanted)
+	default:
+		errGo = exe.loadMachO(f, wanted)
+	}
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to read the executable").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for symbol, addr := range exe.symbols {
+		value, errGo := exe.readString(addr)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo, "unable to read a string variable").With("file", fn, "symbol", symbol).With("stack", stack.Trace().TrimRuntime())
+		}
+		values[symbol] = value
+	}
+	return values, nil
+}
+
+func (exe *executable) loadELF(r io.ReaderAt, wanted map[string]bool) (errGo error) {
+	f, errGo := elf.NewFile(r)
+	if errGo != nil {
+		return errGo
+	}
+	exe.order = f.ByteOrder
+	exe.ptrSize = 4
+	if f.Class == elf.ELFCLASS64 {
+		exe.ptrSize = 8
+	}
+	for _, sect := range f.Sections {
+		if sect.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		fileSize := sect.Size
+		if sect.Type == elf.SHT_NOBITS {
+			fileSize = 0
+		}
+		exe.sections = append(exe.sections, exeSection{addr: sect.Addr, size: sect.Size, fileSize: fileSize, r: sect})
+	}
+
+	syms, errGo := f.Symbols()
+	if errGo != nil {
+		if errGo == elf.ErrNoSymbols {
+			return nil
+		}
+		return errGo
+	}
+	for _, sym := range syms {
+		if wanted[sym.Name] {
+			exe.symbols[sym.Name] = sym.Value
+		}
+	}
+	return nil
+}
+
+func (exe *executable) loadMachO(r io.ReaderAt, wanted map[string]bool) (errGo error) {
+	f, errGo := macho.NewFile(r)
+	if errGo != nil {
+		return errGo
+	}
+	exe.order = f.ByteOrder
+	exe.ptrSize = 4
+	if f.Magic == macho.Magic64 {
+		exe.ptrSize = 8
+	}
+	for _, sect := range f.Sections {
+		fileSize := sect.Size
+		// Zero filled sections, such as __bss, occupy no space within the file
+		if sect.Offset == 0 {
+			fileSize = 0
+		}
+		exe.sections = append(exe.sections, exeSection{addr: sect.Addr, size: sect.Size, fileSize: fileSize, r: sect})
+	}
+
+	if f.Symtab == nil {
+		return nil
+	}
+	for _, sym := range f.Symtab.Syms {
+		// Symbols of Mach-O executables carry a leading underscore
+		name := strings.TrimPrefix(sym.Name, "_")
+		if wanted[name] {
+			exe.symbols[name] = sym.Value
+		}
+	}
+	return nil
+}
+
+func (exe *executable) loadPE(r io.ReaderAt, wanted map[string]bool) (errGo error) {
+	f, errGo := pe.NewFile(r)
+	if errGo != nil {
+		return errGo
+	}
+	exe.order = binary.LittleEndian
+	exe.ptrSize = 4
+	imageBase := uint64(0)
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		exe.ptrSize = 8
+		imageBase = header.ImageBase
+	case *pe.OptionalHeader32:
+		imageBase = uint64(header.ImageBase)
+	}
+	for _, sect := range f.Sections {
+		fileSize := uint64(sect.Size)
+		if fileSize > uint64(sect.VirtualSize) {
+			fileSize = uint64(sect.VirtualSize)
+		}
+		exe.sections = append(exe.sections, exeSection{
+			addr:     imageBase + uint64(sect.VirtualAddress),
+			size:     uint64(sect.VirtualSize),
+			fileSize: fileSize,
+			r:        sect,
+		})
+	}
+
+	for _, sym := range f.Symbols {
+		if !wanted[sym.Name] || sym.SectionNumber <= 0 || int(sym.SectionNumber) > len(f.Sections) {
+			continue
+		}
+		exe.symbols[sym.Name] = imageBase + uint64(f.Sections[sym.SectionNumber-1].VirtualAddress) + uint64(sym.Value)
+	}
+	return nil
+}
+
+// WriteText writes the details of the binary in a human readable form
+//
+func (info *BinaryInfo) WriteText(w io.Writer) (err kv.Error) {
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "path\t%s\n", info.Path)
+	fmt.Fprintf(text, "sha256\t%s\n", info.SHA256)
+	fmt.Fprintf(text, "go\t%s\n", info.GoVersion)
+	fmt.Fprintf(text, "main\t%s\t%s\t%s\n", info.Main.Path, info.Main.Version, info.Main.Sum)
+	for _, symbol := range info.Version {
+		fmt.Fprintf(text, "version\t%s=%s\n", symbol.Symbol, symbol.Value)
+	}
+	if info.VCS != nil {
+		fmt.Fprintf(text, "vcs\t%s\t%s\t%s\tmodified=%t\n", info.VCS.System, info.VCS.Revision, info.VCS.Time, info.VCS.Modified)
+	}
+	for _, setting := range info.Settings {
+		fmt.Fprintf(text, "build\t%s=%s\n", setting.Key, setting.Value)
+	}
+	for _, dep := range info.Deps {
+		if len(dep.Replace) != 0 {
+			fmt.Fprintf(text, "dep\t%s\t%s\t%s\t=> %s\n", dep.Path, dep.Version, dep.Sum, dep.Replace)
+			continue
+		}
+		fmt.Fprintf(text, "dep\t%s\t%s\t%s\n", dep.Path, dep.Version, dep.Sum)
+	}
+
+	if _, errGo := io.WriteString(w, text.String()); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// WriteJSON writes the details of the binary as a JSON document
+//
+func (info *BinaryInfo) WriteJSON(w io.Writer) (err kv.Error) {
+	return writeJSON(w, info)
+}
+
+// BinaryDifference is a single difference found when comparing two binaries
+//
+type BinaryDifference struct {
+	Item string `json:"item"`        // The item that differs, for example go, version:<symbol>, build:<key> or dep:<path>
+	A    string `json:"a,omitempty"` // The value of the first binary, empty when the item is absent
+	B    string `json:"b,omitempty"` // The value of the second binary, empty when the item is absent
+}
+
+// BinaryComparison contains the differences between two binaries
+//
+type BinaryComparison struct {
+	A           *BinaryInfo         `json:"a"`
+	B           *BinaryInfo         `json:"b"`
+	Differences []*BinaryDifference `json:"differences"`
+}
+
+// items flattens the details of a binary into items that can be compared
+//
+func (info *BinaryInfo) items() (items map[string]string) {
+	items = map[string]string{
+		"sha256": info.SHA256,
+		"go":     info.GoVersion,
+		"main":   strings.TrimSpace(info.Main.Path + " " + info.Main.Version),
+	}
+	for _, symbol := range info.Version {
+		items["version:"+symbol.Symbol] = symbol.Value
+	}
+	if info.VCS != nil {
+		items["vcs.revision"] = info.VCS.Revision
+		items["vcs.time"] = info.VCS.Time
+		items["vcs.modified"] = fmt.Sprint(info.VCS.Modified)
+	}
+	for _, setting := range info.Settings {
+		items["build:"+setting.Key] = setting.Value
+	}
+	for _, dep := range info.Deps {
+		items["dep:"+dep.Path] = strings.TrimSpace(dep.Version + " " + dep.Replace)
+	}
+	return items
+}
+
+// CompareBinaries returns the differences in the build information, and version symbols,
+// of two binaries
+//
+func CompareBinaries(a *BinaryInfo, b *BinaryInfo) (comparison *BinaryComparison) {
+	comparison = &BinaryComparison{A: a, B: b, Differences: []*BinaryDifference{}}
+
+	itemsA, itemsB := a.items(), b.items()
+	keys := make([]string, 0, len(itemsA)+len(itemsB))
+	for key := range itemsA {
+		keys = append(keys, key)
+	}
+	for key := range itemsB {
+		if _, isPresent := itemsA[key]; !isPresent {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		valueA, presentA := itemsA[key]
+		valueB, presentB := itemsB[key]
+		if presentA == presentB && valueA == valueB {
+			continue
+		}
+		comparison.Differences = append(comparison.Differences, &BinaryDifference{Item: key, A: valueA, B: valueB})
+	}
+	return comparison
+}
+
+// WriteText writes the differences between the binaries in a human readable form
+//
+func (comparison *BinaryComparison) WriteText(w io.Writer) (err kv.Error) {
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "a\t%s\n", comparison.A.Path)
+	fmt.Fprintf(text, "b\t%s\n", comparison.B.Path)
+	if len(comparison.Differences) == 0 {
+		text.WriteString("the binaries are identical\n")
+	}
+	for _, diff := range comparison.Differences {
+		fmt.Fprintf(text, "%s\t%q\t%q\n", diff.Item, diff.A, diff.B)
+	}
+
+	if _, errGo := io.WriteString(w, text.String()); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// WriteJSON writes the comparison as a JSON document
+//
+func (comparison *BinaryComparison) WriteJSON(w io.Writer) (err kv.Error) {
+	return writeJSON(w, comparison)
+}
@@ -0,0 +1,72 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestInspectBinary checks that injected version symbols are read from binaries built with
+// -trimpath, using the symbol table, and from stripped binaries, using the recorded linker
+// flags, and that the two builds are reported as different
+//
+func TestInspectBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping binary builds in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "inspect")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":             "module example.com/project\n\ngo 1.18\n",
+		"version/version.go": "package version\n\nvar (\n\tVersion   = \"unknown\"\n\tGitHash   = \"unknown\"\n\tBuildTime = \"unknown\"\n)\n",
+		"main.go":            "package main\n\nimport \"example.com/project/version\"\n\nfunc main() { println(version.Version, version.GitHash, version.BuildTime) }\n",
+	})
+
+	ldFlags := "-X example.com/project/version.Version=1.2.3 -X 'example.com/project/version.BuildTime=2022-01-02 03:04'"
+	builds := map[string][]string{
+		"trimmed":  {"-trimpath", "-ldflags", ldFlags},
+		"stripped": {"-ldflags", "-s -w " + ldFlags},
+	}
+	infos := map[string]*BinaryInfo{}
+	for name, args := range builds {
+		binary := filepath.Join(dir, name)
+		cmd := exec.Command("go", append(append([]string{"build", "-o", binary}, args...), ".")...)
+		cmd.Dir = dir
+		if out, errGo := cmd.CombinedOutput(); errGo != nil {
+			t.Fatal(errGo, string(out))
+		}
+
+		info, err := InspectBinary(binary, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]string{}
+		for _, symbol := range info.Version {
+			values[symbol.Symbol] = symbol.Value
+		}
+		if values["example.com/project/version.Version"] != "1.2.3" ||
+			values["example.com/project/version.BuildTime"] != "2022-01-02 03:04" {
+			t.Error(name, "unexpected version symbols", values)
+		}
+		// The stripped binary has no symbol table so unassigned variables are not visible
+		if name == "trimmed" && values["example.com/project/version.GitHash"] != "unknown" {
+			t.Error(name, "unexpected version symbols", values)
+		}
+		infos[name] = info
+	}
+
+	items := map[string]bool{}
+	for _, diff := range CompareBinaries(infos["trimmed"], infos["stripped"]).Differences {
+		items[diff.Item] = true
+	}
+	if !items["build:-trimpath"] || !items["sha256"] || items["version:example.com/project/version.Version"] {
+		t.Error("unexpected differences", items)
+	}
+}
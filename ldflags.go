@@ -0,0 +1,397 @@
+package duat
+
+// This file contains the implementation of linker flag generation for injecting version
+// information into string variables within the packages of the module being built
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/mod/modfile"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// VersionSymbols maps the values duat knows about a build onto package level string variables
+// of the module being built.  Symbols are fully qualified, for example
+// example.com/project/version.GitHash, and symbols that are left empty are not injected.
+//
+type VersionSymbols struct {
+	SemVer    string            // Receives the semantic version of the module
+	GitHash   string            // Receives the hash of the current commit
+	Branch    string            // Receives the name of the current branch
+	BuildTime string            // Receives the time of the build
+	Dirty     string            // Receives "true" if the working tree has uncommitted changes, "false" otherwise
+	Values    map[string]string // Symbols mapped to templates that are rendered using the LDFlagValues
+}
+
+// LDFlagValues contains the values that are available for injection into a build, they are
+// also available to the templates in VersionSymbols.Values, for example {{.SemVer}}
+//
+type LDFlagValues struct {
+	Module    string // The path of the go module being built
+	SemVer    string
+	GitHash   string
+	Branch    string
+	BuildTime string
+	Dirty     string
+}
+
+// duatModulePath is the path of the duat module whose version package projects can import
+// rather than providing their own
+//
+const duatModulePath = "github.com/karlmutch/duat"
+
+// DefaultVersionSymbols returns the symbols of the version package used by duat itself,
+// located relative to the module path, <module>/version
+//
+func DefaultVersionSymbols(modulePath string) (symbols *VersionSymbols) {
+	pkg := modulePath + "/version"
+	return &VersionSymbols{
+		SemVer:    pkg + ".Version",
+		GitHash:   pkg + ".GitHash",
+		BuildTime: pkg + ".BuildTime",
+		Values:    map[string]string{},
+	}
+}
+
+// DuatVersionSymbols returns the symbols of the version package of duat, which earlier releases
+// stamped in every build.  They are added to the default symbols of modules that require duat
+// so that projects importing github.com/karlmutch/duat/version continue to be stamped.
+//
+func DuatVersionSymbols() (symbols *VersionSymbols) {
+	pkg := duatModulePath + "/version"
+	return &VersionSymbols{
+		Values: map[string]string{
+			pkg + ".Version":   "{{.SemVer}}",
+			pkg + ".GitHash":   "{{.GitHash}}",
+			pkg + ".BuildTime": "{{.BuildTime}}",
+		},
+	}
+}
+
+// requiresModule returns true when the go.mod file in moduleDir requires the module path,
+// modules that cannot be read are treated as not requiring it
+//
+func requiresModule(moduleDir string, modulePath string) (isRequired bool) {
+	fn := filepath.Join(moduleDir, "go.mod")
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return false
+	}
+	mod, errGo := modfile.ParseLax(fn, data, nil)
+	if errGo != nil {
+		return false
+	}
+	for _, req := range mod.Require {
+		if req.Mod.Path == modulePath {
+			return true
+		}
+	}
+	return false
+}
+
+// GoModulePath returns the module path declared by the go.mod file in the directory dir, or
+// in the closest of its parent directories, along with the directory of the go.mod file
+//
+func GoModulePath(dir string) (modulePath string, moduleDir string, err kv.Error) {
+	moduleDir, errGo := filepath.Abs(dir)
+	if errGo != nil {
+		return "", "", kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for {
+		fn := filepath.Join(moduleDir, "go.mod")
+		data, errGo := ioutil.ReadFile(fn)
+		if errGo == nil {
+			modulePath = modfile.ModulePath(data)
+			if len(modulePath) == 0 {
+				return "", "", kv.NewError("go.mod has no module declaration").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			return modulePath, moduleDir, nil
+		}
+		if !os.IsNotExist(errGo) {
+			return "", "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		parent := filepath.Dir(moduleDir)
+		if parent == moduleDir {
+			return "", "", kv.NewError("go.mod not found").With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		moduleDir = parent
+	}
+}
+
+// LDFlagValues returns the values of the module that are available for injection
+//
+func (md *MetaData) LDFlagValues(modulePath string, buildTime time.Time) (values *LDFlagValues) {
+	values = &LDFlagValues{
+		Module:    modulePath,
+		BuildTime: buildTime.Format("2006-01-02_15:04:05-0700"),
+		Dirty:     "false",
+	}
+	if md.SemVer != nil {
+		values.SemVer = md.SemVer.String()
+	}
+	if md.Git != nil {
+		values.GitHash = md.Git.Hash
+		values.Branch = md.Git.Branch
+		if md.Git.Repo != nil {
+			if tree, errGo := md.Git.Repo.Worktree(); errGo == nil {
+				if status, errGo := tree.Status(); errGo == nil && !status.IsClean() {
+					values.Dirty = "true"
+				}
+			}
+		}
+	}
+	return values
+}
+
+// VersionLDFlags returns the -ldflags value that injects version information into the module
+// found in dir.  When symbols is nil the duat version package symbols of the module, and those
+// of github.com/karlmutch/duat/version when the module requires duat, are used and any of them
+// that are not present are skipped.  Symbols supplied by the
+// caller must exist as package level string variables otherwise an error is returned.
+//
+func (md *MetaData) VersionLDFlags(dir string, symbols *VersionSymbols, buildTime time.Time) (ldFlags string, err kv.Error) {
+	resolved, modulePath, err := ResolveVersionSymbols(dir, symbols)
+	if err != nil {
+		return "", err
+	}
+	return resolved.LDFlags(md.LDFlagValues(modulePath, buildTime))
+}
+
+// names returns the symbols that will be assigned values
+//
+func (symbols *VersionSymbols) names() (names []string) {
+	unique := map[string]bool{}
+	for _, symbol := range []string{symbols.SemVer, symbols.GitHash, symbols.Branch, symbols.BuildTime, symbols.Dirty} {
+		if len(symbol) != 0 {
+			unique[symbol] = true
+		}
+	}
+	for symbol := range symbols.Values {
+		unique[symbol] = true
+	}
+	names = make([]string, 0, len(unique))
+	for symbol := range unique {
+		names = append(names, symbol)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveVersionSymbols checks the symbols against the module found in dir returning a copy
+// that only contains symbols present in the module, along with the module path.  When symbols
+// is nil the duat version package symbols of the module are resolved and missing symbols are
+// skipped, otherwise missing symbols result in an error.
+//
+func ResolveVersionSymbols(dir string, symbols *VersionSymbols) (resolved *VersionSymbols, modulePath string, err kv.Error) {
+	modulePath, moduleDir, err := GoModulePath(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	explicit := symbols != nil
+	if !explicit {
+		symbols = DefaultVersionSymbols(modulePath)
+		// Only modules that depend upon duat are checked for its version package, this avoids
+		// the go tool looking for it online
+		if modulePath != duatModulePath && requiresModule(moduleDir, duatModulePath) {
+			for symbol, text := range DuatVersionSymbols().Values {
+				symbols.Values[symbol] = text
+			}
+		}
+	}
+
+	missing, err := MissingSymbols(moduleDir, modulePath, symbols.names())
+	if err != nil {
+		return nil, "", err
+	}
+	if len(missing) != 0 && explicit {
+		return nil, "", kv.NewError("ldflags symbols not found").With("symbols", strings.Join(missing, ",")).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	absent := map[string]bool{}
+	for _, symbol := range missing {
+		absent[symbol] = true
+	}
+	keep := func(symbol string) string {
+		if absent[symbol] {
+			return ""
+		}
+		return symbol
+	}
+	resolved = &VersionSymbols{
+		SemVer:    keep(symbols.SemVer),
+		GitHash:   keep(symbols.GitHash),
+		Branch:    keep(symbols.Branch),
+		BuildTime: keep(symbols.BuildTime),
+		Dirty:     keep(symbols.Dirty),
+		Values:    map[string]string{},
+	}
+	for symbol, text := range symbols.Values {
+		if !absent[symbol] {
+			resolved.Values[symbol] = text
+		}
+	}
+	return resolved, modulePath, nil
+}
+
+// LDFlags returns the -ldflags value assigning the values to the symbols, the symbols are not
+// checked against the module, see ResolveVersionSymbols
+//
+func (symbols *VersionSymbols) LDFlags(values *LDFlagValues) (ldFlags string, err kv.Error) {
+	assignments := map[string]string{}
+	for symbol, value := range map[string]string{
+		symbols.SemVer:    values.SemVer,
+		symbols.GitHash:   values.GitHash,
+		symbols.Branch:    values.Branch,
+		symbols.BuildTime: values.BuildTime,
+		symbols.Dirty:     values.Dirty,
+	} {
+		if len(symbol) != 0 {
+			assignments[symbol] = value
+		}
+	}
+
+	for symbol, text := range symbols.Values {
+		tmpl, errGo := template.New(symbol).Funcs(FuncMap(nil)).Option("missingkey=error").Parse(text)
+		if errGo != nil {
+			return "", kv.Wrap(errGo, "invalid ldflags value template").With("symbol", symbol).With("stack", stack.Trace().TrimRuntime())
+		}
+		rendered := &bytes.Buffer{}
+		if errGo = tmpl.Execute(rendered, values); errGo != nil {
+			return "", kv.Wrap(errGo, "invalid ldflags value template").With("symbol", symbol).With("stack", stack.Trace().TrimRuntime())
+		}
+		assignments[symbol] = rendered.String()
+	}
+
+	flags := make([]string, 0, len(assignments))
+	for _, symbol := range symbols.names() {
+		value := assignments[symbol]
+		flag := "-X " + symbol + "=" + value
+		// Values with white space need quoting to survive the splitting done by the go tool.
+		// A quoted field runs to the next matching quote and the go tool has no escapes, so
+		// a value with white space can contain one kind of quote but not both.
+		if strings.ContainsAny(value, " \t\n\r") {
+			quote := "'"
+			if strings.Contains(value, quote) {
+				quote = "\""
+			}
+			if strings.Contains(value, quote) {
+				return "", kv.NewError("ldflags values containing white space cannot contain both single and double quotes").With("symbol", symbol).With("stack", stack.Trace().TrimRuntime())
+			}
+			flag = "-X " + quote + symbol + "=" + value + quote
+		}
+		flags = append(flags, flag)
+	}
+	return strings.Join(flags, " "), nil
+}
+
+// MissingSymbols type checks the packages referenced by the fully qualified symbols and returns
+// those symbols that are not package level string variables, and so cannot be set using -X.
+// Packages within the module are located using moduleDir, other packages are located using
+// the go tool.
+//
+func MissingSymbols(moduleDir string, modulePath string, symbols []string) (missing []string, err kv.Error) {
+	missing = []string{}
+	scopes := map[string]*types.Scope{}
+
+	for _, symbol := range symbols {
+		dot := strings.LastIndex(symbol, ".")
+		if dot <= strings.LastIndex(symbol, "/") || dot == len(symbol)-1 {
+			return missing, kv.NewError("symbols must have the form package/path.Name").With("symbol", symbol).With("stack", stack.Trace().TrimRuntime())
+		}
+		pkgPath, name := symbol[:dot], symbol[dot+1:]
+
+		scope, isPresent := scopes[pkgPath]
+		if !isPresent {
+			if scope, err = packageScope(moduleDir, modulePath, pkgPath); err != nil {
+				return missing, err
+			}
+			scopes[pkgPath] = scope
+		}
+
+		if scope == nil {
+			missing = append(missing, symbol)
+			continue
+		}
+		v, isVar := scope.Lookup(name).(*types.Var)
+		if !isVar || !types.Identical(v.Type(), types.Typ[types.String]) {
+			missing = append(missing, symbol)
+		}
+	}
+	return missing, nil
+}
+
+// packageScope type checks a package returning its package level scope, a nil scope is returned
+// when the package cannot be found.  Type errors are tolerated as only the declarations
+// of the package are of interest.
+//
+func packageScope(moduleDir string, modulePath string, pkgPath string) (scope *types.Scope, err kv.Error) {
+	dir := ""
+	switch {
+	case pkgPath == modulePath:
+		dir = moduleDir
+	case strings.HasPrefix(pkgPath, modulePath+"/"):
+		dir = filepath.Join(moduleDir, filepath.FromSlash(strings.TrimPrefix(pkgPath, modulePath+"/")))
+	default:
+		out := &strings.Builder{}
+		cmd := &Command{
+			Args:   []string{goBinary, "list", "-find", "-f", "{{.Dir}}", pkgPath},
+			Dir:    moduleDir,
+			Stdout: out,
+		}
+		if err = RunCommand(nil, cmd); err != nil {
+			return nil, nil
+		}
+		dir = strings.TrimSpace(out.String())
+	}
+
+	if info, errGo := os.Stat(dir); errGo != nil || !info.IsDir() {
+		return nil, nil
+	}
+
+	bp, errGo := build.Default.ImportDir(dir, 0)
+	if errGo != nil {
+		if _, isNoGo := errGo.(*build.NoGoError); isNoGo || os.IsNotExist(errGo) {
+			return nil, nil
+		}
+		return nil, kv.Wrap(errGo).With("package", pkgPath, "dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0, len(bp.GoFiles))
+	for _, fn := range bp.GoFiles {
+		file, errGo := parser.ParseFile(fset, filepath.Join(dir, fn), nil, 0)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("package", pkgPath, "file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		files = append(files, file)
+	}
+
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	pkg, _ := conf.Check(pkgPath, fset, files, nil)
+	if pkg == nil {
+		return nil, kv.NewError(fmt.Sprintf("unable to type check %s", pkgPath)).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return pkg.Scope(), nil
+}
@@ -0,0 +1,119 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// writeTree creates the files, named using slash separated paths relative to dir, along with
+// any directories they need
+//
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for fn, content := range files {
+		fn = filepath.Join(dir, filepath.FromSlash(fn))
+		if errGo := os.MkdirAll(filepath.Dir(fn), 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo := ioutil.WriteFile(fn, []byte(content), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+}
+
+// TestVersionLDFlags checks that version symbols are located using the module path from go.mod
+// and that symbols which cannot be set by the linker are detected
+//
+func TestVersionLDFlags(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "ldflags")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":             "module example.com/project\n\ngo 1.18\n",
+		"version/version.go": "package version\n\nvar (\n\tVersion = \"unknown\"\n\tGitHash string\n\tBuild   int\n)\n\nconst Constant = \"\"\n",
+	})
+
+	ver, errGo := semver.NewVersion("1.2.3-pre")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	md := &MetaData{SemVer: ver, Git: &GitInfo{Hash: "abc", Branch: "main"}}
+
+	// The default symbols that are absent, BuildTime, are skipped
+	flags, err := md.VersionLDFlags(filepath.Join(dir, "version"), nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-X example.com/project/version.GitHash=abc -X example.com/project/version.Version=1.2.3-pre"
+	if flags != expected {
+		t.Fatal("unexpected flags", flags, "expected", expected)
+	}
+
+	symbols := &VersionSymbols{
+		Values: map[string]string{"example.com/project/version.Version": "{{.SemVer}} on {{.Branch}}"},
+	}
+	if flags, err = md.VersionLDFlags(dir, symbols, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expected = "-X 'example.com/project/version.Version=1.2.3-pre on main'"
+	if flags != expected {
+		t.Fatal("unexpected flags", flags, "expected", expected)
+	}
+
+	// Values with white space may contain one kind of quote but not both
+	symbols.Values["example.com/project/version.Version"] = "it's {{.Branch}}"
+	if flags, err = md.VersionLDFlags(dir, symbols, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expected = "-X \"example.com/project/version.Version=it's main\""
+	if flags != expected {
+		t.Fatal("unexpected flags", flags, "expected", expected)
+	}
+	symbols.Values["example.com/project/version.Version"] = "it's \"{{.Branch}}\""
+	if _, err = md.VersionLDFlags(dir, symbols, time.Now()); err == nil {
+		t.Fatal("a value that cannot be quoted was accepted")
+	}
+
+	// Explicit symbols must be package level string variables
+	for _, symbol := range []string{"example.com/project/version.Build", "example.com/project/version.Constant", "example.com/project/version.Absent"} {
+		if _, err = md.VersionLDFlags(dir, &VersionSymbols{GitHash: symbol}, time.Now()); err == nil {
+			t.Fatal("an invalid symbol was accepted", symbol)
+		}
+	}
+}
+
+// TestDuatVersionLDFlags checks that modules requiring duat have the duat version package
+// stamped along with their own
+//
+func TestDuatVersionLDFlags(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "ldflags")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":                  "module example.com/project\n\ngo 1.18\n\nrequire github.com/karlmutch/duat v0.0.0\n\nreplace github.com/karlmutch/duat => ./duat\n",
+		"main.go":                 "package main\n\nimport _ \"github.com/karlmutch/duat/version\"\n\nfunc main() {}\n",
+		"duat/go.mod":             "module github.com/karlmutch/duat\n\ngo 1.18\n",
+		"duat/version/version.go": "package version\n\nvar (\n\tBuildTime = \"unknown\"\n\tGitHash   = \"unknown\"\n\tVersion   = \"unknown\"\n)\n",
+	})
+
+	md := &MetaData{Git: &GitInfo{Hash: "abc"}}
+	flags, err := md.VersionLDFlags(dir, nil, time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-X github.com/karlmutch/duat/version.BuildTime=2022-01-02_03:04:05+0000 " +
+		"-X github.com/karlmutch/duat/version.GitHash=abc -X github.com/karlmutch/duat/version.Version="
+	if flags != expected {
+		t.Fatal("unexpected flags", flags, "expected", expected)
+	}
+}
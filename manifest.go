@@ -0,0 +1,208 @@
+package duat
+
+// This file contains the implementation of reproducible build support, including the
+// build manifests written beside artifacts so that builds can be independently verified
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+var (
+	// manifestGoEnv are the go env values, recorded in manifests, that influence the output
+	// of the compiler
+	manifestGoEnv = []string{"GOVERSION", "GOOS", "GOARCH", "GOARM", "GOAMD64", "GO386", "GOEXPERIMENT", "GOFLAGS", "CGO_ENABLED"}
+)
+
+// BuildManifest records the inputs and output of building a single artifact so that the
+// artifact can be rebuilt and compared
+//
+type BuildManifest struct {
+	Artifact        string            `json:"artifact"`             // The file name of the artifact
+	SHA256          string            `json:"sha256"`               // The hex encoded digest of the artifact
+	Size            int64             `json:"size"`                 // The size of the artifact in bytes
+	Module          string            `json:"module"`               // The go module path
+	Version         string            `json:"version"`              // The semantic version of the module
+	GitHash         string            `json:"git_hash"`             // The commit that was built
+	Target          string            `json:"target"`               // The os/arch the artifact was built for
+	SourceDate      time.Time         `json:"source_date"`          // The timestamp used for the build
+	GoVersion       string            `json:"go_version"`           // The version of the go toolchain
+	GoEnv           map[string]string `json:"go_env"`               // The go env values that influence the compiler
+	Tags            []string          `json:"tags"`                 // The build tags
+	BuildFlags      []string          `json:"build_flags"`          // The arguments given to go build, excluding the machine specific output path
+	LDFlags         string            `json:"ldflags"`              // The linker flags
+	ModuleGraphHash string            `json:"module_graph_sha256"`  // The hex encoded digest of the go mod graph output
+	PublicKey       string            `json:"public_key,omitempty"` // The base64 encoded ed25519 key that verifies the signature
+	Signature       string            `json:"signature,omitempty"`  // The base64 encoded ed25519 signature of the manifest without a signature
+}
+
+// SourceDate returns the timestamp used for reproducible builds, the SOURCE_DATE_EPOCH
+// environment variable is used when present, otherwise the commit time of HEAD is used
+//
+func (md *MetaData) SourceDate() (date time.Time, err kv.Error) {
+	if epoch, isPresent := os.LookupEnv("SOURCE_DATE_EPOCH"); isPresent {
+		secs, errGo := strconv.ParseInt(strings.TrimSpace(epoch), 10, 64)
+		if errGo != nil {
+			return date, kv.Wrap(errGo, "SOURCE_DATE_EPOCH is not a count of seconds").With("value", epoch).With("stack", stack.Trace().TrimRuntime())
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+
+	if md.Git == nil || md.Git.Repo == nil {
+		return date, kv.NewError("a git repository or SOURCE_DATE_EPOCH is needed for reproducible builds").With("stack", stack.Trace().TrimRuntime())
+	}
+	head, errGo := md.Git.Repo.Head()
+	if errGo != nil {
+		return date, kv.Wrap(errGo, "unable to locate HEAD").With("stack", stack.Trace().TrimRuntime())
+	}
+	commit, errGo := md.Git.Repo.CommitObject(head.Hash())
+	if errGo != nil {
+		return date, kv.Wrap(errGo, "unable to load the HEAD commit").With("hash", head.Hash().String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return commit.Committer.When.UTC(), nil
+}
+
+// LoadSigningKey reads a PKCS #8 PEM encoded ed25519 private key used to sign manifests
+//
+func LoadSigningKey(fn string) (key ed25519.PrivateKey, err kv.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, kv.NewError("no PEM data found").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	parsed, errGo := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	key, isEd25519 := parsed.(ed25519.PrivateKey)
+	if !isEd25519 {
+		return nil, kv.NewError("the key is not an ed25519 private key").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return key, nil
+}
+
+// signedContent returns the bytes covered by the signature of the manifest
+//
+func (manifest *BuildManifest) signedContent() (content []byte, err kv.Error) {
+	unsigned := *manifest
+	unsigned.Signature = ""
+	content, errGo := json.Marshal(&unsigned)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return content, nil
+}
+
+// Sign adds the public key and an ed25519 signature to the manifest
+//
+func (manifest *BuildManifest) Sign(key ed25519.PrivateKey) (err kv.Error) {
+	manifest.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	content, err := manifest.signedContent()
+	if err != nil {
+		return err
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, content))
+	return nil
+}
+
+// Verify checks the signature of the manifest against the public key it contains, callers
+// should also check that the public key is one that they trust
+//
+func (manifest *BuildManifest) Verify() (err kv.Error) {
+	if len(manifest.Signature) == 0 {
+		return kv.NewError("the manifest is not signed").With("artifact", manifest.Artifact).With("stack", stack.Trace().TrimRuntime())
+	}
+	pub, errGo := base64.StdEncoding.DecodeString(manifest.PublicKey)
+	if errGo != nil || len(pub) != ed25519.PublicKeySize {
+		return kv.NewError("the manifest public key is invalid").With("artifact", manifest.Artifact).With("stack", stack.Trace().TrimRuntime())
+	}
+	sig, errGo := base64.StdEncoding.DecodeString(manifest.Signature)
+	if errGo != nil {
+		return kv.Wrap(errGo, "the manifest signature is invalid").With("artifact", manifest.Artifact).With("stack", stack.Trace().TrimRuntime())
+	}
+	content, err := manifest.signedContent()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), content, sig) {
+		return kv.NewError("the manifest signature does not match").With("artifact", manifest.Artifact).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Write saves the manifest as indented JSON
+//
+func (manifest *BuildManifest) Write(fn string) (err kv.Error) {
+	data, errGo := json.MarshalIndent(manifest, "", "  ")
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = ioutil.WriteFile(fn, append(data, '\n'), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded sha256 digest of a file
+//
+func fileSHA256(fn string) (digest string, err kv.Error) {
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, errGo = io.Copy(hash, f); errGo != nil {
+		return "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// moduleGraphHash returns the hex encoded sha256 digest of the go mod graph output
+//
+func moduleGraphHash(run GoRunOptions, env []string) (digest string, err kv.Error) {
+	hash := sha256.New()
+	run.Stdout = hash
+	if err = RunCommand(run.Ctx, run.goCommand(env, "mod", "graph")); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// manifestEnv returns the go env values that are recorded in manifests
+//
+func manifestEnv(run GoRunOptions, env []string) (values map[string]string, err kv.Error) {
+	out := &strings.Builder{}
+	run.Stdout = out
+	if err = RunCommand(run.Ctx, run.goCommand(env, append([]string{"env", "-json"}, manifestGoEnv...)...)); err != nil {
+		return nil, err
+	}
+	values = map[string]string{}
+	if errGo := json.Unmarshal([]byte(out.String()), &values); errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to parse the go env output").With("stack", stack.Trace().TrimRuntime())
+	}
+	for k, v := range values {
+		if len(v) == 0 {
+			delete(values, k)
+		}
+	}
+	return values, nil
+}
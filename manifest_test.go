@@ -0,0 +1,126 @@
+package duat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// TestManifestSigning checks that signed manifests verify and that changes to them are detected
+//
+func TestManifestSigning(t *testing.T) {
+	_, key, errGo := ed25519.GenerateKey(rand.Reader)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	der, errGo := x509.MarshalPKCS8PrivateKey(key)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	dir, errGo := ioutil.TempDir("", "manifest")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	if errGo = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	loaded, err := LoadSigningKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &BuildManifest{Artifact: "test", SHA256: "00", SourceDate: time.Unix(1, 0).UTC()}
+	if err = manifest.Sign(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err = manifest.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	manifest.SHA256 = "01"
+	if err = manifest.Verify(); err == nil {
+		t.Fatal("a modified manifest was verified")
+	}
+}
+
+// TestReproducibleBuild checks that two builds of the same source produce identical binaries
+//
+func TestReproducibleBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping builds in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "reproducible")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":             "module example.com/project\n\ngo 1.18\n",
+		"main.go":            "package main\n\nimport \"example.com/project/version\"\n\nfunc main() { println(version.BuildTime) }\n",
+		"version/version.go": "package version\n\nvar BuildTime = \"unknown\"\n",
+	})
+
+	cwd, errGo := os.Getwd()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = os.Chdir(dir); errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Chdir(cwd)
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	ver, _ := semver.NewVersion("1.0.0")
+	md := &MetaData{Module: "project", SemVer: ver}
+
+	digests := []string{}
+	flags := []string{}
+	for _, outputDir := range []string{"first", "second"} {
+		results, err := md.GoBuildWithOptions(GoBuildOptions{
+			GoRunOptions: GoRunOptions{Stdout: ioutil.Discard, Stderr: ioutil.Discard},
+			OutputDir:    outputDir,
+			Reproducible: true,
+		})
+		if err != nil {
+			t.Fatal(err, results[0].Output)
+		}
+
+		manifest := &BuildManifest{}
+		data, errGo := ioutil.ReadFile(results[0].Manifest)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo = json.Unmarshal(data, manifest); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !manifest.SourceDate.Equal(time.Unix(1600000000, 0)) || len(manifest.GoVersion) == 0 {
+			t.Fatal("unexpected manifest", string(data))
+		}
+		digests = append(digests, manifest.SHA256)
+		flags = append(flags, strings.Join(manifest.BuildFlags, " "))
+	}
+	if digests[0] != digests[1] {
+		t.Fatal("binaries differ between builds", digests)
+	}
+	// Manifests are compared across machines so they cannot contain the output path
+	if flags[0] != flags[1] {
+		t.Fatal("build flags differ between builds", flags)
+	}
+}
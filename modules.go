@@ -0,0 +1,504 @@
+package duat
+
+// This file contains the implementation of discovery for the go modules and main packages
+// within a repository, including those tied together using a go.work file, and of running
+// builds and tests for each module in dependency order
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// GoModule describes a go module found within a repository
+//
+type GoModule struct {
+	Path     string   // The module path from the go.mod file
+	Dir      string   // The absolute directory containing the go.mod file
+	Requires []string // The module paths of the direct requirements
+	Mains    []string // The absolute directories of the main packages within the module
+	DependOn []string // The paths of the other discovered modules that this module depends upon
+
+	replaces map[string]string // Module paths replaced by local directories, from go.mod and go.work
+}
+
+// GoWorkspace contains the modules found beneath a root directory
+//
+type GoWorkspace struct {
+	Root    string      // The absolute root directory
+	WorkDir string      // The directory holding the go.work file, empty if there was none
+	Modules []*GoModule // The modules in dependency order, dependencies come first
+}
+
+// skipDir returns true for directories that the go tooling ignores when matching packages
+//
+func skipDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// fileSafeModule returns a module path in a form that can be used within file names
+//
+func fileSafeModule(modulePath string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(modulePath)
+}
+
+// moduleFileName adds the module path to a file name, before the extension, so that each
+// module of a workspace has its own copy of a report
+//
+func moduleFileName(fn string, modulePath string) string {
+	ext := filepath.Ext(fn)
+	return strings.TrimSuffix(fn, ext) + "-" + fileSafeModule(modulePath) + ext
+}
+
+// loadGoModule reads the go.mod file within a directory
+//
+func loadGoModule(dir string) (module *GoModule, err kv.Error) {
+	fn := filepath.Join(dir, "go.mod")
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	mod, errGo := modfile.ParseLax(fn, data, nil)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if mod.Module == nil {
+		return nil, kv.NewError("go.mod has no module declaration").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	module = &GoModule{
+		Path:     mod.Module.Mod.Path,
+		Dir:      dir,
+		Requires: []string{},
+		Mains:    []string{},
+		DependOn: []string{},
+		replaces: map[string]string{},
+	}
+	for _, req := range mod.Require {
+		module.Requires = append(module.Requires, req.Mod.Path)
+	}
+	for _, rep := range mod.Replace {
+		if modfile.IsDirectoryPath(rep.New.Path) {
+			module.replaces[rep.Old.Path] = filepath.Join(dir, filepath.FromSlash(rep.New.Path))
+		}
+	}
+	return module, nil
+}
+
+// findGoModDirs walks the directory tree beneath root returning the directories that contain
+// go.mod files
+//
+func findGoModDirs(root string) (dirs []string, err kv.Error) {
+	dirs = []string{}
+	errGo := filepath.Walk(root, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		if info.IsDir() {
+			if path != root && skipDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == "go.mod" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", root).With("stack", stack.Trace().TrimRuntime())
+	}
+	return dirs, nil
+}
+
+// FindGoMains returns the directories of the main packages within a module, nested modules
+// and directories ignored by the go tooling are not searched.  Files are selected using the
+// target of the environment without any build tags.
+//
+func FindGoMains(moduleDir string) (mains []string, err kv.Error) {
+	return FindGoMainsWithFilter(moduleDir, GoSourceFilter{})
+}
+
+// FindGoMainsWithFilter returns the directories of the main packages within a module using
+// a GoPackageIndex of the source files selected by the filter, so that tooling files such
+// as those with a //go:build ignore constraint do not make a library appear to be a main
+// package
+//
+func FindGoMainsWithFilter(moduleDir string, filter GoSourceFilter) (mains []string, err kv.Error) {
+	index, err := IndexGoPackages(GoIndexOptions{GoRunOptions: GoRunOptions{Dir: moduleDir}, Filter: filter, Names: true})
+	if err != nil {
+		return nil, err
+	}
+	mains = []string{}
+	for _, pkg := range index.Mains() {
+		if len(pkg.Dir) != 0 {
+			mains = append(mains, pkg.Dir)
+		}
+	}
+	sort.Strings(mains)
+	return mains, nil
+}
+
+// FindGoModules discovers the go modules beneath root.  When root contains a go.work file the
+// modules it uses are returned, otherwise all modules within the directory tree are returned.
+// Modules are ordered so that those required by other modules come first, dependencies are
+// determined using the module requirements and any local replace directives from the go.mod
+// and go.work files.
+//
+func FindGoModules(root string) (ws *GoWorkspace, err kv.Error) {
+	root, errGo := filepath.Abs(root)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", root).With("stack", stack.Trace().TrimRuntime())
+	}
+	ws = &GoWorkspace{Root: root, Modules: []*GoModule{}}
+
+	dirs := []string{}
+	workReplaces := map[string]string{}
+
+	workFn := filepath.Join(root, "go.work")
+	if data, errGo := ioutil.ReadFile(workFn); errGo == nil {
+		work, errGo := modfile.ParseWork(workFn, data, nil)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", workFn).With("stack", stack.Trace().TrimRuntime())
+		}
+		ws.WorkDir = root
+		for _, use := range work.Use {
+			dirs = append(dirs, filepath.Join(root, filepath.FromSlash(use.Path)))
+		}
+		for _, rep := range work.Replace {
+			if modfile.IsDirectoryPath(rep.New.Path) {
+				workReplaces[rep.Old.Path] = filepath.Join(root, filepath.FromSlash(rep.New.Path))
+			}
+		}
+	} else {
+		if dirs, err = findGoModDirs(root); err != nil {
+			return nil, err
+		}
+	}
+
+	byDir := map[string]*GoModule{}
+	modules := map[string]*GoModule{}
+	for _, dir := range dirs {
+		module, err := loadGoModule(filepath.Clean(dir))
+		if err != nil {
+			return nil, err
+		}
+		// Replacements in the go.work file take precedence over those in go.mod files
+		for old, dir := range workReplaces {
+			module.replaces[old] = dir
+		}
+		if module.Mains, err = FindGoMains(module.Dir); err != nil {
+			return nil, err
+		}
+		byDir[module.Dir] = module
+		modules[module.Path] = module
+	}
+
+	for _, module := range modules {
+		deps := map[string]bool{}
+		for _, req := range module.Requires {
+			// A replacement pointing at a discovered module satisfies the requirement
+			if dir, isPresent := module.replaces[req]; isPresent {
+				if dep, isPresent := byDir[filepath.Clean(dir)]; isPresent && dep != module {
+					deps[dep.Path] = true
+				}
+				continue
+			}
+			if dep, isPresent := modules[req]; isPresent && dep != module {
+				deps[dep.Path] = true
+			}
+		}
+		for dep := range deps {
+			module.DependOn = append(module.DependOn, dep)
+		}
+		sort.Strings(module.DependOn)
+	}
+
+	if ws.Modules, err = sortGoModules(modules); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// sortGoModules orders modules so that each follows the modules it depends upon, modules
+// with no ordering between them are sorted by their path
+//
+func sortGoModules(modules map[string]*GoModule) (sorted []*GoModule, err kv.Error) {
+	sorted = make([]*GoModule, 0, len(modules))
+
+	pending := make([]string, 0, len(modules))
+	for modPath := range modules {
+		pending = append(pending, modPath)
+	}
+	sort.Strings(pending)
+
+	done := map[string]bool{}
+	for len(pending) != 0 {
+		remaining := []string{}
+		for _, modPath := range pending {
+			ready := true
+			for _, dep := range modules[modPath].DependOn {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				remaining = append(remaining, modPath)
+				continue
+			}
+			sorted = append(sorted, modules[modPath])
+			done[modPath] = true
+		}
+		if len(remaining) == len(pending) {
+			return nil, kv.NewError("the modules have a dependency cycle").With("modules", strings.Join(remaining, ",")).With("stack", stack.Trace().TrimRuntime())
+		}
+		pending = remaining
+	}
+	return sorted, nil
+}
+
+// GoModuleResult contains the outcome of building, or testing, a single module
+//
+type GoModuleResult struct {
+	Module    *GoModule
+	Builds    []*GoBuildResult    // The binaries built for the main packages of the module
+	Tests     *TestReport         // The test results, when testing
+	Generated []*GoGenerateResult // The go generate directives of the module, when generating
+	Duration  time.Duration
+	Skipped   bool // True when a module that this module depends on failed
+	Err       kv.Error
+}
+
+// GoModulesOptions contains the parameters for building, testing, or generating all of the
+// modules within a workspace
+//
+type GoModulesOptions struct {
+	Build          GoBuildOptions          // The options used for building main packages, the Dir and Name are set for each package
+	Test           GoTestOptions           // The options used for testing modules, the Dir and Packages are set for each module
+	Generate       GoGenerateModuleOptions // The options used for running go generate, the Dir is set for each module
+	RunTests       bool                    // Test each module rather than building its main packages
+	RunGenerate    bool                    // Run the go generate directives of each module rather than building its main packages
+	StopOnFailure  bool                    // Stop at the first module that fails, modules that depend on a failed module are always skipped
+	IncludeModules []string                // When present only the modules with these paths are processed
+}
+
+// GoModules builds the main packages, runs the tests, or runs go generate, for every module
+// within the workspace in dependency order.  Main packages are built into binaries named
+// after their directory, see goMainNames.  When testing with coverage, and CollectOnly is not set, the
+// profiles of all modules are checked using CheckCoverage once every module has passed.
+// When a go.work file is in use go mod tidy is not run as it does not honour the workspace.
+//
+func (md *MetaData) GoModules(ws *GoWorkspace, opts GoModulesOptions) (results []*GoModuleResult, err kv.Error) {
+	results = make([]*GoModuleResult, 0, len(ws.Modules))
+
+	include := map[string]bool{}
+	for _, modPath := range opts.IncludeModules {
+		include[modPath] = true
+	}
+
+	// Binaries from every module share the output directory so their names are chosen up front
+	names := map[string]string{}
+	if !opts.RunTests && !opts.RunGenerate {
+		if names, err = goMainNames(ws, include); err != nil {
+			return results, err
+		}
+	}
+
+	// Coverage is checked using the profiles collected by this run alone
+	if opts.RunTests && opts.Test.Coverage != nil && !opts.Test.Coverage.CollectOnly {
+		opts.Test.Coverage.Profiles = nil
+	}
+
+	failed := map[string]bool{}
+	for _, module := range ws.Modules {
+		if len(include) != 0 && !include[module.Path] {
+			continue
+		}
+
+		result := &GoModuleResult{Module: module}
+		results = append(results, result)
+
+		for _, dep := range module.DependOn {
+			if failed[dep] {
+				result.Skipped = true
+				result.Err = kv.NewError("a module dependency failed").With("module", module.Path, "dependency", dep).With("stack", stack.Trace().TrimRuntime())
+				break
+			}
+		}
+		if !result.Skipped {
+			startTime := time.Now()
+			switch {
+			case opts.RunGenerate:
+				result.Generated, result.Err = md.goModuleGenerate(ws, module, opts.Generate)
+			case opts.RunTests:
+				result.Tests, result.Err = md.goModuleTest(ws, module, opts.Test)
+			default:
+				result.Builds, result.Err = md.goModuleBuild(ws, module, names, opts.Build)
+			}
+			result.Duration = time.Since(startTime)
+		}
+
+		if result.Err != nil {
+			failed[module.Path] = true
+			if opts.StopOnFailure {
+				break
+			}
+		}
+	}
+
+	if len(failed) != 0 {
+		names := make([]string, 0, len(failed))
+		for modPath := range failed {
+			names = append(names, modPath)
+		}
+		sort.Strings(names)
+		return results, kv.NewError("one or more modules failed").With("modules", strings.Join(names, ",")).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// The profiles collected from the modules are merged and checked as a whole
+	if opts.RunTests && opts.Test.Coverage != nil && !opts.Test.Coverage.CollectOnly {
+		if _, err = md.CheckCoverage(opts.Test.Coverage); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// moduleBaseName returns the last element of a module path ignoring any major version
+// suffix, for example example.com/app/v2 results in app
+//
+func moduleBaseName(modulePath string) (name string) {
+	if prefix, _, isOK := module.SplitPathVersion(modulePath); isOK && len(prefix) != 0 {
+		modulePath = prefix
+	}
+	return path.Base(modulePath)
+}
+
+// goMainNames returns the binary names of the main packages of the included modules keyed
+// by their directories.  Main packages are named after their directory, or the module for
+// a main at the root of a module.  Names used by more than one main package are qualified
+// using the module name, for example app-server, and names that still collide are an error.
+//
+func goMainNames(ws *GoWorkspace, include map[string]bool) (names map[string]string, err kv.Error) {
+	names = map[string]string{}
+	users := map[string][]string{}
+	for _, module := range ws.Modules {
+		if len(include) != 0 && !include[module.Path] {
+			continue
+		}
+		for _, dir := range module.Mains {
+			name := moduleBaseName(module.Path)
+			if dir != module.Dir {
+				name = filepath.Base(dir)
+			}
+			names[dir] = name
+			users[name] = append(users[name], dir)
+		}
+	}
+
+	qualified := map[string][]string{}
+	for _, module := range ws.Modules {
+		for _, dir := range module.Mains {
+			name, isPresent := names[dir]
+			if !isPresent {
+				continue
+			}
+			if len(users[name]) > 1 && dir != module.Dir {
+				name = moduleBaseName(module.Path) + "-" + name
+				names[dir] = name
+			}
+			qualified[name] = append(qualified[name], dir)
+		}
+	}
+
+	for name, dirs := range qualified {
+		if len(dirs) > 1 {
+			sort.Strings(dirs)
+			return nil, kv.NewError("main packages produce binaries with the same name").With("name", name, "dirs", strings.Join(dirs, ",")).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return names, nil
+}
+
+func (md *MetaData) goModuleBuild(ws *GoWorkspace, module *GoModule, names map[string]string, opts GoBuildOptions) (builds []*GoBuildResult, err kv.Error) {
+	builds = []*GoBuildResult{}
+	if len(module.Mains) == 0 {
+		return builds, nil
+	}
+
+	// The version and module dependencies are shared by all of the main packages of the
+	// module so are only bumped, and tidied, once
+	if opts.VersionBump && md.SemVer != nil && len(md.SemVer.Prerelease()) != 0 {
+		if _, err = md.BumpPrerelease(); err != nil {
+			return builds, err.With("module", module.Path)
+		}
+	}
+	run := opts.GoRunOptions.defaults()
+	run.Dir = module.Dir
+	run.SkipTidy = run.SkipTidy || len(ws.WorkDir) != 0
+	if err = run.goModTidy(goBuildEnv(opts.Env)); err != nil {
+		return builds, err.With("module", module.Path)
+	}
+
+	for _, dir := range module.Mains {
+		pkgOpts := opts
+		pkgOpts.Dir = dir
+		pkgOpts.Name = names[dir]
+		pkgOpts.SkipTidy = true
+		pkgOpts.VersionBump = false
+
+		results, err := md.GoBuildWithOptions(pkgOpts)
+		builds = append(builds, results...)
+		if err != nil {
+			return builds, err.With("module", module.Path, "dir", dir)
+		}
+	}
+	return builds, nil
+}
+
+func (md *MetaData) goModuleTest(ws *GoWorkspace, module *GoModule, opts GoTestOptions) (report *TestReport, err kv.Error) {
+	opts.Dir = module.Dir
+	opts.Packages = []string{"./..."}
+	opts.SkipTidy = opts.SkipTidy || len(ws.WorkDir) != 0
+	if len(opts.JUnitFile) != 0 {
+		opts.JUnitFile = moduleFileName(opts.JUnitFile, module.Path)
+	}
+	if len(opts.SummaryFile) != 0 {
+		opts.SummaryFile = moduleFileName(opts.SummaryFile, module.Path)
+	}
+
+	// Profiles from each module are only merged and checked once all modules are done
+	if opts.Coverage != nil {
+		shared := opts.Coverage
+		coverage := *shared
+		coverage.CollectOnly = true
+		opts.Coverage = &coverage
+		defer func() { shared.Profiles = coverage.Profiles }()
+	}
+
+	if report, err = md.GoTestReport(opts); err != nil {
+		return report, err.With("module", module.Path)
+	}
+	return report, nil
+}
+
+func (md *MetaData) goModuleGenerate(ws *GoWorkspace, module *GoModule, opts GoGenerateModuleOptions) (generated []*GoGenerateResult, err kv.Error) {
+	opts.Dir = module.Dir
+	opts.SkipTidy = opts.SkipTidy || len(ws.WorkDir) != 0
+
+	if generated, err = md.GoGenerateModule(opts); err != nil {
+		return generated, err.With("module", module.Path)
+	}
+	return generated, nil
+}
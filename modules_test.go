@@ -0,0 +1,169 @@
+package duat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// TestFindGoModules checks that workspace modules are discovered and placed in dependency
+// order using the requirements and replacements of the go.mod and go.work files
+//
+func TestFindGoModules(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "modules")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.work":                 "go 1.18\n\nuse (\n\t./app\n\t./lib\n\t./util\n)\n\nreplace example.com/helpers => ./util\n",
+		"app/go.mod":              "module example.com/app\n\ngo 1.18\n\nrequire example.com/lib v0.0.0\n",
+		"app/main.go":             "package main\n\nfunc main() {}\n",
+		"app/cmd/tool/main.go":    "package main\n\nfunc main() {}\n",
+		"app/internal/x/gen.go":   "//go:build ignore\n\npackage main\n",
+		"app/internal/x/x.go":     "package x\n",
+		"app/testdata/t/main.go":  "package main\n",
+		"lib/go.mod":              "module example.com/lib\n\ngo 1.18\n\nrequire example.com/helpers v1.0.0\n",
+		"lib/lib.go":              "package lib\n",
+		"util/go.mod":             "module example.com/util\n\ngo 1.18\n",
+		"util/util.go":            "package util\n",
+		"unused/go.mod":           "module example.com/unused\n\ngo 1.18\n",
+		"unused/unused_helper.go": "package main\n",
+	})
+
+	// Main packages are found using the go tool which rejects -mod=mod in workspace mode
+	goFlags, isSet := os.LookupEnv("GOFLAGS")
+	os.Setenv("GOFLAGS", "")
+	if isSet {
+		defer os.Setenv("GOFLAGS", goFlags)
+	} else {
+		defer os.Unsetenv("GOFLAGS")
+	}
+
+	ws, err := FindGoModules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := []string{}
+	for _, module := range ws.Modules {
+		order = append(order, module.Path)
+	}
+	if diff := deep.Equal(order, []string{"example.com/util", "example.com/lib", "example.com/app"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	app := ws.Modules[2]
+	mains := []string{}
+	for _, main := range app.Mains {
+		rel, _ := filepath.Rel(app.Dir, main)
+		mains = append(mains, filepath.ToSlash(rel))
+	}
+	if diff := deep.Equal(mains, []string{".", "cmd/tool"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Without the workspace every module is found and a cycle is reported
+	os.Remove(filepath.Join(dir, "go.work"))
+	writeTree(t, dir, map[string]string{
+		"util/go.mod": "module example.com/util\n\ngo 1.18\n\nrequire example.com/app v0.0.0\n",
+		"lib/go.mod":  "module example.com/lib\n\ngo 1.18\n\nrequire example.com/util v1.0.0\n",
+	})
+	if _, err = FindGoModules(dir); err == nil {
+		t.Fatal("a dependency cycle was not detected")
+	}
+}
+
+// TestGoModulesCoverage checks that the coverage of a workspace test run is gated once all
+// of the modules have been tested
+//
+func TestGoModulesCoverage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping tests of modules in short mode")
+	}
+
+	dir, errGo := ioutil.TempDir("", "modules-coverage")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"lib/go.mod":      "module example.com/lib\n\ngo 1.18\n",
+		"lib/lib.go":      "package lib\n\nfunc Covered() int {\n\treturn 1\n}\n\nfunc Uncovered() int {\n\treturn 2\n}\n",
+		"lib/lib_test.go": "package lib\n\nimport \"testing\"\n\nfunc TestCovered(t *testing.T) {\n\tCovered()\n}\n",
+	})
+
+	ws, err := FindGoModules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := &MetaData{}
+	coverage := &CoverageOptions{Dir: filepath.Join(dir, "coverage"), Threshold: 90}
+	opts := GoModulesOptions{
+		Test:     GoTestOptions{GoRunOptions: GoRunOptions{Stdout: ioutil.Discard}, Coverage: coverage},
+		RunTests: true,
+	}
+	if _, err = md.GoModules(ws, opts); err == nil {
+		t.Fatal("coverage below the threshold was not detected")
+	}
+
+	// Profiles left by other runs are not merged with those of the run
+	writeTree(t, coverage.Dir, map[string]string{
+		"profile-stale.out": "mode: set\nexample.com/stale/stale.go:1.1,9.2 20 0\n",
+	})
+	coverage.Threshold = 40
+	if _, err = md.GoModules(ws, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(coverage.Profiles) != 1 {
+		t.Fatal("unexpected profiles", coverage.Profiles)
+	}
+	if _, errGo = os.Stat(filepath.Join(coverage.Dir, "coverage.out")); errGo != nil {
+		t.Fatal(errGo)
+	}
+}
+
+// TestGoMainNames checks that binaries sharing the output directory are given distinct names
+//
+func TestGoMainNames(t *testing.T) {
+	ws := &GoWorkspace{
+		Modules: []*GoModule{
+			{Path: "example.com/app/v2", Dir: "/ws/app", Mains: []string{"/ws/app", "/ws/app/cmd/server"}},
+			{Path: "example.com/api", Dir: "/ws/api", Mains: []string{"/ws/api/cmd/server", "/ws/api/cmd/app"}},
+		},
+	}
+	names, err := goMainNames(ws, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/ws/app":            "app",
+		"/ws/app/cmd/server": "app-server",
+		"/ws/api/cmd/server": "api-server",
+		"/ws/api/cmd/app":    "api-app",
+	}
+	if diff := deep.Equal(names, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Only the included modules take part in the naming
+	names, err = goMainNames(ws, map[string]bool{"example.com/api": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(names, map[string]string{"/ws/api/cmd/server": "server", "/ws/api/cmd/app": "app"}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Names that remain the same once qualified cannot be resolved
+	ws.Modules = append(ws.Modules, &GoModule{Path: "example.com/other/app", Dir: "/ws/other", Mains: []string{"/ws/other/cmd/server"}})
+	if _, err = goMainNames(ws, map[string]bool{}); err == nil {
+		t.Fatal("colliding binary names were accepted")
+	}
+}
@@ -0,0 +1,938 @@
+package duat
+
+// This file contains the implementation of a pure Go packager that writes Debian .deb and
+// RPM .rpm packages for binaries produced by builds.  Packages are described using a small
+// YAML manifest and, like release archives, are deterministic.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+
+	"github.com/Masterminds/semver"
+	"github.com/go-yaml/yaml"
+)
+
+// PackageFile is a file installed by a package
+//
+type PackageFile struct {
+	Src  string `yaml:"src"`  // The file relative to the manifest, a template using the values of ArchiveNameValues
+	Dst  string `yaml:"dst"`  // The absolute path of the installed file
+	Mode string `yaml:"mode"` // The octal permissions of the installed file, the default depends upon the kind of file
+}
+
+// PackageScripts contains the maintainer scripts of a package, each is a file relative to
+// the manifest
+//
+type PackageScripts struct {
+	PreInstall  string `yaml:"preinstall"`
+	PostInstall string `yaml:"postinstall"`
+	PreRemove   string `yaml:"preremove"`
+	PostRemove  string `yaml:"postremove"`
+}
+
+// PackageManifest describes the contents, and metadata, of .deb and .rpm packages
+//
+type PackageManifest struct {
+	Name        string         `yaml:"name"`    // The package name, defaults to the module name
+	Release     string         `yaml:"release"` // The package revision, or release, defaults to 1
+	Summary     string         `yaml:"summary"` // A one line description, defaults to the first line of the description
+	Description string         `yaml:"description"`
+	Maintainer  string         `yaml:"maintainer"`
+	Vendor      string         `yaml:"vendor"`
+	Homepage    string         `yaml:"homepage"`
+	License     string         `yaml:"license"`
+	Section     string         `yaml:"section"`  // The Debian section, defaults to misc
+	Priority    string         `yaml:"priority"` // The Debian priority, defaults to optional
+	Group       string         `yaml:"group"`    // The RPM group, defaults to Unspecified
+	Depends     []string       `yaml:"depends"`  // Dependencies of both package formats, "name [op version]"
+	DebDepends  []string       `yaml:"deb_depends"`
+	RPMDepends  []string       `yaml:"rpm_depends"`
+	Binaries    []PackageFile  `yaml:"binaries"` // Executables, installed into /usr/bin when no destination is given
+	Configs     []PackageFile  `yaml:"configs"`  // Configuration files that are preserved when modified locally
+	Units       []PackageFile  `yaml:"units"`    // Systemd units, installed into the systemd unit directory when no destination is given
+	Files       []PackageFile  `yaml:"files"`    // Other files
+	Scripts     PackageScripts `yaml:"scripts"`
+	dir         string
+}
+
+// LoadPackageManifest reads a YAML, or JSON, package manifest
+//
+func LoadPackageManifest(fn string) (manifest *PackageManifest, err kv.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	manifest = &PackageManifest{}
+	if errGo = yaml.Unmarshal(data, manifest); errGo != nil {
+		return nil, kv.Wrap(errGo, "invalid package manifest").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	manifest.dir = filepath.Dir(fn)
+	return manifest, nil
+}
+
+// DebianVersion returns the Debian version of a semantic version, pre-releases are marked
+// using a tilde so that they sort before the release
+//
+func DebianVersion(ver *semver.Version, release string) (version string) {
+	version = fmt.Sprintf("%d.%d.%d", ver.Major(), ver.Minor(), ver.Patch())
+	if pre := ver.Prerelease(); len(pre) != 0 {
+		version += "~" + pre
+	}
+	if meta := ver.Metadata(); len(meta) != 0 {
+		version += "+" + meta
+	}
+	if len(release) == 0 {
+		release = "1"
+	}
+	return version + "-" + release
+}
+
+// RPMVersion returns the RPM version of a semantic version, pre-releases are marked using a
+// tilde so that they sort before the release and hyphens, which RPM versions cannot
+// contain, are replaced by underscores
+//
+func RPMVersion(ver *semver.Version) (version string) {
+	version = fmt.Sprintf("%d.%d.%d", ver.Major(), ver.Minor(), ver.Patch())
+	if pre := ver.Prerelease(); len(pre) != 0 {
+		version += "~" + strings.Replace(pre, "-", "_", -1)
+	}
+	if meta := ver.Metadata(); len(meta) != 0 {
+		version += "+" + strings.Replace(meta, "-", "_", -1)
+	}
+	return version
+}
+
+// packageDependency is a parsed dependency of the form "name [op version]"
+//
+type packageDependency struct {
+	name    string
+	op      string // One of <, <=, =, >=, >
+	version string
+}
+
+// parseDependency accepts dependencies written using either the Debian, "name (>= 1.0)",
+// or RPM, "name >= 1.0", styles
+//
+func parseDependency(text string) (dep packageDependency, err kv.Error) {
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(text))
+	switch len(fields) {
+	case 1:
+		return packageDependency{name: fields[0]}, nil
+	case 3:
+		op := map[string]string{"<": "<", "<<": "<", "<=": "<=", "=": "=", "==": "=", ">=": ">=", ">": ">", ">>": ">"}[fields[1]]
+		if len(op) != 0 {
+			return packageDependency{name: fields[0], op: op, version: fields[2]}, nil
+		}
+	}
+	return dep, kv.NewError("dependencies must have the form name [op version]").With("dependency", text).With("stack", stack.Trace().TrimRuntime())
+}
+
+// debArch and rpmArch map go targets onto the architecture names of each package format
+//
+func debArch(target GoTarget) string {
+	switch target.Arch {
+	case "386":
+		return "i386"
+	case "arm":
+		if target.Arm == "5" || target.Arm == "6" {
+			return "armel"
+		}
+		return "armhf"
+	case "ppc64le":
+		return "ppc64el"
+	case "mipsle":
+		return "mipsel"
+	case "mips64le":
+		return "mips64el"
+	}
+	return target.Arch
+}
+
+func rpmArch(target GoTarget) string {
+	switch target.Arch {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		switch target.Arm {
+		case "5":
+			return "armv5tel"
+		case "6":
+			return "armv6hl"
+		}
+		return "armv7hl"
+	}
+	return target.Arch
+}
+
+// packageEntry is a file installed by a package
+//
+type packageEntry struct {
+	path   string // The absolute installed path
+	mode   os.FileMode
+	data   []byte
+	config bool
+}
+
+// PackageOptions contains the parameters for writing .deb and .rpm packages
+//
+type PackageOptions struct {
+	Manifest  string     // The package manifest file
+	Formats   []string   // Any of deb and rpm, defaults to both
+	Targets   []GoTarget // The linux targets packaged, defaults to linux/amd64
+	OutputDir string     // The directory receiving the packages, defaults to ./dist
+	ModTime   time.Time  // The modification time of packaged files, defaults to the source date and then the Unix epoch
+}
+
+// LinuxPackages writes .deb and .rpm packages for each of the targets using the binaries,
+// and other files, listed within the manifest.  The names of the packages are returned.
+//
+func (md *MetaData) LinuxPackages(opts PackageOptions) (packages []string, err kv.Error) {
+	manifest, err := LoadPackageManifest(opts.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Name) == 0 {
+		manifest.Name = md.Module
+	}
+	if len(manifest.Release) == 0 {
+		manifest.Release = "1"
+	}
+	if md.SemVer == nil {
+		return nil, kv.NewError("a semantic version is needed to package a module").With("module", md.Module).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	formats := opts.Formats
+	if len(formats) == 0 {
+		formats = []string{"deb", "rpm"}
+	}
+	targets := opts.Targets
+	if len(targets) == 0 {
+		targets = []GoTarget{{OS: "linux", Arch: "amd64"}}
+	}
+	outputDir := opts.OutputDir
+	if len(outputDir) == 0 {
+		outputDir = "dist"
+	}
+	if errGo := os.MkdirAll(outputDir, 0755); errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", outputDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	modTime := opts.ModTime
+	if modTime.IsZero() {
+		if modTime, err = md.SourceDate(); err != nil {
+			modTime = time.Unix(0, 0)
+		}
+	}
+	modTime = modTime.UTC().Truncate(time.Second)
+
+	packages = []string{}
+	for _, target := range targets {
+		if target.OS != "linux" {
+			return packages, kv.NewError("packages can only be written for linux targets").With("os", target.OS).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, format := range formats {
+			entries, err := md.packageEntries(manifest, target, format)
+			if err != nil {
+				return packages, err
+			}
+			fn := ""
+			switch format {
+			case "deb":
+				fn, err = writeDeb(md, manifest, target, entries, modTime, outputDir)
+			case "rpm":
+				fn, err = writeRPM(md, manifest, target, entries, modTime, outputDir)
+			default:
+				err = kv.NewError("unknown package format, use deb or rpm").With("format", format).With("stack", stack.Trace().TrimRuntime())
+			}
+			if err != nil {
+				return packages, err
+			}
+			packages = append(packages, fn)
+		}
+	}
+	return packages, nil
+}
+
+// packageEntries loads the files of the manifest for a target, sorted by installed path
+//
+func (md *MetaData) packageEntries(manifest *PackageManifest, target GoTarget, format string) (entries []*packageEntry, err kv.Error) {
+	values := &ArchiveNameValues{Module: md.Module, OS: target.OS, Arch: target.Arch, Arm: target.Arm}
+	if md.SemVer != nil {
+		values.Version = md.SemVer.String()
+	}
+	if md.Git != nil {
+		values.GitHash = md.Git.Hash
+	}
+
+	unitDir := "/lib/systemd/system"
+	if format == "rpm" {
+		unitDir = "/usr/lib/systemd/system"
+	}
+
+	entries = []*packageEntry{}
+	for _, kind := range []struct {
+		files      []PackageFile
+		defaultDir string
+		mode       os.FileMode
+		config     bool
+	}{
+		{manifest.Binaries, "/usr/bin", 0755, false},
+		{manifest.Configs, "", 0644, true},
+		{manifest.Units, unitDir, 0644, false},
+		{manifest.Files, "", 0644, false},
+	} {
+		for _, file := range kind.files {
+			src := &strings.Builder{}
+			tmpl, errGo := template.New("src").Funcs(FuncMap(nil)).Option("missingkey=error").Parse(file.Src)
+			if errGo == nil {
+				errGo = tmpl.Execute(src, values)
+			}
+			if errGo != nil {
+				return nil, kv.Wrap(errGo, "invalid package file template").With("src", file.Src).With("stack", stack.Trace().TrimRuntime())
+			}
+			fn := src.String()
+			if !filepath.IsAbs(fn) {
+				fn = filepath.Join(manifest.dir, fn)
+			}
+
+			dst := file.Dst
+			if len(dst) == 0 {
+				if len(kind.defaultDir) == 0 {
+					return nil, kv.NewError("package files must have a destination").With("src", file.Src).With("stack", stack.Trace().TrimRuntime())
+				}
+				// Binaries named using the conventions of GoBuildWithOptions are installed
+				// using the name of the module
+				name := filepath.Base(fn)
+				if _, _, isBinary := archiveTarget(md.Module, fn); isBinary && kind.mode == 0755 {
+					name = md.Module
+				}
+				dst = path.Join(kind.defaultDir, name)
+			}
+			if !path.IsAbs(dst) {
+				return nil, kv.NewError("package file destinations must be absolute").With("dst", dst).With("stack", stack.Trace().TrimRuntime())
+			}
+
+			mode := kind.mode
+			if len(file.Mode) != 0 {
+				perm, errGo := strconv.ParseUint(file.Mode, 8, 32)
+				if errGo != nil {
+					return nil, kv.Wrap(errGo, "invalid package file mode").With("mode", file.Mode).With("stack", stack.Trace().TrimRuntime())
+				}
+				mode = os.FileMode(perm).Perm()
+			}
+
+			data, errGo := ioutil.ReadFile(fn)
+			if errGo != nil {
+				return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			entries = append(entries, &packageEntry{path: path.Clean(dst), mode: mode, data: data, config: kind.config})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, kv.NewError("the package manifest contains no files").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	for i := 1; i < len(entries); i++ {
+		if entries[i].path == entries[i-1].path {
+			return nil, kv.NewError("package files must have unique destinations").With("dst", entries[i].path).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return entries, nil
+}
+
+// readScript returns the contents of a maintainer script, or nothing when none was given
+//
+func (manifest *PackageManifest) readScript(fn string) (script []byte, err kv.Error) {
+	if len(fn) == 0 {
+		return nil, nil
+	}
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(manifest.dir, fn)
+	}
+	script, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return script, nil
+}
+
+// summary returns the one line summary, and the remaining description, of the package
+//
+func (manifest *PackageManifest) summary() (summary string, description string) {
+	description = strings.TrimSpace(manifest.Description)
+	summary = strings.TrimSpace(manifest.Summary)
+	if len(summary) == 0 {
+		lines := strings.SplitN(description, "\n", 2)
+		summary = strings.TrimSpace(lines[0])
+		description = ""
+		if len(lines) == 2 {
+			description = strings.TrimSpace(lines[1])
+		}
+	}
+	if len(summary) == 0 {
+		summary = manifest.Name
+	}
+	return summary, description
+}
+
+// writeDeb writes a Debian package, an ar archive containing the debian-binary, control and
+// data members
+//
+func writeDeb(md *MetaData, manifest *PackageManifest, target GoTarget, entries []*packageEntry, modTime time.Time, outputDir string) (fn string, err kv.Error) {
+	version := DebianVersion(md.SemVer, manifest.Release)
+	arch := debArch(target)
+
+	// The data member contains the installed files along with their parent directories
+	dirs := map[string]bool{}
+	data := []*archiveEntry{}
+	md5sums := &strings.Builder{}
+	conffiles := &strings.Builder{}
+	size := 0
+	for _, entry := range entries {
+		for dir := path.Dir(entry.path); dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+		data = append(data, &archiveEntry{name: "." + entry.path, mode: entry.mode, data: entry.data})
+		fmt.Fprintf(md5sums, "%x  %s\n", md5.Sum(entry.data), strings.TrimPrefix(entry.path, "/"))
+		if entry.config {
+			fmt.Fprintf(conffiles, "%s\n", entry.path)
+		}
+		size += len(entry.data)
+	}
+	data = append(data, &archiveEntry{name: "./", mode: os.ModeDir | 0755})
+	for dir := range dirs {
+		data = append(data, &archiveEntry{name: "." + dir + "/", mode: os.ModeDir | 0755})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].name < data[j].name })
+
+	section, priority := manifest.Section, manifest.Priority
+	if len(section) == 0 {
+		section = "misc"
+	}
+	if len(priority) == 0 {
+		priority = "optional"
+	}
+
+	summary, description := manifest.summary()
+	control := &strings.Builder{}
+	fmt.Fprintf(control, "Package: %s\nVersion: %s\nArchitecture: %s\n", manifest.Name, version, arch)
+	for _, field := range [][2]string{
+		{"Maintainer", manifest.Maintainer},
+		{"Installed-Size", strconv.Itoa((size + 1023) / 1024)},
+		{"Section", section},
+		{"Priority", priority},
+		{"Homepage", manifest.Homepage},
+	} {
+		if len(field[1]) != 0 {
+			fmt.Fprintf(control, "%s: %s\n", field[0], field[1])
+		}
+	}
+	depends := []string{}
+	for _, text := range append(append([]string{}, manifest.Depends...), manifest.DebDepends...) {
+		dep, err := parseDependency(text)
+		if err != nil {
+			return "", err
+		}
+		if len(dep.op) != 0 {
+			op := map[string]string{"<": "<<", ">": ">>"}[dep.op]
+			if len(op) == 0 {
+				op = dep.op
+			}
+			depends = append(depends, fmt.Sprintf("%s (%s %s)", dep.name, op, dep.version))
+			continue
+		}
+		depends = append(depends, dep.name)
+	}
+	if len(depends) != 0 {
+		fmt.Fprintf(control, "Depends: %s\n", strings.Join(depends, ", "))
+	}
+	fmt.Fprintf(control, "Description: %s\n", summary)
+	for _, line := range strings.Split(description, "\n") {
+		if line = strings.TrimRight(line, " \t"); len(line) == 0 {
+			if len(description) != 0 {
+				control.WriteString(" .\n")
+			}
+			continue
+		}
+		fmt.Fprintf(control, " %s\n", line)
+	}
+
+	controlEntries := []*archiveEntry{
+		{name: "./", mode: os.ModeDir | 0755},
+		{name: "./control", mode: 0644, data: []byte(control.String())},
+		{name: "./md5sums", mode: 0644, data: []byte(md5sums.String())},
+	}
+	if conffiles.Len() != 0 {
+		controlEntries = append(controlEntries, &archiveEntry{name: "./conffiles", mode: 0644, data: []byte(conffiles.String())})
+	}
+	for _, script := range []struct{ name, fn string }{
+		{"preinst", manifest.Scripts.PreInstall},
+		{"postinst", manifest.Scripts.PostInstall},
+		{"prerm", manifest.Scripts.PreRemove},
+		{"postrm", manifest.Scripts.PostRemove},
+	} {
+		content, err := manifest.readScript(script.fn)
+		if err != nil {
+			return "", err
+		}
+		if content != nil {
+			controlEntries = append(controlEntries, &archiveEntry{name: "./" + script.name, mode: 0755, data: content})
+		}
+	}
+	sort.Slice(controlEntries, func(i, j int) bool { return controlEntries[i].name < controlEntries[j].name })
+
+	controlTar, err := tarGz(controlEntries, modTime)
+	if err != nil {
+		return "", err
+	}
+	dataTar, err := tarGz(data, modTime)
+	if err != nil {
+		return "", err
+	}
+
+	deb := &bytes.Buffer{}
+	deb.WriteString("!<arch>\n")
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		fmt.Fprintf(deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, modTime.Unix(), 0, 0, "100644", len(member.data))
+		deb.Write(member.data)
+		if len(member.data)%2 != 0 {
+			deb.WriteByte('\n')
+		}
+	}
+
+	fn = filepath.Join(outputDir, fmt.Sprintf("%s_%s_%s.deb", manifest.Name, version, arch))
+	if errGo := ioutil.WriteFile(fn, deb.Bytes(), 0644); errGo != nil {
+		return "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return fn, nil
+}
+
+// RPM header tags and types, see https://rpm-software-management.github.io/rpm/manual/format.html
+//
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+
+	rpmSigTagHeaderSignatures = 62
+	rpmSigTagSHA1             = 269
+	rpmSigTagSHA256           = 273
+	rpmSigTagSize             = 1000
+	rpmSigTagMD5              = 1004
+	rpmSigTagPayloadSize      = 1007
+
+	rpmTagHeaderImmutable   = 63
+	rpmTagHeaderI18NTable   = 100
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagVendor            = 1011
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagPreIn             = 1023
+	rpmTagPostIn            = 1024
+	rpmTagPreUn             = 1025
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagPreInProg         = 1085
+	rpmTagPostInProg        = 1086
+	rpmTagPreUnProg         = 1087
+	rpmTagPostUnProg        = 1088
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+
+	rpmSenseLess    = 0x02
+	rpmSenseGreater = 0x04
+	rpmSenseEqual   = 0x08
+	rpmSenseRPMLib  = 0x01000000
+
+	rpmFileConfig    = 0x01
+	rpmFileNoReplace = 0x10
+
+	rpmDigestSHA256 = 8
+)
+
+// rpmDependency is a requirement of an RPM package
+//
+type rpmDependency struct {
+	name    string
+	flags   uint32
+	version string
+}
+
+// rpmEntry is a single tag of an RPM header
+//
+type rpmEntry struct {
+	tag   int32
+	typ   int32
+	count int32
+	data  []byte
+	align int
+}
+
+// rpmHeader accumulates the tags of an RPM header structure
+//
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (header *rpmHeader) addStrings(tag int32, typ int32, values ...string) {
+	data := []byte{}
+	for _, value := range values {
+		data = append(append(data, value...), 0)
+	}
+	header.entries = append(header.entries, rpmEntry{tag: tag, typ: typ, count: int32(len(values)), data: data, align: 1})
+}
+
+func (header *rpmHeader) addString(tag int32, value string) {
+	header.addStrings(tag, rpmTypeString, value)
+}
+
+func (header *rpmHeader) addInt32(tag int32, values ...uint32) {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[4*i:], value)
+	}
+	header.entries = append(header.entries, rpmEntry{tag: tag, typ: rpmTypeInt32, count: int32(len(values)), data: data, align: 4})
+}
+
+func (header *rpmHeader) addInt16(tag int32, values ...uint16) {
+	data := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(data[2*i:], value)
+	}
+	header.entries = append(header.entries, rpmEntry{tag: tag, typ: rpmTypeInt16, count: int32(len(values)), data: data, align: 2})
+}
+
+func (header *rpmHeader) addBin(tag int32, value []byte) {
+	header.entries = append(header.entries, rpmEntry{tag: tag, typ: rpmTypeBin, count: int32(len(value)), data: value, align: 1})
+}
+
+// bytes returns the encoded header, the index begins with the region tag and is otherwise
+// sorted by tag while the region trailer is placed at the end of the data store
+//
+func (header *rpmHeader) bytes(region int32) []byte {
+	entries := append([]rpmEntry{}, header.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	count := int32(len(entries) + 1)
+	store := &bytes.Buffer{}
+	index := &bytes.Buffer{}
+	for _, entry := range entries {
+		for store.Len()%entry.align != 0 {
+			store.WriteByte(0)
+		}
+		binary.Write(index, binary.BigEndian, []int32{entry.tag, entry.typ, int32(store.Len()), entry.count})
+		store.Write(entry.data)
+	}
+	trailerOffset := int32(store.Len())
+	binary.Write(store, binary.BigEndian, []int32{region, rpmTypeBin, -count * 16, 16})
+
+	out := &bytes.Buffer{}
+	out.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(out, binary.BigEndian, []int32{count, int32(store.Len())})
+	binary.Write(out, binary.BigEndian, []int32{region, rpmTypeBin, trailerOffset, 16})
+	out.Write(index.Bytes())
+	out.Write(store.Bytes())
+	return out.Bytes()
+}
+
+// cpioNewc returns a cpio archive in the SVR4 newc format used for RPM payloads
+//
+func cpioNewc(entries []*packageEntry, modTime time.Time) []byte {
+	out := &bytes.Buffer{}
+	write := func(ino int, mode uint32, name string, data []byte) {
+		fmt.Fprintf(out, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			ino, mode, 0, 0, 1, uint32(modTime.Unix()), len(data), 0, 0, 0, 0, len(name)+1, 0)
+		out.WriteString(name)
+		out.WriteByte(0)
+		for out.Len()%4 != 0 {
+			out.WriteByte(0)
+		}
+		out.Write(data)
+		for out.Len()%4 != 0 {
+			out.WriteByte(0)
+		}
+	}
+	for i, entry := range entries {
+		write(i+1, 0100000|uint32(entry.mode.Perm()), "."+entry.path, entry.data)
+	}
+	write(0, 0, "TRAILER!!!", nil)
+	return out.Bytes()
+}
+
+// writeRPM writes an RPM package, the lead, the signature header, the main header and a
+// gzip compressed cpio payload
+//
+func writeRPM(md *MetaData, manifest *PackageManifest, target GoTarget, entries []*packageEntry, modTime time.Time, outputDir string) (fn string, err kv.Error) {
+	version := RPMVersion(md.SemVer)
+	arch := rpmArch(target)
+	nvr := manifest.Name + "-" + version + "-" + manifest.Release
+
+	cpio := cpioNewc(entries, modTime)
+	payload := &bytes.Buffer{}
+	gz, errGo := gzip.NewWriterLevel(payload, gzip.BestCompression)
+	if errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo = gz.Write(cpio); errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = gz.Close(); errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	summary, description := manifest.summary()
+	if len(description) == 0 {
+		description = summary
+	}
+	group := manifest.Group
+	if len(group) == 0 {
+		group = "Unspecified"
+	}
+
+	header := &rpmHeader{}
+	header.addStrings(rpmTagHeaderI18NTable, rpmTypeStringArray, "C")
+	header.addString(rpmTagName, manifest.Name)
+	header.addString(rpmTagVersion, version)
+	header.addString(rpmTagRelease, manifest.Release)
+	header.addStrings(rpmTagSummary, rpmTypeI18NString, summary)
+	header.addStrings(rpmTagDescription, rpmTypeI18NString, description)
+	header.addInt32(rpmTagBuildTime, uint32(modTime.Unix()))
+	header.addString(rpmTagBuildHost, "localhost")
+	header.addStrings(rpmTagGroup, rpmTypeI18NString, group)
+	header.addString(rpmTagOS, "linux")
+	header.addString(rpmTagArch, arch)
+	header.addString(rpmTagSourceRPM, nvr+".src.rpm")
+	header.addString(rpmTagPayloadFormat, "cpio")
+	header.addString(rpmTagPayloadCompressor, "gzip")
+	header.addString(rpmTagPayloadFlags, "9")
+	for _, field := range []struct {
+		tag   int32
+		value string
+	}{
+		{rpmTagVendor, manifest.Vendor},
+		{rpmTagLicense, manifest.License},
+		{rpmTagPackager, manifest.Maintainer},
+		{rpmTagURL, manifest.Homepage},
+	} {
+		if len(field.value) != 0 {
+			header.addString(field.tag, field.value)
+		}
+	}
+
+	for _, script := range []struct {
+		tag     int32
+		progTag int32
+		fn      string
+	}{
+		{rpmTagPreIn, rpmTagPreInProg, manifest.Scripts.PreInstall},
+		{rpmTagPostIn, rpmTagPostInProg, manifest.Scripts.PostInstall},
+		{rpmTagPreUn, rpmTagPreUnProg, manifest.Scripts.PreRemove},
+		{rpmTagPostUn, rpmTagPostUnProg, manifest.Scripts.PostRemove},
+	} {
+		content, err := manifest.readScript(script.fn)
+		if err != nil {
+			return "", err
+		}
+		if content != nil {
+			header.addString(script.tag, string(content))
+			header.addString(script.progTag, "/bin/sh")
+		}
+	}
+
+	// The package provides itself, and requires any dependencies along with the features of
+	// rpm used by the package
+	header.addStrings(rpmTagProvideName, rpmTypeStringArray, manifest.Name)
+	header.addInt32(rpmTagProvideFlags, rpmSenseEqual)
+	header.addStrings(rpmTagProvideVersion, rpmTypeStringArray, version+"-"+manifest.Release)
+
+	requires := []rpmDependency{
+		{"rpmlib(CompressedFileNames)", rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib, "3.0.4-1"},
+		{"rpmlib(FileDigests)", rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib, "4.6.0-1"},
+		{"rpmlib(PayloadFilesHavePrefix)", rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib, "4.0-1"},
+	}
+	if strings.Contains(version, "~") {
+		requires = append(requires, rpmDependency{"rpmlib(TildeInVersions)", rpmSenseLess | rpmSenseEqual | rpmSenseRPMLib, "4.10.0-1"})
+	}
+	for _, text := range append(append([]string{}, manifest.Depends...), manifest.RPMDepends...) {
+		dep, err := parseDependency(text)
+		if err != nil {
+			return "", err
+		}
+		flags := map[string]uint32{
+			"<":  rpmSenseLess,
+			"<=": rpmSenseLess | rpmSenseEqual,
+			"=":  rpmSenseEqual,
+			">=": rpmSenseGreater | rpmSenseEqual,
+			">":  rpmSenseGreater,
+		}[dep.op]
+		requires = append(requires, rpmDependency{dep.name, flags, dep.version})
+	}
+	requireNames := make([]string, 0, len(requires))
+	requireFlags := make([]uint32, 0, len(requires))
+	requireVersions := make([]string, 0, len(requires))
+	for _, require := range requires {
+		requireNames = append(requireNames, require.name)
+		requireFlags = append(requireFlags, require.flags)
+		requireVersions = append(requireVersions, require.version)
+	}
+	header.addStrings(rpmTagRequireName, rpmTypeStringArray, requireNames...)
+	header.addInt32(rpmTagRequireFlags, requireFlags...)
+	header.addStrings(rpmTagRequireVersion, rpmTypeStringArray, requireVersions...)
+
+	// File information is held in parallel arrays indexed by the position of the file in
+	// the payload
+	dirIndex := map[string]uint32{}
+	dirNames := []string{}
+	sizes, mtimes, flags, devices, inodes, dirIndexes := []uint32{}, []uint32{}, []uint32{}, []uint32{}, []uint32{}, []uint32{}
+	modes, rdevs := []uint16{}, []uint16{}
+	digests, linkTos, users, groups, langs, baseNames := []string{}, []string{}, []string{}, []string{}, []string{}, []string{}
+	total := uint32(0)
+	for i, entry := range entries {
+		dir := path.Dir(entry.path) + "/"
+		if _, isPresent := dirIndex[dir]; !isPresent {
+			dirIndex[dir] = uint32(len(dirNames))
+			dirNames = append(dirNames, dir)
+		}
+		fileFlags := uint32(0)
+		if entry.config {
+			fileFlags = rpmFileConfig | rpmFileNoReplace
+		}
+		sizes = append(sizes, uint32(len(entry.data)))
+		mtimes = append(mtimes, uint32(modTime.Unix()))
+		flags = append(flags, fileFlags)
+		devices = append(devices, 1)
+		inodes = append(inodes, uint32(i+1))
+		dirIndexes = append(dirIndexes, dirIndex[dir])
+		modes = append(modes, uint16(0100000|entry.mode.Perm()))
+		rdevs = append(rdevs, 0)
+		digests = append(digests, fmt.Sprintf("%x", sha256.Sum256(entry.data)))
+		linkTos = append(linkTos, "")
+		users = append(users, "root")
+		groups = append(groups, "root")
+		langs = append(langs, "")
+		baseNames = append(baseNames, path.Base(entry.path))
+		total += uint32(len(entry.data))
+	}
+	header.addInt32(rpmTagSize, total)
+	header.addInt32(rpmTagFileSizes, sizes...)
+	header.addInt16(rpmTagFileModes, modes...)
+	header.addInt16(rpmTagFileRDevs, rdevs...)
+	header.addInt32(rpmTagFileMTimes, mtimes...)
+	header.addStrings(rpmTagFileDigests, rpmTypeStringArray, digests...)
+	header.addStrings(rpmTagFileLinkTos, rpmTypeStringArray, linkTos...)
+	header.addInt32(rpmTagFileFlags, flags...)
+	header.addStrings(rpmTagFileUserName, rpmTypeStringArray, users...)
+	header.addStrings(rpmTagFileGroupName, rpmTypeStringArray, groups...)
+	header.addInt32(rpmTagFileDevices, devices...)
+	header.addInt32(rpmTagFileInodes, inodes...)
+	header.addStrings(rpmTagFileLangs, rpmTypeStringArray, langs...)
+	header.addInt32(rpmTagDirIndexes, dirIndexes...)
+	header.addStrings(rpmTagBaseNames, rpmTypeStringArray, baseNames...)
+	header.addStrings(rpmTagDirNames, rpmTypeStringArray, dirNames...)
+	header.addInt32(rpmTagFileDigestAlgo, rpmDigestSHA256)
+	header.addStrings(rpmTagPayloadDigest, rpmTypeStringArray, fmt.Sprintf("%x", sha256.Sum256(payload.Bytes())))
+	header.addInt32(rpmTagPayloadDigestAlgo, rpmDigestSHA256)
+	mainHeader := header.bytes(rpmTagHeaderImmutable)
+
+	// The signature header contains the digests of the main header and payload
+	signed := append(append([]byte{}, mainHeader...), payload.Bytes()...)
+	signature := &rpmHeader{}
+	signature.addString(rpmSigTagSHA1, fmt.Sprintf("%x", sha1.Sum(mainHeader)))
+	signature.addString(rpmSigTagSHA256, fmt.Sprintf("%x", sha256.Sum256(mainHeader)))
+	signature.addInt32(rpmSigTagSize, uint32(len(signed)))
+	digest := md5.Sum(signed)
+	signature.addBin(rpmSigTagMD5, digest[:])
+	signature.addInt32(rpmSigTagPayloadSize, uint32(len(cpio)))
+	sigBytes := signature.bytes(rpmSigTagHeaderSignatures)
+
+	// The lead is a fixed size legacy structure retained for compatibility
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	binary.BigEndian.PutUint16(lead[6:], 0) // Binary package
+	binary.BigEndian.PutUint16(lead[8:], 1)
+	copy(lead[10:75], nvr)
+	binary.BigEndian.PutUint16(lead[76:], 1) // Linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // Header style signature
+
+	rpm := &bytes.Buffer{}
+	rpm.Write(lead)
+	rpm.Write(sigBytes)
+	for rpm.Len()%8 != 0 {
+		rpm.WriteByte(0)
+	}
+	rpm.Write(signed)
+
+	fn = filepath.Join(outputDir, nvr+"."+arch+".rpm")
+	if errGo := ioutil.WriteFile(fn, rpm.Bytes(), 0644); errGo != nil {
+		return "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return fn, nil
+}
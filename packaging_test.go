@@ -0,0 +1,374 @@
+package duat
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/go-test/deep"
+)
+
+// TestLinuxPackages checks that .deb and .rpm packages are named using versions that sort
+// pre-releases first, and are identical when repackaged
+//
+func TestLinuxPackages(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "packaging")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"bin/tool-linux-amd64": "linux",
+		"tool.yaml":            "level: info\n",
+		"tool.service":         "[Service]\nExecStart=/usr/bin/tool\n",
+		"postinst.sh":          "#!/bin/sh\nsystemctl daemon-reload\n",
+		"package.yaml": `name: tool
+description: |
+  A tool
+  that does things
+maintainer: Jane Doe <jane@example.com>
+depends:
+  - libc6 (>= 2.17)
+rpm_depends:
+  - systemd
+binaries:
+  - src: "bin/{{.Module}}-{{.OS}}-{{.Arch}}"
+configs:
+  - src: tool.yaml
+    dst: /etc/tool/tool.yaml
+units:
+  - src: tool.service
+scripts:
+  postinstall: postinst.sh
+`,
+	})
+
+	ver, _ := semver.NewVersion("1.2.3-rc.1")
+	md := &MetaData{Module: "tool", SemVer: ver}
+	opts := PackageOptions{
+		Manifest:  filepath.Join(dir, "package.yaml"),
+		OutputDir: filepath.Join(dir, "dist"),
+		ModTime:   time.Unix(1600000000, 0),
+	}
+
+	packages, err := md.LinuxPackages(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	contents := [][]byte{}
+	for _, pkg := range packages {
+		names = append(names, filepath.Base(pkg))
+		data, errGo := ioutil.ReadFile(pkg)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		contents = append(contents, data)
+	}
+	if diff := deep.Equal(names, []string{"tool_1.2.3~rc.1-1_amd64.deb", "tool-1.2.3~rc.1-1.x86_64.rpm"}); diff != nil {
+		t.Fatal(diff)
+	}
+	checkDeb(t, contents[0])
+	checkRPM(t, contents[1])
+
+	// 32 bit arm packages use the names of the floating point ABI for each version
+	for arm, expected := range map[string][2]string{"5": {"armel", "armv5tel"}, "6": {"armel", "armv6hl"}, "7": {"armhf", "armv7hl"}} {
+		target := GoTarget{OS: "linux", Arch: "arm", Arm: arm}
+		if arch := [2]string{debArch(target), rpmArch(target)}; arch != expected {
+			t.Error("unexpected arm architectures", arm, arch)
+		}
+	}
+
+	if _, err = md.LinuxPackages(opts); err != nil {
+		t.Fatal(err)
+	}
+	for i, pkg := range packages {
+		data, errGo := ioutil.ReadFile(pkg)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !bytes.Equal(data, contents[i]) {
+			t.Error("repackaging produced a different package", pkg)
+		}
+	}
+}
+
+// readAr returns the names, and contents, of the members of an ar archive in order
+//
+func readAr(t *testing.T, data []byte) (names []string, members map[string][]byte) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		t.Fatal("the archive does not begin with the ar magic")
+	}
+	members = map[string][]byte{}
+	for data = data[8:]; len(data) != 0; {
+		if len(data) < 60 || string(data[58:60]) != "`\n" {
+			t.Fatal("invalid ar member header")
+		}
+		name := strings.TrimSpace(string(data[:16]))
+		size, errGo := strconv.Atoi(strings.TrimSpace(string(data[48:58])))
+		if errGo != nil || 60+size > len(data) {
+			t.Fatal("invalid ar member size", name)
+		}
+		names = append(names, name)
+		members[name] = data[60 : 60+size]
+		data = data[60+size+size%2:]
+	}
+	return names, members
+}
+
+// readTarGz returns the names, in order, and contents of the entries of a gzip compressed
+// tar archive
+//
+func readTarGz(t *testing.T, data []byte) (names []string, files map[string]string) {
+	t.Helper()
+	gz, errGo := gzip.NewReader(bytes.NewReader(data))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	files = map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, errGo := tr.Next()
+		if errGo == io.EOF {
+			return names, files
+		}
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		content, errGo := ioutil.ReadAll(tr)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		names = append(names, hdr.Name)
+		files[hdr.Name] = string(content)
+	}
+}
+
+// checkDeb checks the members, control files and data of the test .deb package
+//
+func checkDeb(t *testing.T, data []byte) {
+	names, members := readAr(t, data)
+	if diff := deep.Equal(names, []string{"debian-binary", "control.tar.gz", "data.tar.gz"}); diff != nil {
+		t.Fatal(diff)
+	}
+	if string(members["debian-binary"]) != "2.0\n" {
+		t.Error("unexpected debian-binary", string(members["debian-binary"]))
+	}
+
+	_, control := readTarGz(t, members["control.tar.gz"])
+	expected := map[string]string{
+		"./": "",
+		"./control": "Package: tool\nVersion: 1.2.3~rc.1-1\nArchitecture: amd64\nMaintainer: Jane Doe <jane@example.com>\n" +
+			"Installed-Size: 1\nSection: misc\nPriority: optional\nDepends: libc6 (>= 2.17)\nDescription: A tool\n that does things\n",
+		"./md5sums": fmt.Sprintf("%x  etc/tool/tool.yaml\n%x  lib/systemd/system/tool.service\n%x  usr/bin/tool\n",
+			md5.Sum([]byte("level: info\n")), md5.Sum([]byte("[Service]\nExecStart=/usr/bin/tool\n")), md5.Sum([]byte("linux"))),
+		"./conffiles": "/etc/tool/tool.yaml\n",
+		"./postinst":  "#!/bin/sh\nsystemctl daemon-reload\n",
+	}
+	if diff := deep.Equal(control, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	paths, files := readTarGz(t, members["data.tar.gz"])
+	expectedPaths := []string{"./", "./etc/", "./etc/tool/", "./etc/tool/tool.yaml", "./lib/", "./lib/systemd/", "./lib/systemd/system/",
+		"./lib/systemd/system/tool.service", "./usr/", "./usr/bin/", "./usr/bin/tool"}
+	if diff := deep.Equal(paths, expectedPaths); diff != nil {
+		t.Error(diff)
+	}
+	if files["./usr/bin/tool"] != "linux" {
+		t.Error("unexpected binary contents", files["./usr/bin/tool"])
+	}
+}
+
+// rpmTag is a tag read from an RPM header
+//
+type rpmTag struct {
+	typ   int32
+	count int32
+	data  []byte
+}
+
+// strings returns the values of a string, string array or i18n string tag
+//
+func (tag rpmTag) strings() []string {
+	return strings.Split(string(tag.data), "\x00")[:tag.count]
+}
+
+// int32s returns the values of an int32 tag
+//
+func (tag rpmTag) int32s() (values []uint32) {
+	for i := int32(0); i < tag.count; i++ {
+		values = append(values, binary.BigEndian.Uint32(tag.data[4*i:]))
+	}
+	return values
+}
+
+// readRPMHeader decodes an RPM header structure returning its tags and the remaining data
+//
+func readRPMHeader(t *testing.T, data []byte) (tags map[int32]rpmTag, header []byte, rest []byte) {
+	t.Helper()
+	if len(data) < 16 || !bytes.Equal(data[:4], []byte{0x8e, 0xad, 0xe8, 0x01}) {
+		t.Fatal("invalid rpm header magic")
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	size := int(binary.BigEndian.Uint32(data[12:]))
+	end := 16 + count*16 + size
+	if end > len(data) {
+		t.Fatal("truncated rpm header")
+	}
+	store := data[16+count*16 : end]
+
+	// Entries are read in index order, each extending to the start of the entry that follows
+	// it within the store, and the types are used to find the extent of the final entry
+	tags = map[int32]rpmTag{}
+	for i := 0; i < count; i++ {
+		entry := data[16+i*16:]
+		tag, typ := int32(binary.BigEndian.Uint32(entry)), int32(binary.BigEndian.Uint32(entry[4:]))
+		offset, n := int32(binary.BigEndian.Uint32(entry[8:])), int32(binary.BigEndian.Uint32(entry[12:]))
+		value := store[offset:]
+		switch typ {
+		case rpmTypeInt16:
+			value = value[:2*n]
+		case rpmTypeInt32:
+			value = value[:4*n]
+		case rpmTypeBin:
+			value = value[:n]
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+			length := 0
+			for j := int32(0); j < n; j++ {
+				length += bytes.IndexByte(value[length:], 0) + 1
+			}
+			value = value[:length]
+		}
+		tags[tag] = rpmTag{typ: typ, count: n, data: value}
+	}
+	return tags, data[:end], data[end:]
+}
+
+// readCpio returns the names, in order, and contents of the files within a newc cpio archive
+//
+func readCpio(t *testing.T, data []byte) (names []string, files map[string]string) {
+	t.Helper()
+	files = map[string]string{}
+	field := func(hdr []byte, i int) int {
+		value, errGo := strconv.ParseUint(string(hdr[6+8*i:14+8*i]), 16, 32)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		return int(value)
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for offset := 0; ; {
+		hdr := data[offset:]
+		if len(hdr) < 110 || string(hdr[:6]) != "070701" {
+			t.Fatal("invalid cpio header")
+		}
+		size, nameSize := field(hdr, 6), field(hdr, 11)
+		name := string(hdr[110 : 110+nameSize-1])
+		if name == "TRAILER!!!" {
+			return names, files
+		}
+		start := offset + align(110+nameSize)
+		names = append(names, name)
+		files[name] = string(data[start : start+size])
+		offset = start + align(size)
+	}
+}
+
+// checkRPM checks the lead, signature and main headers, and payload of the test .rpm package
+//
+func checkRPM(t *testing.T, data []byte) {
+	if len(data) < 96 || !bytes.HasPrefix(data, []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("the rpm package does not begin with a lead")
+	}
+	if name := string(bytes.TrimRight(data[10:76], "\x00")); name != "tool-1.2.3~rc.1-1" {
+		t.Error("unexpected lead name", name)
+	}
+
+	signature, _, rest := readRPMHeader(t, data[96:])
+	rest = rest[(8-(len(data)-len(rest))%8)%8:]
+	tags, header, payload := readRPMHeader(t, rest)
+
+	if digest := fmt.Sprintf("%x", sha256.Sum256(header)); signature[rpmSigTagSHA256].strings()[0] != digest {
+		t.Error("the signature header digest does not match the main header")
+	}
+	if size := signature[rpmSigTagSize].int32s()[0]; int(size) != len(rest) {
+		t.Error("unexpected signed size", size, len(rest))
+	}
+	if digest := md5.Sum(rest); !bytes.Equal(signature[rpmSigTagMD5].data, digest[:]) {
+		t.Error("the signature md5 does not match the header and payload")
+	}
+	if digest := fmt.Sprintf("%x", sha256.Sum256(payload)); tags[rpmTagPayloadDigest].strings()[0] != digest {
+		t.Error("the payload digest does not match the payload")
+	}
+
+	for tag, expected := range map[int32][]string{
+		rpmTagName:           {"tool"},
+		rpmTagVersion:        {"1.2.3~rc.1"},
+		rpmTagRelease:        {"1"},
+		rpmTagSummary:        {"A tool"},
+		rpmTagDescription:    {"that does things"},
+		rpmTagArch:           {"x86_64"},
+		rpmTagOS:             {"linux"},
+		rpmTagPackager:       {"Jane Doe <jane@example.com>"},
+		rpmTagPostIn:         {"#!/bin/sh\nsystemctl daemon-reload\n"},
+		rpmTagPostInProg:     {"/bin/sh"},
+		rpmTagPayloadFormat:  {"cpio"},
+		rpmTagRequireName:    {"rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)", "rpmlib(TildeInVersions)", "libc6", "systemd"},
+		rpmTagRequireVersion: {"3.0.4-1", "4.6.0-1", "4.0-1", "4.10.0-1", "2.17", ""},
+		rpmTagBaseNames:      {"tool.yaml", "tool", "tool.service"},
+		rpmTagDirNames:       {"/etc/tool/", "/usr/bin/", "/usr/lib/systemd/system/"},
+		rpmTagFileDigests: {
+			fmt.Sprintf("%x", sha256.Sum256([]byte("level: info\n"))),
+			fmt.Sprintf("%x", sha256.Sum256([]byte("linux"))),
+			fmt.Sprintf("%x", sha256.Sum256([]byte("[Service]\nExecStart=/usr/bin/tool\n"))),
+		},
+	} {
+		if diff := deep.Equal(tags[tag].strings(), expected); diff != nil {
+			t.Error("unexpected rpm tag", tag, diff)
+		}
+	}
+	for tag, expected := range map[int32][]uint32{
+		rpmTagDirIndexes: {0, 1, 2},
+		rpmTagFileFlags:  {rpmFileConfig | rpmFileNoReplace, 0, 0},
+		rpmTagFileSizes:  {12, 5, 34},
+	} {
+		if diff := deep.Equal(tags[tag].int32s(), expected); diff != nil {
+			t.Error("unexpected rpm tag", tag, diff)
+		}
+	}
+
+	gz, errGo := gzip.NewReader(bytes.NewReader(payload))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	cpio, errGo := ioutil.ReadAll(gz)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if size := signature[rpmSigTagPayloadSize].int32s()[0]; int(size) != len(cpio) {
+		t.Error("unexpected payload size", size, len(cpio))
+	}
+	names, files := readCpio(t, cpio)
+	if diff := deep.Equal(names, []string{"./etc/tool/tool.yaml", "./usr/bin/tool", "./usr/lib/systemd/system/tool.service"}); diff != nil {
+		t.Error(diff)
+	}
+	if files["./usr/bin/tool"] != "linux" {
+		t.Error("unexpected binary contents", files["./usr/bin/tool"])
+	}
+}
@@ -0,0 +1,242 @@
+package git
+
+// This file contains the implementation of a durable store for the state of the
+// repositories being watched.  The state records what has been observed in each
+// repository and what the downstream consumer has acknowledged as processed, allowing
+// a restarted watcher to carry on without losing, or duplicating, notifications.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+var (
+	// maxRepoErrors is the number of the most recent errors retained for each repository
+	maxRepoErrors = 10
+
+	stateFN = "watcher-state.json"
+)
+
+// RepoError captures a failure that was observed while a repository was being processed
+//
+type RepoError struct {
+	Msg  string    `json:"msg"`
+	Time time.Time `json:"time"`
+}
+
+// RepoState is the durable record of a repository that is, or was, being watched
+//
+type RepoState struct {
+	Key       string      `json:"key"`                 // The hash of the URL used to name the clone directory
+	URL       string      `json:"url"`                 // The URL of the remote repository
+	Branch    string      `json:"branch"`              // The branch that is being watched
+	LastSeen  string      `json:"lastSeen,omitempty"`  // The most recent commit observed on the branch
+	SeenAt    time.Time   `json:"seenAt,omitempty"`    // The time at which LastSeen was observed
+	LastAcked string      `json:"lastAcked,omitempty"` // The most recent commit that the consumer acknowledged as processed
+	AckedAt   time.Time   `json:"ackedAt,omitempty"`   // The time at which LastAcked was acknowledged
+	Errors    []RepoError `json:"errors,omitempty"`    // The most recent errors, oldest first
+}
+
+// AddError appends an error to the repository history, retaining only the most
+// recent errors
+//
+func (state *RepoState) AddError(msg string) {
+	state.Errors = append(state.Errors, RepoError{Msg: msg, Time: time.Now()})
+	if len(state.Errors) > maxRepoErrors {
+		state.Errors = state.Errors[len(state.Errors)-maxRepoErrors:]
+	}
+}
+
+func (state *RepoState) clone() (copied *RepoState) {
+	copied = &RepoState{}
+	*copied = *state
+	copied.Errors = append([]RepoError{}, state.Errors...)
+	return copied
+}
+
+// StateStore is implemented by the storage backends that can be used to persist
+// the state of watched repositories.  Implementations must be safe for concurrent use.
+//
+type StateStore interface {
+	// Load returns the state for the repository key, or nil if the key is not known
+	Load(key string) (state *RepoState, err kv.Error)
+	// Save stores the state replacing any existing state for the same key
+	Save(state *RepoState) (err kv.Error)
+	// Delete removes any state associated with the key
+	Delete(key string) (err kv.Error)
+	// List returns the state for all known repositories ordered by URL
+	List() (states []*RepoState, err kv.Error)
+}
+
+// FileStateStore is a StateStore that keeps the state of all repositories within a single
+// JSON document that is rewritten atomically on every change
+//
+type FileStateStore struct {
+	fn     string
+	states map[string]*RepoState
+	sync.Mutex
+}
+
+// NewFileStateStore will load, or create, the state file within the supplied directory.  Any
+// manifest files left by older versions of the watcher, named using the '.last' extension,
+// are imported into the store and then removed.
+//
+func NewFileStateStore(dir string) (store *FileStateStore, err kv.Error) {
+	store = &FileStateStore{
+		fn:     filepath.Join(dir, stateFN),
+		states: map[string]*RepoState{},
+	}
+
+	content, errGo := ioutil.ReadFile(store.fn)
+	if errGo != nil && !os.IsNotExist(errGo) {
+		return nil, kv.Wrap(errGo).With("file", store.fn, "stack", stack.Trace().TrimRuntime())
+	}
+	if len(content) != 0 {
+		states := []*RepoState{}
+		if errGo = json.Unmarshal(content, &states); errGo != nil {
+			return nil, kv.Wrap(errGo, "corrupted watcher state").With("file", store.fn, "stack", stack.Trace().TrimRuntime())
+		}
+		for _, state := range states {
+			store.states[state.Key] = state
+		}
+	}
+
+	legacy, errGo := filepath.Glob(filepath.Join(dir, "*.last"))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", dir, "stack", stack.Trace().TrimRuntime())
+	}
+	if len(legacy) == 0 {
+		return store, nil
+	}
+
+	for _, fn := range legacy {
+		key := strings.TrimSuffix(filepath.Base(fn), ".last")
+		if _, isPresent := store.states[key]; isPresent {
+			continue
+		}
+		hash, errGo := ioutil.ReadFile(fn)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", fn, "stack", stack.Trace().TrimRuntime())
+		}
+		// The older manifests were only written after the notification was delivered
+		// so the commit is treated as having been acknowledged
+		store.states[key] = &RepoState{
+			Key:       key,
+			LastSeen:  string(hash),
+			LastAcked: string(hash),
+		}
+	}
+
+	if err = store.flush(); err != nil {
+		return nil, err
+	}
+
+	for _, fn := range legacy {
+		os.Remove(fn)
+	}
+	return store, nil
+}
+
+// flush writes all states to disk, the caller is expected to hold the lock
+func (store *FileStateStore) flush() (err kv.Error) {
+	states := make([]*RepoState, 0, len(store.states))
+	for _, state := range store.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+
+	content, errGo := json.MarshalIndent(states, "", "  ")
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", store.fn, "stack", stack.Trace().TrimRuntime())
+	}
+
+	// Write to a temporary file and rename it so that a crash cannot leave a partially
+	// written state file behind
+	tmp, errGo := ioutil.TempFile(filepath.Dir(store.fn), stateFN)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", store.fn, "stack", stack.Trace().TrimRuntime())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, errGo = tmp.Write(content); errGo != nil {
+		tmp.Close()
+		return kv.Wrap(errGo).With("file", tmp.Name(), "stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = tmp.Sync(); errGo != nil {
+		tmp.Close()
+		return kv.Wrap(errGo).With("file", tmp.Name(), "stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = tmp.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", tmp.Name(), "stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = os.Rename(tmp.Name(), store.fn); errGo != nil {
+		return kv.Wrap(errGo).With("file", store.fn, "stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Load returns a copy of the state for the repository key, or nil if the key is not known
+//
+func (store *FileStateStore) Load(key string) (state *RepoState, err kv.Error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if state, isPresent := store.states[key]; isPresent {
+		return state.clone(), nil
+	}
+	return nil, nil
+}
+
+// Save stores a copy of the state and persists the store
+//
+func (store *FileStateStore) Save(state *RepoState) (err kv.Error) {
+	if state == nil || len(state.Key) == 0 {
+		return kv.NewError("repository state has no key").With("stack", stack.Trace().TrimRuntime())
+	}
+	store.Lock()
+	defer store.Unlock()
+
+	store.states[state.Key] = state.clone()
+	return store.flush()
+}
+
+// Delete removes the state for a repository key and persists the store
+//
+func (store *FileStateStore) Delete(key string) (err kv.Error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, isPresent := store.states[key]; !isPresent {
+		return nil
+	}
+	delete(store.states, key)
+	return store.flush()
+}
+
+// List returns copies of the state for all known repositories ordered by URL
+//
+func (store *FileStateStore) List() (states []*RepoState, err kv.Error) {
+	store.Lock()
+	defer store.Unlock()
+
+	states = make([]*RepoState, 0, len(store.states))
+	for _, state := range store.states {
+		states = append(states, state.clone())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].URL != states[j].URL {
+			return states[i].URL < states[j].URL
+		}
+		return states[i].Key < states[j].Key
+	})
+	return states, nil
+}
@@ -0,0 +1,79 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileStateStore exercises the persistence of repository state across instances
+// of the file backed store, including the import of legacy manifest files
+//
+func TestFileStateStore(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "test-state-store")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// Simulate a manifest written by an older watcher
+	legacyFN := filepath.Join(dir, "legacykey.last")
+	if errGo = ioutil.WriteFile(legacyFN, []byte("abcdef"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	store, err := NewFileStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = os.Stat(legacyFN); !os.IsNotExist(errGo) {
+		t.Fatal("legacy manifest file was not removed after being imported")
+	}
+
+	legacy, err := store.Load("legacykey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy == nil || legacy.LastAcked != "abcdef" {
+		t.Fatal("legacy manifest file was not imported", legacy)
+	}
+
+	state := &RepoState{Key: "key", URL: "https://example.com/repo", Branch: "main", LastSeen: "1234"}
+	for i := 0; i != maxRepoErrors+2; i++ {
+		state.AddError("failure")
+	}
+	if err = store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the store and make sure the state survived
+	store, err = NewFileStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatal("unexpected number of repositories", len(states))
+	}
+	loaded, err := store.Load("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || loaded.URL != state.URL || loaded.LastSeen != state.LastSeen || len(loaded.LastAcked) != 0 {
+		t.Fatal("repository state was not persisted", loaded)
+	}
+	if len(loaded.Errors) != maxRepoErrors {
+		t.Fatal("repository errors were not trimmed", len(loaded.Errors))
+	}
+
+	if err = store.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = store.Load("key"); err != nil || loaded != nil {
+		t.Fatal("repository state was not deleted", loaded, err)
+	}
+}
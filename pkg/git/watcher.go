@@ -21,11 +21,16 @@ import (
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv"
 	"github.com/karlmutch/base62"
+	"github.com/karlmutch/duat/pkg/metrics"
 	"github.com/ulule/deepcopier"
 
+	"gopkg.in/src-d/go-billy.v4/osfs"
 	gogit "gopkg.in/src-d/go-git.v4" // Not forked due to depency tree being too complex, src-d however are a serious org so I dont expect the repo to disappear
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
 )
 
 var (
@@ -36,24 +41,86 @@ var (
 
 // GitOptions encapsulates the parameters describing a clone repositories branch etc
 //
+// When Mirror is set the repository is kept as a bare clone that is only ever fetched, the
+// Depth and SingleBranch clone options can be used to further reduce the size of the mirror.
+// Consumers can use the Checkout method of the Change to obtain a worktree when one is needed.
+//
 type GitOptions struct {
 	CloneOptions *gogit.CloneOptions
 	Branch       string
+	Mirror       bool
 }
 
 // GitWatcher encapsulates the state and control structures around a single clone repository that
 // is being watched and processed
 //
+// When RequireAck is set the consumer of changes must call Ack once a change has been processed,
+// until then the change will be sent again after the watcher is restarted.  When it is not set
+// the delivery of a change to the consumers channel is treated as an acknowledgement.
+//
 type GitWatcher struct {
-	Dir     string
-	Repos   map[string]monitored
-	Remove  bool
-	Ctx     context.Context
-	Cancel  context.CancelFunc
-	Stopped chan struct{}
+	Dir        string
+	Repos      map[string]monitored
+	RemoveDir  bool       // Remove the Dir when the watcher is stopped
+	Store      StateStore // Durable state for the watched repositories
+	RequireAck bool
+	Ctx        context.Context
+	Cancel     context.CancelFunc
+	Stopped    chan struct{}
+
+	pending   map[string]string // Commits sent to consumers that are not yet acknowledged
+	delivered map[string]string // The commit most recently sent to consumers for each repository
+	pollLock  sync.Mutex        // Serializes access to the clone directories
+	metrics   watcherMetrics
+	interval  time.Duration
+	lastPass  time.Time // The time at which the last pass over all repositories completed
 	sync.Mutex
 }
 
+// watcherMetrics contains the instruments used to report on the activities of the watcher,
+// all of which are safe to use when metrics have not been enabled
+//
+type watcherMetrics struct {
+	pollSeconds *metrics.Histogram
+	pollErrors  *metrics.Counter
+	changes     *metrics.Counter
+}
+
+// EnableMetrics will report the activities of the watcher into the supplied registry and
+// add a health check that fails if the watcher has stopped, or stalled
+//
+func (gw *GitWatcher) EnableMetrics(reg *metrics.Registry) {
+	gw.Lock()
+	defer gw.Unlock()
+
+	gw.metrics = watcherMetrics{
+		pollSeconds: reg.Histogram("duat_git_poll_duration_seconds", "Time taken to fetch and check a watched repository", nil, "repo"),
+		pollErrors:  reg.Counter("duat_git_poll_errors_total", "Number of errors seen while checking a watched repository", "repo"),
+		changes:     reg.Counter("duat_git_changes_total", "Number of changes detected and sent to consumers", "repo"),
+	}
+
+	reg.AddHealthCheck("git-watcher", func() (err kv.Error) {
+		select {
+		case <-gw.Stopped:
+			return kv.NewError("git watcher has stopped").With("dir", gw.Dir)
+		default:
+		}
+
+		gw.Lock()
+		defer gw.Unlock()
+
+		if gw.interval == 0 {
+			return nil
+		}
+		// A pass can legitimately take a while when large repositories are cloned so
+		// allow several intervals before deciding the watcher is stuck
+		if stalled := time.Since(gw.lastPass); stalled > 3*gw.interval+time.Minute {
+			return kv.NewError("git watcher has stalled").With("dir", gw.Dir, "since", gw.lastPass.String())
+		}
+		return nil
+	})
+}
+
 func getDirHash(repoURL string) (encodedHash string) {
 	h := sha256.New()
 	h.Write([]byte(repoURL))
@@ -114,6 +181,7 @@ type Change struct {
 	URL    string
 	Dir    string
 	Commit string
+	Mirror bool // Dir contains a bare mirror rather than a worktree
 }
 
 type monitored struct {
@@ -121,10 +189,229 @@ type monitored struct {
 	triggerC chan *Change
 }
 
+// recordError reports the error to the logger and retains it within the durable state
+// of the repository that it was observed against
+//
+func (gw *GitWatcher) recordError(key string, url string, errGo error, loggerC chan<- *LoggerSink) {
+	if errGo == nil {
+		return
+	}
+	reportError(errGo, loggerC)
+
+	gw.Lock()
+	gw.metrics.pollErrors.Inc(url)
+	gw.Unlock()
+
+	state, err := gw.Store.Load(key)
+	if err != nil {
+		reportError(err, loggerC)
+		return
+	}
+	if state == nil {
+		return
+	}
+	state.AddError(errGo.Error())
+	if err = gw.Store.Save(state); err != nil {
+		reportError(err, loggerC)
+	}
+}
+
+// refreshWorktree will clone, or pull, a repository into a directory with a full worktree
+// checked out at the head of the watched branch, returning the commit of the branch head
+//
+func refreshWorktree(ctx context.Context, dirName string, options *GitOptions) (refHash string, errGo error) {
+	if _, errGo := os.Stat(dirName); os.IsNotExist(errGo) {
+		// Git clone into this name
+		if _, errGo = gogit.PlainCloneContext(ctx, dirName, false, options.CloneOptions); errGo != nil {
+			return "", errGo
+		}
+	}
+
+	// Opens a cloned repository
+	repo, errGo := gogit.PlainOpen(dirName)
+	if errGo != nil {
+		return "", errGo
+	}
+	tree, errGo := repo.Worktree()
+	if errGo != nil {
+		return "", errGo
+	}
+
+	refs, errGo := repo.References()
+	if errGo != nil {
+		return "", errGo
+	}
+
+	gitHash := plumbing.Hash{}
+	branchRef := path.Join("refs", "remotes", "origin", options.Branch)
+	errGo = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().String() == branchRef {
+			gitHash = ref.Hash()
+		}
+		return nil
+	})
+	if errGo != nil {
+		return "", errGo
+	}
+	refHash = gitHash.String()
+
+	checkout := &gogit.CheckoutOptions{
+		Branch: "",
+		Hash:   gitHash,
+		Create: false,
+		Force:  true,
+	}
+	if errGo = tree.Checkout(checkout); errGo != nil {
+		// If we had an error then make sure to remove the directory that is already present but only
+		// if we see a .git subdirectory indicating it is a real git project directory
+		dotGit := filepath.Join(dirName, ".git")
+		if _, errStat := os.Stat(dotGit); errStat == nil {
+			os.RemoveAll(dirName)
+		}
+		return "", errGo
+	}
+
+	errGo = tree.PullContext(ctx, &gogit.PullOptions{
+		ReferenceName: plumbing.ReferenceName(path.Join("refs", "heads", options.Branch)),
+		Force:         true,
+	})
+	if errGo != nil && errGo != gogit.NoErrAlreadyUpToDate {
+		return "", errGo
+	}
+	return refHash, nil
+}
+
+// refreshMirror will clone, or fetch, a repository into a bare directory without a
+// worktree, returning the commit of the head of the watched branch
+//
+func refreshMirror(ctx context.Context, dirName string, options *GitOptions) (refHash string, errGo error) {
+	branchRef := plumbing.NewRemoteReferenceName("origin", options.Branch)
+
+	if _, errGo = os.Stat(dirName); os.IsNotExist(errGo) {
+		cloneOpts := *options.CloneOptions
+		cloneOpts.NoCheckout = true
+		cloneOpts.RecurseSubmodules = gogit.NoRecurseSubmodules
+		if cloneOpts.SingleBranch {
+			cloneOpts.ReferenceName = plumbing.NewBranchReferenceName(options.Branch)
+		}
+		if _, errGo = gogit.PlainCloneContext(ctx, dirName, true, &cloneOpts); errGo != nil {
+			// Dont leave a partial mirror behind as it would be reused on the next check
+			os.RemoveAll(dirName)
+			return "", errGo
+		}
+	}
+
+	repo, errGo := gogit.PlainOpen(dirName)
+	if errGo != nil {
+		return "", errGo
+	}
+
+	refSpec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	if options.CloneOptions.SingleBranch {
+		refSpec = config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(options.Branch), branchRef))
+	}
+
+	errGo = repo.FetchContext(ctx, &gogit.FetchOptions{
+		RefSpecs: []config.RefSpec{refSpec},
+		Depth:    options.CloneOptions.Depth,
+		Auth:     options.CloneOptions.Auth,
+		Force:    true,
+	})
+	if errGo != nil && errGo != gogit.NoErrAlreadyUpToDate {
+		return "", errGo
+	}
+
+	ref, errGo := repo.Reference(branchRef, true)
+	if errGo != nil {
+		return "", errGo
+	}
+	return ref.Hash().String(), nil
+}
+
+// poll will refresh the clone for a single repository and return a change if the head of the
+// watched branch has a commit that has not been acknowledged by the consumer, and that
+// has not already been sent to the consumer by this watcher
+//
+func (gw *GitWatcher) poll(ctx context.Context, k string, v monitored, loggerC chan<- *LoggerSink) (change *Change) {
+
+	gw.pollLock.Lock()
+	defer gw.pollLock.Unlock()
+
+	if len(v.options.Branch) == 0 {
+		v.options.Branch = "master"
+	}
+
+	dirName := filepath.Join(gw.Dir, k)
+
+	refresh := refreshWorktree
+	if v.options.Mirror {
+		refresh = refreshMirror
+	}
+	refHash, errGo := refresh(ctx, dirName, v.options)
+	if errGo != nil {
+		gw.recordError(k, v.options.CloneOptions.URL, errGo, loggerC)
+		return nil
+	}
+
+	// Check for updates on any of the repositories by comparing the head of the branch
+	// with the last commit the consumer acknowledged
+	state, err := gw.Store.Load(k)
+	if err != nil {
+		reportError(err, loggerC)
+		return nil
+	}
+	if state == nil {
+		state = &RepoState{Key: k}
+	}
+	state.URL = v.options.CloneOptions.URL
+	state.Branch = v.options.Branch
+
+	if state.LastSeen != refHash {
+		state.LastSeen = refHash
+		state.SeenAt = time.Now()
+	}
+	if err = gw.Store.Save(state); err != nil {
+		reportError(err, loggerC)
+		return nil
+	}
+
+	if state.LastAcked == refHash {
+		return nil
+	}
+
+	gw.Lock()
+	defer gw.Unlock()
+
+	// The repository might have been removed while it was being fetched
+	if _, isPresent := gw.Repos[k]; !isPresent {
+		return nil
+	}
+	// Dont send the same commit a second time while the consumer is still working on it
+	if gw.pending[k] == refHash {
+		return nil
+	}
+
+	if v.triggerC == nil {
+		gw.metrics.pollErrors.Inc(v.options.CloneOptions.URL)
+		reportError(kv.NewError("no trigger channel").With("url", v.options.CloneOptions.URL), loggerC)
+		return nil
+	}
+	return &Change{URL: v.options.CloneOptions.URL,
+		Dir:    dirName,
+		Commit: refHash,
+		Mirror: v.options.Mirror,
+	}
+}
+
 func (gw *GitWatcher) watcher(ctx context.Context, interval time.Duration, loggerC chan<- *LoggerSink) {
 
 	defer close(gw.Stopped)
 
+	gw.Lock()
+	gw.interval = interval
+	gw.lastPass = time.Now()
+	gw.Unlock()
+
 	// On the first pass only we check almost immediately
 	firstPass := true
 	ticker := time.NewTicker(time.Second)
@@ -146,122 +433,50 @@ func (gw *GitWatcher) watcher(ctx context.Context, interval time.Duration, logge
 			}
 			gw.Unlock()
 			for k, v := range checkRepos {
-				dirName := filepath.Join(gw.Dir, k)
-				if _, errGo := os.Stat(dirName); os.IsNotExist(errGo) {
-					// Git clone into this name
-					if _, errGo = gogit.PlainCloneContext(ctx, dirName, false, v.options.CloneOptions); errGo != nil {
-						reportError(errGo, loggerC)
-						continue
-					}
-				}
-
-				// Opens a cloned repository
-				repo, errGo := gogit.PlainOpen(dirName)
-				if errGo != nil {
-					reportError(errGo, loggerC)
-					continue
-				}
-				if len(v.options.Branch) == 0 {
-					v.options.Branch = "master"
-				}
+				startPoll := time.Now()
+				change := gw.poll(ctx, k, v, loggerC)
 
-				tree, errGo := repo.Worktree()
-				if errGo != nil {
-					reportError(errGo, loggerC)
-					continue
-				}
-
-				refs, errGo := repo.References()
-				if errGo != nil {
-					reportError(errGo, loggerC)
-					continue
-				}
+				gw.Lock()
+				reporter := gw.metrics
+				gw.Unlock()
 
-				gitHash := plumbing.Hash{}
-				branchRef := path.Join("refs", "remotes", "origin", v.options.Branch)
-				errGo = refs.ForEach(func(ref *plumbing.Reference) error {
-					if ref.Name().String() == branchRef {
-						gitHash = ref.Hash()
-					}
-					return nil
-				})
-				if errGo != nil {
-					reportError(errGo, loggerC)
+				reporter.pollSeconds.Observe(time.Since(startPoll).Seconds(), v.options.CloneOptions.URL)
+				if change == nil {
 					continue
 				}
-				refHash := gitHash.String()
-
-				options := &gogit.CheckoutOptions{
-					Branch: "",
-					Hash:   gitHash,
-					Create: false,
-					Force:  true,
+				reporter.changes.Inc(v.options.CloneOptions.URL)
+
+				// The commit is recorded as pending before it is sent so that an Ack arriving
+				// as soon as the consumer receives the change cannot be overwritten
+				gw.Lock()
+				gw.delivered[k] = change.Commit
+				if gw.RequireAck {
+					gw.pending[k] = change.Commit
 				}
-				if errGo = tree.Checkout(options); errGo != nil {
-					reportError(errGo, loggerC)
-					// If we had an error then make sure to remove the directory that is already present but only
-					// if we see a .git subdirectory indicating it is a real git project directory
-					dotGit := filepath.Join(dirName, ".git")
-					if _, errGo = os.Stat(dotGit); errGo == nil {
-						os.RemoveAll(dirName)
-					}
-					continue
+				gw.Unlock()
+
+				// Block on sending the notification to the listener, or the system
+				// is shutdown
+				select {
+				case v.triggerC <- change:
+				case <-ctx.Done():
+					return
 				}
 
-				errGo = tree.PullContext(ctx, &gogit.PullOptions{
-					ReferenceName: plumbing.ReferenceName(path.Join("refs", "heads", v.options.Branch)),
-					Force:         true,
-				})
-				if errGo != nil && errGo != gogit.NoErrAlreadyUpToDate {
-					reportError(errGo, loggerC)
+				if gw.RequireAck {
 					continue
 				}
-
-				lastKnownHash := ""
-
-				update := false
-
-				// Check for updates on any of the repositories by looking at the
-				// URL hash file inside the main working directory manifest file
-				manifestFN := filepath.Join(gw.Dir, k+".last")
-				if _, errGo = os.Stat(manifestFN); os.IsNotExist(errGo) {
-					update = true
-				} else {
-					if content, errGo := ioutil.ReadFile(manifestFN); errGo != nil {
-						reportError(errGo, loggerC)
-						update = true
-					} else {
-						lastKnownHash = string(content)
-					}
-				}
-				if lastKnownHash != refHash {
-					update = true
-				}
-
-				if update {
-					if v.triggerC == nil {
-						reportError(kv.NewError("no trigger channel"), loggerC)
-						continue
-					}
-					change :=
-						&Change{URL: v.options.CloneOptions.URL,
-							Dir:    dirName,
-							Commit: refHash,
-						}
-					// Block on sending the notification to the listener, or the system
-					// is shutdown
-					select {
-					case v.triggerC <- change:
-					case <-ctx.Done():
-						return
-					}
-					if errGo = ioutil.WriteFile(manifestFN, []byte(refHash), 0600); errGo != nil {
-						reportError(errGo, loggerC)
-						continue
-					}
+				// Without explicit acknowledgements the delivery of the change is treated as
+				// the change having been processed
+				if err := gw.Ack(change.URL, change.Commit, nil); err != nil {
+					reportError(err, loggerC)
 				}
 			}
 
+			gw.Lock()
+			gw.lastPass = time.Now()
+			gw.Unlock()
+
 		case <-ctx.Done():
 			return
 		}
@@ -275,6 +490,77 @@ func (gw *GitWatcher) watcher(ctx context.Context, interval time.Duration, logge
 	}
 }
 
+// checkoutStorage is a git storer that obtains objects from an existing repository while keeping
+// the references and index for a worktree in memory.  This allows many worktrees to be produced
+// from a single clone, or mirror, without them interfering with each other.
+//
+type checkoutStorage struct {
+	*memory.Storage
+	objects storer.EncodedObjectStorer
+}
+
+func (s *checkoutStorage) NewEncodedObject() plumbing.EncodedObject {
+	return s.objects.NewEncodedObject()
+}
+
+func (s *checkoutStorage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	return s.objects.SetEncodedObject(obj)
+}
+
+func (s *checkoutStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	return s.objects.EncodedObject(t, h)
+}
+
+func (s *checkoutStorage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	return s.objects.IterEncodedObjects(t)
+}
+
+func (s *checkoutStorage) HasEncodedObject(h plumbing.Hash) error {
+	return s.objects.HasEncodedObject(h)
+}
+
+func (s *checkoutStorage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	return s.objects.EncodedObjectSize(h)
+}
+
+// Checkout will materialize the files for the commit of the change into the supplied directory.
+// The directory will not contain git metadata, it is intended for the consumer to build or
+// otherwise process the files for the commit.
+//
+func (change *Change) Checkout(dir string) (err kv.Error) {
+	repo, errGo := gogit.PlainOpen(change.Dir)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", change.Dir, "stack", stack.Trace().TrimRuntime())
+	}
+
+	hash := plumbing.NewHash(change.Commit)
+
+	storage := &checkoutStorage{
+		Storage: memory.NewStorage(),
+		objects: repo.Storer,
+	}
+	if errGo = storage.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash)); errGo != nil {
+		return kv.Wrap(errGo).With("commit", change.Commit, "stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo = os.MkdirAll(dir, 0700); errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir, "stack", stack.Trace().TrimRuntime())
+	}
+
+	worktree, errGo := gogit.Open(storage, osfs.New(dir))
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir, "stack", stack.Trace().TrimRuntime())
+	}
+	tree, errGo := worktree.Worktree()
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir, "stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = tree.Checkout(&gogit.CheckoutOptions{Hash: hash, Force: true}); errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir, "commit", change.Commit, "stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
 // NewGitWatcher will initiate a git repositry watching go routine and struct that
 // will process git activity in a goroutine.  New repositories can be added to the
 // watcher using the returned watcher structure and channels.
@@ -282,10 +568,12 @@ func (gw *GitWatcher) watcher(ctx context.Context, interval time.Duration, logge
 func NewGitWatcher(ctx context.Context, baseDir string, loggerC chan<- *LoggerSink) (watcher *GitWatcher, err kv.Error) {
 
 	watcher = &GitWatcher{
-		Dir:     baseDir,
-		Repos:   map[string]monitored{},
-		Remove:  false,
-		Stopped: make(chan struct{}, 1),
+		Dir:       baseDir,
+		Repos:     map[string]monitored{},
+		RemoveDir: false,
+		Stopped:   make(chan struct{}, 1),
+		pending:   map[string]string{},
+		delivered: map[string]string{},
 	}
 
 	if len(baseDir) == 0 {
@@ -294,7 +582,7 @@ func NewGitWatcher(ctx context.Context, baseDir string, loggerC chan<- *LoggerSi
 			return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
 		watcher.Dir = tmp
-		watcher.Remove = true
+		watcher.RemoveDir = true
 	} else {
 		stat, errGo := os.Stat(baseDir)
 		if os.IsNotExist(errGo) {
@@ -305,6 +593,10 @@ func NewGitWatcher(ctx context.Context, baseDir string, loggerC chan<- *LoggerSi
 		}
 	}
 
+	if watcher.Store, err = NewFileStateStore(watcher.Dir); err != nil {
+		return nil, err
+	}
+
 	defer func() {
 		initWatcher.Do(
 			func() {
@@ -326,6 +618,18 @@ func (gw *GitWatcher) Add(url string, branch string, token string, triggerC chan
 		},
 		Branch: branch,
 	}
+	return gw.AddWithOptions(gitOptions, token, triggerC)
+}
+
+// AddWithOptions is used to register a repository to watch for changes using options supplied
+// by the caller, for example to use a bare mirror of the repository
+//
+func (gw *GitWatcher) AddWithOptions(gitOptions *GitOptions, token string, triggerC chan *Change) (err kv.Error) {
+	if gitOptions == nil || gitOptions.CloneOptions == nil {
+		return kv.NewError("clone options not specified").With("stack", stack.Trace().TrimRuntime())
+	}
+	url := gitOptions.CloneOptions.URL
+	branch := gitOptions.Branch
 
 	if len(token) != 0 {
 		// The intended use of a GitHub personal access token is in replace of your password
@@ -355,9 +659,98 @@ func (gw *GitWatcher) Add(url string, branch string, token string, triggerC chan
 		triggerC: triggerC,
 	}
 
+	// Retain any history for the repository from previous runs of the watcher
+	state, err := gw.Store.Load(urlHash)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &RepoState{Key: urlHash}
+	}
+	state.URL = url
+	state.Branch = branch
+
+	return gw.Store.Save(state)
+}
+
+// Ack is used by the consumer of changes to indicate that a commit has been processed.  If
+// processing failed the failure should be supplied, it will be recorded and the commit will be
+// sent to the consumer again on the next check of the repository.  Acknowledgements of
+// commits older than the one most recently sent, or seen, are ignored.
+//
+func (gw *GitWatcher) Ack(url string, commit string, failure error) (err kv.Error) {
+	urlHash := getDirHash(url)
+
+	gw.Lock()
+	defer gw.Unlock()
+
+	// Only the acknowledgement of the commit that was last sent releases the repository
+	// for redelivery, a late Ack for an older commit leaves the newer one pending
+	if gw.pending[urlHash] == commit {
+		delete(gw.pending, urlHash)
+	}
+
+	state, err := gw.Store.Load(urlHash)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return kv.NewError("url not known to the git watcher").With("url", url, "hash", urlHash, "stack", stack.Trace().TrimRuntime())
+	}
+
+	if failure != nil {
+		state.AddError(failure.Error())
+	} else {
+		// A late Ack for an older commit must not move LastAcked backwards as the commits
+		// already acknowledged would then be sent again
+		if commit != gw.delivered[urlHash] && commit != state.LastSeen {
+			return nil
+		}
+		state.LastAcked = commit
+		state.AckedAt = time.Now()
+	}
+
+	return gw.Store.Save(state)
+}
+
+// Remove stops a repository from being watched, discarding its state and the clone
+// of the repository
+//
+func (gw *GitWatcher) Remove(url string) (err kv.Error) {
+	urlHash := getDirHash(url)
+
+	// Wait for any check of repositories that is in progress to complete before
+	// the clone is removed
+	gw.pollLock.Lock()
+	defer gw.pollLock.Unlock()
+
+	gw.Lock()
+	defer gw.Unlock()
+
+	if _, isPresent := gw.Repos[urlHash]; !isPresent {
+		return kv.NewError("url not present in the git watcher").With("url", url, "hash", urlHash, "stack", stack.Trace().TrimRuntime())
+	}
+	delete(gw.Repos, urlHash)
+	delete(gw.pending, urlHash)
+	delete(gw.delivered, urlHash)
+
+	if err = gw.Store.Delete(urlHash); err != nil {
+		return err
+	}
+
+	if errGo := os.RemoveAll(filepath.Join(gw.Dir, urlHash)); errGo != nil {
+		return kv.Wrap(errGo).With("url", url, "hash", urlHash, "stack", stack.Trace().TrimRuntime())
+	}
 	return nil
 }
 
+// List returns the state of all repositories known to the watcher, including any
+// repositories from earlier runs that have not been added again
+//
+func (gw *GitWatcher) List() (states []*RepoState, err kv.Error) {
+	return gw.Store.List()
+}
+
 // Stop will stop the listening go routine that was initialized by the NewGitWatcher function.
 //
 func (gw *GitWatcher) Stop(ctx context.Context) (orderly bool) {
@@ -389,7 +782,7 @@ func (gw *GitWatcher) Stop(ctx context.Context) (orderly bool) {
 	// only happen if the storage area for the repository was
 	// known and supplied by the caller
 	//
-	if gw.Remove {
+	if gw.RemoveDir {
 		os.RemoveAll(gw.Dir)
 	}
 
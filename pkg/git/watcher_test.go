@@ -0,0 +1,155 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitFile will write a file into a worktree and commit it returning the commit hash
+//
+func commitFile(t *testing.T, repo *gogit.Repository, dir string, fn string, content string) (hash string) {
+	if errGo := ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	tree, errGo := repo.Worktree()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, errGo = tree.Add(fn); errGo != nil {
+		t.Fatal(errGo)
+	}
+	commit, errGo := tree.Commit("test commit", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "duat", Email: "duat@example.com", When: time.Now()},
+	})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	return commit.String()
+}
+
+// TestMirrorCheckout uses a local repository to validate that a bare mirror tracks the
+// watched branch and can materialize a worktree for a commit on request
+//
+func TestMirrorCheckout(t *testing.T) {
+	// The local file transport used by the clone relies on the git upload pack binary
+	if _, errGo := exec.LookPath("git"); errGo != nil {
+		t.Skip("git binary unavailable")
+	}
+
+	baseDir, errGo := ioutil.TempDir("", "test-mirror")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(baseDir)
+
+	srcDir := filepath.Join(baseDir, "src")
+	src, errGo := gogit.PlainInit(srcDir, false)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	first := commitFile(t, src, srcDir, "file.txt", "first")
+
+	options := &GitOptions{
+		CloneOptions: &gogit.CloneOptions{URL: srcDir},
+		Branch:       "master",
+		Mirror:       true,
+	}
+	mirrorDir := filepath.Join(baseDir, "mirror")
+
+	hash, errGo := refreshMirror(context.Background(), mirrorDir, options)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if hash != first {
+		t.Fatal("mirror did not track the first commit", hash, first)
+	}
+	if _, errGo = os.Stat(filepath.Join(mirrorDir, "file.txt")); !os.IsNotExist(errGo) {
+		t.Fatal("mirror unexpectedly contains a worktree")
+	}
+
+	second := commitFile(t, src, srcDir, "file.txt", "second")
+	if hash, errGo = refreshMirror(context.Background(), mirrorDir, options); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if hash != second {
+		t.Fatal("mirror did not track the second commit", hash, second)
+	}
+
+	// Materialize the first commit and make sure the content is from that commit
+	change := &Change{URL: srcDir, Dir: mirrorDir, Commit: first, Mirror: true}
+	outDir := filepath.Join(baseDir, "checkout")
+	if err := change.Checkout(outDir); err != nil {
+		t.Fatal(err)
+	}
+	content, errGo := ioutil.ReadFile(filepath.Join(outDir, "file.txt"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if string(content) != "first" {
+		t.Fatal("materialized worktree has unexpected content", string(content))
+	}
+}
+
+// TestAckPending validates that only the acknowledgement of the commit that was last sent
+// releases a repository for redelivery
+//
+func TestAckPending(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "test-ack")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStateStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	url := "https://example.com/repo.git"
+	key := getDirHash(url)
+	if err = store.Save(&RepoState{Key: key, URL: url, Branch: "master", LastSeen: "second"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	gw := &GitWatcher{
+		Store:      store,
+		RequireAck: true,
+		pending:    map[string]string{key: "second"},
+		delivered:  map[string]string{key: "second"},
+	}
+
+	// A late acknowledgement of an older commit must leave the newer commit pending
+	if err = gw.Ack(url, "first", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if gw.pending[key] != "second" {
+		t.Fatalf("pending commit was cleared by the ack of an older commit, %q", gw.pending[key])
+	}
+
+	if err = gw.Ack(url, "second", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, isPresent := gw.pending[key]; isPresent {
+		t.Fatal("pending commit was not cleared by its ack")
+	}
+
+	// Once acknowledged a late ack of an older commit must not move the state backwards
+	if err = gw.Ack(url, "first", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	state, err := store.Load(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if state.LastAcked != "second" {
+		t.Fatalf("the last acknowledged commit moved backwards to %q", state.LastAcked)
+	}
+}
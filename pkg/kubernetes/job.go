@@ -72,6 +72,7 @@ func (task *Task) runJob(ctx context.Context, logger chan *Status) (err kv.Error
 			if p, ok := event.Object.(*v1.Pod); ok {
 				switch p.Status.Phase {
 				case v1.PodFailed:
+					task.failed = kv.NewError("pod failed").With("id", task.start.ID, "namespace", task.start.Namespace, "message", p.Status.Message, "reason", p.Status.Reason)
 					task.sendStatus(ctx, logger, logxi.LevelInfo, kv.NewError("pod update").With("id", task.start.ID, "namespace", task.start.Namespace, "phase", p.Status.Phase))
 					return
 				case v1.PodSucceeded:
@@ -0,0 +1,45 @@
+package kubernetes
+
+// This file contains the instrumentation of the task runner
+
+import (
+	"sync"
+
+	"github.com/karlmutch/duat/pkg/metrics"
+)
+
+// taskMetrics contains the instruments used to report on tasks, all of which are safe
+// to use when metrics have not been enabled
+//
+type taskMetrics struct {
+	started   *metrics.Counter
+	succeeded *metrics.Counter
+	failed    *metrics.Counter
+	duration  *metrics.Histogram
+}
+
+var (
+	taskReporter     = taskMetrics{}
+	taskReporterLock sync.Mutex
+)
+
+// EnableMetrics will report the tasks started, and their outcomes and durations, by the
+// TasksRunner into the supplied registry
+//
+func EnableMetrics(reg *metrics.Registry) {
+	taskReporterLock.Lock()
+	defer taskReporterLock.Unlock()
+
+	taskReporter = taskMetrics{
+		started:   reg.Counter("duat_tasks_started_total", "Number of tasks started", "namespace"),
+		succeeded: reg.Counter("duat_tasks_succeeded_total", "Number of tasks that ran to completion successfully", "namespace"),
+		failed:    reg.Counter("duat_tasks_failed_total", "Number of tasks that failed", "namespace"),
+		duration:  reg.Histogram("duat_task_duration_seconds", "Time taken for tasks to complete", nil, "namespace", "outcome"),
+	}
+}
+
+func getTaskMetrics() (reporter taskMetrics) {
+	taskReporterLock.Lock()
+	defer taskReporterLock.Unlock()
+	return taskReporter
+}
@@ -91,10 +91,24 @@ func TasksRunner(ctx context.Context, debugMode bool, triggerC chan *TaskSpec, s
 
 			task.sendStatus(ctx, statusC, logxi.LevelInfo, kv.NewError("change detected").With("dir", msg.Dir))
 
+			reporter := getTaskMetrics()
+			reporter.started.Inc(msg.Namespace)
+			startTime := time.Now()
+
 			if err := task.initialize(ctx, debugMode, statusC); err != nil {
+				reporter.failed.Inc(msg.Namespace)
+				reporter.duration.Observe(time.Since(startTime).Seconds(), msg.Namespace, "failed")
 				task.sendStatus(ctx, statusC, logxi.LevelFatal, err)
 				continue
 			}
+
+			if task.failed != nil {
+				reporter.failed.Inc(msg.Namespace)
+				reporter.duration.Observe(time.Since(startTime).Seconds(), msg.Namespace, "failed")
+				continue
+			}
+			reporter.succeeded.Inc(msg.Namespace)
+			reporter.duration.Observe(time.Since(startTime).Seconds(), msg.Namespace, "succeeded")
 		}
 	}
 }
@@ -0,0 +1,395 @@
+package metrics
+
+// This file contains the implementation of a small metrics registry that renders its
+// contents using the Prometheus text exposition format, along with HTTP handlers for
+// scraping the metrics and probing the health of the components that report into it.
+//
+// The registry is intentionally minimal, supporting counters, gauges and histograms with
+// labels, so that components can be instrumented without pulling the Prometheus client
+// libraries and their dependencies into the projects that use duat.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+var (
+	// DefBuckets are the default histogram buckets, in seconds, suitable for timing
+	// network operations and builds
+	DefBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// HealthCheck is a function that returns an error if the component it checks is unhealthy
+//
+type HealthCheck func() (err kv.Error)
+
+// Registry contains a collection of metric families along with health checks.  A nil
+// Registry is valid and discards everything that is reported to it.
+//
+type Registry struct {
+	families map[string]*family
+	checks   map[string]HealthCheck
+	sync.Mutex
+}
+
+// NewRegistry creates an empty metrics registry
+//
+func NewRegistry() (reg *Registry) {
+	return &Registry{
+		families: map[string]*family{},
+		checks:   map[string]HealthCheck{},
+	}
+}
+
+// series holds the values for a single combination of label values
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // Non-cumulative counts, one per bucket plus one for +Inf
+	count   uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+	sync.Mutex
+}
+
+func (fam *family) get(values []string) (s *series) {
+	if len(values) != len(fam.labels) {
+		// Pad, or truncate, so that mismatched instrumentation cannot break the output
+		fixed := make([]string, len(fam.labels))
+		copy(fixed, values)
+		values = fixed
+	}
+	key := strings.Join(values, "\xff")
+	if s = fam.series[key]; s == nil {
+		s = &series{labels: append([]string{}, values...)}
+		if fam.kind == typeHistogram {
+			s.buckets = make([]uint64, len(fam.buckets)+1)
+		}
+		fam.series[key] = s
+	}
+	return s
+}
+
+func (reg *Registry) family(name string, help string, kind string, buckets []float64, labels []string) (fam *family) {
+	if reg == nil {
+		return nil
+	}
+	reg.Lock()
+	defer reg.Unlock()
+
+	if fam = reg.families[name]; fam != nil {
+		if fam.kind == kind {
+			return fam
+		}
+		// A clash of types is a programming error, keep the first registration and
+		// hand back an instrument that is not exported
+		return &family{name: name, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+	}
+	fam = &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  append([]string{}, labels...),
+		buckets: append([]float64{}, buckets...),
+		series:  map[string]*series{},
+	}
+	sort.Float64s(fam.buckets)
+	reg.families[name] = fam
+	return fam
+}
+
+// Counter is a monotonically increasing value partitioned by label values
+//
+type Counter struct {
+	fam *family
+}
+
+// Counter returns the counter with the supplied name, creating it if it does not exist
+//
+func (reg *Registry) Counter(name string, help string, labels ...string) (c *Counter) {
+	return &Counter{fam: reg.family(name, help, typeCounter, nil, labels)}
+}
+
+// Inc adds one to the counter for the label values
+//
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds a positive value to the counter for the label values
+//
+func (c *Counter) Add(v float64, values ...string) {
+	if c == nil || c.fam == nil || v < 0 {
+		return
+	}
+	c.fam.Lock()
+	defer c.fam.Unlock()
+	c.fam.get(values).value += v
+}
+
+// Gauge is a value that can go up and down partitioned by label values
+//
+type Gauge struct {
+	fam *family
+}
+
+// Gauge returns the gauge with the supplied name, creating it if it does not exist
+//
+func (reg *Registry) Gauge(name string, help string, labels ...string) (g *Gauge) {
+	return &Gauge{fam: reg.family(name, help, typeGauge, nil, labels)}
+}
+
+// Set replaces the value of the gauge for the label values
+//
+func (g *Gauge) Set(v float64, values ...string) {
+	if g == nil || g.fam == nil {
+		return
+	}
+	g.fam.Lock()
+	defer g.fam.Unlock()
+	g.fam.get(values).value = v
+}
+
+// Add adds, or with a negative value subtracts, from the gauge for the label values
+//
+func (g *Gauge) Add(v float64, values ...string) {
+	if g == nil || g.fam == nil {
+		return
+	}
+	g.fam.Lock()
+	defer g.fam.Unlock()
+	g.fam.get(values).value += v
+}
+
+// Histogram counts observations into buckets partitioned by label values
+//
+type Histogram struct {
+	fam *family
+}
+
+// Histogram returns the histogram with the supplied name, creating it if it does not exist.
+// If no buckets are supplied DefBuckets will be used.
+//
+func (reg *Registry) Histogram(name string, help string, buckets []float64, labels ...string) (h *Histogram) {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	return &Histogram{fam: reg.family(name, help, typeHistogram, buckets, labels)}
+}
+
+// Observe records a single value in the histogram for the label values
+//
+func (h *Histogram) Observe(v float64, values ...string) {
+	if h == nil || h.fam == nil {
+		return
+	}
+	h.fam.Lock()
+	defer h.fam.Unlock()
+
+	s := h.fam.get(values)
+	i := sort.SearchFloat64s(h.fam.buckets, v)
+	s.buckets[i]++
+	s.count++
+	s.value += v
+}
+
+// AddHealthCheck registers a named check that will be run when the health endpoint
+// is requested
+//
+func (reg *Registry) AddHealthCheck(name string, check HealthCheck) {
+	if reg == nil {
+		return
+	}
+	reg.Lock()
+	defer reg.Unlock()
+	reg.checks[name] = check
+}
+
+// Health runs all of the health checks returning the failures indexed by the check name
+//
+func (reg *Registry) Health() (failures map[string]kv.Error) {
+	failures = map[string]kv.Error{}
+	if reg == nil {
+		return failures
+	}
+
+	reg.Lock()
+	checks := make(map[string]HealthCheck, len(reg.checks))
+	for name, check := range reg.checks {
+		checks[name] = check
+	}
+	reg.Unlock()
+
+	for name, check := range checks {
+		if err := check(); err != nil {
+			failures[name] = err
+		}
+	}
+	return failures
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func labelPairs(names []string, values []string, extra ...string) (pairs string) {
+	items := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		items = append(items, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		items = append(items, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(items) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(items, ",") + "}"
+}
+
+// Write renders all of the metrics in the registry using the Prometheus text format
+//
+func (reg *Registry) Write(out io.Writer) (err kv.Error) {
+	if reg == nil {
+		return nil
+	}
+
+	reg.Lock()
+	names := make([]string, 0, len(reg.families))
+	for name := range reg.families {
+		names = append(names, name)
+	}
+	families := reg.families
+	reg.Unlock()
+
+	sort.Strings(names)
+
+	w := bufio.NewWriter(out)
+	for _, name := range names {
+		reg.Lock()
+		fam := families[name]
+		reg.Unlock()
+
+		fam.writeTo(w)
+	}
+	if errGo := w.Flush(); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (fam *family) writeTo(w io.Writer) {
+	fam.Lock()
+	defer fam.Unlock()
+
+	if len(fam.help) != 0 {
+		fmt.Fprintf(w, "# HELP %s %s\n", fam.name, escapeHelp(fam.help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", fam.name, fam.kind)
+
+	keys := make([]string, 0, len(fam.series))
+	for key := range fam.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := fam.series[key]
+		if fam.kind != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", fam.name, labelPairs(fam.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+		cumulative := uint64(0)
+		for i, bound := range fam.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", fam.name, labelPairs(fam.labels, s.labels, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", fam.name, labelPairs(fam.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", fam.name, labelPairs(fam.labels, s.labels), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", fam.name, labelPairs(fam.labels, s.labels), s.count)
+	}
+}
+
+// MetricsHandler returns an HTTP handler that serves the registry contents for scraping
+//
+func (reg *Registry) MetricsHandler() (handler http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := reg.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// HealthHandler returns an HTTP handler that runs the health checks responding with
+// a 200 status when all checks pass and a 503 status listing the failures otherwise
+//
+func (reg *Registry) HealthHandler() (handler http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		failures := reg.Health()
+		if len(failures) == 0 {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+
+		names := make([]string, 0, len(failures))
+		for name := range failures {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s: %s\n", name, failures[name].Error())
+		}
+	})
+}
+
+// Handler returns an HTTP handler serving the /metrics and /healthz endpoints
+//
+func (reg *Registry) Handler() (handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg.MetricsHandler())
+	mux.Handle("/healthz", reg.HealthHandler())
+	return mux
+}
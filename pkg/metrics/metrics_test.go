@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jjeffery/kv"
+)
+
+// TestExposition checks that counters and histograms are rendered using the
+// Prometheus text format
+//
+func TestExposition(t *testing.T) {
+	reg := NewRegistry()
+
+	reg.Counter("test_errors_total", "Errors seen", "repo").Inc(`https://example.com/"a"`)
+	hist := reg.Histogram("test_seconds", "Durations", []float64{1, 5}, "repo")
+	hist.Observe(0.5, "a")
+	hist.Observe(1, "a")
+	hist.Observe(10, "a")
+
+	out := &strings.Builder{}
+	if err := reg.Write(out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# HELP test_errors_total Errors seen",
+		"# TYPE test_errors_total counter",
+		`test_errors_total{repo="https://example.com/\"a\""} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{repo="a",le="1"} 2`,
+		`test_seconds_bucket{repo="a",le="5"} 2`,
+		`test_seconds_bucket{repo="a",le="+Inf"} 3`,
+		`test_seconds_sum{repo="a"} 11.5`,
+		`test_seconds_count{repo="a"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Error("missing line", line, "in", out.String())
+		}
+	}
+}
+
+// TestHealth checks that the health endpoint reflects the registered checks
+//
+func TestHealth(t *testing.T) {
+	reg := NewRegistry()
+	healthy := true
+	reg.AddHealthCheck("component", func() (err kv.Error) {
+		if !healthy {
+			return kv.NewError("broken")
+		}
+		return nil
+	})
+
+	server := httptest.NewServer(reg.Handler())
+	defer server.Close()
+
+	for _, healthy = range []bool{true, false} {
+		resp, errGo := http.Get(server.URL + "/healthz")
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		resp.Body.Close()
+
+		expected := http.StatusOK
+		if !healthy {
+			expected = http.StatusServiceUnavailable
+		}
+		if resp.StatusCode != expected {
+			t.Error("unexpected health status", resp.StatusCode, "expected", expected)
+		}
+	}
+
+	// A nil registry must be usable by components that have not been given one
+	var none *Registry
+	none.Counter("unused", "").Inc()
+}
@@ -0,0 +1,662 @@
+package duat
+
+// This file contains the implementation of software bill of materials generation for Go
+// modules and binaries, in the SPDX and CycloneDX JSON formats
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"debug/buildinfo"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+
+	"github.com/google/uuid"
+
+	"github.com/go-enry/go-license-detector/v4/licensedb"
+	"github.com/go-enry/go-license-detector/v4/licensedb/filer"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// SBOMLicense is a license detected within the source of a module
+//
+type SBOMLicense struct {
+	ID         string  `json:"id"`         // The SPDX identifier of the license
+	Confidence float32 `json:"confidence"` // The confidence of the license detector, from 0 to 1
+}
+
+// SBOMModule describes a single module included within a bill of materials
+//
+type SBOMModule struct {
+	Path     string        `json:"path"`
+	Version  string        `json:"version,omitempty"`
+	Sum      string        `json:"sum,omitempty"`     // The go.sum hash of the module, h1:base64
+	Replace  string        `json:"replace,omitempty"` // The replacement path, or path@version, used in place of the module
+	Licenses []SBOMLicense `json:"licenses,omitempty"`
+	dir      string        // The local directory of the module source, when known
+}
+
+// SBOM is a software bill of materials for a module, or a binary built from one
+//
+type SBOM struct {
+	Name           string        `json:"name"`
+	Version        string        `json:"version,omitempty"`
+	GitHash        string        `json:"git_hash,omitempty"`
+	Created        time.Time     `json:"created"`
+	GoVersion      string        `json:"go_version,omitempty"`
+	Artifact       string        `json:"artifact,omitempty"`        // The binary described, when the bill of materials was read from one
+	ArtifactSHA256 string        `json:"artifact_sha256,omitempty"` // The hex encoded sha256 digest of the binary
+	Main           *SBOMModule   `json:"main"`
+	Modules        []*SBOMModule `json:"modules"` // The module dependencies, sorted by path
+}
+
+// sortModules orders the module dependencies of the bill of materials by path
+//
+func (sbom *SBOM) sortModules() {
+	sort.Slice(sbom.Modules, func(i, j int) bool {
+		return sbom.Modules[i].Path < sbom.Modules[j].Path
+	})
+}
+
+// ReadBinarySBOM returns a bill of materials for a Go binary using the build information
+// embedded within it by the compiler
+//
+func ReadBinarySBOM(fn string) (sbom *SBOM, err kv.Error) {
+	info, errGo := buildinfo.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to read the build information").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sbom = &SBOM{
+		Name:      info.Main.Path,
+		GoVersion: info.GoVersion,
+		Artifact:  fn,
+		Main: &SBOMModule{
+			Path:    info.Main.Path,
+			Version: info.Main.Version,
+			Sum:     info.Main.Sum,
+		},
+		Modules: make([]*SBOMModule, 0, len(info.Deps)),
+	}
+	if info.Main.Version != "(devel)" {
+		sbom.Version = info.Main.Version
+	}
+	if sbom.ArtifactSHA256, err = fileSHA256(fn); err != nil {
+		return nil, err
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			sbom.GitHash = setting.Value
+		}
+	}
+
+	for _, dep := range info.Deps {
+		mod := &SBOMModule{
+			Path:    dep.Path,
+			Version: dep.Version,
+			Sum:     dep.Sum,
+		}
+		if dep.Replace != nil {
+			mod.Replace = dep.Replace.Path
+			if len(dep.Replace.Version) != 0 {
+				mod.Replace += "@" + dep.Replace.Version
+			}
+			mod.Sum = dep.Replace.Sum
+		}
+		sbom.Modules = append(sbom.Modules, mod)
+	}
+	sbom.sortModules()
+	return sbom, nil
+}
+
+// ReadModuleSBOM returns a bill of materials for a module using the vendor/modules.txt file
+// when the module is vendored, otherwise the requirements of the go.mod file.  Hashes are
+// taken from the go.sum file.
+//
+func ReadModuleSBOM(moduleDir string) (sbom *SBOM, err kv.Error) {
+	mod, err := loadGoModule(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := readGoSum(filepath.Join(moduleDir, "go.sum"))
+	if err != nil {
+		return nil, err
+	}
+
+	sbom = &SBOM{
+		Name: mod.Path,
+		Main: &SBOMModule{Path: mod.Path, dir: moduleDir},
+	}
+
+	if sbom.Modules, err = readVendorModules(moduleDir); err != nil {
+		return nil, err
+	}
+	if sbom.Modules == nil {
+		if sbom.Modules, err = readRequiredModules(moduleDir); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dep := range sbom.Modules {
+		key := dep.Path + " " + dep.Version
+		if len(dep.Replace) != 0 {
+			key = strings.Replace(dep.Replace, "@", " ", 1)
+		}
+		dep.Sum = sums[key]
+
+		vendored := filepath.Join(moduleDir, "vendor", filepath.FromSlash(dep.Path))
+		if info, errGo := os.Stat(vendored); errGo == nil && info.IsDir() {
+			dep.dir = vendored
+		} else if modfile.IsDirectoryPath(dep.Replace) {
+			dep.dir = filepath.Join(moduleDir, filepath.FromSlash(dep.Replace))
+		}
+	}
+	sbom.sortModules()
+	return sbom, nil
+}
+
+// readGoSum returns the module hashes of a go.sum file keyed by "path version", the
+// hashes of go.mod files are not included
+//
+func readGoSum(fn string) (sums map[string]string, err kv.Error) {
+	sums = map[string]string{}
+
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return sums, nil
+		}
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	if errGo = scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return sums, nil
+}
+
+// readVendorModules returns the modules listed in the vendor/modules.txt file of a module,
+// nil is returned when the module is not vendored
+//
+func readVendorModules(moduleDir string) (mods []*SBOMModule, err kv.Error) {
+	fn := filepath.Join(moduleDir, "vendor", "modules.txt")
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return nil, nil
+		}
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	mods = []*SBOMModule{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Module lines have the form "# path version [=> replacement [version]]"
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "# ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "# "))
+		if len(fields) == 0 {
+			continue
+		}
+		mod := &SBOMModule{Path: fields[0]}
+		if len(fields) > 1 && fields[1] != "=>" {
+			mod.Version = fields[1]
+		}
+		for i, field := range fields {
+			if field == "=>" && i+1 < len(fields) {
+				mod.Replace = strings.Join(fields[i+1:], "@")
+				break
+			}
+		}
+		mods = append(mods, mod)
+	}
+	if errGo = scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return mods, nil
+}
+
+// readRequiredModules returns the modules required by the go.mod file of a module with
+// its replace directives applied
+//
+func readRequiredModules(moduleDir string) (mods []*SBOMModule, err kv.Error) {
+	fn := filepath.Join(moduleDir, "go.mod")
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	modFile, errGo := modfile.ParseLax(fn, data, nil)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	mods = make([]*SBOMModule, 0, len(modFile.Require))
+	for _, req := range modFile.Require {
+		mod := &SBOMModule{Path: req.Mod.Path, Version: req.Mod.Version}
+		for _, replace := range modFile.Replace {
+			if replace.Old.Path != req.Mod.Path || (len(replace.Old.Version) != 0 && replace.Old.Version != req.Mod.Version) {
+				continue
+			}
+			mod.Replace = replace.New.Path
+			if len(replace.New.Version) != 0 {
+				mod.Replace += "@" + replace.New.Version
+			}
+		}
+		mods = append(mods, mod)
+	}
+	return mods, nil
+}
+
+// DetectLicenses runs the license detector over the source of every module that can be
+// found locally, either within the module directory, its vendor directory or the module
+// cache.  Licenses below the confidence threshold are discarded.
+//
+func (sbom *SBOM) DetectLicenses(modCache string, confidence float32) (err kv.Error) {
+	licensedb.Preload()
+
+	for _, mod := range append([]*SBOMModule{sbom.Main}, sbom.Modules...) {
+		dir := mod.dir
+		if len(dir) == 0 && len(modCache) != 0 {
+			modPath, modVersion := mod.Path, mod.Version
+			if len(mod.Replace) != 0 {
+				replacement := strings.SplitN(mod.Replace, "@", 2)
+				if len(replacement) != 2 {
+					continue
+				}
+				modPath, modVersion = replacement[0], replacement[1]
+			}
+			escapedPath, errGo := module.EscapePath(modPath)
+			if errGo != nil {
+				continue
+			}
+			escapedVersion, errGo := module.EscapeVersion(modVersion)
+			if errGo != nil {
+				continue
+			}
+			dir = filepath.Join(modCache, filepath.FromSlash(escapedPath)+"@"+escapedVersion)
+		}
+		if info, errGo := os.Stat(dir); len(dir) == 0 || errGo != nil || !info.IsDir() {
+			continue
+		}
+
+		fr, errGo := filer.FromDirectory(dir)
+		if errGo != nil {
+			return kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		matches, errGo := licensedb.Detect(fr)
+		fr.Close()
+		if errGo != nil && errGo != licensedb.ErrNoLicenseFound {
+			return kv.Wrap(errGo).With("dir", dir, "module", mod.Path).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		mod.Licenses = []SBOMLicense{}
+		for id, match := range matches {
+			if match.Confidence >= confidence {
+				mod.Licenses = append(mod.Licenses, SBOMLicense{ID: id, Confidence: match.Confidence})
+			}
+		}
+		sort.Slice(mod.Licenses, func(i, j int) bool {
+			if mod.Licenses[i].Confidence != mod.Licenses[j].Confidence {
+				return mod.Licenses[i].Confidence > mod.Licenses[j].Confidence
+			}
+			return mod.Licenses[i].ID < mod.Licenses[j].ID
+		})
+	}
+	return nil
+}
+
+// purl returns the package URL of a module
+//
+func (mod *SBOMModule) purl() string {
+	if len(mod.Version) == 0 || mod.Version == "(devel)" {
+		return "pkg:golang/" + mod.Path
+	}
+	return "pkg:golang/" + mod.Path + "@" + mod.Version
+}
+
+// license returns the most likely license of a module as an SPDX expression
+//
+func (mod *SBOMModule) license() string {
+	if len(mod.Licenses) == 0 {
+		return "NOASSERTION"
+	}
+	return mod.Licenses[0].ID
+}
+
+// documentID returns a stable identifier for the bill of materials derived from its content
+//
+func (sbom *SBOM) documentID() (id uuid.UUID) {
+	parts := []string{sbom.Name, sbom.Version, sbom.GitHash, sbom.ArtifactSHA256}
+	for _, mod := range sbom.Modules {
+		parts = append(parts, mod.purl(), mod.Sum)
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(strings.Join(parts, "\n")))
+}
+
+var spdxIDChars = regexp.MustCompile(`[^A-Za-z0-9.\-]+`)
+
+// spdxID returns an SPDX element identifier for a module
+//
+func spdxID(mod *SBOMModule) string {
+	return "SPDXRef-Package-" + spdxIDChars.ReplaceAllString(mod.Path+"-"+mod.Version, "-")
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxAnnotation struct {
+	Date      string `json:"annotationDate"`
+	Type      string `json:"annotationType"`
+	Annotator string `json:"annotator"`
+	Comment   string `json:"comment"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	Version          string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	Annotations      []spdxAnnotation  `json:"annotations,omitempty"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+type spdxDocument struct {
+	SPDXVersion  string `json:"spdxVersion"`
+	DataLicense  string `json:"dataLicense"`
+	SPDXID       string `json:"SPDXID"`
+	Name         string `json:"name"`
+	Namespace    string `json:"documentNamespace"`
+	CreationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages      []spdxPackage      `json:"packages"`
+	Relationships []spdxRelationship `json:"relationships"`
+}
+
+// spdxPackage returns the SPDX package for a module.  The go.sum hash is a digest of the
+// module file listing rather than of a downloadable artifact so it is recorded as an
+// annotation, made at the creation time of the document, and not as a checksum.
+//
+func (mod *SBOMModule) spdxPackage(created string) (pkg spdxPackage) {
+	pkg = spdxPackage{
+		Name:             mod.Path,
+		SPDXID:           spdxID(mod),
+		Version:          mod.Version,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: mod.license(),
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+		ExternalRefs:     []spdxExternalRef{{Category: "PACKAGE-MANAGER", Type: "purl", Locator: mod.purl()}},
+	}
+	if len(mod.Sum) != 0 {
+		pkg.Annotations = []spdxAnnotation{{Date: created, Type: "OTHER", Annotator: "Tool: duat", Comment: "go.sum " + mod.Sum}}
+	}
+	return pkg
+}
+
+// WriteSPDX writes the bill of materials as an SPDX 2.3 JSON document
+//
+func (sbom *SBOM) WriteSPDX(w io.Writer) (err kv.Error) {
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        sbom.Name,
+		Namespace:   "https://spdx.org/spdxdocs/" + spdxIDChars.ReplaceAllString(sbom.Name, "-") + "-" + sbom.documentID().String(),
+	}
+	doc.CreationInfo.Created = sbom.Created.UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: duat"}
+
+	main := sbom.Main.spdxPackage(doc.CreationInfo.Created)
+	if len(sbom.Version) != 0 {
+		main.Version = sbom.Version
+	}
+	if len(sbom.ArtifactSHA256) != 0 {
+		main.Checksums = []spdxChecksum{{Algorithm: "SHA256", Value: sbom.ArtifactSHA256}}
+	}
+	doc.Packages = append(doc.Packages, main)
+	doc.Relationships = append(doc.Relationships, spdxRelationship{Element: doc.SPDXID, Type: "DESCRIBES", Related: main.SPDXID})
+
+	for _, mod := range sbom.Modules {
+		pkg := mod.spdxPackage(doc.CreationInfo.Created)
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: main.SPDXID, Type: "DEPENDS_ON", Related: pkg.SPDXID})
+	}
+	return writeJSON(w, doc)
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxLicense struct {
+	License struct {
+		ID string `json:"id"`
+	} `json:"license"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Licenses   []cdxLicense  `json:"licenses,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+type cdxDocument struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string `json:"timestamp"`
+		Tools     []struct {
+			Name string `json:"name"`
+		} `json:"tools"`
+		Component cdxComponent `json:"component"`
+	} `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+// cdxComponent returns the CycloneDX component for a module, the go.sum hash is recorded as
+// a property as it is not the digest of any downloadable artifact
+//
+func (mod *SBOMModule) cdxComponent(componentType string) (component cdxComponent) {
+	component = cdxComponent{
+		Type:    componentType,
+		BOMRef:  mod.purl(),
+		Name:    mod.Path,
+		Version: mod.Version,
+		PURL:    mod.purl(),
+	}
+	if len(mod.Sum) != 0 {
+		component.Properties = []cdxProperty{{Name: "go:sum", Value: mod.Sum}}
+	}
+	if len(mod.Licenses) != 0 {
+		license := cdxLicense{}
+		license.License.ID = mod.Licenses[0].ID
+		component.Licenses = []cdxLicense{license}
+	}
+	return component
+}
+
+// WriteCycloneDX writes the bill of materials as a CycloneDX 1.5 JSON document
+//
+func (sbom *SBOM) WriteCycloneDX(w io.Writer) (err kv.Error) {
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + sbom.documentID().String(),
+		Version:      1,
+	}
+	doc.Metadata.Timestamp = sbom.Created.UTC().Format(time.RFC3339)
+	doc.Metadata.Tools = append(doc.Metadata.Tools, struct {
+		Name string `json:"name"`
+	}{Name: "duat"})
+
+	main := sbom.Main.cdxComponent("application")
+	if len(sbom.Version) != 0 {
+		main.Version = sbom.Version
+	}
+	if len(sbom.ArtifactSHA256) != 0 {
+		main.Hashes = []cdxHash{{Alg: "SHA-256", Content: sbom.ArtifactSHA256}}
+	}
+	doc.Metadata.Component = main
+
+	dependsOn := make([]string, 0, len(sbom.Modules))
+	doc.Components = make([]cdxComponent, 0, len(sbom.Modules))
+	for _, mod := range sbom.Modules {
+		component := mod.cdxComponent("library")
+		doc.Components = append(doc.Components, component)
+		dependsOn = append(dependsOn, component.BOMRef)
+	}
+	doc.Dependencies = []cdxDependency{{Ref: main.BOMRef, DependsOn: dependsOn}}
+	return writeJSON(w, doc)
+}
+
+// writeJSON writes an indented JSON document
+//
+func writeJSON(w io.Writer, doc interface{}) (err kv.Error) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if errGo := encoder.Encode(doc); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// SBOMOptions contains the parameters used to generate a bill of materials
+//
+type SBOMOptions struct {
+	GoRunOptions
+	Binary     string    // A binary to be described, when empty the module within the directory of the options is used
+	Confidence float32   // The minimum confidence of detected licenses, defaults to 0.85
+	Created    time.Time // The creation time of the document, defaults to the source date
+}
+
+// SBOM returns a bill of materials for a binary, or for the module of the options when no
+// binary is given, using the module name of the metadata when present.  The version and git
+// hash of the metadata are used unless the binary records its own.
+//
+func (md *MetaData) SBOM(opts SBOMOptions) (sbom *SBOM, err kv.Error) {
+	run := opts.GoRunOptions.defaults()
+
+	if len(opts.Binary) != 0 {
+		if sbom, err = ReadBinarySBOM(opts.Binary); err != nil {
+			return nil, err
+		}
+	} else {
+		_, moduleDir, err := GoModulePath(run.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if sbom, err = ReadModuleSBOM(moduleDir); err != nil {
+			return nil, err
+		}
+		if sbom.GoVersion, err = goEnvValue(run, "GOVERSION"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(md.Module) != 0 {
+		sbom.Name = md.Module
+	}
+	// The version and git hash recorded within a binary describe the source it was built
+	// from, those of the current checkout are only used when the binary has none
+	if md.SemVer != nil && len(sbom.Version) == 0 {
+		sbom.Version = md.SemVer.String()
+	}
+	if md.Git != nil && len(md.Git.Hash) != 0 && len(sbom.GitHash) == 0 {
+		sbom.GitHash = md.Git.Hash
+	}
+
+	sbom.Created = opts.Created
+	if sbom.Created.IsZero() {
+		if sbom.Created, err = md.SourceDate(); err != nil {
+			sbom.Created = time.Now()
+		}
+	}
+
+	confidence := opts.Confidence
+	if confidence <= 0 {
+		confidence = 0.85
+	}
+	modCache, err := goEnvValue(run, "GOMODCACHE")
+	if err != nil {
+		return nil, err
+	}
+	if err = sbom.DetectLicenses(modCache, confidence); err != nil {
+		return nil, err
+	}
+	return sbom, nil
+}
+
+// goEnvValue returns the value of a single go env variable
+//
+func goEnvValue(run GoRunOptions, name string) (value string, err kv.Error) {
+	out := &strings.Builder{}
+	run.Stdout = out
+	if err = RunCommand(run.Ctx, run.goCommand(goBuildEnv(nil), "env", name)); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,85 @@
+package duat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// TestModuleSBOM checks that vendored modules, replacements and hashes are read and written
+// in both SBOM formats
+//
+func TestModuleSBOM(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "sbom")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"go.mod":             "module example.com/project\n\ngo 1.18\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v1.2.0\n)\n\nreplace example.com/b => ../b\n",
+		"go.sum":             "example.com/a v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\nexample.com/a v1.0.0/go.mod h1:BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBA=\n",
+		"vendor/modules.txt": "# example.com/a v1.0.0\n## explicit\nexample.com/a\n# example.com/b v1.2.0 => ../b\n## explicit\nexample.com/b\n",
+	})
+
+	sbom, err := ReadModuleSBOM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom.Created = time.Unix(1600000000, 0)
+
+	if diff := deep.Equal(sbom.Modules, []*SBOMModule{
+		{Path: "example.com/a", Version: "v1.0.0", Sum: "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{Path: "example.com/b", Version: "v1.2.0", Replace: "../b"},
+	}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	spdx := &strings.Builder{}
+	if err = sbom.WriteSPDX(spdx); err != nil {
+		t.Fatal(err)
+	}
+	doc := &spdxDocument{}
+	if errGo = json.Unmarshal([]byte(spdx.String()), doc); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if len(doc.Packages) != 3 || len(doc.Relationships) != 3 || doc.CreationInfo.Created != "2020-09-13T12:26:40Z" {
+		t.Fatal("unexpected SPDX document", spdx.String())
+	}
+	// go.sum hashes are not artifact digests and are recorded as annotations
+	if pkg := doc.Packages[1]; len(pkg.Checksums) != 0 || len(pkg.Annotations) != 1 || pkg.Annotations[0].Comment != "go.sum h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
+		t.Fatal("unexpected SPDX package", pkg)
+	}
+
+	cdx := &strings.Builder{}
+	if err = sbom.WriteCycloneDX(cdx); err != nil {
+		t.Fatal(err)
+	}
+	bom := &cdxDocument{}
+	if errGo = json.Unmarshal([]byte(cdx.String()), bom); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if len(bom.Components) != 2 || bom.Components[0].PURL != "pkg:golang/example.com/a@v1.0.0" || len(bom.Dependencies[0].DependsOn) != 2 {
+		t.Fatal("unexpected CycloneDX document", cdx.String())
+	}
+	if component := bom.Components[0]; len(component.Hashes) != 0 || len(component.Properties) != 1 || component.Properties[0].Value != "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
+		t.Fatal("unexpected CycloneDX component", component)
+	}
+}
+
+// TestBinarySBOM checks that the build information of the test binary is read
+//
+func TestBinarySBOM(t *testing.T) {
+	sbom, err := ReadBinarySBOM(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sbom.Main.Path != "github.com/karlmutch/duat" || len(sbom.Modules) == 0 || len(sbom.ArtifactSHA256) != 64 {
+		t.Fatal("unexpected binary SBOM", sbom.Main, len(sbom.Modules))
+	}
+}
@@ -0,0 +1,632 @@
+package duat
+
+// This file contains the implementation of checksums and detached signatures for release
+// artifacts.  Signatures are written in the minisign format for ed25519 and minisign keys,
+// and in the SSH signature format, as used by ssh-keygen -Y, for OpenSSH keys.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SHA256SumsFile is the default name of the checksums file for release artifacts
+	SHA256SumsFile = "SHA256SUMS"
+
+	minisignExt       = ".minisig"
+	sshSignatureExt   = ".sig"
+	sshSigNamespace   = "file"
+	sshSigMagic       = "SSHSIG"
+	sshSigArmorBegin  = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorEnd    = "-----END SSH SIGNATURE-----"
+	untrustedPrefix   = "untrusted comment: "
+	trustedPrefix     = "trusted comment: "
+	minisignAlgLegacy = "Ed"
+	minisignAlgHashed = "ED"
+)
+
+// ArtifactKey is a private key used to sign release artifacts
+//
+type ArtifactKey struct {
+	ed25519 ed25519.PrivateKey // Used for minisign signatures
+	keyID   []byte             // The minisign key identifier
+	ssh     ssh.Signer         // Used for SSH signatures
+}
+
+// ArtifactPublicKey is a public key used to verify the signatures of release artifacts
+//
+type ArtifactPublicKey struct {
+	ed25519 ed25519.PublicKey
+	keyID   []byte
+	ssh     ssh.PublicKey
+}
+
+// ed25519KeyID returns the minisign key identifier used for ed25519 keys that are not
+// minisign keys, and so have no identifier of their own
+//
+func ed25519KeyID(pub ed25519.PublicKey) []byte {
+	digest := sha256.Sum256(pub)
+	return digest[:8]
+}
+
+// LoadArtifactKey reads a private key from a file, the key may be a PKCS #8 PEM encoded
+// ed25519 key, a minisign secret key or an OpenSSH private key.  The password is used for
+// encrypted minisign and OpenSSH keys.
+//
+func LoadArtifactKey(fn string, password []byte) (key *ArtifactKey, err kv.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if bytes.HasPrefix(data, []byte(untrustedPrefix)) {
+		if key, err = parseMinisignSecretKey(data, password); err != nil {
+			return nil, err.With("file", fn)
+		}
+		return key, nil
+	}
+
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PRIVATE KEY" {
+		edKey, err := LoadSigningKey(fn)
+		if err != nil {
+			return nil, err
+		}
+		return &ArtifactKey{ed25519: edKey, keyID: ed25519KeyID(edKey.Public().(ed25519.PublicKey))}, nil
+	}
+
+	signer, errGo := ssh.ParsePrivateKey(data)
+	if _, isMissing := errGo.(*ssh.PassphraseMissingError); isMissing {
+		signer, errGo = ssh.ParsePrivateKeyWithPassphrase(data, password)
+	}
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "unrecognized private key").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &ArtifactKey{ssh: signer}, nil
+}
+
+// scryptParams returns the scrypt parameters libsodium derives from the limits stored in
+// minisign secret keys
+//
+func scryptParams(opsLimit uint64, memLimit uint64) (n int, r int, p int) {
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+	r = 8
+	nLog2 := uint(1)
+	if opsLimit < memLimit/32 {
+		p = 1
+		maxN := opsLimit / uint64(r*4)
+		for ; nLog2 < 63; nLog2++ {
+			if uint64(1)<<nLog2 > maxN/2 {
+				break
+			}
+		}
+	} else {
+		maxN := memLimit / uint64(r*128)
+		for ; nLog2 < 63; nLog2++ {
+			if uint64(1)<<nLog2 > maxN/2 {
+				break
+			}
+		}
+		maxRP := (opsLimit / 4) / (uint64(1) << nLog2)
+		if maxRP > 0x3fffffff {
+			maxRP = 0x3fffffff
+		}
+		p = int(maxRP) / r
+	}
+	return 1 << nLog2, r, p
+}
+
+// parseMinisignSecretKey decodes, and decrypts, a minisign secret key file
+//
+func parseMinisignSecretKey(data []byte, password []byte) (key *ArtifactKey, err kv.Error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		return nil, kv.NewError("the minisign secret key is incomplete").With("stack", stack.Trace().TrimRuntime())
+	}
+	raw, errGo := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	// sig_alg[2] kdf_alg[2] cksum_alg[2] salt[32] opslimit[8] memlimit[8] key_id[8] sk[64] checksum[32]
+	if len(raw) != 158 || string(raw[:2]) != minisignAlgLegacy {
+		return nil, kv.NewError("unsupported minisign secret key").With("stack", stack.Trace().TrimRuntime())
+	}
+	keynum := append([]byte{}, raw[54:]...)
+
+	switch string(raw[2:4]) {
+	case "Sc":
+		n, r, p := scryptParams(binary.LittleEndian.Uint64(raw[38:46]), binary.LittleEndian.Uint64(raw[46:54]))
+		stream, errGo := scrypt.Key(password, raw[6:38], n, r, p, len(keynum))
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		for i := range keynum {
+			keynum[i] ^= stream[i]
+		}
+	case "\x00\x00":
+	default:
+		return nil, kv.NewError("unsupported minisign key derivation").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	checksum := blake2b.Sum256(append(append([]byte{}, raw[:2]...), keynum[:72]...))
+	if subtle.ConstantTimeCompare(checksum[:], keynum[72:]) != 1 {
+		return nil, kv.NewError("the minisign secret key password is incorrect").With("stack", stack.Trace().TrimRuntime())
+	}
+	return &ArtifactKey{ed25519: ed25519.PrivateKey(keynum[8:72]), keyID: keynum[:8]}, nil
+}
+
+// LoadArtifactPublicKey reads a public key from a file, the key may be a minisign public
+// key, a PKIX PEM encoded ed25519 key or an OpenSSH authorized key
+//
+func LoadArtifactPublicKey(fn string) (pub *ArtifactPublicKey, err kv.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if bytes.HasPrefix(data, []byte(untrustedPrefix)) {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) < 2 {
+			return nil, kv.NewError("the minisign public key is incomplete").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		raw, errGo := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(raw) != 42 || string(raw[:2]) != minisignAlgLegacy {
+			return nil, kv.NewError("unsupported minisign public key").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		return &ArtifactPublicKey{ed25519: ed25519.PublicKey(raw[10:]), keyID: raw[2:10]}, nil
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		parsed, errGo := x509.ParsePKIXPublicKey(block.Bytes)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		edKey, isEd25519 := parsed.(ed25519.PublicKey)
+		if !isEd25519 {
+			return nil, kv.NewError("the key is not an ed25519 public key").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		return &ArtifactPublicKey{ed25519: edKey, keyID: ed25519KeyID(edKey)}, nil
+	}
+
+	sshKey, _, _, _, errGo := ssh.ParseAuthorizedKey(data)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "unrecognized public key").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &ArtifactPublicKey{ssh: sshKey}, nil
+}
+
+// PublicKey returns the public key matching the private key, in the minisign public key
+// format for ed25519 keys, or the OpenSSH authorized key format
+//
+func (key *ArtifactKey) PublicKey() (pub []byte) {
+	if key.ssh != nil {
+		return ssh.MarshalAuthorizedKey(key.ssh.PublicKey())
+	}
+	raw := append([]byte(minisignAlgLegacy), key.keyID...)
+	raw = append(raw, key.ed25519.Public().(ed25519.PublicKey)...)
+	return []byte(fmt.Sprintf("%sminisign public key %X\n%s\n", untrustedPrefix, binary.LittleEndian.Uint64(key.keyID), base64.StdEncoding.EncodeToString(raw)))
+}
+
+// SignatureFile returns the name of the detached signature written for a file
+//
+func (key *ArtifactKey) SignatureFile(fn string) string {
+	if key.ssh != nil {
+		return fn + sshSignatureExt
+	}
+	return fn + minisignExt
+}
+
+// Sign writes a detached signature for a file beside it, the name of the signature file
+// is returned
+//
+func (key *ArtifactKey) Sign(fn string) (sigFn string, err kv.Error) {
+	sigFn = key.SignatureFile(fn)
+	return sigFn, key.SignTo(fn, sigFn)
+}
+
+// SignTo writes a detached signature for a file into the named signature file
+//
+func (key *ArtifactKey) SignTo(fn string, sigFn string) (err kv.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	var sig []byte
+	if key.ssh != nil {
+		sig, err = key.sshSign(data)
+	} else {
+		sig = key.minisign(data, filepath.Base(fn))
+	}
+	if err != nil {
+		return err.With("file", fn)
+	}
+
+	if errGo = ioutil.WriteFile(sigFn, sig, 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", sigFn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// minisign returns a minisign signature, using a prehashed message, for the data
+//
+func (key *ArtifactKey) minisign(data []byte, name string) (sig []byte) {
+	digest := blake2b.Sum512(data)
+	signature := ed25519.Sign(key.ed25519, digest[:])
+
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), name)
+	global := ed25519.Sign(key.ed25519, append(append([]byte{}, signature...), trusted...))
+
+	raw := append([]byte(minisignAlgHashed), key.keyID...)
+	raw = append(raw, signature...)
+
+	return []byte(untrustedPrefix + "signature from duat secret key\n" +
+		base64.StdEncoding.EncodeToString(raw) + "\n" +
+		trustedPrefix + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+// sshSignedData returns the data covered by an SSH signature of a message
+//
+func sshSignedData(namespace string, hashAlg string, digest []byte) []byte {
+	return append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      string
+	}{namespace, "", hashAlg, string(digest)})...)
+}
+
+// sshSignatureBlob is the body of an armored SSH signature following the magic preamble
+//
+type sshSignatureBlob struct {
+	Version   uint32
+	PublicKey string
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature string
+}
+
+// sshSign returns an armored SSH signature for the data
+//
+func (key *ArtifactKey) sshSign(data []byte) (sig []byte, err kv.Error) {
+	digest := sha512.Sum512(data)
+	signed := sshSignedData(sshSigNamespace, "sha512", digest[:])
+
+	var signature *ssh.Signature
+	var errGo error
+	if algSigner, isAlgSigner := key.ssh.(ssh.AlgorithmSigner); isAlgSigner && key.ssh.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signature, errGo = algSigner.SignWithAlgorithm(rand.Reader, signed, ssh.KeyAlgoRSASHA512)
+	} else {
+		signature, errGo = key.ssh.Sign(rand.Reader, signed)
+	}
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	blob := append([]byte(sshSigMagic), ssh.Marshal(sshSignatureBlob{
+		Version:   1,
+		PublicKey: string(key.ssh.PublicKey().Marshal()),
+		Namespace: sshSigNamespace,
+		HashAlg:   "sha512",
+		Signature: string(ssh.Marshal(signature)),
+	})...)
+
+	armored := &strings.Builder{}
+	armored.WriteString(sshSigArmorBegin + "\n")
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n" + sshSigArmorEnd + "\n")
+	return []byte(armored.String()), nil
+}
+
+// Verify checks the detached signature beside a file
+//
+func (pub *ArtifactPublicKey) Verify(fn string) (err kv.Error) {
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if pub.ssh != nil {
+		sigFn := fn + sshSignatureExt
+		sig, errGo := ioutil.ReadFile(sigFn)
+		if errGo != nil {
+			return kv.Wrap(errGo, "the signature could not be read").With("file", sigFn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if err = pub.sshVerify(data, sig); err != nil {
+			return err.With("file", fn)
+		}
+		return nil
+	}
+
+	sigFn := fn + minisignExt
+	sig, errGo := ioutil.ReadFile(sigFn)
+	if errGo != nil {
+		return kv.Wrap(errGo, "the signature could not be read").With("file", sigFn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = pub.minisignVerify(data, sig); err != nil {
+		return err.With("file", fn)
+	}
+	return nil
+}
+
+// minisignVerify checks a minisign signature, including its trusted comment
+//
+func (pub *ArtifactPublicKey) minisignVerify(data []byte, sig []byte) (err kv.Error) {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], trustedPrefix) {
+		return kv.NewError("the minisign signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	raw, errGo := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if errGo != nil || len(raw) != 74 {
+		return kv.NewError("the minisign signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	global, errGo := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if errGo != nil {
+		return kv.NewError("the minisign signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if !bytes.Equal(raw[2:10], pub.keyID) {
+		return kv.NewError("the signature was created using a different key").With("key_id", hex.EncodeToString(raw[2:10])).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	message := data
+	switch string(raw[:2]) {
+	case minisignAlgHashed:
+		digest := blake2b.Sum512(data)
+		message = digest[:]
+	case minisignAlgLegacy:
+	default:
+		return kv.NewError("unsupported minisign signature algorithm").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	signature := raw[10:]
+	if !ed25519.Verify(pub.ed25519, message, signature) {
+		return kv.NewError("the signature is invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+	trusted := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), trustedPrefix)
+	if !ed25519.Verify(pub.ed25519, append(append([]byte{}, signature...), trusted...), global) {
+		return kv.NewError("the trusted comment signature is invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// sshVerify checks an armored SSH signature
+//
+func (pub *ArtifactPublicKey) sshVerify(data []byte, sig []byte) (err kv.Error) {
+	text := strings.TrimSpace(string(sig))
+	if !strings.HasPrefix(text, sshSigArmorBegin) || !strings.HasSuffix(text, sshSigArmorEnd) {
+		return kv.NewError("the SSH signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	text = strings.TrimSuffix(strings.TrimPrefix(text, sshSigArmorBegin), sshSigArmorEnd)
+	raw, errGo := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	if errGo != nil || !bytes.HasPrefix(raw, []byte(sshSigMagic)) {
+		return kv.NewError("the SSH signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	blob := sshSignatureBlob{}
+	if errGo = ssh.Unmarshal(raw[len(sshSigMagic):], &blob); errGo != nil {
+		return kv.Wrap(errGo, "the SSH signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	if blob.Version != 1 || blob.Namespace != sshSigNamespace {
+		return kv.NewError("unsupported SSH signature").With("version", blob.Version, "namespace", blob.Namespace).With("stack", stack.Trace().TrimRuntime())
+	}
+	if !bytes.Equal([]byte(blob.PublicKey), pub.ssh.Marshal()) {
+		return kv.NewError("the signature was created using a different key").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	var digest []byte
+	switch blob.HashAlg {
+	case "sha512":
+		sum := sha512.Sum512(data)
+		digest = sum[:]
+	case "sha256":
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	default:
+		return kv.NewError("unsupported SSH signature hash").With("hash", blob.HashAlg).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	signature := &ssh.Signature{}
+	if errGo = ssh.Unmarshal([]byte(blob.Signature), signature); errGo != nil {
+		return kv.Wrap(errGo, "the SSH signature is malformed").With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = pub.ssh.Verify(sshSignedData(blob.Namespace, blob.HashAlg, digest), signature); errGo != nil {
+		return kv.Wrap(errGo, "the signature is invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// WriteSHA256Sums writes a checksums file, in the format used by sha256sum, for a list
+// of files.  Files are recorded using their base names so must be unique.
+//
+func WriteSHA256Sums(fn string, files []string) (err kv.Error) {
+	lines := make([]string, 0, len(files))
+	names := map[string]string{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if other, isPresent := names[name]; isPresent {
+			return kv.NewError("artifacts must have unique file names").With("file", file, "other", other).With("stack", stack.Trace().TrimRuntime())
+		}
+		names[name] = file
+
+		digest, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, digest+"  "+name+"\n")
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][66:] < lines[j][66:] })
+
+	if errGo := ioutil.WriteFile(fn, []byte(strings.Join(lines, "")), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// ReadSHA256Sums reads a checksums file returning the hex encoded digests by file name
+//
+func ReadSHA256Sums(fn string) (sums map[string]string, err kv.Error) {
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+	return parseSHA256Sums(f, fn)
+}
+
+func parseSHA256Sums(r io.Reader, fn string) (sums map[string]string, err kv.Error) {
+	sums = map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 64 {
+			return nil, kv.NewError("malformed checksum line").With("file", fn, "line", line).With("stack", stack.Trace().TrimRuntime())
+		}
+		// A leading asterisk marks files hashed in binary mode
+		sums[strings.TrimPrefix(strings.TrimSpace(fields[1]), "*")] = strings.ToLower(fields[0])
+	}
+	if errGo := scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return sums, nil
+}
+
+// SignOptions contains the parameters for signing release artifacts
+//
+type SignOptions struct {
+	Files        []string     // The artifacts to be signed, defaults to the binaries found by GoFetchBuilt
+	SumsFile     string       // The checksums file, defaults to SHA256SUMS within the ./bin directory
+	Key          *ArtifactKey // The signing key, when absent only the checksums are written
+	SignatureDir string       // The directory the signatures are written to, defaults to beside the files signed
+}
+
+// SignArtifacts writes a checksums file for the artifacts and signs it, along with each of
+// the artifacts.  The checksums file and signatures written are returned.
+//
+func (md *MetaData) SignArtifacts(opts SignOptions) (outputs []string, err kv.Error) {
+	files := opts.Files
+	if len(files) == 0 {
+		if files, err = md.GoFetchBuilt(); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, kv.NewError("no artifacts were found to sign").With("module", md.Module).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sumsFile := opts.SumsFile
+	if len(sumsFile) == 0 {
+		sumsFile = filepath.Join("bin", SHA256SumsFile)
+	}
+	if err = WriteSHA256Sums(sumsFile, files); err != nil {
+		return nil, err.With("module", md.Module)
+	}
+	outputs = []string{sumsFile}
+
+	if opts.Key == nil {
+		return outputs, nil
+	}
+	for _, fn := range append([]string{sumsFile}, files...) {
+		sigFn := opts.Key.SignatureFile(fn)
+		if len(opts.SignatureDir) != 0 {
+			sigFn = filepath.Join(opts.SignatureDir, filepath.Base(sigFn))
+		}
+		if err = opts.Key.SignTo(fn, sigFn); err != nil {
+			return outputs, err.With("module", md.Module)
+		}
+		outputs = append(outputs, sigFn)
+	}
+	return outputs, nil
+}
+
+// VerifyArtifacts checks the signature of a checksums file and then the digests, and any
+// signatures present, of the files.  When no files are given every file listed within the
+// checksums file is checked using the directory of the checksums file.
+//
+func VerifyArtifacts(sumsFile string, pub *ArtifactPublicKey, files []string) (verified []string, err kv.Error) {
+	if pub != nil {
+		if err = pub.Verify(sumsFile); err != nil {
+			return nil, err
+		}
+	}
+	sums, err := ReadSHA256Sums(sumsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		for name := range sums {
+			files = append(files, filepath.Join(filepath.Dir(sumsFile), name))
+		}
+		sort.Strings(files)
+	}
+
+	verified = make([]string, 0, len(files))
+	for _, fn := range files {
+		expected, isPresent := sums[filepath.Base(fn)]
+		if !isPresent {
+			return verified, kv.NewError("the file is not listed in the checksums").With("file", fn, "sums", sumsFile).With("stack", stack.Trace().TrimRuntime())
+		}
+		digest, err := fileSHA256(fn)
+		if err != nil {
+			return verified, err
+		}
+		if digest != expected {
+			return verified, kv.NewError("the file does not match its checksum").With("file", fn, "sha256", digest, "expected", expected).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		// Individual signatures are optional as the checksums file is signed
+		if pub != nil {
+			sigFn := fn + minisignExt
+			if pub.ssh != nil {
+				sigFn = fn + sshSignatureExt
+			}
+			if _, errGo := os.Stat(sigFn); errGo == nil {
+				if err = pub.Verify(fn); err != nil {
+					return verified, err
+				}
+			}
+		}
+		verified = append(verified, fn)
+	}
+	return verified, nil
+}
@@ -0,0 +1,112 @@
+package duat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestSignArtifacts checks that checksums and signatures written using ed25519 and OpenSSH
+// keys verify, and that modified artifacts are detected
+//
+func TestSignArtifacts(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "sign")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, priv, errGo := ed25519.GenerateKey(rand.Reader)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	pkcs8, errGo := x509.MarshalPKCS8PrivateKey(priv)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	pkix, errGo := x509.MarshalPKIXPublicKey(pub)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	openssh, errGo := ssh.MarshalPrivateKey(priv, "")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	sshPub, errGo := ssh.NewPublicKey(pub)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	writeTree(t, dir, map[string]string{
+		"key.pem":     string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		"key.pub.pem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})),
+		"id_ed25519":  string(pem.EncodeToMemory(openssh)),
+		"id.pub":      string(ssh.MarshalAuthorizedKey(sshPub)),
+	})
+
+	for _, keys := range [][]string{
+		{"key.pem", "key.pub.pem"},
+		{"key.pem", "minisign.pub"},
+		{"id_ed25519", "id.pub"},
+	} {
+		artifacts := filepath.Join(dir, keys[1]+"-bin")
+		writeTree(t, artifacts, map[string]string{
+			"tool-linux-amd64":  "linux",
+			"tool-darwin-arm64": "darwin",
+		})
+		files := []string{filepath.Join(artifacts, "tool-linux-amd64"), filepath.Join(artifacts, "tool-darwin-arm64")}
+		sumsFile := filepath.Join(artifacts, SHA256SumsFile)
+
+		key, err := LoadArtifactKey(filepath.Join(dir, keys[0]), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys[1] == "minisign.pub" {
+			writeTree(t, dir, map[string]string{"minisign.pub": string(key.PublicKey())})
+		}
+		verifier, err := LoadArtifactPublicKey(filepath.Join(dir, keys[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		md := &MetaData{}
+		outputs, err := md.SignArtifacts(SignOptions{Files: files, SumsFile: sumsFile, Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outputs) != 4 {
+			t.Error(keys, "unexpected outputs", outputs)
+		}
+
+		verified, err := VerifyArtifacts(sumsFile, verifier, nil)
+		if err != nil {
+			t.Fatal(keys, err)
+		}
+		if len(verified) != 2 {
+			t.Error(keys, "unexpected verified files", verified)
+		}
+
+		// Resigning the checksums after an artifact is modified must still leave the
+		// individual artifact signature failing
+		writeTree(t, artifacts, map[string]string{"tool-linux-amd64": "tampered"})
+		if _, err = VerifyArtifacts(sumsFile, verifier, nil); err == nil {
+			t.Error(keys, "a modified artifact was not detected")
+		}
+		if err = WriteSHA256Sums(sumsFile, files); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = key.Sign(sumsFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = VerifyArtifacts(sumsFile, verifier, nil); err == nil {
+			t.Error(keys, "a modified artifact with a stale signature was not detected")
+		}
+	}
+}
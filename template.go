@@ -11,6 +11,7 @@ package duat
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -86,6 +87,19 @@ func toToml(v interface{}) string {
 
 // create template context
 func (md *MetaData) NewTemplateVariables(jsonVals string, loadFiles []string, overrideVals map[string]string, ignoreAWSErrors bool) (vars map[string]interface{}, err kv.Error, warnings []kv.Error) {
+	opts := TemplateOptions{
+		ValueFiles:      loadFiles,
+		OverrideValues:  overrideVals,
+		IgnoreAWSErrors: ignoreAWSErrors,
+	}
+	return md.newTemplateVariables(opts, jsonVals, nil)
+}
+
+// newTemplateVariables deep merges the layers of values in order, the JSON values, the value
+// files, and then the override, string and JSON override values.  When sources is supplied
+// it receives the layers that supplied each value, keyed by the dotted path of the value.
+//
+func (md *MetaData) newTemplateVariables(opts TemplateOptions, jsonVals string, sources map[string][]string) (vars map[string]interface{}, err kv.Error, warnings []kv.Error) {
 
 	vars = map[string]interface{}{}
 
@@ -114,67 +128,68 @@ func (md *MetaData) NewTemplateVariables(jsonVals string, loadFiles []string, ov
 	if err == nil && ecrURL != nil {
 		duatVars["awsecr"] = ecrURL.Hostname()
 	} else {
-		if !ignoreAWSErrors {
+		if !opts.IgnoreAWSErrors {
 			warnings = append(warnings, err)
 		}
 	}
 
 	vars["duat"] = duatVars
 
+	addSources := func(keys []string, source string) {
+		if sources != nil {
+			for _, key := range keys {
+				sources[key] = append(sources[key], source)
+			}
+		}
+	}
+
 	if jsonVals != "" {
 		obj := map[string]interface{}{}
 		if errGo := json.Unmarshal([]byte(jsonVals), &obj); errGo != nil {
 			return nil, kv.Wrap(errGo, "bad json format").With("stack", stack.Trace().TrimRuntime()), warnings
 		}
-		for k, v := range obj {
-			vars[k] = v
-		}
+		mergeValues(vars, normalizeValue(obj).(map[string]interface{}))
 	}
 
-	for _, file := range loadFiles {
-		if bytes, errGo := ioutil.ReadFile(file); errGo != nil {
-			return nil, kv.Wrap(errGo).With("file", file).With("stack", stack.Trace().TrimRuntime()), warnings
-		} else {
-			obj := map[string]interface{}{}
-
-			switch filepath.Ext(file) {
-			case ".json":
-				if errGo := json.Unmarshal(bytes, &obj); errGo != nil {
-					return nil, kv.Wrap(errGo, "unrecognized json").With("file", file).With("stack", stack.Trace().TrimRuntime()), warnings
-				}
-			case ".yaml", ".yml":
-				if errGo := yaml.Unmarshal(bytes, &obj); errGo != nil {
-					return nil, kv.Wrap(errGo, "unrecognized yaml").With("file", file).With("stack", stack.Trace().TrimRuntime()), warnings
-				}
-			case ".toml":
-				if errGo := toml.Unmarshal(bytes, &obj); errGo != nil {
-					return nil, kv.Wrap(errGo, "unrecognized toml").With("file", file).With("stack", stack.Trace().TrimRuntime()), warnings
-				}
-			default:
-				return nil, kv.NewError("unsupported file type (extension)").With("file", file).With("stack", stack.Trace().TrimRuntime()), warnings
-			}
-
-			for k, v := range obj {
-				vars[k] = v
-			}
+	for _, file := range opts.ValueFiles {
+		obj, err := loadValueFile(file)
+		if err != nil {
+			return nil, err, warnings
 		}
-	}
+		mergeValues(vars, obj)
 
-	for k, v := range overrideVals {
+		addSources(leafValuePaths(obj, nil), file)
+	}
 
-		// remove quotes for key="value"
-		if strings.HasPrefix(v, "\"") && strings.HasSuffix(v, "\"") {
-			v = v[1 : len(v)-1]
-		} else if strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") {
-			v = v[1 : len(v)-1]
+	for _, layer := range []struct {
+		source    string
+		overrides map[string]string
+		parse     func(text string) (interface{}, error)
+	}{
+		{"override", opts.OverrideValues, func(text string) (interface{}, error) { return typedValue(text), nil }},
+		{"string override", opts.StringValues, func(text string) (interface{}, error) { return text, nil }},
+		{"json override", opts.JSONValues, func(text string) (value interface{}, errGo error) {
+			errGo = json.Unmarshal([]byte(text), &value)
+			return value, errGo
+		}},
+	} {
+		if err = setOverrides(vars, layer.overrides, layer.parse); err != nil {
+			return nil, err, warnings
+		}
+		keys := make([]string, 0, len(layer.overrides))
+		for path := range layer.overrides {
+			keys = append(keys, overrideValuePath(path))
 		}
-		vars[k] = v
+		addSources(keys, layer.source)
 	}
 
 	return vars, nil, warnings
 }
 
-func templateExecute(t *template.Template, src io.Reader, dest io.Writer, ctx interface{}) (err kv.Error) {
+// templateExecute parses and executes a single input, when a checker is supplied the
+// template is first checked for undefined references
+//
+func templateExecute(t *template.Template, src io.Reader, dest io.Writer, ctx interface{}, checker *templateChecker) (err kv.Error) {
 
 	readBytes, errGo := ioutil.ReadAll(src)
 	if errGo != nil {
@@ -186,26 +201,86 @@ func templateExecute(t *template.Template, src io.Reader, dest io.Writer, ctx in
 		return kv.Wrap(errGo, "pasing failed for template file(s)").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	if checker != nil {
+		if err = checker.check(tmpl); err != nil {
+			return err
+		}
+	}
+
 	if errGo = tmpl.Execute(dest, ctx); errGo != nil {
-		return kv.Wrap(errGo, "output file could not be created").With("stack", stack.Trace().TrimRuntime())
+		return kv.Wrap(errGo, "template execution failed").With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// maxIncludeDepth limits the nesting of include calls so that recursive templates fail
+// rather than exhausting the stack
+//
+const maxIncludeDepth = 1000
+
+// templatePartials parses every file within the directories into the template so that the
+// templates they define can be used by inputs using template, or include.  Files are parsed
+// in name order and hidden files are ignored.
+//
+func templatePartials(t *template.Template, dirs []string) (err kv.Error) {
+	for _, dir := range dirs {
+		errGo := filepath.Walk(dir, func(fn string, info os.FileInfo, errGo error) error {
+			if errGo != nil {
+				return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			if strings.HasPrefix(info.Name(), ".") && fn != dir {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			data, errGo := ioutil.ReadFile(fn)
+			if errGo != nil {
+				return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			rel, errGo := filepath.Rel(dir, fn)
+			if errGo != nil {
+				return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			if _, errGo = t.New(filepath.ToSlash(rel)).Parse(string(data)); errGo != nil {
+				return kv.Wrap(errGo, "parsing failed for partial template").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			return nil
+		})
+		if errGo != nil {
+			if err, isKV := errGo.(kv.Error); isKV {
+				return err
+			}
+			return kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
 	}
 	return nil
 }
 
 // TemplateIOFiles is used to encapsulate some streaming interfaces for input and output documents
 type TemplateIOFiles struct {
-	In  io.Reader
-	Out io.Writer
+	In   io.Reader
+	Out  io.Writer
+	Name string // The name of the input used when reporting errors, optional
 }
 
 // TemplateOptions is used to pass into the Template function both streams and key values
 // for the template engine
 type TemplateOptions struct {
 	IOFiles         []TemplateIOFiles
+	InputDir        string // A directory tree rendered into OutputDir, see templateTree
+	OutputDir       string
+	PartialDirs     []string // Directories of templates, typically containing define blocks, available to all inputs
 	Delimiters      []string
 	ValueFiles      []string
-	OverrideValues  map[string]string
+	OverrideValues  map[string]string // Values set using dotted, and indexed, paths with values typed as bools, integers, or null
+	StringValues    map[string]string // Values set using paths whose values are always strings
+	JSONValues      map[string]string // Values set using paths whose values are JSON documents
 	IgnoreAWSErrors bool
+	Strict          bool // Fails on references to missing values and warns of unused values
 }
 
 // Template takes the TemplateOptions and processes the template execution, it also
@@ -215,14 +290,59 @@ type TemplateOptions struct {
 func (md *MetaData) Template(opts TemplateOptions) (err kv.Error, warnings []kv.Error) {
 
 	tmplErrs := []kv.Error{}
+
+	// include and tpl render using the templates parsed so far, including partials
+	t := template.New("noname")
+	includeDepth := 0
+
 	funcs := template.FuncMap{
 		"RaiseError": func(msg string) string {
 			tmplErrs = append(tmplErrs, kv.NewError(msg).With("stack", stack.Trace().TrimRuntime()))
 			return ""
 		},
+		"include": func(name string, data interface{}) (string, error) {
+			if includeDepth >= maxIncludeDepth {
+				return "", kv.NewError("include nested too deeply, check for recursion").With("template", name, "depth", includeDepth)
+			}
+			includeDepth++
+			defer func() { includeDepth-- }()
+
+			buf := &strings.Builder{}
+			if errGo := t.ExecuteTemplate(buf, name, data); errGo != nil {
+				return "", errGo
+			}
+			return buf.String(), nil
+		},
+		"tpl": func(text string, data interface{}) (string, error) {
+			clone, errGo := t.Clone()
+			if errGo != nil {
+				return "", errGo
+			}
+			tmpl, errGo := clone.New("tpl").Parse(text)
+			if errGo != nil {
+				return "", errGo
+			}
+			buf := &strings.Builder{}
+			if errGo = tmpl.Execute(buf, data); errGo != nil {
+				return "", errGo
+			}
+			return buf.String(), nil
+		},
+		"required": func(msg string, value interface{}) (interface{}, error) {
+			if value == nil {
+				return nil, errors.New(msg)
+			}
+			if text, isString := value.(string); isString && len(text) == 0 {
+				return nil, errors.New(msg)
+			}
+			return value, nil
+		},
+	}
+	for name, fun := range md.TemplateFuncs() {
+		funcs[name] = fun
 	}
 
-	t := template.New("noname").Funcs(FuncMap(funcs))
+	t = t.Funcs(FuncMap(funcs))
 
 	if len(opts.Delimiters) != 0 {
 		if len(opts.Delimiters) != 2 {
@@ -231,20 +351,178 @@ func (md *MetaData) Template(opts TemplateOptions) (err kv.Error, warnings []kv.
 		t = t.Delims(opts.Delimiters[0], opts.Delimiters[1])
 	}
 
-	vars, err, warnings := md.NewTemplateVariables("", opts.ValueFiles, opts.OverrideValues, opts.IgnoreAWSErrors)
+	var sources map[string][]string
+	if opts.Strict {
+		sources = map[string][]string{}
+	}
+	vars, err, warnings := md.newTemplateVariables(opts, "", sources)
 	if err != nil {
 		return err, warnings
 	}
 
+	if err = templatePartials(t, opts.PartialDirs); err != nil {
+		return err, warnings
+	}
+
+	// Strict mode fails execution on missing keys and checks templates before they are
+	// executed so that all of the missing keys can be reported together
+	var checker *templateChecker
+	if opts.Strict {
+		t = t.Option("missingkey=error")
+		checker = newTemplateChecker(t, vars)
+	}
+
 	for _, files := range opts.IOFiles {
-		err = templateExecute(t, files.In, files.Out, vars)
+		tmpl := t
+		if len(files.Name) != 0 {
+			tmpl = t.New(files.Name)
+		}
+		err = templateExecute(tmpl, files.In, files.Out, vars, checker)
 		if err != nil {
 			return err, warnings
 		}
 	}
+	if len(opts.InputDir) != 0 {
+		if len(opts.OutputDir) == 0 {
+			return kv.NewError("an output directory is needed to render an input directory").With("dir", opts.InputDir).With("stack", stack.Trace().TrimRuntime()), warnings
+		}
+		if err = templateTree(t, opts.InputDir, opts.OutputDir, vars, checker); err != nil {
+			return err, warnings
+		}
+	}
+
+	if checker != nil {
+		warnings = append(warnings, checker.unusedValues(sources)...)
+	}
 	if len(tmplErrs) != 0 {
 		return tmplErrs[0], tmplErrs
 	}
 
 	return nil, warnings
 }
+
+// templateTree renders a directory tree into the output directory.  The names of files and
+// directories are themselves templates, and any that render to an empty name are skipped
+// along with their contents.  Files with a .tmpl suffix are rendered and have the suffix
+// removed while other files are copied unchanged.  The permissions of files and
+// directories are retained and symbolic links are recreated.
+//
+func templateTree(t *template.Template, inputDir string, outputDir string, vars interface{}, checker *templateChecker) (err kv.Error) {
+	absOutput, errGo := filepath.Abs(outputDir)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", outputDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Relative paths within the input are mapped onto the rendered paths of their parent
+	// directories as the walk descends
+	rendered := map[string]string{".": outputDir}
+
+	errGo = filepath.Walk(inputDir, func(fn string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if absFn, errGo := filepath.Abs(fn); errGo == nil && absFn == absOutput {
+			return filepath.SkipDir
+		}
+		rel, errGo := filepath.Rel(inputDir, fn)
+		if errGo != nil {
+			return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if rel == "." {
+			if errGo = os.MkdirAll(outputDir, info.Mode().Perm()); errGo != nil {
+				return kv.Wrap(errGo).With("dir", outputDir).With("stack", stack.Trace().TrimRuntime())
+			}
+			return nil
+		}
+
+		parent, isPresent := rendered[filepath.Dir(rel)]
+		if !isPresent {
+			return nil
+		}
+
+		nameOut := &strings.Builder{}
+		nameTmpl, errGo := t.New(filepath.ToSlash(rel) + "#name").Parse(info.Name())
+		if errGo == nil {
+			errGo = nameTmpl.Execute(nameOut, vars)
+		}
+		if errGo != nil {
+			return kv.Wrap(errGo, "file name could not be templated").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		name := strings.TrimSpace(nameOut.String())
+		if len(name) == 0 {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case info.IsDir():
+			dest := filepath.Join(parent, name)
+			rendered[rel] = dest
+			if errGo = os.MkdirAll(dest, info.Mode().Perm()); errGo != nil {
+				return kv.Wrap(errGo).With("dir", dest).With("stack", stack.Trace().TrimRuntime())
+			}
+			// MkdirAll leaves the permissions of existing directories unchanged
+			if errGo = os.Chmod(dest, info.Mode().Perm()); errGo != nil {
+				return kv.Wrap(errGo).With("dir", dest).With("stack", stack.Trace().TrimRuntime())
+			}
+			return nil
+
+		case info.Mode()&os.ModeSymlink != 0:
+			dest := filepath.Join(parent, name)
+			link, errGo := os.Readlink(fn)
+			if errGo != nil {
+				return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			if errGo = os.Remove(dest); errGo != nil && !os.IsNotExist(errGo) {
+				return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+			}
+			if errGo = os.Symlink(link, dest); errGo != nil {
+				return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+			}
+			return nil
+
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		in, errGo := os.Open(fn)
+		if errGo != nil {
+			return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		defer in.Close()
+
+		dest := filepath.Join(parent, strings.TrimSuffix(name, ".tmpl"))
+		out, errGo := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if errGo != nil {
+			return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+		}
+		defer out.Close()
+
+		if strings.HasSuffix(name, ".tmpl") {
+			if err := templateExecute(t.New(filepath.ToSlash(fn)), in, out, vars, checker); err != nil {
+				return err.With("file", fn)
+			}
+		} else if _, errGo = io.Copy(out, in); errGo != nil {
+			return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		// The permissions of existing files, and those altered by the umask, are set explicitly
+		if errGo = out.Chmod(info.Mode().Perm()); errGo != nil {
+			return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+		}
+		if errGo = out.Close(); errGo != nil {
+			return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	})
+
+	if errGo != nil {
+		if err, isKV := errGo.(kv.Error); isKV {
+			return err
+		}
+		return kv.Wrap(errGo).With("dir", inputDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -2,12 +2,23 @@ package duat
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"os/user"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Masterminds/semver"
+	"github.com/go-test/deep"
 	"github.com/jjeffery/kv"
 	"github.com/go-stack/stack"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 // This file contains a number of test functions for the templating features of duat
@@ -46,3 +57,311 @@ func TestUserTemplate(t *testing.T) {
 		t.Fatal(kv.NewError("templated user details incorrect").With("expected", expected, "actual", writer.String()).With("stack", stack.Trace().TrimRuntime()))
 	}
 }
+
+// TestTemplateTree checks that directory trees are rendered with templated names, that only
+// .tmpl files are rendered and that file modes are retained
+//
+func TestTemplateTree(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "stencil")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	inputDir := filepath.Join(dir, "templates")
+	outputDir := filepath.Join(dir, "rendered")
+	writeTree(t, inputDir, map[string]string{
+		"{{.duat.module}}/config.yaml.tmpl":        "version: {{.duat.version}}\n",
+		"{{.duat.module}}/run.sh.tmpl":             "#!/bin/sh\nexec {{.duat.module}}\n",
+		"{{.duat.module}}/static.txt":              "{{.duat.version}}",
+		"{{if .optional}}optional{{end}}/file.txt": "skipped",
+	})
+	if errGo = os.Chmod(filepath.Join(inputDir, "{{.duat.module}}", "run.sh.tmpl"), 0755); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	ver, _ := semver.NewVersion("1.2.3")
+	md := &MetaData{Module: "tool", SemVer: ver, Git: &GitInfo{}, user: &user.User{}}
+	opts := TemplateOptions{
+		InputDir:        inputDir,
+		OutputDir:       outputDir,
+		IgnoreAWSErrors: true,
+	}
+	if err, _ := md.Template(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered := map[string]string{}
+	errGo = filepath.Walk(outputDir, func(fn string, info os.FileInfo, errGo error) error {
+		if errGo != nil || info.IsDir() {
+			return errGo
+		}
+		data, errGo := ioutil.ReadFile(fn)
+		rel, _ := filepath.Rel(outputDir, fn)
+		rendered[filepath.ToSlash(rel)] = info.Mode().Perm().String() + " " + string(data)
+		return errGo
+	})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	expected := map[string]string{
+		"tool/config.yaml": "-rw------- version: 1.2.3\n",
+		"tool/run.sh":      "-rwxr-xr-x #!/bin/sh\nexec tool\n",
+		"tool/static.txt":  "-rw------- {{.duat.version}}",
+	}
+	if diff := deep.Equal(rendered, expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+// TestTemplatePartials checks that partials can be included, piped into other functions,
+// that values can be rendered as templates and that required values are enforced
+//
+func TestTemplatePartials(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "partials")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"_labels.tpl": "{{define \"labels\"}}app: {{.duat.module}}\nversion: {{.duat.version}}{{end}}",
+	})
+
+	ver, _ := semver.NewVersion("1.2.3")
+	md := &MetaData{Module: "tool", SemVer: ver, Git: &GitInfo{}, user: &user.User{}}
+
+	writer := new(bytes.Buffer)
+	opts := TemplateOptions{
+		IOFiles: []TemplateIOFiles{{
+			In:  strings.NewReader("labels:\n{{include \"labels\" . | indent 2}}\n{{tpl .greeting .}}\n"),
+			Out: writer,
+		}},
+		PartialDirs:     []string{dir},
+		OverrideValues:  map[string]string{"greeting": "hello {{.duat.module}}"},
+		IgnoreAWSErrors: true,
+	}
+	if err, _ := md.Template(opts); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(writer.String(), "labels:\n  app: tool\n  version: 1.2.3\nhello tool\n"); diff != nil {
+		t.Fatal(diff)
+	}
+
+	opts.IOFiles = []TemplateIOFiles{{
+		In:  strings.NewReader("{{required \"a name is required\" .name}}"),
+		Out: new(bytes.Buffer),
+	}}
+	err, _ := md.Template(opts)
+	if err == nil || !strings.Contains(err.Error(), "a name is required") {
+		t.Fatal("a missing required value was not reported", err)
+	}
+}
+
+// TestTemplateStrict checks that strict mode reports every missing reference along with its
+// location, and warns about values that were never used
+//
+func TestTemplateStrict(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "strict")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"values.yaml": "name: tool\nimage:\n  tag: latest\n  pullPolicy: Always\nreplicas: 2\n",
+	})
+
+	ver, _ := semver.NewVersion("1.2.3")
+	md := &MetaData{Module: "tool", SemVer: ver, Git: &GitInfo{}, user: &user.User{}}
+
+	opts := TemplateOptions{
+		IOFiles: []TemplateIOFiles{{
+			In:   strings.NewReader("{{.duat.verison}}\n{{with .image}}{{.tg}}{{end}} {{.name}}"),
+			Out:  new(bytes.Buffer),
+			Name: "deployment.yaml",
+		}},
+		ValueFiles:      []string{filepath.Join(dir, "values.yaml")},
+		OverrideValues:  map[string]string{"unused": "value", "image.tga": "1"},
+		IgnoreAWSErrors: true,
+		Strict:          true,
+	}
+	err, _ := md.Template(opts)
+	if err == nil {
+		t.Fatal("missing references were not reported")
+	}
+	for _, reference := range []string{"deployment.yaml:1:7 .duat.verison", "deployment.yaml:2:17 .tg"} {
+		if !strings.Contains(err.Error(), reference) {
+			t.Error("a missing reference was not reported", reference, err)
+		}
+	}
+
+	writer := new(bytes.Buffer)
+	opts.IOFiles = []TemplateIOFiles{{
+		In:  strings.NewReader("{{.name}}:{{with .image}}{{.tag}}{{end}}"),
+		Out: writer,
+	}}
+	err, warnings := md.Template(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writer.String() != "tool:latest" {
+		t.Fatal("unexpected output", writer.String())
+	}
+	// Values are reported using their full path, including siblings of values that were used
+	unused := []string{"image.pullPolicy", "image.tga", "replicas", "unused"}
+	if len(warnings) != len(unused) {
+		t.Fatal("unused values were not reported", warnings)
+	}
+	for i, key := range unused {
+		if !strings.Contains(warnings[i].Error(), key) {
+			t.Error("unused value was not reported", key, warnings[i])
+		}
+	}
+}
+
+// TestTemplateFuncs checks the semantic version and git template functions against a
+// repository with a tagged release followed by further changes
+//
+func TestTemplateFuncs(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "funcs")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, errGo := git.PlainInit(dir, false)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	tree, errGo := repo.Worktree()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	sig := &object.Signature{Name: "Jane Doe", Email: "jane@example.com", When: time.Unix(1600000000, 0)}
+	for i, files := range []map[string]string{
+		{"README.md": "first", "main.go": "package main"},
+		{"README.md": "second", "docs/guide.md": "guide"},
+	} {
+		writeTree(t, dir, files)
+		if _, errGo = tree.Add("."); errGo != nil {
+			t.Fatal(errGo)
+		}
+		hash, errGo := tree.Commit(fmt.Sprintf("change %d\n\ndetails", i+1), &git.CommitOptions{Author: sig})
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if i == 0 {
+			if _, errGo = repo.CreateTag("v1.2.2", hash, &git.CreateTagOptions{Tagger: sig, Message: "release"}); errGo != nil {
+				t.Fatal(errGo)
+			}
+			if _, errGo = repo.CreateTag("latest", hash, nil); errGo != nil {
+				t.Fatal(errGo)
+			}
+		}
+	}
+
+	ver, _ := semver.NewVersion("1.2.3-rc.1")
+	md := &MetaData{
+		Module: "tool",
+		SemVer: ver,
+		Git:    &GitInfo{Repo: repo, URL: url.URL{Path: "/org/repo.git"}},
+		user:   &user.User{},
+	}
+
+	writer := new(bytes.Buffer)
+	opts := TemplateOptions{
+		IOFiles: []TemplateIOFiles{{
+			In: strings.NewReader(strings.Join([]string{
+				`{{semverInc "rc" .duat.version}} {{semverInc "minor" "1.2.3"}}`,
+				`{{semverCmp "1.2.3" .duat.version}} {{semverSatisfies "~1.2.0" "1.2.9"}} {{semverCompare ">=1.2.0" "1.2.3"}}`,
+				`{{range gitLog 5}}{{.Subject}};{{end}}`,
+				`{{gitTags | join ","}}`,
+				`{{gitChangedFiles "v1.2.2" | join ","}}`,
+				`{{gitFileAtRef "v1.2.2" "README.md"}}`,
+				`{{imageName "registry.example.com"}}`,
+			}, "\n")),
+			Out: writer,
+		}},
+		IgnoreAWSErrors: true,
+	}
+	if err, _ := md.Template(opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"1.2.3-rc.2 1.3.0",
+		"1 true true",
+		"change 2;change 1;",
+		"latest,v1.2.2",
+		"README.md,docs/guide.md",
+		"first",
+		"registry.example.com/org/repo/tool:1.2.3-rc.1",
+	}, "\n")
+	if diff := deep.Equal(writer.String(), expected); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+// TestTemplateValues checks that value files are deep merged in order and that path
+// overrides are applied with the expected types
+//
+func TestTemplateValues(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "values")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTree(t, dir, map[string]string{
+		"base.yaml":     "image:\n  repo: tool\n  tag: latest\nports: [80, 443]\nremoved: true\n",
+		"override.json": `{"image": {"tag": "1.2.3"}, "removed": null}`,
+		"secrets.env":   "# comment\nexport TOKEN=\"a\\tb\"\nUSER='jane doe'\nHOST=localhost # comment\n",
+		"app.ini":       "debug = false\n[db]\nhost = db.local\nport = \"5432\"\n",
+	})
+
+	ver, _ := semver.NewVersion("1.2.3")
+	md := &MetaData{Module: "tool", SemVer: ver, Git: &GitInfo{}, user: &user.User{}}
+
+	writer := new(bytes.Buffer)
+	opts := TemplateOptions{
+		IOFiles: []TemplateIOFiles{{
+			In:  strings.NewReader(`{{omit . "duat" "Env" | toJson}}`),
+			Out: writer,
+		}},
+		ValueFiles: []string{
+			filepath.Join(dir, "base.yaml"),
+			filepath.Join(dir, "override.json"),
+			filepath.Join(dir, "secrets.env"),
+			filepath.Join(dir, "app.ini"),
+		},
+		OverrideValues: map[string]string{
+			"image.pullPolicy": "Always",
+			"replicas":         "3",
+			"ports[2]":         "8080",
+			"enabled":          "true",
+			"quoted":           `"true"`,
+			"zip":              "007",
+			`dotted\.key`:      "x",
+		},
+		StringValues:    map[string]string{"db.port": "5433", "version": "1"},
+		JSONValues:      map[string]string{"resources": `{"cpu": "1", "memory": 2}`, "ports[0]": "81"},
+		IgnoreAWSErrors: true,
+	}
+	if err, _ := md.Template(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"HOST":"localhost","TOKEN":"a\tb","USER":"jane doe",` +
+		`"db":{"host":"db.local","port":"5433"},"debug":"false","dotted.key":"x","enabled":true,` +
+		`"image":{"pullPolicy":"Always","repo":"tool","tag":"1.2.3"},"ports":[81,443,8080],` +
+		`"quoted":"true","replicas":3,"resources":{"cpu":"1","memory":2},"version":"1","zip":"007"}`
+	if diff := deep.Equal(writer.String(), expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	for _, path := range []string{"a..b", "[0]", "a[x]", "a[0]b", "a."} {
+		if _, err := parseValuePath(path); err == nil {
+			t.Error("an invalid value path was accepted", path)
+		}
+	}
+}
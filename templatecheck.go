@@ -0,0 +1,291 @@
+package duat
+
+// This file contains a static checker for templates used by the strict mode of the template
+// engine.  It reports every reference to a value missing from the template variables, rather
+// than only the first reported when executing using missingkey=error, and records the
+// variables that the templates used so that unused values can be reported.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// templateChecker walks the parse trees of templates following the value of dot where it
+// can be determined without executing the template
+//
+type templateChecker struct {
+	tmpl    *template.Template
+	vars    map[string]interface{}
+	used    map[string]bool // The dotted paths of the values referenced
+	touched map[string]bool // The dotted paths of the values referenced, and their parents
+	allUsed bool            // Set when the variables are passed whole to a function
+	visited map[string]bool // Named templates already checked with a value of dot, preventing recursion
+	missing []string
+}
+
+// templateDot is the value of dot at a point within a template, known is false when the
+// value can only be determined during execution.  The path contains the keys leading from
+// the template variables to dot, it is nil when they are not known.
+//
+type templateDot struct {
+	value interface{}
+	known bool
+	root  bool
+	path  []string
+}
+
+func newTemplateChecker(tmpl *template.Template, vars map[string]interface{}) (checker *templateChecker) {
+	return &templateChecker{
+		tmpl:    tmpl,
+		vars:    vars,
+		used:    map[string]bool{},
+		touched: map[string]bool{},
+		visited: map[string]bool{},
+	}
+}
+
+// check returns an error listing the file, line and column of every undefined reference
+// within the template, and any templates it invokes
+//
+func (checker *templateChecker) check(tmpl *template.Template) (err kv.Error) {
+	checker.missing = []string{}
+	if tmpl.Tree != nil {
+		checker.walk(tmpl.Tree, tmpl.Tree.Root, checker.rootDot())
+	}
+	if len(checker.missing) != 0 {
+		return kv.NewError("undefined template values were referenced").With("references", strings.Join(checker.missing, ", ")).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// rootDot returns the value of dot at the start of a template
+//
+func (checker *templateChecker) rootDot() templateDot {
+	return templateDot{value: checker.vars, known: true, root: true, path: []string{}}
+}
+
+// use records that a template referenced the value of a path, the template variables as a
+// whole are referenced using an empty path
+//
+func (checker *templateChecker) use(path []string) {
+	if path == nil {
+		return
+	}
+	if len(path) == 0 {
+		checker.allUsed = true
+		return
+	}
+	checker.used[valuePath(path)] = true
+	checker.touch(path)
+}
+
+// touch records that a template tested, or descended into, the value of a path without
+// using all of the values within it
+//
+func (checker *templateChecker) touch(path []string) {
+	for i := 1; i <= len(path); i++ {
+		checker.touched[valuePath(path[:i])] = true
+	}
+}
+
+// isUsed returns true when the value of a dotted path, one of its parents, or one of its
+// children was referenced
+//
+func (checker *templateChecker) isUsed(path string) bool {
+	if checker.touched[path] {
+		return true
+	}
+	elems, err := parseValuePath(path)
+	if err != nil {
+		return checker.used[path]
+	}
+	keys := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		key, _ := elem.(string)
+		keys = append(keys, key)
+		if checker.used[valuePath(keys)] {
+			return true
+		}
+	}
+	return false
+}
+
+// unusedValues returns warnings for the values of the value files, and override values,
+// that were not referenced by any of the checked templates.  Values are reported using
+// their full path so that misspelt keys are found alongside keys that were used.
+//
+func (checker *templateChecker) unusedValues(sources map[string][]string) (warnings []kv.Error) {
+	warnings = []kv.Error{}
+	if checker.allUsed {
+		return warnings
+	}
+
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		if !checker.isUsed(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		warnings = append(warnings, kv.NewError("value was not used by the templates").With("key", key, "source", strings.Join(sources[key], ",")))
+	}
+	return warnings
+}
+
+func (checker *templateChecker) walk(tree *parse.Tree, node parse.Node, dot templateDot) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			checker.walk(tree, child, dot)
+		}
+	case *parse.ActionNode:
+		checker.pipe(tree, node.Pipe, dot)
+	case *parse.IfNode:
+		checker.test(tree, node.Pipe, dot)
+		checker.walk(tree, node.List, dot)
+		checker.walk(tree, node.ElseList, dot)
+	case *parse.WithNode:
+		// A single reference only sets dot, the values used are those referenced within
+		checker.walk(tree, node.List, checker.test(tree, node.Pipe, dot))
+		checker.walk(tree, node.ElseList, dot)
+	case *parse.RangeNode:
+		checker.pipe(tree, node.Pipe, dot)
+		checker.walk(tree, node.List, templateDot{})
+		checker.walk(tree, node.ElseList, dot)
+	case *parse.TemplateNode:
+		checker.invoke(node.Name, checker.test(tree, node.Pipe, dot))
+	}
+}
+
+// invoke checks a named template, such as a partial, using the value of dot it is passed.
+// Values passed to templates that cannot be checked are treated as used.
+//
+func (checker *templateChecker) invoke(name string, dot templateDot) {
+	tmpl := checker.tmpl.Lookup(name)
+	if !dot.known || tmpl == nil || tmpl.Tree == nil {
+		checker.use(dot.path)
+		return
+	}
+	visit := name + "\n" + valuePath(dot.path)
+	if checker.visited[visit] {
+		return
+	}
+	checker.visited[visit] = true
+	checker.touch(dot.path)
+	checker.walk(tmpl.Tree, tmpl.Tree.Root, dot)
+}
+
+func (checker *templateChecker) pipe(tree *parse.Tree, pipe *parse.PipeNode, dot templateDot) {
+	if pipe == nil {
+		return
+	}
+	for _, cmd := range pipe.Cmds {
+		// include is checked like the template action when its arguments are simple
+		if len(cmd.Args) == 3 {
+			if ident, isIdent := cmd.Args[0].(*parse.IdentifierNode); isIdent && ident.Ident == "include" {
+				if name, isString := cmd.Args[1].(*parse.StringNode); isString {
+					if data := checker.resolve(tree, cmd.Args[2], dot, true); data.path != nil {
+						checker.invoke(name.Text, data)
+						continue
+					}
+				}
+			}
+		}
+		for _, arg := range cmd.Args {
+			checker.arg(tree, arg, dot)
+		}
+	}
+}
+
+func (checker *templateChecker) arg(tree *parse.Tree, node parse.Node, dot templateDot) {
+	switch node := node.(type) {
+	case *parse.DotNode:
+		checker.use(dot.path)
+	case *parse.FieldNode, *parse.VariableNode:
+		checker.use(checker.resolve(tree, node, dot, true).path)
+	case *parse.ChainNode:
+		checker.arg(tree, node.Node, dot)
+	case *parse.PipeNode:
+		checker.pipe(tree, node, dot)
+	}
+}
+
+// test checks a pipeline whose value is tested, or becomes dot, returning its value.  A
+// single reference is only touched, leaving the values within it to be used individually.
+//
+func (checker *templateChecker) test(tree *parse.Tree, pipe *parse.PipeNode, dot templateDot) (value templateDot) {
+	if value = checker.resolvePipe(tree, pipe, dot); value.path != nil {
+		checker.touch(value.path)
+		return value
+	}
+	checker.pipe(tree, pipe, dot)
+	return value
+}
+
+// resolvePipe returns the value of a pipeline when it is a single field reference, reporting
+// missing keys
+//
+func (checker *templateChecker) resolvePipe(tree *parse.Tree, pipe *parse.PipeNode, dot templateDot) templateDot {
+	if pipe == nil || len(pipe.Decl) != 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return templateDot{}
+	}
+	return checker.resolve(tree, pipe.Cmds[0].Args[0], dot, true)
+}
+
+// resolve follows a field, or $ variable, reference through the maps of the template
+// variables reporting missing keys when report is set.  The path of the reference is
+// returned when it is known, even when the value is not.
+//
+func (checker *templateChecker) resolve(tree *parse.Tree, node parse.Node, dot templateDot, report bool) templateDot {
+	idents := []string{}
+	switch node := node.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		idents = node.Ident
+	case *parse.VariableNode:
+		if node.Ident[0] != "$" {
+			return templateDot{}
+		}
+		dot = checker.rootDot()
+		idents = node.Ident[1:]
+	default:
+		return templateDot{}
+	}
+	if !dot.known || dot.path == nil {
+		return templateDot{}
+	}
+	path := append(append([]string{}, dot.path...), idents...)
+
+	value := dot.value
+	for i, ident := range idents {
+		var isPresent bool
+		switch container := value.(type) {
+		case map[string]interface{}:
+			value, isPresent = container[ident]
+		case map[interface{}]interface{}:
+			value, isPresent = container[ident]
+		default:
+			// Methods and struct fields are left to be checked during execution
+			return templateDot{path: path}
+		}
+		if !isPresent {
+			if report {
+				location, _ := tree.ErrorContext(node)
+				checker.missing = append(checker.missing, fmt.Sprintf("%s .%s", location, strings.Join(idents[:i+1], ".")))
+			}
+			return templateDot{path: path}
+		}
+	}
+	return templateDot{value: value, known: true, root: len(idents) == 0 && dot.root, path: path}
+}
@@ -0,0 +1,291 @@
+package duat
+
+// This file contains template functions that are bound to the meta data of a module, giving
+// templates access to semantic version arithmetic, the git history of the repository and the
+// names of images, without the need to run tools before templating
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/semver"
+
+	"gopkg.in/src-d/go-git.v4" // Not forked due to depency tree being too complex, src-d however are a serious org so I dont expect the repo to disappear
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// GitCommit contains the details of a commit returned by the gitLog template function
+//
+type GitCommit struct {
+	Hash      string
+	ShortHash string
+	Author    string
+	Email     string
+	When      time.Time
+	Subject   string // The first line of the commit message
+	Message   string
+}
+
+// TemplateFuncs returns the template functions that use the meta data of the module,
+// these are added to those of FuncMap by Template.  Functions that fail return errors
+// that stop template execution.
+//
+//	semverInc part version       increments the major, minor, patch or rc part of a version
+//	semverCmp a b                returns -1, 0, or 1 when a is older, the same, or newer than b
+//	semverSatisfies cons version returns true when the version matches the constraint
+//	gitLog n                     returns the most recent n commits reachable from HEAD
+//	gitTags                      returns the tags of the repository in version order
+//	gitChangedFiles ref          returns the files changed between a tag, or other ref, and HEAD
+//	gitFileAtRef ref path        returns the contents of a file as of a tag, or other ref
+//	imageName [registry]         returns the image name, and version tag, of the module
+//
+func (md *MetaData) TemplateFuncs() (funcs template.FuncMap) {
+	return template.FuncMap{
+		"semverInc":       semverInc,
+		"semverCmp":       semverCmp,
+		"semverSatisfies": semverSatisfies,
+		"gitLog":          md.gitLog,
+		"gitTags":         md.gitTags,
+		"gitChangedFiles": md.gitChangedFiles,
+		"gitFileAtRef":    md.gitFileAtRef,
+		"imageName":       md.imageName,
+	}
+}
+
+func semverInc(part string, version string) (string, error) {
+	ver, errGo := semver.NewVersion(version)
+	if errGo != nil {
+		return "", errGo
+	}
+	next := *ver
+	switch part {
+	case "major":
+		next = ver.IncMajor()
+	case "minor":
+		next = ver.IncMinor()
+	case "patch":
+		next = ver.IncPatch()
+	case "rc":
+		// Release candidates are numbered rc.1, rc.2 and so on, other pre-releases become rc.1
+		rc := 1
+		if parts := strings.Split(ver.Prerelease(), "."); len(parts) == 2 && parts[0] == "rc" {
+			if n, errGo := strconv.Atoi(parts[1]); errGo == nil {
+				rc = n + 1
+			}
+		}
+		if next, errGo = ver.SetMetadata(""); errGo == nil {
+			next, errGo = next.SetPrerelease(fmt.Sprintf("rc.%d", rc))
+		}
+		if errGo != nil {
+			return "", errGo
+		}
+	default:
+		return "", fmt.Errorf("unknown version part %q, use major, minor, patch or rc", part)
+	}
+	return next.String(), nil
+}
+
+func semverCmp(a string, b string) (int, error) {
+	verA, errGo := semver.NewVersion(a)
+	if errGo != nil {
+		return 0, errGo
+	}
+	verB, errGo := semver.NewVersion(b)
+	if errGo != nil {
+		return 0, errGo
+	}
+	return verA.Compare(verB), nil
+}
+
+func semverSatisfies(constraint string, version string) (bool, error) {
+	cons, errGo := semver.NewConstraint(constraint)
+	if errGo != nil {
+		return false, errGo
+	}
+	ver, errGo := semver.NewVersion(version)
+	if errGo != nil {
+		return false, errGo
+	}
+	return cons.Check(ver), nil
+}
+
+// gitRepo returns the repository of the module, or an error when git was not loaded
+//
+func (md *MetaData) gitRepo() (repo *git.Repository, errGo error) {
+	if md.Git == nil || md.Git.Repo == nil {
+		return nil, errors.New("git information is not available for the module")
+	}
+	return md.Git.Repo, nil
+}
+
+// gitCommit returns the commit a tag, branch, or hash refers to
+//
+func (md *MetaData) gitCommit(ref string) (commit *object.Commit, errGo error) {
+	repo, errGo := md.gitRepo()
+	if errGo != nil {
+		return nil, errGo
+	}
+	hash, errGo := repo.ResolveRevision(plumbing.Revision(ref))
+	if errGo != nil {
+		return nil, fmt.Errorf("%s could not be resolved, %v", ref, errGo)
+	}
+	return repo.CommitObject(*hash)
+}
+
+func (md *MetaData) gitLog(n int) (commits []GitCommit, errGo error) {
+	head, errGo := md.gitCommit("HEAD")
+	if errGo != nil {
+		return nil, errGo
+	}
+	repo, _ := md.gitRepo()
+	iter, errGo := repo.Log(&git.LogOptions{From: head.Hash})
+	if errGo != nil {
+		return nil, errGo
+	}
+	defer iter.Close()
+
+	commits = []GitCommit{}
+	for len(commits) < n {
+		commit, errGo := iter.Next()
+		if errGo != nil {
+			break
+		}
+		hash := commit.Hash.String()
+		commits = append(commits, GitCommit{
+			Hash:      hash,
+			ShortHash: hash[:7],
+			Author:    commit.Author.Name,
+			Email:     commit.Author.Email,
+			When:      commit.Author.When,
+			Subject:   strings.TrimSpace(strings.SplitN(commit.Message, "\n", 2)[0]),
+			Message:   commit.Message,
+		})
+	}
+	return commits, nil
+}
+
+// gitTags returns tags that are semantic versions in version order, after any other tags
+// which are in name order
+//
+func (md *MetaData) gitTags() (tags []string, errGo error) {
+	repo, errGo := md.gitRepo()
+	if errGo != nil {
+		return nil, errGo
+	}
+	iter, errGo := repo.Tags()
+	if errGo != nil {
+		return nil, errGo
+	}
+	tags = []string{}
+	versions := map[string]*semver.Version{}
+	errGo = iter.ForEach(func(ref *plumbing.Reference) error {
+		tag := ref.Name().Short()
+		tags = append(tags, tag)
+		if ver, errGo := semver.NewVersion(tag); errGo == nil {
+			versions[tag] = ver
+		}
+		return nil
+	})
+	if errGo != nil {
+		return nil, errGo
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		verI, verJ := versions[tags[i]], versions[tags[j]]
+		switch {
+		case verI == nil && verJ == nil:
+			return tags[i] < tags[j]
+		case verI == nil || verJ == nil:
+			return verI == nil
+		case !verI.Equal(verJ):
+			return verI.LessThan(verJ)
+		}
+		return tags[i] < tags[j]
+	})
+	return tags, nil
+}
+
+// gitChangedFiles returns the names of the files that differ between a ref and HEAD, renamed
+// files are reported using both names
+//
+func (md *MetaData) gitChangedFiles(ref string) (files []string, errGo error) {
+	from, errGo := md.gitCommit(ref)
+	if errGo != nil {
+		return nil, errGo
+	}
+	to, errGo := md.gitCommit("HEAD")
+	if errGo != nil {
+		return nil, errGo
+	}
+	fromTree, errGo := from.Tree()
+	if errGo != nil {
+		return nil, errGo
+	}
+	toTree, errGo := to.Tree()
+	if errGo != nil {
+		return nil, errGo
+	}
+	changes, errGo := fromTree.Diff(toTree)
+	if errGo != nil {
+		return nil, errGo
+	}
+
+	names := map[string]bool{}
+	for _, change := range changes {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if len(name) != 0 {
+				names[name] = true
+			}
+		}
+	}
+	files = make([]string, 0, len(names))
+	for name := range names {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (md *MetaData) gitFileAtRef(ref string, path string) (string, error) {
+	commit, errGo := md.gitCommit(ref)
+	if errGo != nil {
+		return "", errGo
+	}
+	file, errGo := commit.File(path)
+	if errGo != nil {
+		return "", fmt.Errorf("%s could not be read at %s, %v", path, ref, errGo)
+	}
+	return file.Contents()
+}
+
+// imageName returns the repository and version of the image for the module, prefixed by the
+// registry when one is supplied or the default AWS ECR registry can be found
+//
+func (md *MetaData) imageName(registry ...string) (string, error) {
+	if len(registry) > 1 {
+		return "", errors.New("imageName accepts at most one registry")
+	}
+	if md.Git == nil || md.SemVer == nil {
+		return "", errors.New("git and version information are needed to name images")
+	}
+	repo, version, _, err := md.GenerateImageName()
+	if err != nil {
+		return "", err
+	}
+
+	host := ""
+	if len(registry) != 0 {
+		host = strings.TrimSuffix(registry[0], "/")
+	} else if ecrURL, err := GetECRDefaultURL(); err == nil && ecrURL != nil {
+		host = ecrURL.Hostname()
+	}
+	if len(host) != 0 {
+		repo = host + "/" + repo
+	}
+	return repo + ":" + version, nil
+}
@@ -0,0 +1,386 @@
+package duat
+
+// This file contains the loading and layering of template values.  Values are read from
+// JSON, YAML, TOML, .env and INI files, or the standard input, and are deep merged in the
+// order they are supplied.  Overrides use dotted, and indexed, paths in the style of the
+// helm --set, --set-string and --set-json options.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-yaml/yaml"
+
+	"github.com/go-stack/stack" // Forked copy of https://github.com/go-stack/stack
+	"github.com/jjeffery/kv"    // Forked copy of https://github.com/jjeffery/kv
+)
+
+// maxValueIndex limits the size of lists created by indexed override paths
+//
+const maxValueIndex = 65536
+
+// StdinValues is the name of the value file that is read from the standard input, its
+// contents can be either YAML or JSON
+//
+const StdinValues = "-"
+
+// loadValueFile reads the template variables within a JSON, YAML, TOML, .env or INI file,
+// or from the standard input.  Nested maps are returned as map[string]interface{} values.
+//
+func loadValueFile(file string) (obj map[string]interface{}, err kv.Error) {
+	var data []byte
+	var errGo error
+	if file == StdinValues {
+		data, errGo = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, errGo = ioutil.ReadFile(file)
+	}
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", file).With("stack", stack.Trace().TrimRuntime())
+	}
+	obj = map[string]interface{}{}
+
+	ext := filepath.Ext(file)
+	if file == StdinValues {
+		ext = ".yaml"
+	}
+	switch ext {
+	case ".json":
+		if errGo := json.Unmarshal(data, &obj); errGo != nil {
+			return nil, kv.Wrap(errGo, "unrecognized json").With("file", file).With("stack", stack.Trace().TrimRuntime())
+		}
+	case ".yaml", ".yml":
+		if errGo := yaml.Unmarshal(data, &obj); errGo != nil {
+			return nil, kv.Wrap(errGo, "unrecognized yaml").With("file", file).With("stack", stack.Trace().TrimRuntime())
+		}
+	case ".toml":
+		if errGo := toml.Unmarshal(data, &obj); errGo != nil {
+			return nil, kv.Wrap(errGo, "unrecognized toml").With("file", file).With("stack", stack.Trace().TrimRuntime())
+		}
+	case ".env":
+		if obj, err = parseEnvValues(data); err != nil {
+			return nil, err.With("file", file)
+		}
+	case ".ini":
+		if obj, err = parseINIValues(data); err != nil {
+			return nil, err.With("file", file)
+		}
+	default:
+		return nil, kv.NewError("unsupported file type (extension)").With("file", file).With("stack", stack.Trace().TrimRuntime())
+	}
+	return normalizeValue(obj).(map[string]interface{}), nil
+}
+
+// parseEnvValues reads KEY=VALUE lines, optionally prefixed with export.  Double quoted
+// values support escapes, single quoted values are literal and unquoted values end at a
+// comment.
+//
+func parseEnvValues(data []byte) (obj map[string]interface{}, err kv.Error) {
+	obj = map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		pair := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(pair[0])
+		if len(pair) != 2 || len(key) == 0 {
+			return nil, kv.NewError("env lines must have the form KEY=VALUE").With("line", lineNum).With("stack", stack.Trace().TrimRuntime())
+		}
+		value := strings.TrimSpace(pair[1])
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, errGo := strconv.Unquote(value)
+			if errGo != nil {
+				return nil, kv.Wrap(errGo, "invalid quoted value").With("line", lineNum).With("stack", stack.Trace().TrimRuntime())
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		obj[key] = value
+	}
+	if errGo := scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return obj, nil
+}
+
+// parseINIValues reads key = value lines with keys following a [section] header placed
+// into a map named after the section
+//
+func parseINIValues(data []byte) (obj map[string]interface{}, err kv.Error) {
+	obj = map[string]interface{}{}
+	section := obj
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			name := strings.TrimSpace(strings.TrimSuffix(line[1:], "]"))
+			if !strings.HasSuffix(line, "]") || len(name) == 0 {
+				return nil, kv.NewError("invalid ini section").With("line", lineNum).With("stack", stack.Trace().TrimRuntime())
+			}
+			existing, isMap := obj[name].(map[string]interface{})
+			if !isMap {
+				existing = map[string]interface{}{}
+				obj[name] = existing
+			}
+			section = existing
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(pair[0])
+		if len(pair) != 2 || len(key) == 0 {
+			return nil, kv.NewError("ini lines must have the form key = value").With("line", lineNum).With("stack", stack.Trace().TrimRuntime())
+		}
+		value := strings.TrimSpace(pair[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		section[key] = value
+	}
+	if errGo := scanner.Err(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return obj, nil
+}
+
+// normalizeValue converts the map[interface{}]interface{} values produced by the YAML
+// decoder into map[string]interface{} values so that layers can be merged
+//
+func normalizeValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			obj[fmt.Sprint(k)] = normalizeValue(v)
+		}
+		return obj
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = normalizeValue(v)
+		}
+		return value
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalizeValue(v)
+		}
+		return value
+	}
+	return value
+}
+
+// mergeValues deep merges the src values into dst.  Maps are merged key by key, other
+// values replace those in dst, and null values remove the key from dst.
+//
+func mergeValues(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		srcMap, isSrcMap := v.(map[string]interface{})
+		dstMap, isDstMap := dst[k].(map[string]interface{})
+		if isSrcMap && isDstMap {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// parseValuePath splits a path such as a.b[0].c into its keys, and list indexes.  A
+// backslash escapes a dot, or bracket, that is part of a key.
+//
+func parseValuePath(path string) (elems []interface{}, err kv.Error) {
+	elems = []interface{}{}
+	key := &strings.Builder{}
+	needKey := true
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '\\':
+			if i+1 < len(path) {
+				i++
+			}
+			key.WriteByte(path[i])
+		case '.', '[':
+			if key.Len() != 0 {
+				elems = append(elems, key.String())
+				key.Reset()
+			} else if needKey {
+				return nil, kv.NewError("value paths cannot contain empty keys").With("path", path).With("stack", stack.Trace().TrimRuntime())
+			}
+			needKey = c == '.'
+			if c == '.' {
+				continue
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, kv.NewError("value path index is missing a ]").With("path", path).With("stack", stack.Trace().TrimRuntime())
+			}
+			index, errGo := strconv.Atoi(path[i+1 : i+end])
+			if errGo != nil || index < 0 || index >= maxValueIndex {
+				return nil, kv.NewError("value path indexes must be small positive integers").With("path", path).With("stack", stack.Trace().TrimRuntime())
+			}
+			elems = append(elems, index)
+			i += end
+		default:
+			if !needKey {
+				return nil, kv.NewError("value path indexes must be followed by a dot or another index").With("path", path).With("stack", stack.Trace().TrimRuntime())
+			}
+			key.WriteByte(c)
+		}
+	}
+	if key.Len() != 0 {
+		elems = append(elems, key.String())
+	} else if needKey {
+		return nil, kv.NewError("value paths cannot contain empty keys").With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, isKey := elems[0].(string); !isKey {
+		return nil, kv.NewError("value paths must begin with a key").With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	return elems, nil
+}
+
+// setValue places a value at the path within the container, creating maps and lists as
+// needed, and returns the updated container.  A nil value removes a key.
+//
+func setValue(container interface{}, path []interface{}, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+	switch elem := path[0].(type) {
+	case int:
+		list, _ := container.([]interface{})
+		for len(list) <= elem {
+			list = append(list, nil)
+		}
+		list[elem] = setValue(list[elem], path[1:], value)
+		return list
+	default:
+		key := elem.(string)
+		obj, isMap := container.(map[string]interface{})
+		if !isMap {
+			obj = map[string]interface{}{}
+		}
+		if len(path) == 1 && value == nil {
+			delete(obj, key)
+			return obj
+		}
+		obj[key] = setValue(obj[key], path[1:], value)
+		return obj
+	}
+}
+
+// typedValue converts the value of an override into a bool, integer or null when it has
+// that form, quoted values and numbers with leading zeros remain strings
+//
+func typedValue(value string) interface{} {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if len(value) > 1 && value[0] == '0' {
+		return value
+	}
+	if i, errGo := strconv.ParseInt(value, 10, 64); errGo == nil {
+		return i
+	}
+	return value
+}
+
+// setOverrides applies path overrides to the values in path order, parse converts the text
+// of each override into its value
+//
+func setOverrides(vars map[string]interface{}, overrides map[string]string, parse func(text string) (interface{}, error)) (err kv.Error) {
+	paths := make([]string, 0, len(overrides))
+	for path := range overrides {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		elems, err := parseValuePath(path)
+		if err != nil {
+			return err
+		}
+		value, errGo := parse(overrides[path])
+		if errGo != nil {
+			return kv.Wrap(errGo, "invalid override value").With("path", path).With("stack", stack.Trace().TrimRuntime())
+		}
+		setValue(vars, elems, normalizeValue(value))
+	}
+	return nil
+}
+
+// valuePath returns the dotted path of a list of keys, escaping the characters that
+// parseValuePath treats specially
+//
+func valuePath(keys []string) (path string) {
+	escaper := strings.NewReplacer(`\`, `\\`, ".", `\.`, "[", `\[`)
+	escaped := make([]string, 0, len(keys))
+	for _, key := range keys {
+		escaped = append(escaped, escaper.Replace(key))
+	}
+	return strings.Join(escaped, ".")
+}
+
+// leafValuePaths returns the dotted paths of the values within a map that are not maps
+// themselves, empty maps and lists are treated as values
+//
+func leafValuePaths(obj map[string]interface{}, prefix []string) (paths []string) {
+	paths = []string{}
+	for key, value := range obj {
+		keys := append(append([]string{}, prefix...), key)
+		if child, isMap := value.(map[string]interface{}); isMap && len(child) != 0 {
+			paths = append(paths, leafValuePaths(child, keys)...)
+			continue
+		}
+		paths = append(paths, valuePath(keys))
+	}
+	return paths
+}
+
+// overrideValuePath returns the dotted path of the value set by an override up to any list
+// index, as templates use lists as a whole
+//
+func overrideValuePath(path string) (key string) {
+	elems, err := parseValuePath(path)
+	if err != nil {
+		return path
+	}
+	keys := []string{}
+	for _, elem := range elems {
+		key, isKey := elem.(string)
+		if !isKey {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return valuePath(keys)
+}